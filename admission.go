@@ -0,0 +1,162 @@
+package attach
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrOverloaded = errors.New("the powbox is overloaded, try again later")
+var ErrInvalidAdmissionOption = errors.New("invalid admission option")
+
+const metricAttachOverloaded = "attach.overloaded"
+
+// how often the system state is sampled at most
+const admissionSampleInterval = time.Second
+
+// how long clients are told to back off when the powbox is overloaded
+const overloadRetryAfter = 30 * time.Second
+
+const (
+	procLoadAvg  = "/proc/loadavg"
+	procMemInfo  = "/proc/meminfo"
+	thermalZone0 = "/sys/class/thermal/thermal_zone0/temp"
+)
+
+// admissionController refuses new attach jobs while the system is overloaded, so that
+// small devices like a Raspberry Pi don't thermal-throttle or run out of memory during
+// bursts. while overloaded, bundles up to shedAbove txs can still be admitted so that
+// only the expensive jobs are shed. metrics which can't be read on the platform are ignored.
+type admissionController struct {
+	maxLoad       float64
+	minFreeMemMB  uint64
+	maxCPUTemp    float64
+	shedAbove     int
+	mu            sync.Mutex
+	lastSample    time.Time
+	overloadCause string
+}
+
+// ParseOption parses one of the admission control options.
+func (a *admissionController) ParseOption(option string, args []string) error {
+	if len(args) != 1 {
+		return errors.Wrap(ErrInvalidAdmissionOption, option)
+	}
+	var err error
+	switch option {
+	case "max_load":
+		a.maxLoad, err = strconv.ParseFloat(args[0], 64)
+		if err == nil && a.maxLoad <= 0 {
+			err = ErrInvalidAdmissionOption
+		}
+	case "min_free_memory":
+		a.minFreeMemMB, err = strconv.ParseUint(args[0], 10, 64)
+	case "max_cpu_temp":
+		a.maxCPUTemp, err = strconv.ParseFloat(args[0], 64)
+		if err == nil && a.maxCPUTemp <= 0 {
+			err = ErrInvalidAdmissionOption
+		}
+	case "overload_max_txs":
+		a.shedAbove, err = strconv.Atoi(args[0])
+		if err == nil && a.shedAbove <= 0 {
+			err = ErrInvalidAdmissionOption
+		}
+	default:
+		return errors.Wrap(ErrInvalidAdmissionOption, option)
+	}
+	if err != nil {
+		return errors.Wrapf(ErrInvalidAdmissionOption, "invalid value for %s", option)
+	}
+	return nil
+}
+
+// Enabled reports whether any threshold is configured.
+func (a *admissionController) Enabled() bool {
+	return a.maxLoad > 0 || a.minFreeMemMB > 0 || a.maxCPUTemp > 0
+}
+
+// Admit decides whether a bundle with the given number of txs is accepted. if not,
+// the cause of the overload is returned as error. high priority jobs are always
+// admitted while low priority ones are shed regardless of their size.
+func (a *admissionController) Admit(txs int, priority priorityClass) error {
+	a.mu.Lock()
+	if time.Since(a.lastSample) >= admissionSampleInterval {
+		a.overloadCause = a.sample()
+		a.lastSample = time.Now()
+	}
+	cause := a.overloadCause
+	a.mu.Unlock()
+	if cause == "" || priority == priorityHigh || (priority != priorityLow && a.shedAbove > 0 && txs <= a.shedAbove) {
+		return nil
+	}
+	metricsReg.Inc(metricAttachOverloaded)
+	return errors.Wrap(ErrOverloaded, cause)
+}
+
+// sample returns why the system is overloaded or an empty string if it isn't.
+func (a *admissionController) sample() string {
+	if a.maxLoad > 0 {
+		if load, err := loadAverage(); err == nil && load > a.maxLoad {
+			return fmt.Sprintf("load average %.2f above %.2f", load, a.maxLoad)
+		}
+	}
+	if a.minFreeMemMB > 0 {
+		if free, err := availableMemoryMB(); err == nil && free < a.minFreeMemMB {
+			return fmt.Sprintf("available memory %dMB below %dMB", free, a.minFreeMemMB)
+		}
+	}
+	if a.maxCPUTemp > 0 {
+		if temp, err := cpuTemperature(); err == nil && temp > a.maxCPUTemp {
+			return fmt.Sprintf("cpu temperature %.1f°C above %.1f°C", temp, a.maxCPUTemp)
+		}
+	}
+	return ""
+}
+
+// loadAverage returns the one minute load average.
+func loadAverage() (float64, error) {
+	data, err := ioutil.ReadFile(procLoadAvg)
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, errors.New("empty " + procLoadAvg)
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// availableMemoryMB returns the memory available for new allocations.
+func availableMemoryMB() (uint64, error) {
+	f, err := os.Open(procMemInfo)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			return kb / 1024, err
+		}
+	}
+	return 0, errors.New("MemAvailable missing in " + procMemInfo)
+}
+
+// cpuTemperature returns the temperature of the first thermal zone in degrees celsius.
+func cpuTemperature() (float64, error) {
+	data, err := ioutil.ReadFile(thermalZone0)
+	if err != nil {
+		return 0, err
+	}
+	milli, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+	return milli / 1000, err
+}
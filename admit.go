@@ -0,0 +1,219 @@
+package attach
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// admitMode defines how admitAttach treats quotas.
+type admitMode int
+
+const (
+	// check and consume the quotas
+	admitCharge admitMode = iota
+	// only check the quotas, e.g. for the canAttach pre-flight
+	admitPeek
+	// the quotas were already charged and a slot reserved via canAttach
+	admitReserved
+)
+
+// attachGrant is what an admitted client may do.
+type attachGrant struct {
+	// identity is the authenticated client, e.g. "key:<name>", empty for anonymous clients
+	identity string
+	txLimit  int
+	priority priorityClass
+	// the PoW pool the job is queued in
+	pool string
+}
+
+// admitAttach runs the authorization, quota and load checks for a bundle with txs
+// transactions at the requested MWM. it returns what the client may do or the status
+// and error to reject the request with.
+func (s *site) admitAttach(w http.ResponseWriter, r *http.Request, span trace.Span, body []byte, command string, txs int, requestedMWM int, mode admitMode) (*attachGrant, int, error) {
+	if s.clientRules != nil && !s.clientRules.Allowed(s.clientHost(r)) {
+		logger.Warnf("denying %s for %s by ip rules\n", command, s.anonymizer.Addr(s.clientHost(r)))
+		return nil, http.StatusForbidden, ErrIPDenied
+	}
+	if s.agentRules != nil && !s.agentRules.Allowed(r.UserAgent()) {
+		logger.Warnf("denying %s for user agent %q\n", command, r.UserAgent())
+		return nil, http.StatusForbidden, ErrUserAgentDenied
+	}
+	if s.signer != nil {
+		if err := s.signer.Verify(r, body); err != nil {
+			logger.Warnf("denying %s for %s: %s\n", command, s.anonymizer.Addr(s.clientHost(r)), err.Error())
+			return nil, http.StatusUnauthorized, err
+		}
+	}
+	var geo *geoPolicy
+	if s.geoIP != nil {
+		country := s.geoIP.Country(s.clientHost(r))
+		span.SetAttributes(attribute.String("attach.country", country))
+		if mode != admitPeek {
+			metricsReg.Inc(metricCountryPrefix + country)
+		}
+		geo = s.geoPolicies[country]
+		if geo != nil && geo.deny {
+			logger.Warnf("denying %s for %s from %s by geo policy\n", command, s.anonymizer.Addr(s.clientHost(r)), country)
+			return nil, http.StatusForbidden, errors.Wrap(ErrCountryDenied, country)
+		}
+	}
+	live := s.limits()
+	if live.MaxMWM > 0 && requestedMWM > live.MaxMWM {
+		return nil, http.StatusForbidden, errMWMAbove(live.MaxMWM)
+	}
+	// instead of silently doing the PoW with the default MWM, tell the client the max
+	if s.mwmNegotiation && requestedMWM > s.network.maxMWM {
+		return nil, http.StatusForbidden, errMWMAbove(s.network.maxMWM)
+	}
+	mwm := s.network.MWM(requestedMWM)
+	// take consumes quota tokens unless the request is only a pre-flight or was reserved
+	take := func(identity string, cost float64, perMinute float64) bool {
+		switch mode {
+		case admitPeek:
+			return limiter.Available(identity, cost, perMinute)
+		case admitReserved:
+			return true
+		}
+		return limiter.AllowN(identity, cost, perMinute)
+	}
+	// enforce applies the entitlements of a key or token
+	enforce := func(identity string, e *entitlements) (int, error) {
+		if !e.Allows(command) {
+			return http.StatusForbidden, errors.Wrap(ErrCommandNotAllowed, command)
+		}
+		if e.maxMWM > 0 && requestedMWM > e.maxMWM {
+			return http.StatusForbidden, errMWMAbove(e.maxMWM)
+		}
+		if e.rateLimit == 0 {
+			return 0, nil
+		}
+		// higher MWMs consume proportionally more of the rate limit
+		allowed := take(identity, requestCost(mwm), float64(e.rateLimit))
+		setRateLimitHeaders(w, identity, float64(e.rateLimit))
+		if !allowed {
+			logger.Warnf("rate limiting %s\n", identity)
+			return http.StatusTooManyRequests, ErrRateLimited
+		}
+		return 0, nil
+	}
+	grant := &attachGrant{txLimit: live.MaxTxs, priority: priorityNormal, pool: s.pool}
+	if s.certAuth != nil {
+		profile, subject, err := s.certAuth.Authorize(r)
+		if err != nil {
+			logger.Warnf("denying %s for client certificate '%s': %s\n", command, subject, err.Error())
+			return nil, http.StatusForbidden, err
+		}
+		if profile.maxTxInBundle > 0 {
+			grant.txLimit = profile.maxTxInBundle
+		}
+		grant.identity = "cert:" + subject
+		span.SetAttributes(attribute.String("attach.client_cert", subject))
+	}
+	if s.apiKeys != nil {
+		key, err := s.apiKeys.Authorize(r)
+		if err != nil {
+			logger.Warnf("denying %s for %s: %s\n", command, s.anonymizer.Addr(s.clientHost(r)), err.Error())
+			return nil, http.StatusUnauthorized, err
+		}
+		grant.identity = "key:" + key.name
+		keyEntitlements := key.entitlements
+		if n, ok := live.KeyRateLimits[key.name]; ok {
+			keyEntitlements.rateLimit = n
+		}
+		if status, err := enforce(grant.identity, &keyEntitlements); err != nil {
+			return nil, status, err
+		}
+		if key.maxTxs > 0 {
+			grant.txLimit = key.maxTxs
+		}
+		grant.priority = key.priority
+		if key.pool != "" {
+			grant.pool = key.pool
+		}
+		span.SetAttributes(attribute.String("attach.api_key", key.name))
+	}
+	if s.jwtAuthz != nil {
+		claims, err := s.jwtAuthz.Authorize(r)
+		if err != nil {
+			logger.Warnf("denying %s for %s: %s\n", command, s.anonymizer.Addr(s.clientHost(r)), err.Error())
+			w.Header().Set("WWW-Authenticate", `Bearer realm="attach"`)
+			return nil, http.StatusUnauthorized, err
+		}
+		grant.identity = "jwt:" + claims.Subject
+		tokenEntitlements := &entitlements{maxMWM: claims.MaxMWM, rateLimit: claims.RateLimit}
+		if len(claims.Commands) > 0 {
+			tokenEntitlements.commands = map[string]bool{}
+			for _, c := range claims.Commands {
+				tokenEntitlements.commands[c] = true
+			}
+		}
+		if status, err := enforce(grant.identity, tokenEntitlements); err != nil {
+			return nil, status, err
+		}
+		if claims.MaxTxs > 0 {
+			grant.txLimit = claims.MaxTxs
+		}
+		if claims.Priority != "" {
+			if grant.priority, err = parsePriority(claims.Priority); err != nil {
+				return nil, http.StatusForbidden, err
+			}
+		}
+		span.SetAttributes(attribute.String("attach.token_subject", claims.Subject))
+	}
+
+	if geo != nil {
+		if geo.rateLimit > 0 {
+			identity := "geo:" + s.clientHost(r)
+			allowed := take(identity, requestCost(mwm), float64(geo.rateLimit))
+			setRateLimitHeaders(w, identity, float64(geo.rateLimit))
+			if !allowed {
+				logger.Warnf("rate limiting %s by geo policy\n", s.anonymizer.Addr(s.clientHost(r)))
+				return nil, http.StatusTooManyRequests, ErrRateLimited
+			}
+		}
+		// the country's priority caps the one of keys and tokens
+		if geo.priority < grant.priority {
+			grant.priority = geo.priority
+		}
+	}
+
+	// the budget is charged by the estimated work instead of the number of requests
+	if live.HashBudget > 0 && !take(hashBudgetIdentity, estimatedHashes(txs, mwm), live.HashBudget) {
+		logger.Warnf("hash budget of %g hashes per minute exhausted\n", live.HashBudget)
+		return nil, http.StatusTooManyRequests, ErrHashBudgetExceeded
+	}
+
+	// a reserved slot was already checked against the load when it was handed out
+	if mode == admitReserved {
+		return grant, 0, nil
+	}
+
+	if s.admission != nil {
+		if err := s.admission.Admit(txs, grant.priority); err != nil {
+			logger.Warnf("refusing attachToTangle: %s\n", err.Error())
+			w.Header().Set("Retry-After", strconv.Itoa(int(overloadRetryAfter.Seconds())))
+			return nil, http.StatusServiceUnavailable, err
+		}
+	}
+
+	if s.earlyRejection != nil {
+		if err := s.earlyRejection.Admit(s.scheduler.pressure, grant.priority); err != nil {
+			logger.Warnf("refusing %s early: %s\n", command, err.Error())
+			w.Header().Set("Retry-After", strconv.Itoa(int(overloadRetryAfter.Seconds())))
+			return nil, http.StatusTooManyRequests, err
+		}
+	}
+
+	// high priority clients aren't affected by the tightened limit
+	if limit := s.dynamicLimit.Limit(s.scheduler.pressure, grant.txLimit); txs > limit && grant.priority != priorityHigh {
+		logger.Warnf("canceling request as it exceeds the txs limit under pressure (%d>%d)\n", txs, limit)
+		w.Header().Set("Retry-After", strconv.Itoa(int(overloadRetryAfter.Seconds())))
+		return nil, http.StatusServiceUnavailable, errors.Wrapf(ErrBundleLimitTightened, "max allowed right now is %d", limit)
+	}
+	return grant, 0, nil
+}
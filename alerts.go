@@ -0,0 +1,267 @@
+package attach
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidAlertOption = errors.New("expected slack <url>, discord <url>, webhook <url> or email <host:port> <from> <to> [user password] after the alert option")
+var ErrInvalidAlertQueueOption = errors.New("expected a number of waiting requests and a duration after the alert_queue option")
+var ErrInvalidAlertErrorsOption = errors.New("expected a max number of errors per minute after the alert_errors option")
+
+const defaultAlertCooldown = 10 * time.Minute
+
+// how often the queue and error rate are checked
+const alertCheckInterval = 10 * time.Second
+
+// the operational events which are alerted
+const (
+	eventQueueSaturated = "queue_saturated"
+	eventPoWFailed      = "pow_failed"
+	eventUpstreamDown   = "upstream_down"
+	eventErrorSpike     = "error_spike"
+	eventRejectionSpike = "rejection_spike"
+)
+
+type alertMsg struct {
+	Event   string    `json:"event"`
+	Message string    `json:"message"`
+	Host    string    `json:"host"`
+	Time    time.Time `json:"time"`
+}
+
+func (a *alertMsg) String() string {
+	return fmt.Sprintf("[%s] %s: %s", a.Host, a.Event, a.Message)
+}
+
+// alertSink delivers alerts to the operator.
+type alertSink interface {
+	Send(ctx context.Context, msg *alertMsg) error
+}
+
+// webhookSink posts the alert as JSON, the body is built by payload.
+type webhookSink struct {
+	url     string
+	client  *http.Client
+	payload func(msg *alertMsg) interface{}
+}
+
+func (s *webhookSink) Send(ctx context.Context, msg *alertMsg) error {
+	body, err := json.Marshal(s.payload(msg))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(contentType, contentTypeJSON)
+	res, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= http.StatusBadRequest {
+		return errors.Errorf("http status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// emailSink sends the alert via SMTP.
+type emailSink struct {
+	addr     string
+	from, to string
+	auth     smtp.Auth
+}
+
+func (s *emailSink) Send(ctx context.Context, msg *alertMsg) error {
+	body := "From: " + s.from + "\r\n" +
+		"To: " + s.to + "\r\n" +
+		"Subject: attach alert: " + msg.Event + "\r\n" +
+		"\r\n" + msg.String() + "\r\n"
+	return smtp.SendMail(s.addr, s.auth, s.from, strings.Split(s.to, ","), []byte(body))
+}
+
+func newAlertSink(args []string) (alertSink, error) {
+	if len(args) < 2 {
+		return nil, ErrInvalidAlertOption
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	switch {
+	case args[0] == "slack" && len(args) == 2:
+		return &webhookSink{url: args[1], client: client, payload: func(msg *alertMsg) interface{} {
+			return map[string]string{"text": msg.String()}
+		}}, nil
+	case args[0] == "discord" && len(args) == 2:
+		return &webhookSink{url: args[1], client: client, payload: func(msg *alertMsg) interface{} {
+			return map[string]string{"content": msg.String()}
+		}}, nil
+	case args[0] == "webhook" && len(args) == 2:
+		return &webhookSink{url: args[1], client: client, payload: func(msg *alertMsg) interface{} {
+			return msg
+		}}, nil
+	case args[0] == "email" && (len(args) == 4 || len(args) == 6):
+		host, _, err := net.SplitHostPort(args[1])
+		if err != nil {
+			return nil, ErrInvalidAlertOption
+		}
+		sink := &emailSink{addr: args[1], from: args[2], to: args[3]}
+		if len(args) == 6 {
+			sink.auth = smtp.PlainAuth("", args[4], args[5], host)
+		}
+		return sink, nil
+	}
+	return nil, ErrInvalidAlertOption
+}
+
+// alerter notifies the configured sinks about operational events. every event is
+// sent at most once per cooldown so that a flapping condition doesn't flood the sinks.
+type alerter struct {
+	sinks    []alertSink
+	cooldown time.Duration
+	// requests waiting for the PoW lock for longer than queueFor count as saturation, 0 disables it
+	queueMax int
+	queueFor time.Duration
+	// the max attach errors per minute, 0 disables it
+	errorsMax int
+
+	mu     sync.Mutex
+	last   map[string]time.Time
+	cancel context.CancelFunc
+}
+
+var alerts *alerter
+
+func newAlerter() *alerter {
+	return &alerter{cooldown: defaultAlertCooldown, last: map[string]time.Time{}}
+}
+
+// ParseOption parses one of the alert options.
+func (a *alerter) ParseOption(option string, args []string) error {
+	var err error
+	switch option {
+	case "alert":
+		var sink alertSink
+		if sink, err = newAlertSink(args); err == nil {
+			a.sinks = append(a.sinks, sink)
+		}
+	case "alert_cooldown":
+		if len(args) != 1 {
+			return ErrInvalidAlertOption
+		}
+		if a.cooldown, err = time.ParseDuration(args[0]); err != nil {
+			return ErrInvalidAlertOption
+		}
+	case "alert_queue":
+		if len(args) != 2 {
+			return ErrInvalidAlertQueueOption
+		}
+		if a.queueMax, err = strconv.Atoi(args[0]); err != nil || a.queueMax <= 0 {
+			return ErrInvalidAlertQueueOption
+		}
+		if a.queueFor, err = time.ParseDuration(args[1]); err != nil {
+			return ErrInvalidAlertQueueOption
+		}
+	case "alert_errors":
+		if len(args) != 1 {
+			return ErrInvalidAlertErrorsOption
+		}
+		if a.errorsMax, err = strconv.Atoi(args[0]); err != nil || a.errorsMax <= 0 {
+			return ErrInvalidAlertErrorsOption
+		}
+	}
+	return err
+}
+
+// Fire sends an alert unless the event was already alerted within the cooldown.
+// it doesn't block, the sinks are notified in the background.
+func (a *alerter) Fire(event string, format string, args ...interface{}) {
+	if a == nil {
+		return
+	}
+	now := time.Now()
+	a.mu.Lock()
+	if now.Sub(a.last[event]) < a.cooldown {
+		a.mu.Unlock()
+		return
+	}
+	a.last[event] = now
+	a.mu.Unlock()
+	host, _ := os.Hostname()
+	msg := &alertMsg{Event: event, Message: fmt.Sprintf(format, args...), Host: host, Time: now}
+	logger.Warnf("alert %s\n", msg.String())
+	for _, sink := range a.sinks {
+		go func(sink alertSink) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := sink.Send(ctx, msg); err != nil {
+				logger.Errorf("unable to send %s alert: %s\n", event, err.Error())
+			}
+		}(sink)
+	}
+}
+
+func (a *alerter) Start() error {
+	if a.queueMax == 0 && a.errorsMax == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	a.cancel = cancel
+	go a.monitor(ctx)
+	return nil
+}
+
+func (a *alerter) Stop() error {
+	if a.cancel != nil {
+		a.cancel()
+	}
+	return nil
+}
+
+// monitor watches the queue and the error rate.
+func (a *alerter) monitor(ctx context.Context) {
+	ticker := time.NewTicker(alertCheckInterval)
+	defer ticker.Stop()
+	var saturatedSince time.Time
+	var errorCounts []int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if a.queueMax > 0 {
+				waiting := waitingJobs()
+				switch {
+				case waiting < a.queueMax:
+					saturatedSince = time.Time{}
+				case saturatedSince.IsZero():
+					saturatedSince = now
+				case now.Sub(saturatedSince) >= a.queueFor:
+					a.Fire(eventQueueSaturated, "%d requests waiting for the PoW lock for %s", waiting, now.Sub(saturatedSince).Truncate(time.Second))
+				}
+			}
+			if a.errorsMax > 0 {
+				// the cumulative error count of the last minute of checks
+				errorCounts = append(errorCounts, metricsReg.Totals()[metricAttachErrors])
+				if window := int(time.Minute / alertCheckInterval); len(errorCounts) > window {
+					errorCounts = errorCounts[len(errorCounts)-window-1:]
+				}
+				if errs := errorCounts[len(errorCounts)-1] - errorCounts[0]; errs > int64(a.errorsMax) {
+					a.Fire(eventErrorSpike, "%d attach errors within the last minute", errs)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package attach
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidAnonymizeMode = errors.New("invalid anonymize_ips mode, expected truncate or hash [salt]")
+
+type anonymizeMode int
+
+const (
+	anonymizeOff anonymizeMode = iota
+	anonymizeTruncate
+	anonymizeHash
+)
+
+// ipAnonymizer rewrites client addresses before they end up in logs or traces.
+// limits and abuse detection keep operating on the raw address.
+type ipAnonymizer struct {
+	mode anonymizeMode
+	salt []byte
+}
+
+func newIPAnonymizer(args []string) (*ipAnonymizer, error) {
+	switch {
+	case len(args) == 1 && args[0] == "truncate":
+		return &ipAnonymizer{mode: anonymizeTruncate}, nil
+	case len(args) >= 1 && len(args) <= 2 && args[0] == "hash":
+		a := &ipAnonymizer{mode: anonymizeHash}
+		if len(args) == 2 {
+			a.salt = []byte(args[1])
+			return a, nil
+		}
+		// without a configured salt hashes are only stable until the next restart
+		a.salt = make([]byte, 32)
+		if _, err := rand.Read(a.salt); err != nil {
+			return nil, err
+		}
+		return a, nil
+	}
+	return nil, ErrInvalidAnonymizeMode
+}
+
+// truncateIP keeps the /24 of IPv4 and the /48 of IPv6 addresses.
+func truncateIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32))
+	}
+	return ip.Mask(net.CIDRMask(48, 128))
+}
+
+// Addr returns the anonymized form of the given remote address (host or host:port).
+func (a *ipAnonymizer) Addr(remoteAddr string) string {
+	if a.mode == anonymizeOff {
+		return remoteAddr
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "invalid"
+	}
+	switch a.mode {
+	case anonymizeTruncate:
+		return truncateIP(ip).String()
+	default:
+		mac := hmac.New(sha256.New, a.salt)
+		mac.Write(truncateIP(ip))
+		mac.Write(ip)
+		// the truncated network stays visible so abuse from a single network can still be spotted
+		return truncateIP(ip).String() + "/" + hex.EncodeToString(mac.Sum(nil))[:12]
+	}
+}
@@ -0,0 +1,109 @@
+package attach
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var ErrAPIKeyRequired = errors.New("a valid API key is required")
+var ErrCommandNotAllowed = errors.New("the command is not allowed for this client")
+var ErrInvalidAPIKeyOption = errors.New("expected a name, a key and optional commands, max_mwm, max_txs, rate_limit, priority and pool settings after the api_key option")
+
+// the header carrying the API key
+const apiKeyHeader = "X-API-Key"
+
+// entitlements define what a client may do. zero values mean that the plugin's defaults apply.
+type entitlements struct {
+	// commands the client may use, all if empty
+	commands  map[string]bool
+	maxMWM    int
+	maxTxs    int
+	rateLimit int
+	priority  priorityClass
+	// the PoW pool the jobs are queued in, the one of the site if empty
+	pool string
+}
+
+// Allows reports whether the client may use the given command.
+func (e *entitlements) Allows(command string) bool {
+	return len(e.commands) == 0 || e.commands[command]
+}
+
+type apiKey struct {
+	name string
+	entitlements
+}
+
+// apiKeyAuth requires one of the configured API keys, each with its own entitlements,
+// effectively turning the plugin into a multi-tenant powbox.
+type apiKeyAuth struct {
+	// keyed by the SHA-256 of the key so that the keys don't linger in memory as is
+	keys map[[sha256.Size]byte]*apiKey
+}
+
+func newAPIKeyAuth() *apiKeyAuth {
+	return &apiKeyAuth{keys: map[[sha256.Size]byte]*apiKey{}}
+}
+
+// Add parses "<name> <key> [commands <a,b>] [max_mwm <n>] [max_txs <n>] [rate_limit <n>] [priority <class>] [pool <name>]".
+func (a *apiKeyAuth) Add(args []string) error {
+	if len(args) < 2 || len(args)%2 != 0 {
+		return ErrInvalidAPIKeyOption
+	}
+	key := &apiKey{name: args[0], entitlements: entitlements{priority: priorityNormal}}
+	for i := 2; i < len(args); i += 2 {
+		value := args[i+1]
+		var err error
+		switch args[i] {
+		case "commands":
+			key.commands = map[string]bool{}
+			for _, command := range strings.Split(value, ",") {
+				key.commands[command] = true
+			}
+		case "max_mwm":
+			key.maxMWM, err = strconv.Atoi(value)
+		case "max_txs":
+			key.maxTxs, err = strconv.Atoi(value)
+		case "rate_limit":
+			key.rateLimit, err = strconv.Atoi(value)
+		case "priority":
+			key.priority, err = parsePriority(value)
+		case "pool":
+			key.pool = value
+		default:
+			return errors.Wrap(ErrInvalidAPIKeyOption, args[i])
+		}
+		if err != nil {
+			return errors.Wrapf(ErrInvalidAPIKeyOption, "invalid %s for key %s", args[i], key.name)
+		}
+	}
+	a.keys[sha256.Sum256([]byte(args[1]))] = key
+	return nil
+}
+
+// Has reports whether a key with the name is configured.
+func (a *apiKeyAuth) Has(name string) bool {
+	for _, key := range a.keys {
+		if key.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize returns the key presented by the request.
+func (a *apiKeyAuth) Authorize(r *http.Request) (*apiKey, error) {
+	raw := r.Header.Get(apiKeyHeader)
+	if raw == "" {
+		return nil, ErrAPIKeyRequired
+	}
+	key, ok := a.keys[sha256.Sum256([]byte(raw))]
+	if !ok {
+		return nil, ErrAPIKeyRequired
+	}
+	return key, nil
+}
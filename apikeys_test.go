@@ -0,0 +1,146 @@
+package attach
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestAPIKeyAuthAdd(t *testing.T) {
+	a := newAPIKeyAuth()
+	err := a.Add([]string{"wallet", "s3cret", "commands", "attachToTangle,getNodeInfo", "max_mwm", "14",
+		"max_txs", "8", "rate_limit", "30", "priority", "high", "pool", "fast"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Has("wallet") || a.Has("s3cret") {
+		t.Fatal("expected the key to be known by its name only")
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set(apiKeyHeader, "s3cret")
+	key, err := a.Authorize(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.name != "wallet" || key.maxMWM != 14 || key.maxTxs != 8 || key.rateLimit != 30 ||
+		key.priority != priorityHigh || key.pool != "fast" {
+		t.Fatalf("unexpected key %+v", key)
+	}
+	if !key.Allows(attachToTangleCommand) || !key.Allows("getNodeInfo") || key.Allows("interruptAttachingToTangle") {
+		t.Fatalf("unexpected commands %v", key.commands)
+	}
+
+	invalid := [][]string{
+		{"wallet"},
+		{"wallet", "s3cret", "max_mwm"},
+		{"wallet", "s3cret", "max_mwm", "high"},
+		{"wallet", "s3cret", "priority", "urgent"},
+		{"wallet", "s3cret", "unknown", "1"},
+	}
+	for _, args := range invalid {
+		if err := newAPIKeyAuth().Add(args); errors.Cause(err) != ErrInvalidAPIKeyOption {
+			t.Errorf("%q: expected %v, got %v", args, ErrInvalidAPIKeyOption, err)
+		}
+	}
+}
+
+func TestAPIKeyAuthAuthorize(t *testing.T) {
+	a := newAPIKeyAuth()
+	if err := a.Add([]string{"wallet", "s3cret"}); err != nil {
+		t.Fatal(err)
+	}
+	key, err := a.Authorize(httptest.NewRequest(http.MethodPost, "/", nil))
+	if err != ErrAPIKeyRequired {
+		t.Fatalf("expected %v without a key, got %v", ErrAPIKeyRequired, err)
+	}
+	for _, raw := range []string{"other", "S3CRET", "s3cret "} {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Header.Set(apiKeyHeader, raw)
+		if key, err = a.Authorize(r); err != ErrAPIKeyRequired {
+			t.Errorf("%q: expected %v, got %v", raw, ErrAPIKeyRequired, err)
+		}
+	}
+	// keys without commands may use all of them
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set(apiKeyHeader, "s3cret")
+	if key, err = a.Authorize(r); err != nil || !key.Allows(attachToTangleCommand) || !key.Allows("getNodeInfo") {
+		t.Fatalf("expected the key to allow all commands, got %v, %v", key, err)
+	}
+}
+
+// admitKey runs the admission of an attach request presenting the API key.
+func admitKey(s *site, raw string, command string, txs int, mwm int) (*attachGrant, int, error) {
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	if raw != "" {
+		r.Header.Set(apiKeyHeader, raw)
+	}
+	span := trace.SpanFromContext(context.Background())
+	return s.admitAttach(httptest.NewRecorder(), r, span, nil, command, txs, mwm, admitCharge)
+}
+
+func TestAdmitAPIKeyEntitlements(t *testing.T) {
+	s := newSite()
+	s.scheduler = &powScheduler{pressure: &queuePressure{}}
+	s.pool = "default"
+	s.apiKeys = newAPIKeyAuth()
+	keys := [][]string{
+		{"admit-restricted", "restricted", "commands", "getNodeInfo", "max_mwm", "9"},
+		{"admit-limited", "limited", "rate_limit", "486"},
+		{"admit-premium", "premium", "max_txs", "50", "priority", "high", "pool", "fast"},
+	}
+	for _, args := range keys {
+		if err := s.apiKeys.Add(args); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		key     string
+		command string
+		mwm     int
+		status  int
+		err     error
+	}{
+		{"no key", "", attachToTangleCommand, 14, http.StatusUnauthorized, ErrAPIKeyRequired},
+		{"unknown key", "unknown", attachToTangleCommand, 14, http.StatusUnauthorized, ErrAPIKeyRequired},
+		{"command not allowed", "restricted", attachToTangleCommand, 9, http.StatusForbidden, ErrCommandNotAllowed},
+		{"mwm above the key's max", "restricted", "getNodeInfo", 14, http.StatusForbidden, ErrMWMNotAllowed},
+		{"allowed", "restricted", "getNodeInfo", 9, 0, nil},
+	}
+	for _, test := range tests {
+		_, status, err := admitKey(s, test.key, test.command, 1, test.mwm)
+		if status != test.status || errors.Cause(err) != test.err {
+			t.Errorf("%s: expected %d %v, got %d %v", test.name, test.status, test.err, status, err)
+		}
+	}
+
+	grant, _, err := admitKey(s, "premium", attachToTangleCommand, 1, 14)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grant.identity != "key:admit-premium" || grant.txLimit != 50 || grant.priority != priorityHigh || grant.pool != "fast" {
+		t.Fatalf("unexpected grant %+v", grant)
+	}
+	grant, _, err = admitKey(s, "limited", attachToTangleCommand, 1, 14)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grant.txLimit != s.maxTxInBundle || grant.priority != priorityNormal || grant.pool != "default" {
+		t.Fatalf("expected the site's defaults, got %+v", grant)
+	}
+
+	// an MWM 14 request costs 3^5 tokens, the first one above used half of the limit
+	if _, _, err := admitKey(s, "limited", attachToTangleCommand, 1, 14); err != nil {
+		t.Fatalf("expected the second request to be allowed: %s", err.Error())
+	}
+	if _, status, err := admitKey(s, "limited", attachToTangleCommand, 1, 14); status != http.StatusTooManyRequests || err != ErrRateLimited {
+		t.Fatalf("expected the third request to be rate limited, got %d %v", status, err)
+	}
+}
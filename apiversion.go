@@ -0,0 +1,45 @@
+package attach
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidAPIVersionsOption = errors.New("expected the accepted API versions after the api_versions option")
+
+// IRI's error message for a missing or unsupported version, client libraries match on it
+var ErrInvalidAPIVersion = errors.New("Invalid API Version")
+
+const apiVersionHeader = "X-IOTA-API-Version"
+
+// the version IRI assumes and echoes if the client sends none
+const defaultAPIVersion = "1"
+
+func parseAPIVersions(args []string) (map[string]bool, error) {
+	if len(args) == 0 {
+		return nil, ErrInvalidAPIVersionsOption
+	}
+	versions := map[string]bool{}
+	for _, version := range args {
+		versions[version] = true
+	}
+	return versions, nil
+}
+
+// negotiateAPIVersion checks the API version of a locally answered command against the
+// accepted ones and echoes it like IRI does. it reports false after writing the error
+// response for an unaccepted version.
+func (s *site) negotiateAPIVersion(w http.ResponseWriter, r *http.Request) bool {
+	version := strings.TrimSpace(r.Header.Get(apiVersionHeader))
+	if len(s.apiVersions) > 0 && !s.apiVersions[version] {
+		s.writeError(w, http.StatusBadRequest, ErrInvalidAPIVersion)
+		return false
+	}
+	if version == "" {
+		version = defaultAPIVersion
+	}
+	w.Header().Set(apiVersionHeader, version)
+	return true
+}
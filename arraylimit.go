@@ -0,0 +1,104 @@
+package attach
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidMaxArrayOption = errors.New("expected a command and a max number of elements after the max_array option")
+
+// parseMaxArray parses "<command> <max elements>".
+func parseMaxArray(args []string) (string, int, error) {
+	if len(args) != 2 {
+		return "", 0, ErrInvalidMaxArrayOption
+	}
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n <= 0 {
+		return "", 0, ErrInvalidMaxArrayOption
+	}
+	return args[0], n, nil
+}
+
+// arrayLimit returns the max number of elements of the array fields of a command, 0 if unlimited.
+func (s *site) arrayLimit(command string) int {
+	if n, ok := s.arrayLimits[command]; ok {
+		return n
+	}
+	return s.maxArraySize
+}
+
+// checkArraySizes rejects bodies with top level arrays longer than the command's limit,
+// without decoding the elements.
+func (s *site) checkArraySizes(body []byte) error {
+	cmd := &struct {
+		Command string `json:"command"`
+	}{}
+	if err := json.Unmarshal(body, cmd); err != nil {
+		// left to the node
+		return nil
+	}
+	command, limit := cmd.Command, s.arrayLimit(cmd.Command)
+	if limit == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return ErrBodyUnparsable
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return ErrBodyUnparsable
+		}
+		tok, err := dec.Token()
+		if err != nil {
+			return ErrBodyUnparsable
+		}
+		delim, ok := tok.(json.Delim)
+		if !ok {
+			continue
+		}
+		if delim == '{' {
+			// skip nested objects
+			if err := skipJSON(dec, 1); err != nil {
+				return err
+			}
+			continue
+		}
+		count := 0
+		for dec.More() {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return ErrBodyUnparsable
+			}
+			if count++; count > limit {
+				return fmt.Errorf("%s accepts at most %d elements in %s", command, limit, key)
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return ErrBodyUnparsable
+		}
+	}
+	return nil
+}
+
+// skipJSON consumes tokens until depth levels of objects or arrays are closed.
+func skipJSON(dec *json.Decoder, depth int) error {
+	for depth > 0 {
+		tok, err := dec.Token()
+		if err != nil {
+			return ErrBodyUnparsable
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+	return nil
+}
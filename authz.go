@@ -0,0 +1,157 @@
+package attach
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrNotAuthorized = errors.New("the request is not authorized by the authorization service")
+var ErrAuthzFailed = errors.New("the authorization service is unavailable, try again later")
+var ErrInvalidAuthzOption = errors.New("expected the URL of the policy decision and an optional cache duration after the authz option")
+
+const (
+	metricAuthzErrors    = "attach.authz.errors"
+	metricAuthzCacheHits = "attach.authz.cache_hits"
+)
+
+const (
+	authzTimeout = 5 * time.Second
+	// more cached decisions drop the expired ones
+	authzCacheSize = 10000
+)
+
+type authzDecision struct {
+	allowed bool
+	expires time.Time
+}
+
+// externalAuthz delegates the decision whether an attach request is allowed to an
+// authorization service with the API of Open Policy Agent: the request metadata is
+// POSTed as {"input": ...} to the decision URL, e.g. http://opa:8181/v1/data/attach/allow,
+// and the answer's result must be true or an object with allow set to true. decisions are
+// cached by their input, requests are rejected while the service fails.
+type externalAuthz struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]authzDecision
+}
+
+// newExternalAuthz parses "<decision url> [cache duration]".
+func newExternalAuthz(args []string) (*externalAuthz, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, ErrInvalidAuthzOption
+	}
+	a := &externalAuthz{url: args[0], client: &http.Client{Timeout: authzTimeout}, cache: map[[sha256.Size]byte]authzDecision{}}
+	if len(args) == 2 {
+		var err error
+		if a.ttl, err = time.ParseDuration(args[1]); err != nil || a.ttl < 0 {
+			return nil, ErrInvalidAuthzOption
+		}
+	}
+	return a, nil
+}
+
+// authzResult accepts both a boolean result and an object with an allow field.
+type authzResult struct {
+	Result json.RawMessage `json:"result"`
+}
+
+func (a *externalAuthz) query(input []byte) (bool, error) {
+	res, err := a.client.Post(a.url, contentTypeJSON, bytes.NewReader(input))
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return false, errors.Errorf("the authorization service answered with status %d", res.StatusCode)
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(nil, res.Body, maxPolicyAnswerSize))
+	if err != nil {
+		return false, err
+	}
+	answer := &authzResult{}
+	if err := json.Unmarshal(data, answer); err != nil {
+		return false, errors.Wrap(err, "unable to parse the answer of the authorization service")
+	}
+	// an undefined decision has no result and denies
+	if len(answer.Result) == 0 {
+		return false, nil
+	}
+	var allowed bool
+	if err := json.Unmarshal(answer.Result, &allowed); err == nil {
+		return allowed, nil
+	}
+	var object struct {
+		Allow bool `json:"allow"`
+	}
+	if err := json.Unmarshal(answer.Result, &object); err != nil {
+		return false, errors.New("the result of the authorization service is neither a boolean nor an object")
+	}
+	return object.Allow, nil
+}
+
+// Authorize returns the decision about the request metadata, cached if possible.
+func (a *externalAuthz) Authorize(m *bundleMetadata) (bool, error) {
+	input, err := json.Marshal(struct {
+		Input *bundleMetadata `json:"input"`
+	}{m})
+	if err != nil {
+		return false, err
+	}
+	key := sha256.Sum256(input)
+	now := time.Now()
+	if a.ttl > 0 {
+		a.mu.Lock()
+		decision, ok := a.cache[key]
+		a.mu.Unlock()
+		if ok && now.Before(decision.expires) {
+			metricsReg.Inc(metricAuthzCacheHits)
+			return decision.allowed, nil
+		}
+	}
+	allowed, err := a.query(input)
+	if err != nil {
+		return false, err
+	}
+	if a.ttl > 0 {
+		a.mu.Lock()
+		if len(a.cache) >= authzCacheSize {
+			for k, d := range a.cache {
+				if now.After(d.expires) {
+					delete(a.cache, k)
+				}
+			}
+		}
+		a.cache[key] = authzDecision{allowed: allowed, expires: now.Add(a.ttl)}
+		a.mu.Unlock()
+	}
+	return allowed, nil
+}
+
+// authorizeExternally asks the authorization service whether the attach request is allowed.
+func (s *site) authorizeExternally(r *http.Request, grant *attachGrant, source string, mwm int, trytes []Trytes) (int, error) {
+	if s.authz == nil {
+		return 0, nil
+	}
+	allowed, err := s.authz.Authorize(newBundleMetadata(r, attachToTangleCommand, grant.identity, source, mwm, trytes))
+	if err != nil {
+		metricsReg.Inc(metricAuthzErrors)
+		logger.Errorf("external authorization failed: %s\n", err.Error())
+		return http.StatusServiceUnavailable, ErrAuthzFailed
+	}
+	if !allowed {
+		logger.Warnf("denying attachToTangle for %s by the authorization service\n", s.anonymizer.Addr(source))
+		return http.StatusForbidden, ErrNotAuthorized
+	}
+	return 0, nil
+}
@@ -0,0 +1,159 @@
+package attach
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var ErrEmptyBatch = errors.New("the batch doesn't contain any bundles")
+var ErrBatchTooLarge = errors.New("the batch contains too many bundles")
+
+// the command attaching several independent bundles in one request
+const attachToTangleBatchCommand = "attachToTangleBatch"
+
+// AttachToTangleBatchCmd carries several bundles, each with its own tips and MWM.
+type AttachToTangleBatchCmd struct {
+	Command string              `json:"command"`
+	Bundles []AttachToTangleCmd `json:"bundles"`
+}
+
+// BatchBundleRes is the outcome of one bundle of a batch. Result holds the regular
+// attachToTangle response if the bundle was attached, otherwise Error says why not.
+type BatchBundleRes struct {
+	Status int             `json:"status"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	// Code is the stable error code if error_codes is enabled
+	Code string `json:"code,omitempty"`
+	// MaxMWM is the max MWM the client may request instead, if mwm_negotiation is enabled
+	MaxMWM int `json:"maxMWM,omitempty"`
+}
+
+type AttachToTangleBatchRes struct {
+	Results  []BatchBundleRes `json:"results"`
+	Duration int64            `json:"duration"`
+}
+
+// batchAdmittedKey marks the per bundle requests of a batch which was already admitted
+// as a whole. the value is the grant of the client.
+type batchAdmittedKey struct{}
+
+// batchGrant returns the grant of an already admitted batch bundle request.
+func batchGrant(r *http.Request) (*attachGrant, bool) {
+	grant, ok := r.Context().Value(batchAdmittedKey{}).(*attachGrant)
+	return grant, ok
+}
+
+// bufferedResponse captures the response of a single bundle of a batch.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(status int) { b.status = status }
+
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
+
+// serveBatch authorizes the batch as a whole and then runs every bundle through the
+// regular attach pipeline, one after another.
+func (h AttachToTangleHandler) serveBatch(w http.ResponseWriter, r *http.Request, span trace.Span, body []byte) (int, error) {
+	start := time.Now()
+	command := &AttachToTangleBatchCmd{}
+	if err := json.Unmarshal(body, command); err != nil {
+		return http.StatusBadRequest, ErrBodyUnparsable
+	}
+	if len(command.Bundles) == 0 {
+		return http.StatusBadRequest, ErrEmptyBatch
+	}
+	if len(command.Bundles) > h.site.maxBatchBundles {
+		return http.StatusBadRequest, errors.Wrapf(ErrBatchTooLarge, "max allowed is %d", h.site.maxBatchBundles)
+	}
+	span.SetAttributes(attribute.Int("attach.batch_bundles", len(command.Bundles)))
+
+	// quotas are charged for the batch as a whole, by its total size and highest MWM
+	var txs, mwm int
+	for _, bundle := range command.Bundles {
+		txs += len(bundle.Trytes)
+		if bundle.MWM > mwm {
+			mwm = bundle.MWM
+		}
+	}
+	grant, status, err := h.site.admitAttach(w, r, span, body, attachToTangleCommand, txs, mwm, admitCharge)
+	if err != nil {
+		h.site.countRejection(err)
+		spanError(span, err)
+		return status, err
+	}
+
+	ctx := context.WithValue(r.Context(), batchAdmittedKey{}, grant)
+	res := &AttachToTangleBatchRes{Results: make([]BatchBundleRes, len(command.Bundles))}
+	for i := range command.Bundles {
+		bundle := command.Bundles[i]
+		bundle.Command = attachToTangleCommand
+		res.Results[i] = h.attachBatchBundle(ctx, r, &bundle)
+	}
+	res.Duration = int64(time.Since(start) / time.Millisecond)
+
+	resBytes, err := json.Marshal(res)
+	if err != nil {
+		return http.StatusInternalServerError, ErrBuildingRes
+	}
+	h.site.signResponse(w, resBytes)
+	w.Header().Set(contentType, contentTypeJSON)
+	w.Header().Set("access-control-allow-origin", "*")
+	w.Write(resBytes)
+	return http.StatusOK, nil
+}
+
+// attachBatchBundle runs a single bundle of a batch through the attach pipeline.
+func (h AttachToTangleHandler) attachBatchBundle(ctx context.Context, r *http.Request, bundle *AttachToTangleCmd) BatchBundleRes {
+	if len(bundle.Trytes) == 0 {
+		return BatchBundleRes{Status: http.StatusBadRequest, Error: "no trytes given"}
+	}
+	body, err := json.Marshal(bundle)
+	if err != nil {
+		return BatchBundleRes{Status: http.StatusBadRequest, Error: err.Error()}
+	}
+	sub := r.WithContext(ctx)
+	sub.Body = ioutil.NopCloser(bytes.NewReader(body))
+	sub.ContentLength = int64(len(body))
+
+	rec := &bufferedResponse{header: http.Header{}, status: http.StatusOK}
+	status, err := h.serveAttach(rec, sub)
+	// code returns the error code if error codes are enabled
+	code := func(status int, err error) string {
+		if !h.site.errorCodes {
+			return ""
+		}
+		return errorCode(status, err)
+	}
+	switch {
+	case err != nil:
+		res := BatchBundleRes{Status: status, Error: err.Error(), Code: code(status, err)}
+		if h.site.mwmNegotiation {
+			res.MaxMWM, _ = maxMWMOf(err)
+		}
+		return res
+	case status >= http.StatusBadRequest:
+		return BatchBundleRes{Status: status, Error: http.StatusText(status), Code: code(status, nil)}
+	case rec.status >= http.StatusBadRequest:
+		iriErr := &iriErrorRes{}
+		json.Unmarshal(rec.body.Bytes(), iriErr)
+		return BatchBundleRes{Status: rec.status, Error: iriErr.Error, Code: iriErr.Code}
+	case !json.Valid(rec.body.Bytes()):
+		// e.g. a truncated response in chaos mode
+		return BatchBundleRes{Status: http.StatusBadGateway, Error: "invalid response for bundle"}
+	}
+	return BatchBundleRes{Status: rec.status, Result: json.RawMessage(rec.body.Bytes())}
+}
@@ -0,0 +1,88 @@
+package attach
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// how much of a request body is looked at to find out which command it carries
+const commandPeekSize = 4096
+
+var bodyReaderPool = sync.Pool{
+	New: func() interface{} { return bufio.NewReaderSize(nil, commandPeekSize) },
+}
+
+var bodyBufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func getBodyReader(r io.Reader) *bufio.Reader {
+	br := bodyReaderPool.Get().(*bufio.Reader)
+	br.Reset(r)
+	return br
+}
+
+func putBodyReader(br *bufio.Reader) {
+	br.Reset(nil)
+	bodyReaderPool.Put(br)
+}
+
+func getBodyBuffer() *bytes.Buffer {
+	return bodyBufferPool.Get().(*bytes.Buffer)
+}
+
+func putBodyBuffer(buf *bytes.Buffer) {
+	// don't keep huge bundles around forever
+	if buf.Cap() > maxBodyBufferCap {
+		return
+	}
+	buf.Reset()
+	bodyBufferPool.Put(buf)
+}
+
+// buffers above this capacity are not returned to the pool
+const maxBodyBufferCap = 4 << 20
+
+// peekCommand looks for the top level command field within the first bytes of the
+// body without consuming them. ok is false if the command couldn't be determined,
+// e.g. because it comes after a large trytes array.
+func peekCommand(br *bufio.Reader) (command string, ok bool) {
+	return peekField(br, "command")
+}
+
+// peekField looks for a top level string field within the first bytes of the body
+// without consuming them.
+func peekField(br *bufio.Reader, field string) (value string, ok bool) {
+	// a short body results in an error but still returns what's there
+	peeked, _ := br.Peek(commandPeekSize)
+	dec := json.NewDecoder(bytes.NewReader(peeked))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return "", false
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return "", false
+		}
+		if key == field {
+			if err := dec.Decode(&value); err != nil {
+				return "", false
+			}
+			return value, true
+		}
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// peekedBody passes the peeked and the remaining body on while closing the original body.
+type peekedBody struct {
+	*bufio.Reader
+	io.Closer
+}
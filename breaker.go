@@ -0,0 +1,90 @@
+package attach
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrUpstreamUnavailable = errors.New("upstream node is unavailable, try again later")
+
+// circuitBreaker stops forwarding requests to the upstream node after a number of
+// consecutive failures. after the cooldown a single probe request is let through
+// which closes the circuit again if it succeeds.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// Allow reports whether a request may be sent to the upstream node.
+func (b *circuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	// half-open: let one probe through
+	b.probing = true
+	return true
+}
+
+func (b *circuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures >= b.threshold {
+		logger.Infof("upstream node recovered, closing circuit\n")
+	}
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *circuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.failures >= b.threshold {
+		if b.failures == b.threshold {
+			logger.Warnf("upstream node failed %d times in a row, opening circuit for %s\n", b.failures, b.cooldown)
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// retryPolicy retries failed upstream requests with exponential backoff.
+type retryPolicy struct {
+	retries int
+	backoff time.Duration
+}
+
+const (
+	defaultRetryBackoff = 100 * time.Millisecond
+	maxRetries          = 10
+	maxRetryBackoff     = 30 * time.Second
+)
+
+// Delay returns the backoff before the given retry attempt (starting at 1), capped at maxRetryBackoff.
+func (p retryPolicy) Delay(attempt int) time.Duration {
+	delay := p.backoff
+	for i := 1; i < attempt && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryBackoff {
+		return maxRetryBackoff
+	}
+	return delay
+}
+
+// Wait sleeps before the given retry attempt (starting at 1).
+func (p retryPolicy) Wait(attempt int) {
+	time.Sleep(p.Delay(attempt))
+}
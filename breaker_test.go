@@ -0,0 +1,45 @@
+package attach
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	b := &circuitBreaker{threshold: 2, cooldown: 20 * time.Millisecond}
+	b.Failure()
+	if !b.Allow() {
+		t.Fatal("expected the circuit to stay closed below the threshold")
+	}
+	b.Failure()
+	if b.Allow() {
+		t.Fatal("expected the circuit to open at the threshold")
+	}
+
+	// after the cooldown a single probe is let through
+	time.Sleep(30 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("expected a probe after the cooldown")
+	}
+	if b.Allow() {
+		t.Fatal("expected no other request while the probe is pending")
+	}
+
+	// a failed probe opens the circuit for another cooldown
+	b.Failure()
+	if b.Allow() {
+		t.Fatal("expected the circuit to open again after a failed probe")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("expected a probe after the second cooldown")
+	}
+
+	// a successful probe closes it
+	b.Success()
+	for i := 0; i < 3; i++ {
+		if !b.Allow() {
+			t.Fatal("expected the circuit to close after a successful probe")
+		}
+	}
+}
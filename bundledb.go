@@ -0,0 +1,272 @@
+package attach
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/coreos/bbolt"
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidBundleDBOption = errors.New("expected a database path and an optional retention after the bundle_db option")
+var ErrBundleDBWithoutStats = errors.New("the bundle_db option requires the stats option for access to the bundles endpoint")
+var ErrInvalidBundleQuery = errors.New("expected bundle, address or a from/to time range as query")
+
+const bundlesPath = "/attach/bundles"
+
+const (
+	defaultBundleQueryLimit = 100
+	maxBundleQueryLimit     = 1000
+	// the index keys contain the attach time as big endian unix nanoseconds
+	bundleIndexTimeBytes = 8
+)
+
+var (
+	bundlesBucket       = []byte("bundles")
+	bundlesByTimeBucket = []byte("bundles_by_time")
+	bundlesByAddrBucket = []byte("bundles_by_address")
+)
+
+// bundleDB stores every attached bundle in a local bbolt database, giving operators
+// a lightweight explorer for what their powbox produced. bundles are indexed by the
+// time they were attached and by the addresses of their transactions.
+type bundleDB struct {
+	path string
+	// bundles older than the retention are dropped, 0 keeps them forever
+	retention time.Duration
+	db        *bolt.DB
+}
+
+type storedBundle struct {
+	Bundle   string     `json:"bundle"`
+	Attached time.Time  `json:"attached"`
+	Client   string     `json:"client,omitempty"`
+	MWM      int        `json:"mwm"`
+	Value    int64      `json:"value"`
+	Txs      []storedTx `json:"transactions"`
+}
+
+type storedTx struct {
+	Hash    string `json:"hash"`
+	Address string `json:"address"`
+	Value   int64  `json:"value"`
+	Trytes  string `json:"trytes"`
+}
+
+// newBundleDB parses "<path> [retention]".
+func newBundleDB(args []string) (*bundleDB, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, ErrInvalidBundleDBOption
+	}
+	d := &bundleDB{path: args[0]}
+	if len(args) == 2 {
+		var err error
+		if d.retention, err = time.ParseDuration(args[1]); err != nil || d.retention <= 0 {
+			return nil, ErrInvalidBundleDBOption
+		}
+	}
+	return d, nil
+}
+
+func (d *bundleDB) Start() error {
+	db, err := bolt.Open(d.path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bundlesBucket, bundlesByTimeBucket, bundlesByAddrBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	d.db = db
+	return nil
+}
+
+func (d *bundleDB) Stop() error {
+	if d.db == nil {
+		return nil
+	}
+	err := d.db.Close()
+	d.db = nil
+	return err
+}
+
+func timeKey(t time.Time) []byte {
+	key := make([]byte, bundleIndexTimeBytes)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
+
+// Add stores the attached transactions of a bundle and drops the bundles past the retention.
+func (d *bundleDB) Add(bundle string, client string, mwm int, txs []Tx) error {
+	now := time.Now()
+	rec := &storedBundle{Bundle: bundle, Attached: now, Client: client, MWM: mwm, Txs: make([]storedTx, len(txs))}
+	for i := range txs {
+		rec.Txs[i] = storedTx{Hash: string(txs[i].Hash()), Address: string(txs[i].Address), Value: txs[i].Value, Trytes: string(txs[i].Trytes())}
+		if txs[i].Value > 0 {
+			rec.Value += txs[i].Value
+		}
+	}
+	contents, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		if d.retention > 0 {
+			if err := d.expire(tx, now.Add(-d.retention)); err != nil {
+				return err
+			}
+		}
+		if err := tx.Bucket(bundlesBucket).Put([]byte(bundle), contents); err != nil {
+			return err
+		}
+		when := timeKey(now)
+		if err := tx.Bucket(bundlesByTimeBucket).Put(append(when, bundle...), nil); err != nil {
+			return err
+		}
+		for _, t := range rec.Txs {
+			key := append(append([]byte(t.Address), when...), bundle...)
+			if err := tx.Bucket(bundlesByAddrBucket).Put(key, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// expire deletes the bundles attached before the given time including their index entries.
+func (d *bundleDB) expire(tx *bolt.Tx, before time.Time) error {
+	limit := timeKey(before)
+	c := tx.Bucket(bundlesByTimeBucket).Cursor()
+	for k, _ := c.First(); k != nil && string(k[:bundleIndexTimeBytes]) < string(limit); k, _ = c.Next() {
+		bundle := k[bundleIndexTimeBytes:]
+		if contents := tx.Bucket(bundlesBucket).Get(bundle); contents != nil {
+			rec := &storedBundle{}
+			if err := json.Unmarshal(contents, rec); err == nil {
+				for _, t := range rec.Txs {
+					key := append(append([]byte(t.Address), k[:bundleIndexTimeBytes]...), bundle...)
+					if err := tx.Bucket(bundlesByAddrBucket).Delete(key); err != nil {
+						return err
+					}
+				}
+			}
+			if err := tx.Bucket(bundlesBucket).Delete(bundle); err != nil {
+				return err
+			}
+		}
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Query returns the bundle with the given hash, or the latest bundles with a transaction
+// to the address and/or attached within the time range, newest first.
+func (d *bundleDB) Query(bundle string, address string, from time.Time, to time.Time, limit int) ([]*storedBundle, error) {
+	found := []*storedBundle{}
+	err := d.db.View(func(tx *bolt.Tx) error {
+		bundles := tx.Bucket(bundlesBucket)
+		add := func(hash []byte) error {
+			contents := bundles.Get(hash)
+			if contents == nil {
+				return nil
+			}
+			rec := &storedBundle{}
+			if err := json.Unmarshal(contents, rec); err != nil {
+				return err
+			}
+			found = append(found, rec)
+			return nil
+		}
+		if bundle != "" {
+			return add([]byte(bundle))
+		}
+		// both indexes are ordered by time after the prefix, so they are walked backwards
+		prefix := []byte(address)
+		c := tx.Bucket(bundlesByTimeBucket).Cursor()
+		if address != "" {
+			c = tx.Bucket(bundlesByAddrBucket).Cursor()
+		}
+		upper := append(append([]byte{}, prefix...), timeKey(to)...)
+		k, _ := c.Seek(upper)
+		if k == nil {
+			k, _ = c.Last()
+		} else {
+			k, _ = c.Prev()
+		}
+		for ; k != nil && len(found) < limit; k, _ = c.Prev() {
+			if len(k) < len(prefix)+bundleIndexTimeBytes || string(k[:len(prefix)]) != address {
+				break
+			}
+			when := time.Unix(0, int64(binary.BigEndian.Uint64(k[len(prefix):len(prefix)+bundleIndexTimeBytes])))
+			if when.Before(from) {
+				break
+			}
+			if err := add(k[len(prefix)+bundleIndexTimeBytes:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+func (s *site) isBundlesRequest(r *http.Request) bool {
+	return s.bundleDB != nil && r.URL.Path == bundlesPath
+}
+
+// serveBundles answers queries like ?bundle=<hash>, ?address=<address>&limit=<n> or
+// ?from=<RFC3339>&to=<RFC3339>, with the stats credentials.
+func (s *site) serveBundles(w http.ResponseWriter, r *http.Request) (int, error) {
+	if !s.statsCreds.Authorized(r) {
+		return requireAuth(w, "attach stats")
+	}
+	query := r.URL.Query()
+	bundle, address := query.Get("bundle"), query.Get("address")
+	from, to := time.Time{}, time.Now()
+	var err error
+	if v := query.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return http.StatusBadRequest, ErrInvalidBundleQuery
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return http.StatusBadRequest, ErrInvalidBundleQuery
+		}
+	}
+	if bundle == "" && address == "" && query.Get("from") == "" && query.Get("to") == "" {
+		return http.StatusBadRequest, ErrInvalidBundleQuery
+	}
+	limit := defaultBundleQueryLimit
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			return http.StatusBadRequest, ErrInvalidBundleQuery
+		}
+		if limit > maxBundleQueryLimit {
+			limit = maxBundleQueryLimit
+		}
+	}
+	found, err := s.bundleDB.Query(bundle, address, from, to, limit)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	resBytes, err := json.Marshal(found)
+	if err != nil {
+		return http.StatusInternalServerError, ErrBuildingRes
+	}
+	w.Header().Set(contentType, contentTypeJSON)
+	w.Write(resBytes)
+	return http.StatusOK, nil
+}
@@ -0,0 +1,80 @@
+package attach
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var ErrBundleDenied = errors.New("the bundle is denied by a bundle rule")
+var ErrInvalidBundleRuleOption = errors.New("expected tag or address, a tryte prefix and deny, high, normal or low after the bundle_rule option")
+
+const metricBundleRulePrefix = "attach.bundle_rule."
+
+// bundleRule matches bundles with a transaction whose tag or address starts with the
+// prefix, e.g. to give bundles with the operator's app tag priority or reject spam tags.
+type bundleRule struct {
+	field  string
+	prefix string
+	// deny or the priority of the matched bundles
+	deny     bool
+	priority priorityClass
+}
+
+// parseBundleRule parses "<tag|address> <prefix> <deny|high|normal|low>".
+func parseBundleRule(args []string) (*bundleRule, error) {
+	if len(args) != 3 || (args[0] != "tag" && args[0] != "address") {
+		return nil, ErrInvalidBundleRuleOption
+	}
+	max := txTagEnd - txTagOffset
+	if args[0] == "address" {
+		max = txAddressEnd - txMessageEnd
+	}
+	prefix := strings.ToUpper(args[1])
+	if prefix == "" || len(prefix) > max || CheckTrytes(args[0], Trytes(prefix)) != nil {
+		return nil, ErrInvalidBundleRuleOption
+	}
+	rule := &bundleRule{field: args[0], prefix: prefix}
+	if args[2] == "deny" {
+		rule.deny = true
+		return rule, nil
+	}
+	var err error
+	if rule.priority, err = parsePriority(args[2]); err != nil {
+		return nil, ErrInvalidBundleRuleOption
+	}
+	return rule, nil
+}
+
+// Matches reports whether any transaction of the bundle has the prefix.
+func (b *bundleRule) Matches(trytes []Trytes) bool {
+	start, end := txTagOffset, txTagEnd
+	if b.field == "address" {
+		start, end = txMessageEnd, txAddressEnd
+	}
+	for _, tx := range trytes {
+		if len(tx) >= end && strings.HasPrefix(string(tx[start:end]), b.prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyBundleRules applies the first matching rule, in the order of the config, to the grant.
+func (s *site) applyBundleRules(grant *attachGrant, trytes []Trytes) (*attachGrant, error) {
+	for _, rule := range s.bundleRules {
+		if !rule.Matches(trytes) {
+			continue
+		}
+		metricsReg.Inc(metricBundleRulePrefix + rule.field + "." + rule.prefix)
+		if rule.deny {
+			logger.Warnf("denying bundle with %s %s\n", rule.field, rule.prefix)
+			return nil, errors.Wrapf(ErrBundleDenied, "%s %s", rule.field, rule.prefix)
+		}
+		// the grant may be shared by the bundles of a batch
+		routed := *grant
+		routed.priority = rule.priority
+		return &routed, nil
+	}
+	return grant, nil
+}
@@ -0,0 +1,150 @@
+package attach
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidCacheOption = errors.New("expected a command and a ttl after the cache option")
+var ErrCommandNotCacheable = errors.New("only idempotent read commands can be cached")
+
+const cacheStatusHeader = "X-Attach-Cache"
+
+// the max number of cached responses
+const maxCachedResponses = 10000
+
+const (
+	metricCacheHits   = "attach.cache.hits"
+	metricCacheMisses = "attach.cache.misses"
+)
+
+// the commands whose responses only depend on the request and the node's state
+var cacheableCommands = map[string]bool{
+	"getNodeInfo":            true,
+	"getNeighbors":           true,
+	"getTips":                true,
+	"getBalances":            true,
+	"findTransactions":       true,
+	"getTrytes":              true,
+	"getInclusionStates":     true,
+	"wereAddressesSpentFrom": true,
+	"checkConsistency":       true,
+}
+
+type cachedResponse struct {
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+// responseCache answers idempotent commands from a cache with a ttl per command,
+// so that public endpoints don't hit the node with the same queries over and over.
+type responseCache struct {
+	ttls map[string]time.Duration
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*cachedResponse
+}
+
+// Add parses "<command> <ttl>".
+func (c *responseCache) Add(args []string) error {
+	if len(args) != 2 {
+		return ErrInvalidCacheOption
+	}
+	if !cacheableCommands[args[0]] {
+		return errors.Wrap(ErrCommandNotCacheable, args[0])
+	}
+	ttl, err := time.ParseDuration(args[1])
+	if err != nil || ttl <= 0 {
+		return ErrInvalidCacheOption
+	}
+	if c.ttls == nil {
+		c.ttls = map[string]time.Duration{}
+		c.entries = map[[sha256.Size]byte]*cachedResponse{}
+	}
+	c.ttls[args[0]] = ttl
+	return nil
+}
+
+// Cached reports whether responses of the command are cached.
+func (c *responseCache) Cached(command string) bool {
+	if c == nil {
+		return false
+	}
+	_, ok := c.ttls[command]
+	return ok
+}
+
+func (c *responseCache) get(key [sha256.Size]byte) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res, ok := c.entries[key]
+	if !ok || time.Now().After(res.expires) {
+		return nil
+	}
+	return res
+}
+
+func (c *responseCache) put(key [sha256.Size]byte, res *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxCachedResponses {
+		now := time.Now()
+		for k, cached := range c.entries {
+			if now.After(cached.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxCachedResponses {
+			return
+		}
+	}
+	c.entries[key] = res
+}
+
+// serveCached answers the command from the cache or forwards it and caches a successful response.
+func (h AttachToTangleHandler) serveCached(w http.ResponseWriter, r *http.Request, command string, body []byte) (int, error) {
+	// the command is part of the body, so the body alone identifies the query
+	key := sha256.Sum256(body)
+	if res := h.site.cache.get(key); res != nil {
+		metricsReg.Inc(metricCacheHits)
+		for name, values := range res.header {
+			w.Header()[name] = values
+		}
+		w.Header().Set(cacheStatusHeader, "HIT")
+		w.Header().Set("Age", strconv.Itoa(int(time.Since(res.stored).Seconds())))
+		w.Write(res.body)
+		return http.StatusOK, nil
+	}
+	metricsReg.Inc(metricCacheMisses)
+	rec := &bufferedResponse{header: http.Header{}, status: http.StatusOK}
+	status, err := h.forward(rec, r)
+	if err != nil {
+		return status, err
+	}
+	if status != 0 && status != http.StatusOK {
+		rec.status = status
+	}
+	if rec.status == http.StatusOK {
+		now := time.Now()
+		h.site.cache.put(key, &cachedResponse{
+			header:  rec.header,
+			body:    append([]byte(nil), rec.body.Bytes()...),
+			stored:  now,
+			expires: now.Add(h.site.cache.ttls[command]),
+		})
+	}
+	for name, values := range rec.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set(cacheStatusHeader, "MISS")
+	w.WriteHeader(rec.status)
+	w.Write(rec.body.Bytes())
+	return 0, nil
+}
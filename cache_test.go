@@ -0,0 +1,73 @@
+package attach
+
+import (
+	"crypto/sha256"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestResponseCacheAdd(t *testing.T) {
+	c := &responseCache{}
+	if err := c.Add([]string{"getTips", "5s"}); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Cached("getTips") || c.Cached("getNodeInfo") {
+		t.Fatalf("expected only getTips to be cached, got %v", c.ttls)
+	}
+	for _, args := range [][]string{{"getTips"}, {"getTips", "soon"}, {"getTips", "0s"}, {"getTips", "5s", "extra"}, {"attachToTangle", "5s"}} {
+		if err := c.Add(args); err == nil {
+			t.Errorf("%q: expected an error", args)
+		}
+	}
+	var nilCache *responseCache
+	if nilCache.Cached("getTips") {
+		t.Fatal("expected nothing to be cached without the option")
+	}
+}
+
+func TestResponseCacheExpiry(t *testing.T) {
+	c := &responseCache{}
+	if err := c.Add([]string{"getTips", "1h"}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	fresh, stale := sha256.Sum256([]byte("fresh")), sha256.Sum256([]byte("stale"))
+	c.put(fresh, &cachedResponse{body: []byte("fresh"), stored: now, expires: now.Add(time.Hour)})
+	c.put(stale, &cachedResponse{body: []byte("stale"), stored: now.Add(-time.Hour), expires: now.Add(-time.Second)})
+	if res := c.get(fresh); res == nil || string(res.body) != "fresh" {
+		t.Fatalf("expected the fresh response, got %+v", res)
+	}
+	if res := c.get(stale); res != nil {
+		t.Fatalf("expected the expired response to be a miss, got %+v", res)
+	}
+}
+
+func TestResponseCacheFull(t *testing.T) {
+	c := &responseCache{}
+	if err := c.Add([]string{"getTips", "1h"}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i := 0; i < maxCachedResponses; i++ {
+		expires := now.Add(time.Hour)
+		if i == 0 {
+			expires = now.Add(-time.Second)
+		}
+		c.put(sha256.Sum256([]byte(strconv.Itoa(i))), &cachedResponse{stored: now, expires: expires})
+	}
+
+	// the expired entry makes room for a new one
+	added := sha256.Sum256([]byte("added"))
+	c.put(added, &cachedResponse{stored: now, expires: now.Add(time.Hour)})
+	if c.get(added) == nil {
+		t.Fatal("expected the expired entry to be replaced")
+	}
+
+	// without expired entries new responses aren't cached
+	dropped := sha256.Sum256([]byte("dropped"))
+	c.put(dropped, &cachedResponse{stored: now, expires: now.Add(time.Hour)})
+	if c.get(dropped) != nil || len(c.entries) != maxCachedResponses {
+		t.Fatalf("expected the full cache to drop the response, got %d entries", len(c.entries))
+	}
+}
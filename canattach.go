@@ -0,0 +1,155 @@
+package attach
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var ErrInvalidReservation = errors.New("the reservation is unknown, expired or doesn't cover the bundle")
+var ErrReservationsDisabled = errors.New("reservations are not enabled")
+var ErrInvalidCanAttachCmd = errors.New("canAttach requires a positive number of transactions")
+
+// the pre-flight command telling wallets up front whether an attach would be accepted
+const canAttachCommand = "canAttach"
+
+// CanAttachCmd asks whether a bundle of the given size and MWM would be accepted.
+type CanAttachCmd struct {
+	Command string `json:"command"`
+	Txs     int    `json:"transactions"`
+	MWM     int    `json:"minWeightMagnitude"`
+	// Reserve charges the quotas right away and hands out a reservation token which
+	// lets the attachToTangle request skip the quota and load checks
+	Reserve bool `json:"reserve,omitempty"`
+}
+
+type CanAttachRes struct {
+	CanAttach bool   `json:"canAttach"`
+	Reason    string `json:"reason,omitempty"`
+	// EstimatedDuration is a rough guess of the attach duration in milliseconds including the queue
+	EstimatedDuration int64  `json:"estimatedDuration"`
+	Reservation       string `json:"reservation,omitempty"`
+	// ReservationExpiresAt is the unix time in milliseconds after which the reservation is void
+	ReservationExpiresAt int64 `json:"reservationExpiresAt,omitempty"`
+}
+
+type reservation struct {
+	txs     int
+	mwm     int
+	expires time.Time
+}
+
+// reservationStore keeps the handed out reservation tokens until they are redeemed or expire.
+type reservationStore struct {
+	ttl    time.Duration
+	mu     sync.Mutex
+	tokens map[string]reservation
+}
+
+func newReservationStore(ttl time.Duration) *reservationStore {
+	return &reservationStore{ttl: ttl, tokens: map[string]reservation{}}
+}
+
+// Reserve hands out a token for a bundle of up to txs transactions at the given MWM.
+func (s *reservationStore) Reserve(txs int, mwm int) (string, time.Time, error) {
+	if s.ttl == 0 {
+		return "", time.Time{}, ErrReservationsDisabled
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(b)
+	now := time.Now()
+	expires := now.Add(s.ttl)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.collect(now)
+	s.tokens[token] = reservation{txs: txs, mwm: mwm, expires: expires}
+	return token, expires, nil
+}
+
+// Collect drops the expired reservations.
+func (s *reservationStore) Collect(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.collect(now)
+}
+
+// collect drops the expired reservations, the caller must hold the lock.
+func (s *reservationStore) collect(now time.Time) {
+	for t, res := range s.tokens {
+		if now.After(res.expires) {
+			delete(s.tokens, t)
+		}
+	}
+}
+
+// Redeem consumes the token if it is valid for a bundle of txs transactions at the given MWM.
+func (s *reservationStore) Redeem(token string, txs int, mwm int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res, ok := s.tokens[token]
+	if !ok || time.Now().After(res.expires) || txs > res.txs || mwm > res.mwm {
+		return false
+	}
+	delete(s.tokens, token)
+	return true
+}
+
+// serveCanAttach answers the canAttach pre-flight command. refusals due to limits are
+// part of the response while failed authentication is answered with the error status.
+func (s *site) serveCanAttach(w http.ResponseWriter, r *http.Request, span trace.Span, body []byte) (int, error) {
+	command := &CanAttachCmd{}
+	if err := json.Unmarshal(body, command); err != nil {
+		return http.StatusBadRequest, ErrBodyUnparsable
+	}
+	if command.Txs <= 0 {
+		return http.StatusBadRequest, ErrInvalidCanAttachCmd
+	}
+	if command.Reserve && s.reservations.ttl == 0 {
+		return http.StatusBadRequest, ErrReservationsDisabled
+	}
+
+	mode := admitPeek
+	if command.Reserve {
+		mode = admitCharge
+	}
+	res := &CanAttachRes{}
+	grant, status, err := s.admitAttach(w, r, span, body, attachToTangleCommand, command.Txs, command.MWM, mode)
+	switch {
+	case status == http.StatusUnauthorized:
+		return status, err
+	case err != nil:
+		res.Reason = err.Error()
+	case command.Txs > grant.txLimit:
+		res.Reason = errors.Wrapf(ErrTxBundleLimitExceeded, "max allowed is %d", grant.txLimit).Error()
+	default:
+		res.CanAttach = true
+		res.EstimatedDuration = int64(s.scheduler.pressure.Estimate(command.Txs) / time.Millisecond)
+	}
+
+	if res.CanAttach && command.Reserve {
+		token, expires, err := s.reservations.Reserve(command.Txs, s.network.MWM(command.MWM))
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		res.Reservation = token
+		res.ReservationExpiresAt = expires.UnixNano() / int64(time.Millisecond)
+	}
+
+	resBytes, err := json.Marshal(res)
+	if err != nil {
+		return http.StatusInternalServerError, ErrBuildingRes
+	}
+	w.Header().Set(contentType, contentTypeJSON)
+	w.Header().Set("access-control-allow-origin", "*")
+	w.Write(resBytes)
+	return http.StatusOK, nil
+}
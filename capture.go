@@ -0,0 +1,203 @@
+package attach
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidCaptureOption = errors.New("expected a directory, an optional sample percent and an optional max size in MB after the capture option")
+
+const metricCaptured = "attach.captured"
+
+const (
+	// the bodies of a capture are truncated beyond this size
+	maxCapturedBodySize = 1 << 20
+	defaultCaptureMaxMB = 100
+)
+
+// the request headers kept in captures, all others could carry credentials
+var capturedHeaders = []string{contentType, "User-Agent", apiVersionHeader, includeHashesHeader, tryteEncodingHeader}
+
+// CapturedRequest is the sanitized request of a capture.
+type CapturedRequest struct {
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body"`
+}
+
+// CapturedResponse is the response of a capture, Error is the error handed to Caddy
+// if the plugin didn't write the response itself.
+type CapturedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// Capture is a recorded request/response pair, as read by the attach-replay tool.
+type Capture struct {
+	Time      time.Time        `json:"time"`
+	RequestID string           `json:"requestId"`
+	Command   string           `json:"command"`
+	Request   CapturedRequest  `json:"request"`
+	Response  CapturedResponse `json:"response"`
+}
+
+// captureRecorder passes the response on while recording it.
+type captureRecorder struct {
+	http.ResponseWriter
+	capture *Capture
+	body    bytes.Buffer
+}
+
+func (c *captureRecorder) WriteHeader(status int) {
+	c.capture.Response.Status = status
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *captureRecorder) Write(p []byte) (int, error) {
+	if c.capture.Response.Status == 0 {
+		c.capture.Response.Status = http.StatusOK
+	}
+	if room := maxCapturedBodySize - c.body.Len(); room > 0 {
+		if len(p) > room {
+			c.body.Write(p[:room])
+		} else {
+			c.body.Write(p)
+		}
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+type capturingKey struct{}
+
+// requestCapture writes sampled request/response pairs of the intercepted commands to
+// files in a directory, so that bug reports of wallet vendors can be reproduced with
+// the attach-replay tool. credentials and client addresses aren't recorded. capturing
+// stops once the directory holds the max size.
+type requestCapture struct {
+	dir           string
+	samplePercent float64
+	maxSize       int64
+
+	mu   sync.Mutex
+	size int64
+	full bool
+}
+
+// newRequestCapture parses "<dir> [sample percent] [max size MB]".
+func newRequestCapture(args []string) (*requestCapture, error) {
+	if len(args) < 1 || len(args) > 3 {
+		return nil, ErrInvalidCaptureOption
+	}
+	c := &requestCapture{dir: args[0], samplePercent: 100, maxSize: defaultCaptureMaxMB << 20}
+	if len(args) >= 2 {
+		var err error
+		if c.samplePercent, err = strconv.ParseFloat(args[1], 64); err != nil || c.samplePercent <= 0 || c.samplePercent > 100 {
+			return nil, ErrInvalidCaptureOption
+		}
+	}
+	if len(args) == 3 {
+		mb, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil || mb <= 0 {
+			return nil, ErrInvalidCaptureOption
+		}
+		c.maxSize = mb << 20
+	}
+	return c, nil
+}
+
+// Start creates the directory and accounts for the captures already in it.
+func (c *requestCapture) Start() error {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size = 0
+	for _, f := range files {
+		c.size += f.Size()
+	}
+	return nil
+}
+
+// Begin samples the request of the command and returns the writer recording the response,
+// nil if the request isn't captured, and the context of the request. the body is copied
+// as it may be reused.
+func (c *requestCapture) Begin(ctx context.Context, w http.ResponseWriter, r *http.Request, command string, body []byte) (*captureRecorder, context.Context) {
+	if ctx.Value(capturingKey{}) != nil || rand.Float64()*100 >= c.samplePercent {
+		return nil, ctx
+	}
+	c.mu.Lock()
+	full := c.full
+	c.mu.Unlock()
+	if full {
+		return nil, ctx
+	}
+	capture := &Capture{Time: time.Now(), RequestID: requestID(r), Command: command,
+		Request: CapturedRequest{Method: r.Method, Path: r.URL.Path, Header: http.Header{}}}
+	for _, name := range capturedHeaders {
+		if value := r.Header.Get(name); value != "" {
+			capture.Request.Header.Set(name, value)
+		}
+	}
+	if len(body) > maxCapturedBodySize {
+		body = body[:maxCapturedBodySize]
+	}
+	capture.Request.Body = string(body)
+	// sub-requests, e.g. the bundles of a batch, are part of this capture
+	return &captureRecorder{ResponseWriter: w, capture: capture}, context.WithValue(ctx, capturingKey{}, true)
+}
+
+// Finish writes the capture with the outcome of the request.
+func (c *requestCapture) Finish(rec *captureRecorder, status int, err error) {
+	capture := rec.capture
+	capture.Response.Header = rec.Header()
+	capture.Response.Body = rec.body.String()
+	if capture.Response.Status == 0 {
+		capture.Response.Status = status
+	}
+	if err != nil {
+		capture.Response.Error = err.Error()
+	}
+	data, merr := json.Marshal(capture)
+	if merr != nil {
+		logger.Errorf("unable to encode the capture of request %s: %s\n", capture.RequestID, merr.Error())
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.full {
+		return
+	}
+	if c.size+int64(len(data)) > c.maxSize {
+		c.full = true
+		logger.Warnf("stopped capturing requests, %s holds the max size of %dMB\n", c.dir, c.maxSize>>20)
+		return
+	}
+	name := fmt.Sprintf("%d-%s.json", capture.Time.UnixNano(), capture.RequestID)
+	if err := ioutil.WriteFile(filepath.Join(c.dir, name), data, 0600); err != nil {
+		logger.Errorf("unable to write the capture of request %s: %s\n", capture.RequestID, err.Error())
+		return
+	}
+	c.size += int64(len(data))
+	metricsReg.Inc(metricCaptured)
+}
@@ -0,0 +1,101 @@
+package attach
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidChaosOption = errors.New("invalid chaos option")
+var ErrChaosNotEnabled = errors.New("chaos_* options require the chaos option to be set explicitly")
+
+const metricChaosInjected = "attach.chaos_injected"
+
+// chaosInjector makes the attach path misbehave on purpose so that clients can
+// test their retry logic against a realistic powbox. it must never be used in production.
+type chaosInjector struct {
+	enabled bool
+	// artificial delay range added before the PoW
+	minDelay, maxDelay time.Duration
+	// percentage of requests answered with a random 429 or 500
+	errorPercent float64
+	// percentage of responses which are cut off in the middle
+	truncatePercent float64
+}
+
+// ParseOption parses the chaos option and one of the chaos_* options.
+func (ci *chaosInjector) ParseOption(option string, args []string) error {
+	switch {
+	case option == "chaos" && len(args) == 0:
+		ci.enabled = true
+	case option == "chaos_delay" && (len(args) == 1 || len(args) == 2):
+		var err error
+		if ci.minDelay, err = time.ParseDuration(args[0]); err != nil {
+			return err
+		}
+		ci.maxDelay = ci.minDelay
+		if len(args) == 2 {
+			if ci.maxDelay, err = time.ParseDuration(args[1]); err != nil {
+				return err
+			}
+		}
+		if ci.minDelay < 0 || ci.maxDelay < ci.minDelay {
+			return errors.Wrap(ErrInvalidChaosOption, "invalid delay range")
+		}
+	case option == "chaos_errors" && len(args) == 1:
+		percent, err := strconv.ParseFloat(args[0], 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return errors.Wrap(ErrInvalidChaosOption, "invalid error percentage")
+		}
+		ci.errorPercent = percent
+	case option == "chaos_truncate" && len(args) == 1:
+		percent, err := strconv.ParseFloat(args[0], 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return errors.Wrap(ErrInvalidChaosOption, "invalid truncate percentage")
+		}
+		ci.truncatePercent = percent
+	default:
+		return errors.Wrap(ErrInvalidChaosOption, option)
+	}
+	return nil
+}
+
+func (ci *chaosInjector) hit(percent float64) bool {
+	return percent > 0 && rand.Float64()*100 < percent
+}
+
+// Fail returns the status of an injected error or 0 if the request should proceed.
+func (ci *chaosInjector) Fail() int {
+	if !ci.hit(ci.errorPercent) {
+		return 0
+	}
+	metricsReg.Inc(metricChaosInjected)
+	if rand.Intn(2) == 0 {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+// Delay sleeps for a random duration within the configured delay range.
+func (ci *chaosInjector) Delay() {
+	if ci.maxDelay == 0 {
+		return
+	}
+	delay := ci.minDelay
+	if ci.maxDelay > ci.minDelay {
+		delay += time.Duration(rand.Int63n(int64(ci.maxDelay - ci.minDelay)))
+	}
+	time.Sleep(delay)
+}
+
+// Truncate cuts off the response body for a share of the responses.
+func (ci *chaosInjector) Truncate(body []byte) []byte {
+	if !ci.hit(ci.truncatePercent) || len(body) < 2 {
+		return body
+	}
+	metricsReg.Inc(metricChaosInjected)
+	return body[:rand.Intn(len(body)-1)+1]
+}
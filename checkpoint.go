@@ -0,0 +1,159 @@
+package attach
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidCheckpointsOption = errors.New("expected a directory after the pow_checkpoints option")
+
+// powCheckpoints saves every attached transaction of a bundle while its PoW runs, so
+// that the same job sent again after a restart only does the PoW of the remaining
+// transactions. the checkpoint of a job is removed once its PoW is done.
+type powCheckpoints struct {
+	dir string
+}
+
+func newPoWCheckpoints(args []string) (*powCheckpoints, error) {
+	if len(args) != 1 {
+		return nil, ErrInvalidCheckpointsOption
+	}
+	return &powCheckpoints{dir: args[0]}, nil
+}
+
+func (c *powCheckpoints) Start() error {
+	return os.MkdirAll(c.dir, 0700)
+}
+
+type checkpointEntry struct {
+	Index  int    `json:"index"`
+	Trytes Trytes `json:"trytes"`
+}
+
+// checkpoint holds the attached transactions of one job, on disk if it has a path.
+type checkpoint struct {
+	path string
+	done map[int]Trytes
+}
+
+func newCheckpoint() *checkpoint {
+	return &checkpoint{done: map[int]Trytes{}}
+}
+
+// Merge adds attached transactions, e.g. the ones of a partial result to resume.
+func (cp *checkpoint) Merge(done map[int]Trytes) {
+	for i, trytes := range done {
+		cp.done[i] = trytes
+	}
+}
+
+// Attached returns the attached transactions by index.
+func (cp *checkpoint) Attached() map[int]Trytes {
+	done := make(map[int]Trytes, len(cp.done))
+	for i, trytes := range cp.done {
+		done[i] = trytes
+	}
+	return done
+}
+
+type checkpointKey struct{}
+
+// withCheckpoint returns a context whose PoW is checkpointed to cp.
+func withCheckpoint(ctx context.Context, cp *checkpoint) context.Context {
+	return context.WithValue(ctx, checkpointKey{}, cp)
+}
+
+// checkpointOf returns the checkpoint of the PoW, if the caller set one.
+func checkpointOf(ctx context.Context) *checkpoint {
+	cp, _ := ctx.Value(checkpointKey{}).(*checkpoint)
+	return cp
+}
+
+// Open returns the checkpoint of the job, identified by its tips, mwm and the trytes
+// as submitted. it must be called before the PoW modifies the transactions.
+func (c *powCheckpoints) Open(tra *Transaction, tx []Tx, mwm int64) *checkpoint {
+	h := sha256.New()
+	h.Write([]byte(tra.Trunk))
+	h.Write([]byte(tra.Branch))
+	h.Write([]byte(strconv.FormatInt(mwm, 10)))
+	for i := range tx {
+		h.Write([]byte(tx[i].Trytes()))
+	}
+	cp := newCheckpoint()
+	cp.path = filepath.Join(c.dir, hex.EncodeToString(h.Sum(nil)))
+	f, err := os.Open(cp.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warnf("unable to read the PoW checkpoint %s: %s\n", cp.path, err.Error())
+		}
+		return cp
+	}
+	defer f.Close()
+	// a line cut off by a crash is ignored, its transaction is attached again
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 4096), 16384)
+	for scanner.Scan() {
+		entry := &checkpointEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err == nil {
+			cp.done[entry.Index] = entry.Trytes
+		}
+	}
+	if len(cp.done) > 0 {
+		logger.Infof("resuming the PoW of %d already attached transactions from checkpoint %s\n", len(cp.done), cp.path)
+	}
+	return cp
+}
+
+// Restore returns the attached transaction at the index if it was checkpointed and still
+// approves the given trunk and branch.
+func (cp *checkpoint) Restore(i int, trunk Trytes, branch Trytes, mwm int64) (*Tx, bool) {
+	trytes, ok := cp.done[i]
+	if !ok {
+		return nil, false
+	}
+	tx, err := parseTransaction(trytes)
+	if err != nil || tx.TrunkTransaction != trunk || tx.BranchTransaction != branch || !tx.HasValidNonce(mwm) {
+		return nil, false
+	}
+	return tx, true
+}
+
+// Save records an attached transaction and appends it to the file of the checkpoint.
+func (cp *checkpoint) Save(i int, tx *Tx) {
+	cp.done[i] = tx.Trytes()
+	if cp.path == "" {
+		return
+	}
+	line, err := json.Marshal(&checkpointEntry{Index: i, Trytes: cp.done[i]})
+	if err != nil {
+		return
+	}
+	f, err := os.OpenFile(cp.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err == nil {
+		_, err = f.Write(append(line, '\n'))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		logger.Warnf("unable to save the PoW checkpoint %s: %s\n", cp.path, err.Error())
+	}
+}
+
+// Remove drops the checkpoint of a finished job.
+func (cp *checkpoint) Remove() {
+	if cp.path == "" {
+		return
+	}
+	if err := os.Remove(cp.path); err != nil && !os.IsNotExist(err) {
+		logger.Warnf("unable to remove the PoW checkpoint %s: %s\n", cp.path, err.Error())
+	}
+}
@@ -0,0 +1,187 @@
+// attach-bench measures the PoW backends across MWMs and bundle sizes and prints the
+// expected attach latencies, which helps sizing the hardware and choosing the limits of
+// the attach plugin before going live.
+//
+//	attach-bench -pow PowSSE,PowGo -mwm 9-15 -txs 1,4,8 -runs 3
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/iotaledger/iota.go/pow"
+)
+
+// the number of trytes of a transaction
+const txTrytesSize = 2673
+
+func main() {
+	backends := flag.String("pow", "", "comma separated PoW backends to measure, all available ones by default")
+	mwms := flag.String("mwm", "9-15", "the range of MWMs to measure")
+	sizes := flag.String("txs", "1,2,4,8,16", "comma separated bundle sizes to estimate the latency of")
+	runs := flag.Int("runs", 3, "the number of transactions measured per backend and MWM")
+	procs := flag.Int("procs", defaultProcs(), "the number of threads of the PoW")
+	flag.Parse()
+
+	names, err := parseBackends(*backends)
+	if err == nil && *runs <= 0 {
+		err = fmt.Errorf("expected a positive number of runs")
+	}
+	if err == nil && *procs <= 0 {
+		err = fmt.Errorf("expected a positive number of threads")
+	}
+	var minMWM, maxMWM int
+	if err == nil {
+		minMWM, maxMWM, err = parseRange(*mwms)
+	}
+	var txs []int
+	if err == nil {
+		txs, err = parseSizes(*sizes)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprint(w, "backend\tmwm\tper tx\t")
+	for _, n := range txs {
+		fmt.Fprintf(w, "%d txs\t", n)
+	}
+	fmt.Fprintln(w)
+	for _, name := range names {
+		fn := availableBackends()[name]
+		for mwm := minMWM; mwm <= maxMWM; mwm++ {
+			fmt.Fprintf(os.Stderr, "measuring %s at MWM %d\n", name, mwm)
+			perTx, err := measure(fn, mwm, *runs, *procs)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s failed at MWM %d: %s\n", name, mwm, err.Error())
+				os.Exit(1)
+			}
+			// the transactions of a bundle are chained, their PoW runs one after another
+			fmt.Fprintf(w, "%s\t%d\t%s\t", name, mwm, round(perTx))
+			for _, n := range txs {
+				fmt.Fprintf(w, "%s\t", round(perTx*time.Duration(n)))
+			}
+			fmt.Fprintln(w)
+		}
+	}
+	w.Flush()
+}
+
+// defaultProcs leaves a core to the rest of the system, like the attach plugin does.
+func defaultProcs() int {
+	if n := runtime.NumCPU(); n > 1 {
+		return n - 1
+	}
+	return 1
+}
+
+// availableBackends returns the PoW backends of iota.go compiled into this build, named
+// like the plugin names them. The synchronized variants only serialize the searches and
+// are left out.
+func availableBackends() map[string]pow.ProofOfWorkFunc {
+	available := map[string]pow.ProofOfWorkFunc{}
+	for _, name := range pow.GetProofOfWorkImplementations() {
+		if strings.HasPrefix(name, "Sync") {
+			continue
+		}
+		fn, err := pow.GetProofOfWorkImpl(name)
+		if err != nil {
+			continue
+		}
+		available["Pow"+name] = fn
+	}
+	return available
+}
+
+func parseBackends(s string) ([]string, error) {
+	available := availableBackends()
+	if s == "" {
+		names := make([]string, 0, len(available))
+		for name := range available {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := available[name]; !ok {
+			return nil, fmt.Errorf("the PoW backend %s isn't available in this build", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func parseRange(s string) (int, int, error) {
+	parts := strings.SplitN(s, "-", 2)
+	min, err := strconv.Atoi(parts[0])
+	max := min
+	if err == nil && len(parts) == 2 {
+		max, err = strconv.Atoi(parts[1])
+	}
+	if err != nil || min <= 0 || max < min {
+		return 0, 0, fmt.Errorf("expected a MWM or a range like 9-15 instead of %q", s)
+	}
+	return min, max, nil
+}
+
+func parseSizes(s string) ([]int, error) {
+	var sizes []int
+	for _, size := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(size))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("expected positive bundle sizes instead of %q", s)
+		}
+		sizes = append(sizes, n)
+	}
+	return sizes, nil
+}
+
+// randomTrytes returns the trytes of a transaction with a random message, so that every
+// run searches a nonce of its own.
+func randomTrytes() string {
+	const alphabet = "9ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	b := make([]byte, txTrytesSize)
+	rand.Read(b)
+	for i := range b {
+		b[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+	return string(b)
+}
+
+// measure returns the mean PoW duration of a transaction at the MWM.
+func measure(fn pow.ProofOfWorkFunc, mwm int, runs int, procs int) (time.Duration, error) {
+	var total time.Duration
+	for i := 0; i < runs; i++ {
+		trytes := randomTrytes()
+		start := time.Now()
+		nonce, err := fn(trytes, mwm, procs)
+		if err != nil {
+			return 0, err
+		}
+		total += time.Since(start)
+		if nonce == "" {
+			return 0, fmt.Errorf("no nonce found")
+		}
+	}
+	return total / time.Duration(runs), nil
+}
+
+func round(d time.Duration) time.Duration {
+	if d < time.Second {
+		return d.Round(time.Millisecond)
+	}
+	return d.Round(10 * time.Millisecond)
+}
@@ -0,0 +1,102 @@
+// attach-replay sends the requests recorded by the capture option to a Caddy instance
+// with the attach plugin again and compares the responses with the recorded ones.
+//
+//	attach-replay -target http://localhost:14265 captures/*.json
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	attach "github.com/luca-moser/caddy-iri-attach"
+)
+
+func main() {
+	target := flag.String("target", "http://localhost:14265", "the base URL requests are replayed against")
+	showBodies := flag.Bool("bodies", false, "print the recorded and the replayed response bodies")
+	timeout := flag.Duration("timeout", 5*time.Minute, "the timeout of each replayed request")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] <capture files>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	var mismatches int
+	for _, path := range flag.Args() {
+		capture, err := readCapture(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err.Error())
+			os.Exit(1)
+		}
+		status, body, err := replay(client, *target, capture)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err.Error())
+			os.Exit(1)
+		}
+		// nonces differ on every attach, so only the status is compared
+		outcome := "ok"
+		if status != capture.Response.Status {
+			outcome = "MISMATCH"
+			mismatches++
+		}
+		fmt.Printf("%s %s %s: recorded %d, replayed %d\n", outcome, capture.RequestID, capture.Command, capture.Response.Status, status)
+		if *showBodies || status != capture.Response.Status {
+			recorded := capture.Response.Body
+			if recorded == "" {
+				recorded = capture.Response.Error
+			}
+			fmt.Printf("  recorded: %s\n  replayed: %s\n", strings.TrimSpace(recorded), strings.TrimSpace(body))
+		}
+	}
+	if mismatches > 0 {
+		fmt.Printf("%d of %d responses differ\n", mismatches, flag.NArg())
+		os.Exit(1)
+	}
+}
+
+func readCapture(path string) (*attach.Capture, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	capture := &attach.Capture{}
+	if err := json.Unmarshal(data, capture); err != nil {
+		return nil, err
+	}
+	return capture, nil
+}
+
+func replay(client *http.Client, target string, capture *attach.Capture) (int, string, error) {
+	req, err := http.NewRequest(capture.Request.Method, strings.TrimSuffix(target, "/")+capture.Request.Path,
+		bytes.NewReader([]byte(capture.Request.Body)))
+	if err != nil {
+		return 0, "", err
+	}
+	for name, values := range capture.Request.Header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return 0, "", err
+	}
+	return res.StatusCode, string(body), nil
+}
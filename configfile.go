@@ -0,0 +1,209 @@
+package attach
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyfile"
+	"github.com/pkg/errors"
+	"go.yaml.in/yaml/v3"
+)
+
+var ErrInvalidImportOption = errors.New("expected a file and an optional reload interval after the import option")
+var ErrInvalidConfigFile = errors.New("invalid attach config file")
+
+// configFile holds options of the attach directive in a YAML or JSON file, keyed by
+// the option name. the value is the argument, a list of arguments or, for options
+// which can be repeated like api_key, a list of argument lists:
+//
+//	hash_budget: 1e12
+//	trusted_proxies: [10.0.0.0/8, 192.168.0.0/16]
+//	api_key:
+//	  - [wallet, "{$WALLET_KEY}", max_txs, 20]
+//	  - [exchange, "{file:/etc/attach/exchange.key}", priority, high]
+//
+// the file is turned into a directive block and parsed like the Caddyfile, so it
+// supports the same options and placeholders.
+type configFile struct {
+	file     string
+	interval time.Duration
+
+	modTime time.Time
+	cancel  context.CancelFunc
+}
+
+func newConfigFile(args []string) (*configFile, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, ErrInvalidImportOption
+	}
+	f := &configFile{file: args[0]}
+	if len(args) == 2 {
+		var err error
+		if f.interval, err = time.ParseDuration(args[1]); err != nil || f.interval <= 0 {
+			return nil, ErrInvalidImportOption
+		}
+	}
+	return f, nil
+}
+
+// Block reads the file and returns its options as an attach directive block.
+func (f *configFile) Block() (*caddy.Controller, error) {
+	info, err := os.Stat(f.file)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := ioutil.ReadFile(f.file)
+	if err != nil {
+		return nil, err
+	}
+	options := map[string]yaml.Node{}
+	if err := yaml.Unmarshal(contents, &options); err != nil {
+		return nil, errors.Wrapf(ErrInvalidConfigFile, "%s: %s", f.file, err.Error())
+	}
+	var lines []optionLine
+	for name, node := range options {
+		if name == "import" {
+			return nil, errors.Wrapf(ErrInvalidConfigFile, "%s:%d: files can't be imported recursively", f.file, node.Line)
+		}
+		node := node
+		occurrences, err := optionLines(name, &node)
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidConfigFile, "%s:%d: %s: %s", f.file, node.Line, name, err.Error())
+		}
+		lines = append(lines, occurrences...)
+	}
+	// options are applied in the order of the file and end up on the same lines as
+	// in the file, so that errors point to the right place
+	sort.Slice(lines, func(i, j int) bool { return lines[i].line < lines[j].line })
+	var block strings.Builder
+	block.WriteString("attach {")
+	current := 1
+	for i, option := range lines {
+		// options from the same line, e.g. of a flow sequence, still need lines of their own
+		if i > 0 && option.line <= current {
+			option.line = current + 1
+		}
+		for ; current < option.line; current++ {
+			block.WriteString("\n")
+		}
+		block.WriteString(" " + option.name)
+		for _, arg := range option.args {
+			if strings.HasSuffix(arg, `\`) || strings.Contains(arg, `\"`) {
+				return nil, errors.Wrapf(ErrInvalidConfigFile, "%s:%d: %s: a backslash can't precede a quote or end a value", f.file, option.line, option.name)
+			}
+			block.WriteString(" " + quoteArg(arg))
+		}
+	}
+	block.WriteString("\n}\n")
+	f.modTime = info.ModTime()
+	c := &caddy.Controller{Dispenser: caddyfile.NewDispenser(f.file, strings.NewReader(block.String()))}
+	c.Next()
+	return c, nil
+}
+
+// quoteArg quotes the value for the Caddyfile lexer, which only unescapes \" in quoted
+// tokens and keeps other backslashes as they are, e.g. in regular expressions.
+func quoteArg(arg string) string {
+	return `"` + strings.Replace(arg, `"`, `\"`, -1) + `"`
+}
+
+// optionLine is an occurrence of an option in the config file.
+type optionLine struct {
+	line int
+	name string
+	args []string
+}
+
+// optionLines turns the value of an option into its occurrences.
+func optionLines(name string, node *yaml.Node) ([]optionLine, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Tag == "!!null" {
+			// a flag without arguments
+			return []optionLine{{line: node.Line, name: name}}, nil
+		}
+		return []optionLine{{line: node.Line, name: name, args: []string{node.Value}}}, nil
+	case yaml.SequenceNode:
+		var lines []optionLine
+		var args []string
+		for _, item := range node.Content {
+			switch item.Kind {
+			case yaml.ScalarNode:
+				args = append(args, item.Value)
+			case yaml.SequenceNode:
+				line := optionLine{line: item.Line, name: name, args: []string{}}
+				for _, arg := range item.Content {
+					if arg.Kind != yaml.ScalarNode {
+						return nil, errors.New("expected a list of arguments")
+					}
+					line.args = append(line.args, arg.Value)
+				}
+				lines = append(lines, line)
+			default:
+				return nil, errors.New("expected arguments or lists of arguments")
+			}
+		}
+		if len(args) > 0 && len(lines) > 0 {
+			return nil, errors.New("can't mix arguments and lists of arguments")
+		}
+		if len(args) > 0 {
+			return []optionLine{{line: node.Line, name: name, args: args}}, nil
+		}
+		return lines, nil
+	}
+	return nil, errors.New("expected arguments or lists of arguments")
+}
+
+// Start watches the file if a reload interval is set.
+func (f *configFile) Start() error {
+	if f.interval == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	f.cancel = cancel
+	go f.watch(ctx)
+	return nil
+}
+
+func (f *configFile) Stop() error {
+	if f.cancel != nil {
+		f.cancel()
+	}
+	return nil
+}
+
+// watch reloads Caddy once the file changed and still parses, so that all options
+// are applied the same way as on startup. if the new config fails, Caddy keeps running
+// with the previous one.
+func (f *configFile) watch(ctx context.Context) {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(f.file)
+		if err != nil {
+			logger.Errorf("can't check the config file: %s\n", err.Error())
+			continue
+		}
+		if info.ModTime().Equal(f.modTime) {
+			continue
+		}
+		if _, err := f.Block(); err != nil {
+			logger.Errorf("not reloading, the config file is invalid: %s\n", err.Error())
+			continue
+		}
+		logger.Infof("config file %s changed, reloading\n", f.file)
+		if err := requestReload(); err != nil {
+			logger.Errorf("unable to reload: %s\n", err.Error())
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package attach
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// writeConfigFile writes the contents to a file in a temporary directory.
+func writeConfigFile(t *testing.T, name string, contents string) string {
+	file := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(file, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// dispensedOption is an option as the directive parsing sees it.
+type dispensedOption struct {
+	line int
+	name string
+	args []string
+}
+
+// dispenseBlock returns the options of the config file as the directive parsing sees them.
+func dispenseBlock(t *testing.T, file string) []dispensedOption {
+	c, err := (&configFile{file: file}).Block()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Val() != "attach" {
+		t.Fatalf("expected an attach directive, got %q", c.Val())
+	}
+	var options []dispensedOption
+	for c.NextBlock() {
+		option := dispensedOption{line: c.Line(), name: c.Val(), args: c.RemainingArgs()}
+		if len(option.args) == 0 {
+			option.args = nil
+		}
+		options = append(options, option)
+	}
+	return options
+}
+
+func TestConfigFileBlock(t *testing.T) {
+	file := writeConfigFile(t, "attach.yml", `# limits
+hash_budget: 1e12
+trusted_proxies: [10.0.0.0/8, 192.168.0.0/16]
+user_agent_deny: 'Bot\d+'
+api_key:
+  - [wallet, "{$WALLET_KEY}", max_txs, 20]
+  - [exchange, 'say "hi"', priority, high]
+tag: "héllo wörld"
+path: 'C:\attach\limits.json'
+empty: ""
+lenient_trytes:
+`)
+	expected := []dispensedOption{
+		{2, "hash_budget", []string{"1e12"}},
+		{3, "trusted_proxies", []string{"10.0.0.0/8", "192.168.0.0/16"}},
+		{4, "user_agent_deny", []string{`Bot\d+`}},
+		{6, "api_key", []string{"wallet", "{$WALLET_KEY}", "max_txs", "20"}},
+		{7, "api_key", []string{"exchange", `say "hi"`, "priority", "high"}},
+		{8, "tag", []string{"héllo wörld"}},
+		{9, "path", []string{`C:\attach\limits.json`}},
+		{10, "empty", []string{""}},
+		{11, "lenient_trytes", nil},
+	}
+	if options := dispenseBlock(t, file); !reflect.DeepEqual(options, expected) {
+		t.Fatalf("expected the options to round trip as\n%v\ngot\n%v", expected, options)
+	}
+}
+
+func TestConfigFileBlockJSON(t *testing.T) {
+	file := writeConfigFile(t, "attach.json", `{
+	"max_trytes": 10000,
+	"api_key": [["wallet", "s3cret"], ["exchange", "k\\ey"]],
+	"user_agent_deny": ["Bot\\d+", "curl"]
+}`)
+	expected := []dispensedOption{
+		{2, "max_trytes", []string{"10000"}},
+		// the lists of a flow sequence on one line get lines of their own
+		{3, "api_key", []string{"wallet", "s3cret"}},
+		{4, "api_key", []string{"exchange", `k\ey`}},
+		{5, "user_agent_deny", []string{`Bot\d+`, "curl"}},
+	}
+	if options := dispenseBlock(t, file); !reflect.DeepEqual(options, expected) {
+		t.Fatalf("expected the options to round trip as\n%v\ngot\n%v", expected, options)
+	}
+}
+
+func TestConfigFileBlockInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+	}{
+		{"not yaml", "hash_budget: [1e12"},
+		{"not a map", "- hash_budget"},
+		{"recursive import", "import: other.yml"},
+		{"nested map", "api_key:\n  wallet: s3cret"},
+		{"mixed arguments", "api_key: [wallet, [exchange, s3cret]]"},
+		{"nested lists", "api_key: [[wallet, [s3cret]]]"},
+		{"trailing backslash", `user_agent_deny: 'Bot\'`},
+		{"escaped quote", `user_agent_deny: 'Bot\"'`},
+	}
+	for _, test := range tests {
+		file := writeConfigFile(t, "attach.yml", test.contents)
+		if _, err := (&configFile{file: file}).Block(); errors.Cause(err) != ErrInvalidConfigFile {
+			t.Errorf("%s: expected %v, got %v", test.name, ErrInvalidConfigFile, err)
+		}
+	}
+	if _, err := (&configFile{file: filepath.Join(t.TempDir(), "attach.yml")}).Block(); !os.IsNotExist(err) {
+		t.Errorf("expected a missing file to be reported, got %v", err)
+	}
+}
+
+func TestNewConfigFile(t *testing.T) {
+	f, err := newConfigFile([]string{"attach.yml", "30s"})
+	if err != nil || f.file != "attach.yml" || f.interval.Seconds() != 30 {
+		t.Fatalf("unexpected config file %+v, %v", f, err)
+	}
+	for _, args := range [][]string{nil, {"attach.yml", "often"}, {"attach.yml", "-1s"}, {"a", "1s", "b"}} {
+		if _, err := newConfigFile(args); err != ErrInvalidImportOption {
+			t.Errorf("%q: expected %v, got %v", args, ErrInvalidImportOption, err)
+		}
+	}
+}
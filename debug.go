@@ -0,0 +1,59 @@
+package attach
+
+import (
+	"crypto/subtle"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var ErrMissingDebugCredentials = errors.New("expected user and password after the debug option")
+
+const debugPathPrefix = "/attach/debug"
+
+// basicCredentials protect the plugin's own endpoints with HTTP basic auth.
+type basicCredentials struct {
+	user, password string
+}
+
+func (c *basicCredentials) Authorized(r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	return ok &&
+		subtle.ConstantTimeCompare([]byte(user), []byte(c.user)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(c.password)) == 1
+}
+
+func requireAuth(w http.ResponseWriter, realm string) (int, error) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
+	return http.StatusUnauthorized, nil
+}
+
+var debugMux = http.NewServeMux()
+
+func init() {
+	debugMux.HandleFunc("/debug/pprof/", pprof.Index)
+	debugMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	debugMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	debugMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	debugMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	debugMux.Handle("/debug/vars", expvar.Handler())
+	expvar.Publish("attach", expvar.Func(func() interface{} {
+		return metricsReg.Totals()
+	}))
+}
+
+func (s *site) isDebugRequest(r *http.Request) bool {
+	return s.debugCreds != nil && strings.HasPrefix(r.URL.Path, debugPathPrefix+"/")
+}
+
+// serveDebug serves pprof under /attach/debug/pprof/ and expvar under /attach/debug/vars.
+func (s *site) serveDebug(w http.ResponseWriter, r *http.Request) (int, error) {
+	if !s.debugCreds.Authorized(r) {
+		return requireAuth(w, "attach debug")
+	}
+	http.StripPrefix("/attach", debugMux).ServeHTTP(w, r)
+	return http.StatusOK, nil
+}
@@ -0,0 +1,75 @@
+package attach
+
+import (
+	"math/rand"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+var ErrEarlyRejected = errors.New("the PoW queue is filling up, try again later")
+var ErrInvalidEarlyRejectionOption = errors.New("expected a min and a max queue depth and an optional max probability between 0 and 1 after the early_rejection option")
+
+const metricEarlyRejections = "attach.early_rejections"
+
+// the share of the rejection probability applying to each priority class, high priority
+// jobs are never rejected early
+var earlyRejectionWeights = [priorityClasses]float64{
+	priorityLow:    1,
+	priorityNormal: 0.25,
+	priorityHigh:   0,
+}
+
+// earlyRejection rejects a growing fraction of new jobs as the queue of the scheduler
+// grows, like random early detection in routers. the probability rises linearly from 0
+// at the min depth to the max probability at the max depth, beyond which low priority jobs
+// are always rejected. it keeps the queue short instead of letting everyone wait for the
+// worst-case latency, and sheds low priority jobs first.
+type earlyRejection struct {
+	minDepth       int
+	maxDepth       int
+	maxProbability float64
+}
+
+// newEarlyRejection parses "<min depth> <max depth> [max probability]".
+func newEarlyRejection(args []string) (*earlyRejection, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, ErrInvalidEarlyRejectionOption
+	}
+	e := &earlyRejection{maxProbability: 1}
+	var err error
+	if e.minDepth, err = strconv.Atoi(args[0]); err != nil || e.minDepth < 0 {
+		return nil, ErrInvalidEarlyRejectionOption
+	}
+	if e.maxDepth, err = strconv.Atoi(args[1]); err != nil || e.maxDepth <= e.minDepth {
+		return nil, ErrInvalidEarlyRejectionOption
+	}
+	if len(args) == 3 {
+		if e.maxProbability, err = strconv.ParseFloat(args[2], 64); err != nil || e.maxProbability <= 0 || e.maxProbability > 1 {
+			return nil, ErrInvalidEarlyRejectionOption
+		}
+	}
+	return e, nil
+}
+
+// probability returns the chance of rejecting a job of the priority at the queue depth.
+func (e *earlyRejection) probability(depth int, priority priorityClass) float64 {
+	if depth <= e.minDepth {
+		return 0
+	}
+	p := 1.0
+	if depth < e.maxDepth {
+		p = e.maxProbability * float64(depth-e.minDepth) / float64(e.maxDepth-e.minDepth)
+	}
+	return p * earlyRejectionWeights[priority]
+}
+
+// Admit decides at random whether a new job is queued given the waiting jobs.
+func (e *earlyRejection) Admit(p *queuePressure, priority priorityClass) error {
+	depth := p.Waiting()
+	if rand.Float64() >= e.probability(depth, priority) {
+		return nil
+	}
+	metricsReg.Inc(metricEarlyRejections)
+	return errors.Wrapf(ErrEarlyRejected, "%d jobs are queued", depth)
+}
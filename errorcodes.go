@@ -0,0 +1,129 @@
+package attach
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInternal = errors.New("internal error while attaching the bundle")
+var ErrChaos = errors.New("injected chaos error")
+
+// the stable error codes clients can branch on instead of parsing the messages
+const (
+	codeInvalidRequest   = "ERR_INVALID_REQUEST"
+	codeInvalidTrytes    = "ERR_INVALID_TRYTES"
+	codeInvalidTips      = "ERR_INVALID_TIPS"
+	codeInvalidTimestamp = "ERR_INVALID_TIMESTAMP"
+	codeBundleLimit      = "ERR_BUNDLE_LIMIT"
+	codeMWMNotAllowed    = "ERR_MWM_NOT_ALLOWED"
+	codeAuthFailed       = "ERR_AUTH_FAILED"
+	codeDenied           = "ERR_DENIED"
+	codeRateLimited      = "ERR_RATE_LIMITED"
+	codeTooManyJobs      = "ERR_TOO_MANY_JOBS"
+	codeSpam             = "ERR_SPAM"
+	codeOverloaded       = "ERR_OVERLOADED"
+	codeReplayed         = "ERR_REPLAYED"
+	codeNotFound         = "ERR_NOT_FOUND"
+	codeMethodNotAllowed = "ERR_METHOD_NOT_ALLOWED"
+	codeUnsupportedType  = "ERR_UNSUPPORTED_CONTENT_TYPE"
+	codePoWFailed        = "ERR_POW_FAILED"
+	codeUpstream         = "ERR_UPSTREAM"
+	codeUnavailable      = "ERR_UNAVAILABLE"
+	codeInternal         = "ERR_INTERNAL"
+)
+
+var errorCodes = map[error]string{
+	ErrMissingBody:            codeInvalidRequest,
+	ErrBodyUnparsable:         codeInvalidRequest,
+	ErrBuildingTx:             codeInvalidTrytes,
+	ErrMalformedTrytes:        codeInvalidTrytes,
+	ErrTxBundleLimitExceeded:  codeBundleLimit,
+	ErrBundleLimitTightened:   codeBundleLimit,
+	ErrBatchTooLarge:          codeBundleLimit,
+	ErrTrytesSizeExceeded:     codeBundleLimit,
+	ErrMWMNotAllowed:          codeMWMNotAllowed,
+	ErrTooManyJobs:            codeTooManyJobs,
+	ErrSpamDetected:           codeSpam,
+	ErrEarlyRejected:          codeOverloaded,
+	ErrUnsupportedContentType: codeUnsupportedType,
+	ErrPoWFailed:              codePoWFailed,
+	ErrPoWInterrupted:         codePoWFailed,
+	ErrInternal:               codeInternal,
+}
+
+// the codes of the errors which are only classified as rejections
+var reasonCodes = map[string]string{
+	reasonAuthFailed:       codeAuthFailed,
+	reasonDenied:           codeDenied,
+	reasonLimitExceeded:    codeBundleLimit,
+	reasonRateLimited:      codeRateLimited,
+	reasonOverloaded:       codeOverloaded,
+	reasonInvalidTrytes:    codeInvalidTrytes,
+	reasonInvalidTips:      codeInvalidTips,
+	reasonInvalidTimestamp: codeInvalidTimestamp,
+	reasonReplayed:         codeReplayed,
+}
+
+// errorCode returns the code of the error, errors without one of their own get the
+// code of the status.
+func errorCode(status int, err error) string {
+	if err != nil {
+		if code, ok := errorCodes[errors.Cause(err)]; ok {
+			return code
+		}
+		if code, ok := reasonCodes[rejectionReason(err)]; ok {
+			return code
+		}
+	}
+	switch {
+	case status == http.StatusUnauthorized:
+		return codeAuthFailed
+	case status == http.StatusForbidden:
+		return codeDenied
+	case status == http.StatusNotFound:
+		return codeNotFound
+	case status == http.StatusMethodNotAllowed:
+		return codeMethodNotAllowed
+	case status == http.StatusUnsupportedMediaType:
+		return codeUnsupportedType
+	case status == http.StatusTooManyRequests:
+		return codeRateLimited
+	case status == http.StatusBadGateway || status == http.StatusGatewayTimeout:
+		return codeUpstream
+	case status == http.StatusServiceUnavailable:
+		return codeUnavailable
+	case status < http.StatusInternalServerError:
+		return codeInvalidRequest
+	}
+	return codeInternal
+}
+
+// writeError writes an IRI style error response, with the error code if error codes are
+// enabled. the caller must return a status below 400 to Caddy afterwards.
+func (s *site) writeError(w http.ResponseWriter, status int, err error) {
+	res := &iriErrorRes{Error: err.Error()}
+	if s.errorCodes {
+		res.Code = errorCode(status, err)
+	}
+	if s.mwmNegotiation {
+		res.MaxMWM, _ = maxMWMOf(err)
+	}
+	resBytes, _ := json.Marshal(res)
+	w.Header().Set(contentType, contentTypeJSON)
+	w.Header().Set("access-control-allow-origin", "*")
+	w.WriteHeader(status)
+	w.Write(resBytes)
+}
+
+// writeCodedError answers the error a handler returned to Caddy as JSON with its code,
+// instead of Caddy's plain text status page.
+func (s *site) writeCodedError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if err == nil {
+		err = errors.New(http.StatusText(status))
+	} else {
+		logger.Debugf("answering request %s with %d: %s\n", requestID(r), status, err.Error())
+	}
+	s.writeError(w, status, err)
+}
@@ -0,0 +1,411 @@
+package attach
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidEventsOption = errors.New("expected nats <host:port> <subject> or kafka <host:port> <topic> [partition] after the events option")
+
+const (
+	metricEventsPublished = "attach.events.published"
+	metricEventsDropped   = "attach.events.dropped"
+	metricEventsFailed    = "attach.events.failed"
+)
+
+// events waiting to be published, more are dropped instead of holding up the attach jobs
+const eventQueueSize = 1024
+
+const eventDialTimeout = 5 * time.Second
+
+// attachEvent describes a completed attachment for downstream pipelines.
+type attachEvent struct {
+	Bundle       string    `json:"bundle"`
+	Transactions []string  `json:"transactions"`
+	Value        int64     `json:"value"`
+	Client       string    `json:"client,omitempty"`
+	MWM          int       `json:"mwm"`
+	DurationMs   int64     `json:"durationMs"`
+	Time         time.Time `json:"time"`
+}
+
+func newAttachEvent(bundle string, client string, mwm int, txs []Tx, took time.Duration) *attachEvent {
+	ev := &attachEvent{Bundle: bundle, Transactions: make([]string, len(txs)), Client: client, MWM: mwm,
+		DurationMs: int64(took / time.Millisecond), Time: time.Now()}
+	for i := range txs {
+		ev.Transactions[i] = string(txs[i].Hash())
+		if txs[i].Value > 0 {
+			ev.Value += txs[i].Value
+		}
+	}
+	return ev
+}
+
+// eventSink publishes the JSON encoded events to a message broker.
+type eventSink interface {
+	Publish(payload []byte) error
+	Close() error
+	String() string
+}
+
+// eventStream publishes an event for every completed attachment to the configured
+// brokers. publishing happens in the background, a broker being down never delays
+// or fails the attach jobs.
+type eventStream struct {
+	sinks  []eventSink
+	queue  chan []byte
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Add parses "nats <host:port> <subject>" or "kafka <host:port> <topic> [partition]".
+func (e *eventStream) Add(args []string) error {
+	if len(args) < 3 {
+		return ErrInvalidEventsOption
+	}
+	switch {
+	case args[0] == "nats" && len(args) == 3:
+		e.sinks = append(e.sinks, &natsSink{addr: args[1], subject: args[2]})
+	case args[0] == "kafka" && len(args) <= 4:
+		sink := &kafkaSink{addr: args[1], topic: args[2]}
+		if len(args) == 4 {
+			partition, err := strconv.Atoi(args[3])
+			if err != nil || partition < 0 {
+				return ErrInvalidEventsOption
+			}
+			sink.partition = int32(partition)
+		}
+		e.sinks = append(e.sinks, sink)
+	default:
+		return ErrInvalidEventsOption
+	}
+	return nil
+}
+
+// Publish queues the event for all sinks.
+func (e *eventStream) Publish(ev *attachEvent) {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	select {
+	case e.queue <- payload:
+	default:
+		metricsReg.Inc(metricEventsDropped)
+	}
+}
+
+func (e *eventStream) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	e.queue = make(chan []byte, eventQueueSize)
+	e.cancel, e.done = cancel, make(chan struct{})
+	go e.run(ctx)
+	return nil
+}
+
+func (e *eventStream) Stop() error {
+	if e.cancel == nil {
+		return nil
+	}
+	e.cancel()
+	<-e.done
+	for _, sink := range e.sinks {
+		sink.Close()
+	}
+	return nil
+}
+
+func (e *eventStream) run(ctx context.Context) {
+	defer close(e.done)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case payload := <-e.queue:
+			for _, sink := range e.sinks {
+				if err := sink.Publish(payload); err != nil {
+					metricsReg.Inc(metricEventsFailed)
+					logger.Warnf("unable to publish attach event to %s: %s\n", sink.String(), err.Error())
+					continue
+				}
+				metricsReg.Inc(metricEventsPublished)
+			}
+		}
+	}
+}
+
+// natsSink publishes to a NATS subject via the plain text protocol. the connection
+// is established on demand and again after errors.
+type natsSink struct {
+	addr    string
+	subject string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (n *natsSink) String() string {
+	return "nats " + n.addr + " " + n.subject
+}
+
+func (n *natsSink) connect() error {
+	conn, err := net.DialTimeout("tcp", n.addr, eventDialTimeout)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(eventDialTimeout))
+	info, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(info, "INFO ") {
+		conn.Close()
+		return errors.Errorf("unexpected greeting %q", strings.TrimSpace(info))
+	}
+	conn.SetReadDeadline(time.Time{})
+	if _, err := io.WriteString(conn, "CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"caddy-attach\"}\r\n"); err != nil {
+		conn.Close()
+		return err
+	}
+	n.conn = conn
+	go n.answerPings(conn, reader)
+	return nil
+}
+
+// answerPings keeps the connection alive, the server closes it if pings go unanswered.
+func (n *natsSink) answerPings(conn net.Conn, reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			n.drop(conn)
+			return
+		}
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			n.mu.Lock()
+			_, err = io.WriteString(conn, "PONG\r\n")
+			n.mu.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			logger.Warnf("nats server %s: %s\n", n.addr, strings.TrimSpace(line))
+		}
+		if err != nil {
+			n.drop(conn)
+			return
+		}
+	}
+}
+
+// drop closes the connection unless it was already replaced.
+func (n *natsSink) drop(conn net.Conn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	conn.Close()
+	if n.conn == conn {
+		n.conn = nil
+	}
+}
+
+func (n *natsSink) Publish(payload []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conn == nil {
+		if err := n.connect(); err != nil {
+			return err
+		}
+	}
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "PUB %s %d\r\n", n.subject, len(payload))
+	buf.Write(payload)
+	buf.WriteString("\r\n")
+	n.conn.SetWriteDeadline(time.Now().Add(eventDialTimeout))
+	if _, err := n.conn.Write(buf.Bytes()); err != nil {
+		n.conn.Close()
+		n.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (n *natsSink) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conn == nil {
+		return nil
+	}
+	err := n.conn.Close()
+	n.conn = nil
+	return err
+}
+
+// kafkaSink produces to one partition of a Kafka topic with Produce requests of version 3.
+// the broker has to be the leader of the partition, there is no metadata lookup.
+type kafkaSink struct {
+	addr      string
+	topic     string
+	partition int32
+
+	conn          net.Conn
+	correlationID int32
+}
+
+const (
+	kafkaProduceKey     = 0
+	kafkaProduceVersion = 3
+	kafkaClientID       = "caddy-attach"
+	kafkaAcksLeader     = 1
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func (k *kafkaSink) String() string {
+	return "kafka " + k.addr + " " + k.topic + "/" + strconv.Itoa(int(k.partition))
+}
+
+func kafkaString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, int16(len(s)))
+	buf.WriteString(s)
+}
+
+func kafkaVarint(buf *bytes.Buffer, v int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutVarint(tmp[:], v)])
+}
+
+// kafkaRecordBatch wraps the payload in a record batch of the message format version 2.
+func kafkaRecordBatch(payload []byte, now time.Time) []byte {
+	record := &bytes.Buffer{}
+	record.WriteByte(0)     // attributes
+	kafkaVarint(record, 0)  // timestamp delta
+	kafkaVarint(record, 0)  // offset delta
+	kafkaVarint(record, -1) // null key
+	kafkaVarint(record, int64(len(payload)))
+	record.Write(payload)
+	kafkaVarint(record, 0) // headers
+
+	// the part of the batch covered by the CRC
+	body := &bytes.Buffer{}
+	ts := now.UnixNano() / int64(time.Millisecond)
+	binary.Write(body, binary.BigEndian, int16(0))  // attributes
+	binary.Write(body, binary.BigEndian, int32(0))  // last offset delta
+	binary.Write(body, binary.BigEndian, ts)        // base timestamp
+	binary.Write(body, binary.BigEndian, ts)        // max timestamp
+	binary.Write(body, binary.BigEndian, int64(-1)) // producer id
+	binary.Write(body, binary.BigEndian, int16(-1)) // producer epoch
+	binary.Write(body, binary.BigEndian, int32(-1)) // base sequence
+	binary.Write(body, binary.BigEndian, int32(1))  // records
+	kafkaVarint(body, int64(record.Len()))
+	body.Write(record.Bytes())
+
+	batch := &bytes.Buffer{}
+	binary.Write(batch, binary.BigEndian, int64(0)) // base offset
+	// the length counts from the partition leader epoch to the end
+	binary.Write(batch, binary.BigEndian, int32(4+1+4+body.Len()))
+	binary.Write(batch, binary.BigEndian, int32(-1)) // partition leader epoch
+	batch.WriteByte(2)                               // magic
+	binary.Write(batch, binary.BigEndian, crc32.Checksum(body.Bytes(), castagnoli))
+	batch.Write(body.Bytes())
+	return batch.Bytes()
+}
+
+func (k *kafkaSink) Publish(payload []byte) error {
+	if k.conn == nil {
+		conn, err := net.DialTimeout("tcp", k.addr, eventDialTimeout)
+		if err != nil {
+			return err
+		}
+		k.conn = conn
+	}
+	k.correlationID++
+	batch := kafkaRecordBatch(payload, time.Now())
+	req := &bytes.Buffer{}
+	binary.Write(req, binary.BigEndian, int16(kafkaProduceKey))
+	binary.Write(req, binary.BigEndian, int16(kafkaProduceVersion))
+	binary.Write(req, binary.BigEndian, k.correlationID)
+	kafkaString(req, kafkaClientID)
+	binary.Write(req, binary.BigEndian, int16(-1)) // no transactional id
+	binary.Write(req, binary.BigEndian, int16(kafkaAcksLeader))
+	binary.Write(req, binary.BigEndian, int32(eventDialTimeout/time.Millisecond))
+	binary.Write(req, binary.BigEndian, int32(1)) // topics
+	kafkaString(req, k.topic)
+	binary.Write(req, binary.BigEndian, int32(1)) // partitions
+	binary.Write(req, binary.BigEndian, k.partition)
+	binary.Write(req, binary.BigEndian, int32(len(batch)))
+	req.Write(batch)
+
+	if err := k.roundTrip(req.Bytes()); err != nil {
+		k.conn.Close()
+		k.conn = nil
+		return err
+	}
+	return nil
+}
+
+// roundTrip sends the request and checks the error code of the produce response.
+func (k *kafkaSink) roundTrip(req []byte) error {
+	k.conn.SetDeadline(time.Now().Add(2 * eventDialTimeout))
+	frame := make([]byte, 4, 4+len(req))
+	binary.BigEndian.PutUint32(frame, uint32(len(req)))
+	if _, err := k.conn.Write(append(frame, req...)); err != nil {
+		return err
+	}
+	var size int32
+	if err := binary.Read(k.conn, binary.BigEndian, &size); err != nil {
+		return err
+	}
+	if size < 4 || size > 1<<20 {
+		return errors.Errorf("invalid response size %d", size)
+	}
+	res := make([]byte, size)
+	if _, err := io.ReadFull(k.conn, res); err != nil {
+		return err
+	}
+	r := bytes.NewReader(res)
+	var correlationID, topics, partitions, partition int32
+	var nameLen, errorCode int16
+	binary.Read(r, binary.BigEndian, &correlationID)
+	if correlationID != k.correlationID {
+		return errors.Errorf("unexpected correlation id %d", correlationID)
+	}
+	binary.Read(r, binary.BigEndian, &topics)
+	binary.Read(r, binary.BigEndian, &nameLen)
+	if nameLen < 0 || int(nameLen) > r.Len() {
+		return errors.New("malformed produce response")
+	}
+	r.Seek(int64(nameLen), io.SeekCurrent)
+	binary.Read(r, binary.BigEndian, &partitions)
+	binary.Read(r, binary.BigEndian, &partition)
+	if err := binary.Read(r, binary.BigEndian, &errorCode); err != nil {
+		return errors.New("malformed produce response")
+	}
+	if topics != 1 || partitions != 1 {
+		return errors.New("malformed produce response")
+	}
+	if errorCode != 0 {
+		return errors.Errorf("kafka error code %d", errorCode)
+	}
+	return nil
+}
+
+func (k *kafkaSink) Close() error {
+	if k.conn == nil {
+		return nil
+	}
+	err := k.conn.Close()
+	k.conn = nil
+	return err
+}
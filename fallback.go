@@ -0,0 +1,65 @@
+package attach
+
+import (
+	"context"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrPoWPanicked = errors.New("the PoW backend panicked")
+var ErrInvalidFallbackOption = errors.New("expected nothing or a PoW timeout after the fallback_to_node option")
+
+const metricNodeFallbacks = "attach.node_fallbacks"
+
+// nodeFallback forwards attachToTangle requests to the node if the local PoW fails,
+// trading latency for reliability.
+type nodeFallback struct {
+	// the local PoW is given up after this long, 0 waits for it
+	timeout time.Duration
+}
+
+func newNodeFallback(args []string) (*nodeFallback, error) {
+	f := &nodeFallback{}
+	switch len(args) {
+	case 0:
+	case 1:
+		var err error
+		if f.timeout, err = time.ParseDuration(args[0]); err != nil || f.timeout <= 0 {
+			return nil, ErrInvalidFallbackOption
+		}
+	default:
+		return nil, ErrInvalidFallbackOption
+	}
+	return f, nil
+}
+
+// powContext bounds the local PoW by the timeout.
+func (f *nodeFallback) powContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if f.timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, f.timeout)
+}
+
+// doPowRecovered runs the PoW and turns a panic of the backend into an error, so that
+// the request can still be forwarded to the node.
+func (s *site) doPowRecovered(ctx context.Context, tra *Transaction, tx []Tx, mwm int64, pow PowFunc, onTx func(i int, took time.Duration)) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			metricsReg.Inc(metricAttachPanics)
+			logger.Errorf("recovered from panic of the %s PoW backend: %v\n%s", s.activePoW(), rec, debug.Stack())
+			err = errors.Wrapf(ErrPoWPanicked, "%v", rec)
+		}
+	}()
+	return s.doPow(ctx, tra, tx, mwm, pow, onTx)
+}
+
+// forwardAfterFailure hands the original request to the node after the local PoW failed.
+func (h AttachToTangleHandler) forwardAfterFailure(w http.ResponseWriter, r *http.Request) (int, error) {
+	metricsReg.Inc(metricNodeFallbacks)
+	logger.Warnf("forwarding request %s to the node as the local PoW failed\n", requestID(r))
+	return h.forward(w, r)
+}
@@ -0,0 +1,159 @@
+package attach
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// the fuzz targets of the parsing layer, the seeds run with every go test and
+//
+//	go test -run XXX -fuzz FuzzAttachToTangleCmd
+//
+// fuzzes one of them. the seeds are built from the zero-value transaction of the PoW
+// self-test, which is the one fixture of a valid transaction the plugin ships.
+
+// seedTxTrytes returns the trytes of the zero-value transaction of the self-test.
+func seedTxTrytes() Trytes {
+	tx := zeroValueBundle(emptyHash, "")[0]
+	return tx.Trytes()
+}
+
+// seedAttachBody returns an attachToTangle body of the zero-value transaction.
+func seedAttachBody(t testing.TB) []byte {
+	body, err := json.Marshal(&AttachToTangleCmd{
+		Command:      attachToTangleCommand,
+		TrunkTxHash:  emptyHash,
+		BranchTxHash: emptyHash,
+		MWM:          14,
+		Trytes:       []Trytes{seedTxTrytes()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// FuzzAttachToTangleCmd runs a body through the parsing and validation of attach requests,
+// none of which may panic.
+func FuzzAttachToTangleCmd(f *testing.F) {
+	body := seedAttachBody(f)
+	f.Add(body)
+	f.Add(bytes.Replace(body, []byte(`"trytes":["`), []byte(`"trytes":["ab`), 1))
+	f.Add([]byte(`{"command":"attachToTangle","trytes":["` + strings.Repeat("9", txTrytesSize-1) + `"]}`))
+	f.Add([]byte(`{"command":"attachToTangle","trytes":[]}`))
+	f.Add([]byte(`{"command":"attachToTangle","trytes":null}`))
+	f.Add([]byte(`{}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		command, err := ParseAttachToTangleCmd(data)
+		if err != nil {
+			return
+		}
+		s := &site{lenientTrytes: true, trytesSizeCheck: true}
+		if err := s.checkTrytesSize(command.Trytes, 1000); err != nil {
+			return
+		}
+		if err := s.sanitizeTrytes(command); err != nil {
+			return
+		}
+		txs, err := ParseTransactions(command.Trytes)
+		if err != nil {
+			return
+		}
+		CheckBundle(txs)
+	})
+}
+
+// FuzzPeekCommand checks that peeking at the command agrees with parsing the whole body.
+func FuzzPeekCommand(f *testing.F) {
+	f.Add(seedAttachBody(f))
+	f.Add([]byte(`{"command":"getNodeInfo"}`))
+	f.Add([]byte(`{"trytes":["` + string(seedTxTrytes()) + `"],"command":"attachToTangle"}`))
+	f.Add([]byte(`{"nested":{"command":"getNodeInfo"},"command":"attachToTangle"}`))
+	f.Add([]byte(`{"command":1}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		command, ok := peekCommand(bufio.NewReaderSize(bytes.NewReader(data), commandPeekSize))
+		if !ok || len(data) > commandPeekSize {
+			return
+		}
+		parsed := &struct {
+			Command string `json:"command"`
+		}{}
+		if err := json.Unmarshal(data, parsed); err == nil && parsed.Command != command {
+			t.Fatalf("peeked command %q but parsed %q", command, parsed.Command)
+		}
+	})
+}
+
+// FuzzValidateCommand runs a body through the schema and array size checks.
+func FuzzValidateCommand(f *testing.F) {
+	f.Add(seedAttachBody(f))
+	f.Add([]byte(`{"command":"getTrytes","hashes":["` + string(emptyHash) + `"]}`))
+	f.Add([]byte(`{"command":"attachToTangle","minWeightMagnitude":"14"}`))
+	f.Add([]byte(`[]`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s := &site{maxArraySize: 100, arrayLimits: map[string]int{attachToTangleCommand: 10}}
+		if s.validateCommand(data) != nil {
+			return
+		}
+		s.checkArraySizes(data)
+	})
+}
+
+// FuzzMsgpack checks that decoded MessagePack encodes to the same value again.
+func FuzzMsgpack(f *testing.F) {
+	var value interface{}
+	dec := json.NewDecoder(bytes.NewReader(seedAttachBody(f)))
+	dec.UseNumber()
+	if err := dec.Decode(&value); err != nil {
+		f.Fatal(err)
+	}
+	encoded, err := appendMsgpack(nil, value)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(encoded)
+	f.Add([]byte{0x80})
+	f.Add([]byte{0xc0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		value, rest, err := (&msgpackDecoder{}).decode(data)
+		if err != nil || len(rest) != 0 {
+			return
+		}
+		encoded, err := appendMsgpack(nil, value)
+		if err != nil {
+			return
+		}
+		again, rest, err := (&msgpackDecoder{}).decode(encoded)
+		if err != nil || len(rest) != 0 || !reflect.DeepEqual(value, again) {
+			t.Fatalf("re-encoded MessagePack decodes to %#v instead of %#v", again, value)
+		}
+	})
+}
+
+// FuzzTryteCodec checks that unpacked t5b1 bytes pack to the same bytes again.
+func FuzzTryteCodec(f *testing.F) {
+	packed, err := packTrytes(seedTxTrytes())
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(packed)
+	f.Add([]byte{})
+	f.Add([]byte{121, 135, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		trytes, err := unpackTrytes(data)
+		if err != nil {
+			return
+		}
+		packed, err := packTrytes(trytes)
+		if err != nil {
+			t.Fatalf("unpacked trytes can't be packed: %s", err.Error())
+		}
+		if !bytes.Equal(packed, data) {
+			t.Fatalf("unpacked trytes pack to %x instead of %x", packed, data)
+		}
+	})
+}
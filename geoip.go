@@ -0,0 +1,307 @@
+package attach
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidGeoIPDatabase = errors.New("invalid MaxMind database")
+var ErrCountryDenied = errors.New("attachToTangle is not available in the client's country")
+var ErrInvalidGeoPolicy = errors.New("expected a country code and deny, rate_limit <per minute> or priority <class> after the geo_policy option")
+
+// the prefix of the per country request counters
+const metricCountryPrefix = "attach.requests.country."
+
+// the label of clients without a known country
+const unknownCountry = "unknown"
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// geoIPDB looks up the country of client addresses in a MaxMind (GeoIP2/GeoLite2
+// country or city) database. only the parts of the format needed for that are supported.
+type geoIPDB struct {
+	data       []byte
+	tree       []byte
+	section    []byte
+	nodeCount  uint
+	recordSize uint
+	ipv4Start  uint
+	ipVersion  uint
+}
+
+// geoPolicy applies to the clients of a country.
+type geoPolicy struct {
+	deny      bool
+	rateLimit int
+	priority  priorityClass
+}
+
+func openGeoIPDB(file string) (*geoIPDB, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	idx := bytes.LastIndex(data, mmdbMetadataMarker)
+	if idx < 0 {
+		return nil, ErrInvalidGeoIPDatabase
+	}
+	dec := &mmdbDecoder{data: data[idx+len(mmdbMetadataMarker):]}
+	value, _, err := dec.decode(0, 0)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidGeoIPDatabase, err.Error())
+	}
+	meta, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, ErrInvalidGeoIPDatabase
+	}
+	db := &geoIPDB{data: data}
+	for key, field := range map[string]*uint{"node_count": &db.nodeCount, "record_size": &db.recordSize, "ip_version": &db.ipVersion} {
+		n, ok := meta[key].(uint64)
+		if !ok {
+			return nil, errors.Wrapf(ErrInvalidGeoIPDatabase, "missing %s", key)
+		}
+		*field = uint(n)
+	}
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, errors.Wrapf(ErrInvalidGeoIPDatabase, "unsupported record size %d", db.recordSize)
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	// the data section follows the tree after 16 zero bytes
+	if treeSize+16 > uint(idx) {
+		return nil, ErrInvalidGeoIPDatabase
+	}
+	db.tree = data[:treeSize]
+	db.section = data[treeSize+16 : idx]
+	if db.ipVersion == 6 {
+		// IPv4 addresses live under ::/96
+		node := uint(0)
+		for i := 0; i < 96 && node < db.nodeCount; i++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a node.
+func (db *geoIPDB) record(node uint, bit uint) uint {
+	switch db.recordSize {
+	case 24:
+		off := node*6 + bit*3
+		b := db.tree[off : off+3]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := db.tree[node*7 : node*7+7]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	}
+	off := node*8 + bit*4
+	return uint(binary.BigEndian.Uint32(db.tree[off : off+4]))
+}
+
+// Country returns the ISO code of the address' country or unknownCountry.
+func (db *geoIPDB) Country(host string) string {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return unknownCountry
+	}
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = db.ipv4Start
+	} else if db.ipVersion == 4 {
+		return unknownCountry
+	}
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = db.record(node, bit)
+	}
+	if node <= db.nodeCount {
+		return unknownCountry
+	}
+	dec := &mmdbDecoder{data: db.section}
+	value, _, err := dec.decode(node-db.nodeCount-16, 0)
+	if err != nil {
+		return unknownCountry
+	}
+	record, _ := value.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		if country, ok := record[key].(map[string]interface{}); ok {
+			if code, ok := country["iso_code"].(string); ok {
+				return code
+			}
+		}
+	}
+	return unknownCountry
+}
+
+// the max nesting of maps, arrays and pointers which is decoded
+const maxMMDBDepth = 32
+
+// mmdbDecoder decodes the MaxMind DB data section format.
+type mmdbDecoder struct {
+	data []byte
+}
+
+// decode decodes the value at offset and returns the offset after it.
+func (d *mmdbDecoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > maxMMDBDepth || offset >= uint(len(d.data)) {
+		return nil, 0, ErrInvalidGeoIPDatabase
+	}
+	ctrl := d.data[offset]
+	offset++
+	typ := uint(ctrl >> 5)
+	if typ == 1 {
+		// pointer
+		ptr, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(ptr, depth+1)
+		return value, next, err
+	}
+	if typ == 0 {
+		if offset >= uint(len(d.data)) {
+			return nil, 0, ErrInvalidGeoIPDatabase
+		}
+		typ = 7 + uint(d.data[offset])
+		offset++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(d.data)) {
+			return nil, 0, ErrInvalidGeoIPDatabase
+		}
+		extra := uint(0)
+		for _, b := range d.data[offset : offset+n] {
+			extra = extra<<8 | uint(b)
+		}
+		offset += n
+		size = [...]uint{29, 285, 65821}[n-1] + extra
+	}
+
+	switch typ {
+	case 7: // map
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, ErrInvalidGeoIPDatabase
+			}
+			if m[name], offset, err = d.decode(next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case 11: // array
+		arr := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			arr = append(arr, value)
+			offset = next
+		}
+		return arr, offset, nil
+	case 14: // boolean, the size is the value
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(d.data)) {
+		return nil, 0, ErrInvalidGeoIPDatabase
+	}
+	raw := d.data[offset : offset+size]
+	offset += size
+	switch typ {
+	case 2: // utf8 string
+		return string(raw), offset, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, ErrInvalidGeoIPDatabase
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, ErrInvalidGeoIPDatabase
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), offset, nil
+	case 5, 6, 9, 8: // uint16, uint32, uint64, int32
+		if size > 8 {
+			return nil, 0, ErrInvalidGeoIPDatabase
+		}
+		var n uint64
+		for _, b := range raw {
+			n = n<<8 | uint64(b)
+		}
+		if typ == 8 {
+			return int64(int32(n)), offset, nil
+		}
+		return n, offset, nil
+	case 4, 10: // bytes, uint128
+		return raw, offset, nil
+	}
+	return nil, 0, errors.Wrapf(ErrInvalidGeoIPDatabase, "unsupported data type %d", typ)
+}
+
+// pointer decodes the target of a pointer and returns the offset after it.
+func (d *mmdbDecoder) pointer(ctrl byte, offset uint) (uint, uint, error) {
+	ss := uint(ctrl>>3) & 3
+	n := ss + 1
+	if offset+n > uint(len(d.data)) {
+		return 0, 0, ErrInvalidGeoIPDatabase
+	}
+	ptr := uint(0)
+	if ss != 3 {
+		ptr = uint(ctrl & 7)
+	}
+	for _, b := range d.data[offset : offset+n] {
+		ptr = ptr<<8 | uint(b)
+	}
+	ptr += [...]uint{0, 2048, 526336, 0}[ss]
+	return ptr, offset + n, nil
+}
+
+// parseGeoPolicy parses "<country code> deny|rate_limit <n>|priority <class>".
+func (s *site) parseGeoPolicy(args []string) (string, *geoPolicy, error) {
+	if len(args) < 2 {
+		return "", nil, ErrInvalidGeoPolicy
+	}
+	country := strings.ToUpper(args[0])
+	policy := s.geoPolicies[country]
+	if policy == nil {
+		policy = &geoPolicy{priority: priorityHigh}
+	}
+	var err error
+	switch {
+	case args[1] == "deny" && len(args) == 2:
+		policy.deny = true
+	case args[1] == "rate_limit" && len(args) == 3:
+		policy.rateLimit, err = strconv.Atoi(args[2])
+		if err == nil && policy.rateLimit <= 0 {
+			err = ErrInvalidGeoPolicy
+		}
+	case args[1] == "priority" && len(args) == 3:
+		policy.priority, err = parsePriority(args[2])
+	default:
+		err = ErrInvalidGeoPolicy
+	}
+	if err != nil {
+		return "", nil, ErrInvalidGeoPolicy
+	}
+	return country, policy, nil
+}
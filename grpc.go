@@ -0,0 +1,256 @@
+package attach
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var ErrGRPCMessage = errors.New("invalid gRPC message")
+
+// progressKey holds a func(done, total int) called after each transaction's PoW.
+type progressKey struct{}
+
+// withProgress returns a context which reports the PoW progress of an attach to fn.
+func withProgress(ctx context.Context, fn func(done, total int)) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+func attachProgress(ctx context.Context) func(done, total int) {
+	fn, _ := ctx.Value(progressKey{}).(func(done, total int))
+	return fn
+}
+
+// grpcFrontend serves the Attach service defined in proto/attach.proto. requests are
+// translated into attachToTangle commands and run through the regular pipeline.
+type grpcFrontend struct {
+	addr    string
+	handler *AttachToTangleHandler
+	server  *grpc.Server
+}
+
+// attachServer is implemented by grpcFrontend, it's the handler type of the service.
+type attachServer interface {
+	attach(req *grpcAttachRequest, stream grpc.ServerStream) error
+}
+
+var attachServiceDesc = grpc.ServiceDesc{
+	ServiceName: "attach.Attach",
+	HandlerType: (*attachServer)(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "AttachToTangle",
+		ServerStreams: true,
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			req := &grpcAttachRequest{}
+			if err := stream.RecvMsg(req); err != nil {
+				return err
+			}
+			return srv.(attachServer).attach(req, stream)
+		},
+	}},
+	Metadata: "proto/attach.proto",
+}
+
+func (g *grpcFrontend) Start() error {
+	lis, err := net.Listen("tcp", g.addr)
+	if err != nil {
+		return err
+	}
+	g.server = grpc.NewServer(grpc.ForceServerCodec(protoCodec{}))
+	g.server.RegisterService(&attachServiceDesc, g)
+	go g.server.Serve(lis)
+	logger.Infof("serving the gRPC attach service on %s\n", g.addr)
+	return nil
+}
+
+func (g *grpcFrontend) Stop() error {
+	if g.server != nil {
+		g.server.GracefulStop()
+	}
+	return nil
+}
+
+func (g *grpcFrontend) attach(req *grpcAttachRequest, stream grpc.ServerStream) error {
+	ctx := stream.Context()
+	if g.handler == nil {
+		return status.Error(codes.Unavailable, "the attach handler isn't ready yet")
+	}
+	body, err := json.Marshal(&AttachToTangleCmd{
+		Command:      attachToTangleCommand,
+		TrunkTxHash:  Trytes(req.TrunkTransaction),
+		BranchTxHash: Trytes(req.BranchTransaction),
+		MWM:          int(req.MinWeightMagnitude),
+		Trytes:       req.Trytes,
+	})
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var sendErr error
+	ctx = withProgress(ctx, func(done, total int) {
+		if sendErr == nil {
+			sendErr = stream.SendMsg(&grpcAttachProgress{DoneTransactions: uint32(done), TotalTransactions: uint32(total)})
+		}
+	})
+	r, err := http.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	r = r.WithContext(ctx)
+	r.Header.Set(contentType, contentTypeJSON)
+	// metadata carries the authorization headers
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for name, values := range md {
+			r.Header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+	requestID(r)
+
+	rec := &bufferedResponse{header: http.Header{}, status: http.StatusOK}
+	code, err := g.handler.serveAttach(rec, r)
+	switch {
+	case err != nil:
+		return status.Error(grpcCode(code), err.Error())
+	case code >= http.StatusBadRequest:
+		return status.Error(grpcCode(code), http.StatusText(code))
+	case rec.status >= http.StatusBadRequest:
+		iriErr := &iriErrorRes{}
+		if json.Unmarshal(rec.body.Bytes(), iriErr) != nil || iriErr.Error == "" {
+			iriErr.Error = http.StatusText(rec.status)
+		}
+		return status.Error(grpcCode(rec.status), iriErr.Error)
+	}
+	if sendErr != nil {
+		return sendErr
+	}
+	res := &AttachToTangleRes{}
+	if err := json.Unmarshal(rec.body.Bytes(), res); err != nil {
+		return status.Error(codes.Internal, ErrBuildingRes.Error())
+	}
+	return stream.SendMsg(&grpcAttachProgress{
+		DoneTransactions:  uint32(len(res.Trytes)),
+		TotalTransactions: uint32(len(res.Trytes)),
+		Trytes:            res.Trytes,
+		Duration:          res.Duration,
+	})
+}
+
+// grpcCode maps the HTTP status of a refused attach to a gRPC code.
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return codes.Unavailable
+	}
+	return codes.Internal
+}
+
+type grpcAttachRequest struct {
+	TrunkTransaction   string
+	BranchTransaction  string
+	MinWeightMagnitude int32
+	Trytes             []Trytes
+}
+
+type grpcAttachProgress struct {
+	DoneTransactions  uint32
+	TotalTransactions uint32
+	Trytes            []Trytes
+	Duration          int64
+}
+
+// protoCodec encodes the messages of proto/attach.proto in the protobuf wire format,
+// which keeps the service compatible with generated clients without generated code here.
+type protoCodec struct{}
+
+func (protoCodec) Name() string { return "proto" }
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(*grpcAttachProgress)
+	if !ok {
+		return nil, errors.Wrapf(ErrGRPCMessage, "can't marshal %T", v)
+	}
+	var b []byte
+	if msg.DoneTransactions != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(msg.DoneTransactions))
+	}
+	if msg.TotalTransactions != 0 {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(msg.TotalTransactions))
+	}
+	for _, t := range msg.Trytes {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, string(t))
+	}
+	if msg.Duration != 0 {
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(msg.Duration))
+	}
+	return b, nil
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(*grpcAttachRequest)
+	if !ok {
+		return errors.Wrapf(ErrGRPCMessage, "can't unmarshal %T", v)
+	}
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return ErrGRPCMessage
+		}
+		data = data[n:]
+		switch {
+		case (num == 1 || num == 2 || num == 4) && typ == protowire.BytesType:
+			s, n := protowire.ConsumeString(data)
+			if n < 0 {
+				return ErrGRPCMessage
+			}
+			switch num {
+			case 1:
+				msg.TrunkTransaction = s
+			case 2:
+				msg.BranchTransaction = s
+			case 4:
+				msg.Trytes = append(msg.Trytes, Trytes(s))
+			}
+			data = data[n:]
+		case num == 3 && typ == protowire.VarintType:
+			mwm, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return ErrGRPCMessage
+			}
+			msg.MinWeightMagnitude = int32(mwm)
+			data = data[n:]
+		default:
+			// skip unknown fields like generated code does
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return ErrGRPCMessage
+			}
+			data = data[n:]
+		}
+	}
+	return nil
+}
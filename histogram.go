@@ -0,0 +1,81 @@
+package attach
+
+import (
+	"strconv"
+	"sync"
+)
+
+const (
+	metricMWMPrefix        = "attach.mwm."
+	metricBundleSizePrefix = "attach.bundle_txs.le_"
+)
+
+// MWMs above this are counted as invalid, a hash only has 243 trits
+const maxHistogramMWM = 243
+
+// the upper bounds of the bundle size buckets, larger bundles go into the "inf" bucket
+var bundleSizeBounds = []int{1, 2, 4, 8, 16, 32, 64, 128, 256}
+
+// trafficHistograms counts the requested MWMs and bundle sizes, so that limits
+// can be tuned to the actual traffic.
+type trafficHistograms struct {
+	mu          sync.Mutex
+	mwm         map[string]int64
+	bundleSizes []int64
+}
+
+var histograms = newTrafficHistograms()
+
+func newTrafficHistograms() *trafficHistograms {
+	return &trafficHistograms{mwm: map[string]int64{}, bundleSizes: make([]int64, len(bundleSizeBounds)+1)}
+}
+
+// bundleSizeBucket returns the name of the bucket of a bundle size.
+func bundleSizeBucket(txs int) (int, string) {
+	for i, bound := range bundleSizeBounds {
+		if txs <= bound {
+			return i, strconv.Itoa(bound)
+		}
+	}
+	return len(bundleSizeBounds), "inf"
+}
+
+// Observe records a request as it was sent by the client.
+func (h *trafficHistograms) Observe(mwm int, txs int) {
+	// keep bogus values from blowing up the number of counters
+	mwmName := "invalid"
+	if mwm >= 0 && mwm <= maxHistogramMWM {
+		mwmName = strconv.Itoa(mwm)
+	}
+	bucket, name := bundleSizeBucket(txs)
+	h.mu.Lock()
+	h.mwm[mwmName]++
+	h.bundleSizes[bucket]++
+	h.mu.Unlock()
+	metricsReg.Inc(metricMWMPrefix + mwmName)
+	metricsReg.Inc(metricBundleSizePrefix + name)
+}
+
+type histogramSummary struct {
+	// MWM maps the requested MWMs to the number of requests
+	MWM map[string]int64 `json:"mwm"`
+	// BundleSizes maps the upper bounds of the bundle size buckets to the number of requests
+	BundleSizes map[string]int64 `json:"bundleSizes"`
+}
+
+func (h *trafficHistograms) Summary() *histogramSummary {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	summary := &histogramSummary{MWM: map[string]int64{}, BundleSizes: map[string]int64{}}
+	for mwm, n := range h.mwm {
+		summary.MWM[mwm] = n
+	}
+	for i, n := range h.bundleSizes {
+		name := "inf"
+		if i < len(bundleSizeBounds) {
+			name = strconv.Itoa(bundleSizeBounds[i])
+		}
+		summary.BundleSizes[name] = n
+	}
+	return summary
+}
@@ -0,0 +1,187 @@
+package attach
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidHistoryOption = errors.New("expected the number of entries per client and an optional retention after the attach_history option")
+var ErrHistoryWithoutAPIKeys = errors.New("the attach_history option requires api keys to identify clients")
+
+const historyPath = "/attach/history"
+
+const defaultHistoryRetention = 24 * time.Hour
+
+const (
+	jobRunning  = "running"
+	jobAttached = "attached"
+	jobRejected = "rejected"
+	jobFailed   = "failed"
+)
+
+// historyEntry is an attach job as listed to its client.
+type historyEntry struct {
+	RequestID  string    `json:"requestId"`
+	Time       time.Time `json:"time"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	Bundle     string    `json:"bundle,omitempty"`
+	Txs        int       `json:"txs"`
+	DurationMs int64     `json:"durationMs"`
+	// the number of transactions whose PoW is done
+	Done int `json:"done"`
+	// the trytes of the attached transactions by index if the PoW failed midway
+	Attached map[int]Trytes `json:"attached,omitempty"`
+}
+
+// attachHistory keeps the recent attach jobs of every API key, so that clients can
+// look up what happened to their requests without access to the server logs.
+type attachHistory struct {
+	entries   int
+	retention time.Duration
+
+	mu      sync.Mutex
+	clients map[string][]*historyEntry
+}
+
+func newAttachHistory(args []string) (*attachHistory, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, ErrInvalidHistoryOption
+	}
+	h := &attachHistory{retention: defaultHistoryRetention, clients: map[string][]*historyEntry{}}
+	var err error
+	if h.entries, err = strconv.Atoi(args[0]); err != nil || h.entries <= 0 {
+		return nil, ErrInvalidHistoryOption
+	}
+	if len(args) == 2 {
+		if h.retention, err = time.ParseDuration(args[1]); err != nil || h.retention <= 0 {
+			return nil, ErrInvalidHistoryOption
+		}
+	}
+	return h, nil
+}
+
+// Start begins the entry of a job, the returned entry is nil for anonymous clients.
+func (h *attachHistory) Start(identity string, requestID string, txs int) *historyEntry {
+	if h == nil || identity == "" {
+		return nil
+	}
+	entry := &historyEntry{RequestID: requestID, Time: time.Now(), Status: jobRunning, Txs: txs}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entries := h.expired(append(h.clients[identity], entry))
+	if len(entries) > h.entries {
+		entries = entries[len(entries)-h.entries:]
+	}
+	h.clients[identity] = entries
+	return entry
+}
+
+// Progress records the number of transactions whose PoW is done.
+func (h *attachHistory) Progress(entry *historyEntry, done int) {
+	if entry == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entry.Done = done
+}
+
+// Attached records the transactions attached before the PoW failed.
+func (h *attachHistory) Attached(entry *historyEntry, done map[int]Trytes) {
+	if entry == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entry.Attached = done
+}
+
+// jobStatus classifies the outcome of a job by the status and error of its request.
+func jobStatus(status int, err error) string {
+	switch {
+	case err == nil && status < http.StatusBadRequest:
+		return jobAttached
+	case status >= http.StatusInternalServerError:
+		return jobFailed
+	}
+	return jobRejected
+}
+
+// Finish completes the entry with the outcome of the job.
+func (h *attachHistory) Finish(entry *historyEntry, status int, err error) {
+	if entry == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entry.DurationMs = int64(time.Since(entry.Time) / time.Millisecond)
+	entry.Status = jobStatus(status, err)
+	if err != nil {
+		entry.Error = err.Error()
+	}
+}
+
+// List returns copies of the entries of a client, newest first.
+func (h *attachHistory) List(identity string) []historyEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entries := h.expired(h.clients[identity])
+	if len(entries) == 0 {
+		delete(h.clients, identity)
+	} else {
+		h.clients[identity] = entries
+	}
+	list := make([]historyEntry, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		list = append(list, *entries[i])
+	}
+	return list
+}
+
+// Collect drops the expired entries of all clients.
+func (h *attachHistory) Collect() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for identity, entries := range h.clients {
+		if entries = h.expired(entries); len(entries) == 0 {
+			delete(h.clients, identity)
+		} else {
+			h.clients[identity] = entries
+		}
+	}
+}
+
+// expired drops the entries older than the retention, the caller must hold the lock.
+func (h *attachHistory) expired(entries []*historyEntry) []*historyEntry {
+	cutoff := time.Now().Add(-h.retention)
+	for len(entries) > 0 && entries[0].Time.Before(cutoff) {
+		entries = entries[1:]
+	}
+	return entries
+}
+
+func (s *site) isHistoryRequest(r *http.Request) bool {
+	return s.history != nil && r.Method == http.MethodGet && r.URL.Path == historyPath
+}
+
+// serveHistory lists the recent jobs of the API key of the request.
+func (s *site) serveHistory(w http.ResponseWriter, r *http.Request) (int, error) {
+	key, err := s.apiKeys.Authorize(r)
+	if err != nil {
+		return http.StatusUnauthorized, err
+	}
+	resBytes, err := json.Marshal(s.history.List("key:" + key.name))
+	if err != nil {
+		return http.StatusInternalServerError, ErrBuildingRes
+	}
+	w.Header().Set(contentType, contentTypeJSON)
+	w.Header().Set("access-control-allow-origin", "*")
+	w.Write(resBytes)
+	return http.StatusOK, nil
+}
@@ -0,0 +1,116 @@
+package attach
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrMissingSignature = errors.New("missing request signature")
+var ErrInvalidSignature = errors.New("invalid request signature")
+var ErrSignatureExpired = errors.New("request signature timestamp outside of the allowed window")
+var ErrInvalidHMACOption = errors.New("expected secret and optional max clock skew after the hmac_secret option")
+var ErrSignatureReplayed = errors.New("request signature was already used")
+
+const signatureHeader = "X-Attach-Signature"
+
+const defaultSignatureMaxSkew = 5 * time.Minute
+
+// requestSigner verifies that the request body was signed with the shared secret.
+// clients send "X-Attach-Signature: t=<unix seconds>,sig=<hex HMAC-SHA256 of '<t>.<body>'>".
+// signatures are only accepted once within the allowed time window to prevent replays.
+type requestSigner struct {
+	secret  []byte
+	maxSkew time.Duration
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func newRequestSigner(args []string) (*requestSigner, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, ErrInvalidHMACOption
+	}
+	s := &requestSigner{secret: []byte(args[0]), maxSkew: defaultSignatureMaxSkew, seen: map[string]time.Time{}}
+	if len(args) == 2 {
+		skew, err := time.ParseDuration(args[1])
+		if err != nil {
+			return nil, err
+		}
+		if skew <= 0 {
+			return nil, ErrInvalidHMACOption
+		}
+		s.maxSkew = skew
+	}
+	return s, nil
+}
+
+func parseSignatureHeader(header string) (string, string) {
+	var ts, sig string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			ts = kv[1]
+		case "sig":
+			sig = kv[1]
+		}
+	}
+	return ts, sig
+}
+
+// Verify checks the signature of the given body.
+func (s *requestSigner) Verify(r *http.Request, body []byte) error {
+	header := r.Header.Get(signatureHeader)
+	if header == "" {
+		return ErrMissingSignature
+	}
+	ts, sig := parseSignatureHeader(header)
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || sig == "" {
+		return ErrInvalidSignature
+	}
+	signedAt := time.Unix(unix, 0)
+	now := time.Now()
+	if signedAt.Before(now.Add(-s.maxSkew)) || signedAt.After(now.Add(s.maxSkew)) {
+		return ErrSignatureExpired
+	}
+
+	given, err := hex.DecodeString(sig)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	if !hmac.Equal(given, mac.Sum(nil)) {
+		return ErrInvalidSignature
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for seenSig, expires := range s.seen {
+		if now.After(expires) {
+			delete(s.seen, seenSig)
+		}
+	}
+	// hex decoding ignores the case, the canonical form keeps a signature from being
+	// replayed with differently cased digits
+	canonical := hex.EncodeToString(given)
+	if _, used := s.seen[canonical]; used {
+		return ErrSignatureReplayed
+	}
+	s.seen[canonical] = signedAt.Add(s.maxSkew)
+	return nil
+}
@@ -0,0 +1,125 @@
+package attach
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signBody(secret string, signedAt time.Time, body []byte) (ts string, sig string) {
+	ts = strconv.FormatInt(signedAt.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return ts, hex.EncodeToString(mac.Sum(nil))
+}
+
+func signedRequest(header string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	if header != "" {
+		r.Header.Set(signatureHeader, header)
+	}
+	return r
+}
+
+func TestNewRequestSigner(t *testing.T) {
+	s, err := newRequestSigner([]string{"secret"})
+	if err != nil || s.maxSkew != defaultSignatureMaxSkew {
+		t.Fatalf("expected the default skew, got %v, %v", s, err)
+	}
+	if s, err = newRequestSigner([]string{"secret", "30s"}); err != nil || s.maxSkew != 30*time.Second {
+		t.Fatalf("expected a skew of 30s, got %v, %v", s, err)
+	}
+	for _, args := range [][]string{nil, {"secret", "soon"}, {"secret", "0s"}, {"secret", "-1m"}, {"secret", "30s", "extra"}} {
+		if _, err := newRequestSigner(args); err == nil {
+			t.Errorf("%q: expected an error", args)
+		}
+	}
+}
+
+func TestRequestSignerVerify(t *testing.T) {
+	s, err := newRequestSigner([]string{"secret", "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`{"command":"attachToTangle"}`)
+	now := time.Now()
+
+	ts, sig := signBody("secret", now, body)
+	if err := s.Verify(signedRequest("t="+ts+", sig="+sig), body); err != nil {
+		t.Fatalf("expected the signature to be valid: %s", err.Error())
+	}
+
+	otherTs, otherSig := signBody("other", now, body)
+	oldTs, oldSig := signBody("secret", now.Add(-2*time.Minute), body)
+	futureTs, futureSig := signBody("secret", now.Add(2*time.Minute), body)
+	tests := []struct {
+		name   string
+		header string
+		body   []byte
+		err    error
+	}{
+		{"missing", "", body, ErrMissingSignature},
+		{"no timestamp", "sig=" + sig, body, ErrInvalidSignature},
+		{"no signature", "t=" + ts, body, ErrInvalidSignature},
+		{"not hex", "t=" + ts + ",sig=xyz", body, ErrInvalidSignature},
+		{"other body", "t=" + ts + ",sig=" + sig, []byte(`{}`), ErrInvalidSignature},
+		{"other secret", "t=" + otherTs + ",sig=" + otherSig, body, ErrInvalidSignature},
+		{"too old", "t=" + oldTs + ",sig=" + oldSig, body, ErrSignatureExpired},
+		{"too new", "t=" + futureTs + ",sig=" + futureSig, body, ErrSignatureExpired},
+	}
+	for _, test := range tests {
+		if err := s.Verify(signedRequest(test.header), test.body); err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestRequestSignerReplay(t *testing.T) {
+	s, err := newRequestSigner([]string{"secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`{"command":"attachToTangle"}`)
+	ts, sig := signBody("secret", time.Now(), body)
+	if err := s.Verify(signedRequest("t="+ts+",sig="+sig), body); err != nil {
+		t.Fatalf("expected the first use to be valid: %s", err.Error())
+	}
+	if err := s.Verify(signedRequest("t="+ts+",sig="+sig), body); err != ErrSignatureReplayed {
+		t.Fatalf("expected %v, got %v", ErrSignatureReplayed, err)
+	}
+
+	// hex decoding ignores the case, a recased signature is the same signature
+	letter := strings.IndexAny(sig, "abcdef")
+	recased := []string{strings.ToUpper(sig), sig[:letter] + strings.ToUpper(sig[letter:letter+1]) + sig[letter+1:]}
+	for _, recasedSig := range recased {
+		if err := s.Verify(signedRequest("t="+ts+",sig="+recasedSig), body); err != ErrSignatureReplayed {
+			t.Errorf("%s: expected %v, got %v", recasedSig, ErrSignatureReplayed, err)
+		}
+	}
+}
+
+func TestRequestSignerForgetsExpired(t *testing.T) {
+	s, err := newRequestSigner([]string{"secret", "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.seen["stale"] = time.Now().Add(-time.Second)
+	body := []byte(`{}`)
+	ts, sig := signBody("secret", time.Now(), body)
+	if err := s.Verify(signedRequest("t="+ts+",sig="+sig), body); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.seen["stale"]; ok {
+		t.Fatal("expected the expired signature to be forgotten")
+	}
+	if len(s.seen) != 1 {
+		t.Fatalf("expected one remembered signature, got %d", len(s.seen))
+	}
+}
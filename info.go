@@ -0,0 +1,164 @@
+package attach
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const infoPath = "/attach/info"
+
+const (
+	pluginModule  = "github.com/luca-moser/caddy-iri-attach"
+	iotaLibModule = "github.com/iotaledger/iota.go"
+)
+
+// Version is the plugin version, it can be set at build time with
+// -ldflags "-X github.com/luca-moser/caddy-iri-attach.Version=<version>".
+// otherwise it is taken from the module information of the binary.
+var Version string
+
+const poweredByHeader = "X-Powered-By-Attach"
+
+// moduleVersion returns the version of a module the binary was built with.
+func moduleVersion(path string) string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Path == path {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == path {
+			if dep.Replace != nil && dep.Replace.Version != "" {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return "unknown"
+}
+
+var buildVersion struct {
+	once    sync.Once
+	version string
+}
+
+func pluginVersion() string {
+	if Version != "" {
+		return Version
+	}
+	buildVersion.once.Do(func() {
+		buildVersion.version = moduleVersion(pluginModule)
+	})
+	return buildVersion.version
+}
+
+// stampPoweredBy tells which version and PoW backend served the request.
+func (s *site) stampPoweredBy(w http.ResponseWriter) {
+	if s.poweredBy {
+		w.Header().Set(poweredByHeader, pluginVersion()+"/"+s.activePoW())
+	}
+}
+
+// hashRateMeter keeps a moving average of the measured PoW hash rate.
+type hashRateMeter struct {
+	mu   sync.Mutex
+	rate float64
+}
+
+var hashRate = &hashRateMeter{}
+
+// Observe feeds the expected number of hashes of a PoW and its duration into the average.
+func (m *hashRateMeter) Observe(hashes float64, took time.Duration) {
+	if took <= 0 {
+		return
+	}
+	rate := hashes / took.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.rate == 0 {
+		m.rate = rate
+		return
+	}
+	m.rate = latencySmoothing*rate + (1-latencySmoothing)*m.rate
+}
+
+// Rate returns the average hashes per second, 0 without any PoW so far.
+func (m *hashRateMeter) Rate() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.rate
+}
+
+type infoLimits struct {
+	MaxTxsInBundle int     `json:"maxTxsInBundle"`
+	CurrentMaxTxs  int     `json:"currentMaxTxs"`
+	DefaultMWM     int     `json:"defaultMwm"`
+	MinMWM         int     `json:"minMwm"`
+	MaxMWM         int     `json:"maxMwm"`
+	MaxBatch       int     `json:"maxBatchBundles,omitempty"`
+	HashBudget     float64 `json:"hashBudgetPerMinute,omitempty"`
+}
+
+// InfoRes describes the powbox so that clients can adapt their requests to it.
+type InfoRes struct {
+	Version        string     `json:"version"`
+	IotaLibVersion string     `json:"iotaLibVersion"`
+	PoWBackend     string     `json:"powBackend"`
+	PoWProcs       int        `json:"powProcs"`
+	Network        string     `json:"network"`
+	Limits         infoLimits `json:"limits"`
+	// HashRate is the measured number of hashes per second, 0 until the first PoW
+	HashRate float64 `json:"hashRate"`
+	// the commands answered by the plugin instead of the node
+	Commands []string `json:"commands"`
+}
+
+func (s *site) isInfoRequest(r *http.Request) bool {
+	return s.infoEnabled && r.Method == http.MethodGet && r.URL.Path == infoPath
+}
+
+func (s *site) serveInfo(w http.ResponseWriter) (int, error) {
+	commands := []string{}
+	for _, command := range []string{attachToTangleCommand, canAttachCommand, attachToTangleBatchCommand,
+		getPreattachedCommand, getAttachResultCommand, promoteTransactionCommand, reattachCommand} {
+		if s.handledLocally(command) {
+			commands = append(commands, command)
+		}
+	}
+	live := s.limits()
+	maxMWM := s.network.maxMWM
+	if live.MaxMWM > 0 && live.MaxMWM < maxMWM {
+		maxMWM = live.MaxMWM
+	}
+	res := &InfoRes{
+		Version:        pluginVersion(),
+		IotaLibVersion: moduleVersion(iotaLibModule),
+		PoWBackend:     s.activePoW(),
+		PoWProcs:       s.powProcs(),
+		Network:        s.network.name,
+		Limits: infoLimits{
+			MaxTxsInBundle: live.MaxTxs,
+			CurrentMaxTxs:  s.dynamicLimit.Limit(s.scheduler.pressure, live.MaxTxs),
+			DefaultMWM:     s.network.defaultMWM,
+			MinMWM:         s.network.minMWM,
+			MaxMWM:         maxMWM,
+			MaxBatch:       s.maxBatchBundles,
+			HashBudget:     live.HashBudget,
+		},
+		HashRate: hashRate.Rate(),
+		Commands: commands,
+	}
+	resBytes, err := json.Marshal(res)
+	if err != nil {
+		return http.StatusInternalServerError, ErrBuildingRes
+	}
+	w.Header().Set(contentType, contentTypeJSON)
+	w.Header().Set("access-control-allow-origin", "*")
+	w.Write(resBytes)
+	return http.StatusOK, nil
+}
@@ -0,0 +1,27 @@
+package attach
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeInfoPoWProcs(t *testing.T) {
+	s := newSite()
+	s.scheduler = &powScheduler{pressure: &queuePressure{}}
+	s.powName = "PowGo"
+	s.liveLimits.Store(&runtimeLimits{MaxTxs: s.maxTxInBundle, PoWProcs: 3})
+
+	w := httptest.NewRecorder()
+	if _, err := s.serveInfo(w); err != nil {
+		t.Fatal(err)
+	}
+	res := &InfoRes{}
+	if err := json.Unmarshal(w.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	// the threads of the site, not the ones another site's search currently runs with
+	if res.PoWProcs != 3 || res.PoWBackend != "PowGo" || res.Network != "mainnet" {
+		t.Fatalf("unexpected info %+v", res)
+	}
+}
@@ -0,0 +1,78 @@
+package attach
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrPoWInterrupted = errors.New("the PoW was interrupted before a nonce was found")
+var ErrInvalidNonce = errors.New("the PoW backend returned an invalid nonce")
+
+// backendStopper returns how to stop the nonce search of the trytes on the named backend,
+// nil if it can't be stopped. only the search of the trytes is stopped, not the one of
+// another job which holds the backend meanwhile, see backendLock.Stop.
+func backendStopper(name string) func(trytes Trytes) {
+	if !isBuiltinPoW(name) {
+		return nil
+	}
+	return backendLockFor(name).Stop
+}
+
+// detachedContext has the values of its parent but isn't canceled with it.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// detachContext keeps a job running after its client went away.
+func detachContext(ctx context.Context) context.Context {
+	return detachedContext{ctx}
+}
+
+type powResult struct {
+	nonce Trytes
+	err   error
+}
+
+// interruptiblePow searches the nonce of a transaction and stops the search within the
+// backend once the context is done.
+func (s *site) interruptiblePow(ctx context.Context, pow PowFunc, trytes Trytes, mwm int) (Trytes, error) {
+	if ctx.Done() == nil || s.powInterrupt == nil {
+		return checkedNonce(pow(trytes, mwm))
+	}
+	resCh := make(chan powResult, 1)
+	go func() {
+		nonce, err := pow(trytes, mwm)
+		resCh <- powResult{nonce, err}
+	}()
+	select {
+	case res := <-resCh:
+		return checkedNonce(res.nonce, res.err)
+	case <-ctx.Done():
+		s.powInterrupt(trytes)
+		// a stopped search returns right away, one which can't be stopped holds the
+		// backend until it found the nonce
+		<-resCh
+		return "", ctx.Err()
+	}
+}
+
+// checkedNonce catches searches which were stopped from elsewhere, the backends
+// return an empty nonce without an error then. It also rejects nonces which wouldn't
+// fit into the transaction.
+func checkedNonce(nonce Trytes, err error) (Trytes, error) {
+	switch {
+	case err != nil:
+		return nonce, err
+	case nonce == "":
+		return "", ErrPoWInterrupted
+	case len(nonce) != nonceTrinarySize/3 || nonce.IsValid() != nil:
+		return "", ErrInvalidNonce
+	}
+	return nonce, nil
+}
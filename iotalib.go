@@ -0,0 +1,383 @@
+package attach
+
+import (
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/iotaledger/iota.go/address"
+	"github.com/iotaledger/iota.go/api"
+	"github.com/iotaledger/iota.go/bundle"
+	"github.com/iotaledger/iota.go/consts"
+	"github.com/iotaledger/iota.go/curl"
+	"github.com/iotaledger/iota.go/pow"
+	"github.com/iotaledger/iota.go/transaction"
+	"github.com/iotaledger/iota.go/trinary"
+	"github.com/pkg/errors"
+)
+
+// the plugin reaches the IOTA library only through this file and the Go PoW backend of
+// pow_go.go. the types below are the plugin's own, the iota.go types don't leak into the
+// rest of the plugin, so that the library can be swapped again in one place.
+
+// Trytes are tryte encoded data, like the trytes of a transaction, a hash or a nonce.
+type Trytes string
+
+// IsValid checks that the trytes only contain the characters 9 and A-Z.
+func (t Trytes) IsValid() error {
+	for _, r := range t {
+		if err := trinary.ValidTryte(r); err != nil {
+			return errors.New("invalid character in trytes")
+		}
+	}
+	return nil
+}
+
+// Trits converts valid trytes to trits.
+func (t Trytes) Trits() Trits {
+	return Trits(trinary.MustTrytesToTrits(string(t)))
+}
+
+// Trits are balanced ternary digits, -1, 0 or 1.
+type Trits []int8
+
+// Trytes converts trits, whose number must be a multiple of 3, to trytes.
+func (t Trits) Trytes() Trytes {
+	return Trytes(trinary.MustTritsToTrytes(trinary.Trits(t)))
+}
+
+// Int returns the integer the trits encode, least significant trit first.
+func (t Trits) Int() int64 {
+	return trinary.TritsToInt(trinary.Trits(t))
+}
+
+// intToTrytes encodes the integer in the given number of trytes.
+func intToTrytes(value int64, size int) Trytes {
+	return Trytes(trinary.IntToTrytes(value, size))
+}
+
+const (
+	hashTrinarySize      = consts.HashTrinarySize
+	nonceTrinarySize     = consts.NonceTrinarySize
+	tagTrinarySize       = consts.TagTrinarySize
+	timestampTrinarySize = consts.TimestampTrinarySize
+)
+
+// emptyHash is the hash of all 9s, like the one of the genesis.
+var emptyHash = Trytes(consts.NullHashTrytes)
+
+// toTrytes validates trytes given as a string.
+func toTrytes(s string) (Trytes, error) {
+	t := Trytes(s)
+	return t, t.IsValid()
+}
+
+// toAddress validates an address of 81 trytes, or of 90 trytes including its checksum.
+func toAddress(s string) (Trytes, error) {
+	if len(s) == consts.AddressWithChecksumTrytesSize {
+		addr := s[:consts.HashTrytesSize]
+		if err := address.ValidChecksum(addr, s[consts.HashTrytesSize:]); err != nil {
+			return "", errors.New("checksum is illegal")
+		}
+		return toTrytes(addr)
+	}
+	if len(s) != consts.HashTrytesSize {
+		return "", errors.New("invalid address trytes")
+	}
+	return toTrytes(s)
+}
+
+// Tx is a parsed transaction. the fields keep the layout the plugin always had, the
+// attachment timestamps stay in their trytes as they are written back unchanged.
+type Tx struct {
+	SignatureMessageFragment      Trytes
+	Address                       Trytes
+	Value                         int64
+	ObsoleteTag                   Trytes
+	Timestamp                     time.Time
+	CurrentIndex                  int64
+	LastIndex                     int64
+	Bundle                        Trytes
+	TrunkTransaction              Trytes
+	BranchTransaction             Trytes
+	Tag                           Trytes
+	AttachmentTimestamp           Trytes
+	AttachmentTimestampLowerBound Trytes
+	AttachmentTimestampUpperBound Trytes
+	Nonce                         Trytes
+}
+
+// parseTransaction parses the trytes of a transaction.
+func parseTransaction(trytes Trytes) (*Tx, error) {
+	switch err := trytes.IsValid(); {
+	case err != nil:
+		return nil, errors.New("invalid transaction " + err.Error())
+	case len(trytes) != txTrytesSize:
+		return nil, errors.New("invalid trits counts in transaction")
+	case trytes[2279:2295] != "9999999999999999":
+		return nil, errors.New("invalid value in transaction")
+	}
+	parsed, err := transaction.ParseTransaction(trinary.MustTrytesToTrits(string(trytes)), true)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{
+		SignatureMessageFragment:      Trytes(parsed.SignatureMessageFragment),
+		Address:                       Trytes(parsed.Address),
+		Value:                         parsed.Value,
+		ObsoleteTag:                   Trytes(parsed.ObsoleteTag),
+		Timestamp:                     time.Unix(int64(parsed.Timestamp), 0),
+		CurrentIndex:                  int64(parsed.CurrentIndex),
+		LastIndex:                     int64(parsed.LastIndex),
+		Bundle:                        Trytes(parsed.Bundle),
+		TrunkTransaction:              Trytes(parsed.TrunkTransaction),
+		BranchTransaction:             Trytes(parsed.BranchTransaction),
+		Tag:                           Trytes(parsed.Tag),
+		AttachmentTimestamp:           intToTrytes(parsed.AttachmentTimestamp, timestampTrinarySize/3),
+		AttachmentTimestampLowerBound: intToTrytes(parsed.AttachmentTimestampLowerBound, timestampTrinarySize/3),
+		AttachmentTimestampUpperBound: intToTrytes(parsed.AttachmentTimestampUpperBound, timestampTrinarySize/3),
+		Nonce:                         Trytes(parsed.Nonce),
+	}, nil
+}
+
+// libTx converts the transaction to the one of iota.go.
+func (tx *Tx) libTx() *transaction.Transaction {
+	return &transaction.Transaction{
+		SignatureMessageFragment:      string(tx.SignatureMessageFragment),
+		Address:                       string(tx.Address),
+		Value:                         tx.Value,
+		ObsoleteTag:                   string(tx.ObsoleteTag),
+		Timestamp:                     uint64(tx.Timestamp.Unix()),
+		CurrentIndex:                  uint64(tx.CurrentIndex),
+		LastIndex:                     uint64(tx.LastIndex),
+		Bundle:                        string(tx.Bundle),
+		TrunkTransaction:              string(tx.TrunkTransaction),
+		BranchTransaction:             string(tx.BranchTransaction),
+		Tag:                           string(tx.Tag),
+		AttachmentTimestamp:           trinary.TrytesToInt(string(tx.AttachmentTimestamp)),
+		AttachmentTimestampLowerBound: trinary.TrytesToInt(string(tx.AttachmentTimestampLowerBound)),
+		AttachmentTimestampUpperBound: trinary.TrytesToInt(string(tx.AttachmentTimestampUpperBound)),
+		Nonce:                         string(tx.Nonce),
+	}
+}
+
+// Trytes returns the trytes of the transaction. the fields must have their sizes, as
+// the ones of parsed transactions, of zeroValueBundle and of checked nonces have.
+func (tx *Tx) Trytes() Trytes {
+	return Trytes(transaction.MustTransactionToTrytes(tx.libTx()))
+}
+
+// Hash returns the hash of the transaction.
+func (tx *Tx) Hash() Trytes {
+	return Trytes(transaction.TransactionHash(tx.libTx()))
+}
+
+// HasValidNonce reports whether the hash of the transaction ends with mwm zero trits.
+func (tx *Tx) HasValidNonce(mwm int64) bool {
+	return int64(trinary.TrailingZeros(tx.Hash().Trits())) >= mwm
+}
+
+// hashTrytes returns the Curl hash of trytes, whose number must be a multiple of 81.
+func hashTrytes(trytes Trytes) (Trytes, error) {
+	hash, err := curl.HashTrytes(string(trytes))
+	return Trytes(hash), err
+}
+
+// zeroValueBundle builds a bundle with a single zero-value transaction, as used for
+// promotions and spam.
+func zeroValueBundle(addr Trytes, tag Trytes) []Tx {
+	txs := bundle.AddEntry(nil, bundle.BundleEntry{
+		Address:   string(addr),
+		Tag:       string(tag),
+		Timestamp: uint64(time.Now().Unix()),
+	})
+	// finalizing only fails on trytes which aren't, the address and tag are given as such
+	txs, _ = bundle.Finalize(txs)
+	bndl := make([]Tx, len(txs))
+	for i := range txs {
+		tx, _ := parseTransaction(Trytes(transaction.MustTransactionToTrytes(&txs[i])))
+		bndl[i] = *tx
+	}
+	return bndl
+}
+
+// validBundle checks that the transactions, in index order, balance to zero, are signed
+// correctly and hash to their bundle hash.
+func validBundle(txs []Tx) error {
+	bndl := make(bundle.Bundle, len(txs))
+	for i := range txs {
+		bndl[i] = *txs[i].libTx()
+	}
+	return bundle.ValidBundle(bndl)
+}
+
+// PowFunc searches the nonce which makes the hash of the transaction trytes end with
+// mwm zero trits. a search stopped by its backend returns an empty nonce without an error.
+type PowFunc func(trytes Trytes, mwm int) (Trytes, error)
+
+// the PoW implementations of this package, like the vector ones of pow_c128.go, which are
+// registered at init if their build tags are set
+var nativePoWFuncs = map[string]PowFunc{}
+
+// how to stop the running search of a built-in backend. they report false if no search
+// runs yet. the backends of iota.go, except for the Go one, can't be stopped.
+var powStoppers = map[string]func() bool{}
+
+func registerNativePoW(name string, fn PowFunc, stop func() bool) {
+	nativePoWFuncs[name] = fn
+	powStoppers[name] = stop
+}
+
+// the built-in PoW implementations from the presumably fastest to the slowest
+var powPreference = []string{"PowAVX", "PowNEON", "PowCARM64", "PowSSE", "PowC128", "PowC", "PowGo"}
+
+// builtinPoWFuncs returns the PoW implementations of iota.go and of this package by name,
+// the ones of iota.go are prefixed with Pow like the plugin always named them. none of
+// them re-hashes the whole transaction per attempt: the first 2592 trytes, which don't
+// change while the nonce is searched, are absorbed into a Curl mid-state once and each
+// attempt only transforms the state of the last chunk with the nonce trits.
+func builtinPoWFuncs() map[string]PowFunc {
+	funcs := map[string]PowFunc{}
+	for _, name := range pow.GetProofOfWorkImplementations() {
+		// the sync variants only add a lock, which backendLock already is
+		if strings.HasPrefix(name, "Sync") {
+			continue
+		}
+		fn, err := pow.GetProofOfWorkImpl(name)
+		if err == nil {
+			funcs["Pow"+name] = libPoW(fn)
+		}
+	}
+	// the Go search of iota.go can't be stopped, the one of pow_go.go replaces it
+	funcs[powGo] = powGoSearch
+	for name, fn := range nativePoWFuncs {
+		funcs[name] = fn
+	}
+	return funcs
+}
+
+// libPoW runs a PoW func of iota.go on the configured number of threads.
+func libPoW(fn pow.ProofOfWorkFunc) PowFunc {
+	return func(trytes Trytes, mwm int) (Trytes, error) {
+		if trytes == "" {
+			return "", errors.New("invalid trytes")
+		}
+		nonce, err := fn(string(trytes), mwm, powThreads())
+		return Trytes(nonce), err
+	}
+}
+
+// bestPoWFunc returns the presumably fastest PoW implementation available on this machine.
+func bestPoWFunc() (string, PowFunc) {
+	funcs := builtinPoWFuncs()
+	for _, name := range powPreference {
+		if fn, ok := funcs[name]; ok {
+			return name, fn
+		}
+	}
+	return powGo, powGoSearch
+}
+
+// the number of threads of the PoW funcs, all but one core by default
+var powProcs = func() int {
+	if n := runtime.NumCPU(); n > 1 {
+		return n - 1
+	}
+	return 1
+}()
+
+// powThreads returns the number of threads PoW funcs use.
+func powThreads() int {
+	return powProcs
+}
+
+// setPoWThreads sets the number of threads of the PoW funcs. it is process-wide and read
+// on every call, so it is only changed while holding the backend lock, see lockedPoW.
+func setPoWThreads(n int) {
+	powProcs = n
+}
+
+// nodeClient talks to the API of a node.
+type nodeClient struct {
+	api *api.API
+}
+
+// nodeMilestones are the milestones a node reported in its node info.
+type nodeMilestones struct {
+	LatestMilestoneIndex               int64
+	LatestSolidSubtangleMilestoneIndex int64
+}
+
+// nodeAPI returns a client of the API of the node.
+func nodeAPI(node *upstreamNode, client *http.Client) *nodeClient {
+	// composing only fails without a URI, the node always has one
+	nodeAPI, _ := api.ComposeAPI(api.HTTPClientSettings{URI: node.url.String(), Client: client})
+	return &nodeClient{api: nodeAPI}
+}
+
+// GetTrytes fetches the transactions of the hashes. unknown ones are all 9s.
+func (n *nodeClient) GetTrytes(hashes []Trytes) ([]Tx, error) {
+	res, err := n.api.GetTrytes(libTrytes(hashes)...)
+	if err != nil {
+		return nil, err
+	}
+	txs := make([]Tx, len(res))
+	for i := range res {
+		tx, err := parseTransaction(Trytes(res[i]))
+		if err != nil {
+			return nil, err
+		}
+		txs[i] = *tx
+	}
+	return txs, nil
+}
+
+// BroadcastTransactions sends the attached transactions to the neighbors of the node.
+func (n *nodeClient) BroadcastTransactions(txs []Tx) error {
+	_, err := n.api.BroadcastTransactions(txTrytes(txs)...)
+	return err
+}
+
+// StoreTransactions stores the attached transactions on the node.
+func (n *nodeClient) StoreTransactions(txs []Tx) error {
+	_, err := n.api.StoreTransactions(txTrytes(txs)...)
+	return err
+}
+
+// GetNodeInfo fetches the latest milestones of the node.
+func (n *nodeClient) GetNodeInfo() (*nodeMilestones, error) {
+	info, err := n.api.GetNodeInfo()
+	if err != nil {
+		return nil, err
+	}
+	return &nodeMilestones{
+		LatestMilestoneIndex:               info.LatestMilestoneIndex,
+		LatestSolidSubtangleMilestoneIndex: info.LatestSolidSubtangleMilestoneIndex,
+	}, nil
+}
+
+// GetTransactionsToApprove lets the node select the trunk and branch tips.
+func (n *nodeClient) GetTransactionsToApprove(depth int64) (Trytes, Trytes, error) {
+	res, err := n.api.GetTransactionsToApprove(uint64(depth))
+	if err != nil {
+		return "", "", err
+	}
+	return Trytes(res.TrunkTransaction), Trytes(res.BranchTransaction), nil
+}
+
+func libTrytes(trytes []Trytes) []trinary.Trytes {
+	converted := make([]trinary.Trytes, len(trytes))
+	for i := range trytes {
+		converted[i] = string(trytes[i])
+	}
+	return converted
+}
+
+func txTrytes(txs []Tx) []trinary.Trytes {
+	trytes := make([]trinary.Trytes, len(txs))
+	for i := range txs {
+		trytes[i] = string(txs[i].Trytes())
+	}
+	return trytes
+}
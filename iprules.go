@@ -0,0 +1,150 @@
+package attach
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrIPDenied = errors.New("the client address is not allowed to use the attach interception")
+var ErrInvalidIPRulesOption = errors.New("expected a rule file and an optional reload interval after the ip_rules option")
+
+const defaultIPRulesReload = 10 * time.Second
+
+type ipRule struct {
+	allow bool
+	net   *net.IPNet
+}
+
+// ipRules allows or denies clients of the attach interception by CIDR, independently
+// of any ipfilter in front of the whole site. the rule file holds one "allow <cidr>" or
+// "deny <cidr>" per line, the first matching rule wins. if there are allow rules,
+// unmatched clients are denied. the file is reloaded when it changes.
+type ipRules struct {
+	file     string
+	interval time.Duration
+
+	mu      sync.RWMutex
+	rules   []ipRule
+	modTime time.Time
+	cancel  context.CancelFunc
+}
+
+func newIPRules(args []string) (*ipRules, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, ErrInvalidIPRulesOption
+	}
+	rules := &ipRules{file: args[0], interval: defaultIPRulesReload}
+	if len(args) == 2 {
+		var err error
+		if rules.interval, err = time.ParseDuration(args[1]); err != nil || rules.interval <= 0 {
+			return nil, ErrInvalidIPRulesOption
+		}
+	}
+	// a broken file fails the startup, later it only keeps the previous rules
+	if err := rules.load(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (l *ipRules) load() error {
+	info, err := os.Stat(l.file)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(l.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var rules []ipRule
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 || (fields[0] != "allow" && fields[0] != "deny") {
+			return errors.Errorf("%s:%d: expected allow or deny and a CIDR", l.file, line)
+		}
+		nets, err := parseCIDRs(fields[1:])
+		if err != nil {
+			return errors.Wrapf(err, "%s:%d", l.file, line)
+		}
+		rules = append(rules, ipRule{allow: fields[0] == "allow", net: nets[0]})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.rules, l.modTime = rules, info.ModTime()
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *ipRules) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	l.cancel = cancel
+	go l.watch(ctx)
+	return nil
+}
+
+func (l *ipRules) Stop() error {
+	if l.cancel != nil {
+		l.cancel()
+	}
+	return nil
+}
+
+func (l *ipRules) watch(ctx context.Context) {
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(l.file)
+		if err != nil {
+			logger.Errorf("can't check the ip rules file: %s\n", err.Error())
+			continue
+		}
+		l.mu.RLock()
+		changed := !info.ModTime().Equal(l.modTime)
+		l.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := l.load(); err != nil {
+			logger.Errorf("keeping the previous ip rules, reloading failed: %s\n", err.Error())
+			continue
+		}
+		logger.Infof("reloaded the ip rules from %s\n", l.file)
+	}
+}
+
+// Allowed reports whether the client host may use the attach interception.
+func (l *ipRules) Allowed(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	hasAllow := false
+	for _, rule := range l.rules {
+		if rule.net.Contains(ip) {
+			return rule.allow
+		}
+		hasAllow = hasAllow || rule.allow
+	}
+	return !hasAllow
+}
@@ -0,0 +1,71 @@
+package attach
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var ErrTooManyJobs = errors.New("too many concurrent attach jobs of the client, wait for one to finish")
+var ErrInvalidMaxJobsOption = errors.New("expected a positive number of jobs after the max_jobs_per_client option")
+
+// jobLimiter caps the attach jobs a single client may have queued or running at once,
+// so that one wallet backend can't occupy the whole queue. it's independent of the
+// rate limits which count requests over time.
+type jobLimiter struct {
+	max int
+
+	mu      sync.Mutex
+	running map[string]int
+}
+
+func newJobLimiter(args []string) (*jobLimiter, error) {
+	if len(args) != 1 {
+		return nil, ErrInvalidMaxJobsOption
+	}
+	max, err := strconv.Atoi(args[0])
+	if err != nil || max <= 0 {
+		return nil, ErrInvalidMaxJobsOption
+	}
+	return &jobLimiter{max: max, running: map[string]int{}}, nil
+}
+
+// Acquire counts a job of the client, it reports false if the client is at its limit.
+func (l *jobLimiter) Acquire(client string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.running[client] >= l.max {
+		return false
+	}
+	l.running[client]++
+	return true
+}
+
+// Release must be called once an acquired job is done.
+func (l *jobLimiter) Release(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.running[client] <= 1 {
+		delete(l.running, client)
+		return
+	}
+	l.running[client]--
+}
+
+// acquireJob counts a job of the client against its limit and returns the func releasing it.
+// clients with an identity are counted by it, anonymous clients by their address.
+func (s *site) acquireJob(command string, identity string, host string) (func(), error) {
+	if s.jobLimits == nil {
+		return func() {}, nil
+	}
+	client, logged := identity, identity
+	if client == "" {
+		client, logged = "ip:"+host, s.anonymizer.Addr(host)
+	}
+	if !s.jobLimits.Acquire(client) {
+		logger.Warnf("refusing %s of %s, it has %d jobs queued or running\n", command, logged, s.jobLimits.max)
+		return nil, errors.Wrapf(ErrTooManyJobs, "max allowed is %d", s.jobLimits.max)
+	}
+	return func() { s.jobLimits.Release(client) }, nil
+}
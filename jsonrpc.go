@@ -0,0 +1,110 @@
+package attach
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+)
+
+// the only JSON-RPC version which is unwrapped
+const jsonRPCVersion = "2.0"
+
+// JSON-RPC 2.0 error codes
+const (
+	jsonRPCParseError     = -32700
+	jsonRPCInvalidRequest = -32600
+	jsonRPCInvalidParams  = -32602
+	jsonRPCServerError    = -32000
+)
+
+type jsonRPCRequest struct {
+	Version string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type jsonRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type jsonRPCResponse struct {
+	Version string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *jsonRPCError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// serveJSONRPC unwraps a JSON-RPC 2.0 request into a regular IRI command with the
+// method as command and the named params as fields, runs it through the handler
+// and wraps the outcome into a JSON-RPC response envelope.
+func (h AttachToTangleHandler) serveJSONRPC(w http.ResponseWriter, r *http.Request, body []byte) (int, error) {
+	req := &jsonRPCRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		return writeJSONRPC(w, &jsonRPCResponse{Error: &jsonRPCError{jsonRPCParseError, err.Error()}})
+	}
+	res := &jsonRPCResponse{ID: req.ID}
+	if req.Version != jsonRPCVersion || req.Method == "" {
+		res.Error = &jsonRPCError{jsonRPCInvalidRequest, "invalid JSON-RPC 2.0 request"}
+		return writeJSONRPC(w, res)
+	}
+
+	params := map[string]json.RawMessage{}
+	if len(req.Params) > 0 {
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			res.Error = &jsonRPCError{jsonRPCInvalidParams, "params must be an object"}
+			return writeJSONRPC(w, res)
+		}
+	}
+	params["command"], _ = json.Marshal(req.Method)
+	inner, err := json.Marshal(params)
+	if err != nil {
+		res.Error = &jsonRPCError{jsonRPCInvalidParams, err.Error()}
+		return writeJSONRPC(w, res)
+	}
+
+	sub := r.WithContext(r.Context())
+	sub.Body = ioutil.NopCloser(bytes.NewReader(inner))
+	sub.ContentLength = int64(len(inner))
+	rec := &bufferedResponse{header: http.Header{}, status: http.StatusOK}
+	status, err := h.serveAttach(rec, sub)
+	switch {
+	case err != nil:
+		res.Error = &jsonRPCError{jsonRPCServerError, err.Error()}
+	case status >= http.StatusBadRequest:
+		res.Error = &jsonRPCError{jsonRPCServerError, http.StatusText(status)}
+	case rec.status >= http.StatusBadRequest:
+		iriErr := &iriErrorRes{}
+		if json.Unmarshal(rec.body.Bytes(), iriErr) != nil || iriErr.Error == "" {
+			iriErr.Error = http.StatusText(rec.status)
+		}
+		res.Error = &jsonRPCError{jsonRPCServerError, iriErr.Error}
+	case !json.Valid(rec.body.Bytes()):
+		res.Error = &jsonRPCError{jsonRPCServerError, "invalid response"}
+	default:
+		res.Result = json.RawMessage(rec.body.Bytes())
+	}
+	for name, values := range rec.header {
+		if name != contentType {
+			w.Header()[name] = values
+		}
+	}
+	return writeJSONRPC(w, res)
+}
+
+func writeJSONRPC(w http.ResponseWriter, res *jsonRPCResponse) (int, error) {
+	res.Version = jsonRPCVersion
+	if res.ID == nil {
+		res.ID = json.RawMessage("null")
+	}
+	resBytes, err := json.Marshal(res)
+	if err != nil {
+		return http.StatusInternalServerError, ErrBuildingRes
+	}
+	w.Header().Set(contentType, contentTypeJSON)
+	w.Header().Set("access-control-allow-origin", "*")
+	w.Write(resBytes)
+	return http.StatusOK, nil
+}
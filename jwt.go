@@ -0,0 +1,202 @@
+package attach
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+var ErrMissingBearerToken = errors.New("missing bearer token")
+var ErrInvalidBearerToken = errors.New("invalid bearer token")
+var ErrUnknownSigningKey = errors.New("unknown token signing key")
+var ErrJWTKeySource = errors.New("either jwt_secret or jwt_jwks must be configured for bearer token authorization")
+var ErrMWMNotAllowed = errors.New("the requested min weight magnitude exceeds the allowed maximum")
+
+const jwksRefreshInterval = time.Hour
+const jwksMinRefetchInterval = time.Minute
+
+// attachClaims are the claims controlling what a token holder may do.
+// zero values mean that the plugin's defaults apply.
+type attachClaims struct {
+	jwt.StandardClaims
+	MaxMWM    int `json:"attach_max_mwm,omitempty"`
+	MaxTxs    int `json:"attach_max_txs,omitempty"`
+	RateLimit int `json:"attach_rate_limit,omitempty"`
+	// Commands restricts the intercepted commands the token may use
+	Commands []string `json:"attach_commands,omitempty"`
+	// Priority is the priority class of the token's jobs: high, normal or low
+	Priority string `json:"attach_priority,omitempty"`
+}
+
+// jwtAuth validates Authorization: Bearer tokens either against a shared
+// secret (HMAC) or against the keys published at a JWKS URL.
+type jwtAuth struct {
+	secret   []byte
+	jwksURL  string
+	issuer   string
+	audience string
+
+	mu        sync.RWMutex
+	keys      map[string]interface{}
+	fetchedAt time.Time
+	client    *http.Client
+}
+
+func newJWTAuth() *jwtAuth {
+	return &jwtAuth{keys: map[string]interface{}{}, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func bearerToken(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return "", ErrMissingBearerToken
+	}
+	return strings.TrimSpace(header[7:]), nil
+}
+
+// Authorize parses and validates the request's bearer token.
+func (a *jwtAuth) Authorize(r *http.Request) (*attachClaims, error) {
+	raw, err := bearerToken(r)
+	if err != nil {
+		return nil, err
+	}
+	claims := &attachClaims{}
+	parser := &jwt.Parser{}
+	if a.secret != nil {
+		parser.ValidMethods = []string{"HS256", "HS384", "HS512"}
+	} else {
+		parser.ValidMethods = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}
+	}
+	if _, err := parser.ParseWithClaims(raw, claims, a.key); err != nil {
+		return nil, errors.Wrap(ErrInvalidBearerToken, err.Error())
+	}
+	if a.issuer != "" && !claims.VerifyIssuer(a.issuer, true) {
+		return nil, errors.Wrap(ErrInvalidBearerToken, "unexpected issuer")
+	}
+	if a.audience != "" && !claims.VerifyAudience(a.audience, true) {
+		return nil, errors.Wrap(ErrInvalidBearerToken, "unexpected audience")
+	}
+	return claims, nil
+}
+
+func (a *jwtAuth) key(token *jwt.Token) (interface{}, error) {
+	if a.secret != nil {
+		return a.secret, nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	a.mu.RLock()
+	key, ok := a.keys[kid]
+	stale := time.Since(a.fetchedAt) > jwksRefreshInterval
+	recent := time.Since(a.fetchedAt) < jwksMinRefetchInterval
+	a.mu.RUnlock()
+	if ok && !stale {
+		return key, nil
+	}
+	// refetch on unknown key ids to pick up key rotations, but not more often than once a minute
+	if !recent || stale {
+		if err := a.fetchKeys(); err != nil {
+			logger.Warnf("unable to fetch JWKS from %s: %s\n", a.jwksURL, err.Error())
+		}
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrUnknownSigningKey
+}
+
+type jwkSet struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	} `json:"keys"`
+}
+
+func decodeJWKInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (a *jwtAuth) fetchKeys() error {
+	a.mu.Lock()
+	a.fetchedAt = time.Now()
+	a.mu.Unlock()
+
+	res, err := a.client.Get(a.jwksURL)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("http status %d", res.StatusCode)
+	}
+	set := &jwkSet{}
+	if err := json.NewDecoder(res.Body).Decode(set); err != nil {
+		return err
+	}
+
+	keys := map[string]interface{}{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err := decodeJWKInt(k.N)
+			if err != nil {
+				continue
+			}
+			e, err := decodeJWKInt(k.E)
+			if err != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, err := decodeJWKInt(k.X)
+			if err != nil {
+				continue
+			}
+			y, err := decodeJWKInt(k.Y)
+			if err != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		}
+	}
+
+	a.mu.Lock()
+	a.keys = keys
+	a.mu.Unlock()
+	return nil
+}
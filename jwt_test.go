@@ -0,0 +1,169 @@
+package attach
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+func bearerRequest(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims *attachClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	raw, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func validClaims() *attachClaims {
+	return &attachClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   "wallet",
+			Issuer:    "issuer",
+			Audience:  "attach",
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+		MaxMWM:   14,
+		MaxTxs:   4,
+		Commands: []string{attachToTangleCommand},
+		Priority: "high",
+	}
+}
+
+func TestJWTAuthSecret(t *testing.T) {
+	secret := []byte("secret")
+	a := newJWTAuth()
+	a.secret = secret
+	a.issuer = "issuer"
+	a.audience = "attach"
+
+	claims, err := a.Authorize(bearerRequest(signToken(t, jwt.SigningMethodHS256, secret, "", validClaims())))
+	if err != nil {
+		t.Fatalf("expected the token to be valid: %s", err.Error())
+	}
+	if claims.Subject != "wallet" || claims.MaxMWM != 14 || claims.MaxTxs != 4 || claims.Priority != "high" ||
+		len(claims.Commands) != 1 || claims.Commands[0] != attachToTangleCommand {
+		t.Fatalf("unexpected claims %+v", claims)
+	}
+
+	expired := validClaims()
+	expired.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	wrongIssuer := validClaims()
+	wrongIssuer.Issuer = "other"
+	wrongAudience := validClaims()
+	wrongAudience.Audience = "other"
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"missing", "", ErrMissingBearerToken},
+		{"garbage", "not.a.token", ErrInvalidBearerToken},
+		{"other secret", signToken(t, jwt.SigningMethodHS256, []byte("other"), "", validClaims()), ErrInvalidBearerToken},
+		{"expired", signToken(t, jwt.SigningMethodHS256, secret, "", expired), ErrInvalidBearerToken},
+		{"other issuer", signToken(t, jwt.SigningMethodHS256, secret, "", wrongIssuer), ErrInvalidBearerToken},
+		{"other audience", signToken(t, jwt.SigningMethodHS256, secret, "", wrongAudience), ErrInvalidBearerToken},
+		{"unsigned", signToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "", validClaims()), ErrInvalidBearerToken},
+		{"asymmetric", signToken(t, jwt.SigningMethodRS256, rsaKey, "", validClaims()), ErrInvalidBearerToken},
+	}
+	for _, test := range tests {
+		if _, err := a.Authorize(bearerRequest(test.token)); errors.Cause(err) != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("Authorization", "bearer  abc ")
+	if token, err := bearerToken(r); err != nil || token != "abc" {
+		t.Fatalf("expected the token abc, got %q, %v", token, err)
+	}
+	r.Header.Set("Authorization", "Basic abc")
+	if _, err := bearerToken(r); err != ErrMissingBearerToken {
+		t.Fatalf("expected %v, got %v", ErrMissingBearerToken, err)
+	}
+}
+
+func jwkInt(n *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(n.Bytes())
+}
+
+func TestJWTAuthJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches int32
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": jwkInt(rsaKey.N), "e": jwkInt(big.NewInt(int64(rsaKey.E)))},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": jwkInt(ecKey.X), "y": jwkInt(ecKey.Y)},
+			{"kty": "RSA", "kid": "enc", "use": "enc", "n": jwkInt(rsaKey.N), "e": jwkInt(big.NewInt(int64(rsaKey.E)))},
+		}})
+	}))
+	defer jwks.Close()
+
+	a := newJWTAuth()
+	a.jwksURL = jwks.URL
+
+	if _, err := a.Authorize(bearerRequest(signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa", validClaims()))); err != nil {
+		t.Fatalf("expected the RSA signed token to be valid: %s", err.Error())
+	}
+	if _, err := a.Authorize(bearerRequest(signToken(t, jwt.SigningMethodES256, ecKey, "ec", validClaims()))); err != nil {
+		t.Fatalf("expected the EC signed token to be valid: %s", err.Error())
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Fatalf("expected the keys to be fetched once, got %d fetches", n)
+	}
+
+	// keys not meant for signatures aren't used, and unknown key ids don't refetch within a minute
+	for _, kid := range []string{"enc", "unknown"} {
+		_, err := a.Authorize(bearerRequest(signToken(t, jwt.SigningMethodRS256, rsaKey, kid, validClaims())))
+		if errors.Cause(err) != ErrInvalidBearerToken {
+			t.Fatalf("%s: expected %v, got %v", kid, ErrInvalidBearerToken, err)
+		}
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Fatalf("expected no refetch within a minute, got %d fetches", n)
+	}
+
+	// a shared secret must not be accepted in place of the published keys
+	hmacToken := signToken(t, jwt.SigningMethodHS256, []byte("secret"), "rsa", validClaims())
+	if _, err := a.Authorize(bearerRequest(hmacToken)); errors.Cause(err) != ErrInvalidBearerToken {
+		t.Fatalf("expected %v, got %v", ErrInvalidBearerToken, err)
+	}
+}
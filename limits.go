@@ -0,0 +1,208 @@
+package attach
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidLimits = errors.New("invalid limits")
+var ErrInvalidLimitsFileOption = errors.New("expected a limits file and an optional reload interval after the limits_file option")
+var ErrMissingLimitsCredentials = errors.New("expected user and password after the limits_admin option")
+
+const limitsPath = "/attach/limits"
+
+const defaultLimitsReload = 10 * time.Second
+
+// runtimeLimits are the limits which can be changed without reloading Caddy, either
+// via the limits endpoint or a watched limits file. they are swapped as a whole, so
+// requests always see a consistent set.
+type runtimeLimits struct {
+	MaxTxs int `json:"maxTxs"`
+	// MaxMWM rejects requests above it, 0 allows the whole range of the network
+	MaxMWM     int     `json:"maxMwm"`
+	HashBudget float64 `json:"hashBudget"`
+	PoWProcs   int     `json:"powProcs"`
+	// KeyRateLimits overrides the rate limits of API keys by name
+	KeyRateLimits map[string]int `json:"keyRateLimits,omitempty"`
+}
+
+// limits returns the current limits, they must not be modified.
+func (s *site) limits() *runtimeLimits {
+	return s.liveLimits.Load().(*runtimeLimits)
+}
+
+// patched returns a copy of the limits with the fields of the JSON patch applied.
+// the key rate limits must refer to the given API keys.
+func (l *runtimeLimits) patched(patch []byte, keys *apiKeyAuth) (*runtimeLimits, error) {
+	next := *l
+	next.KeyRateLimits = map[string]int{}
+	for name, n := range l.KeyRateLimits {
+		next.KeyRateLimits[name] = n
+	}
+	if err := json.Unmarshal(patch, &next); err != nil {
+		return nil, errors.Wrap(ErrInvalidLimits, err.Error())
+	}
+	if err := next.validate(keys); err != nil {
+		return nil, err
+	}
+	return &next, nil
+}
+
+func (l *runtimeLimits) validate(keys *apiKeyAuth) error {
+	switch {
+	case l.MaxTxs <= 0:
+		return errors.Wrap(ErrInvalidLimits, "maxTxs must be positive")
+	case l.MaxMWM < 0 || l.MaxMWM > maxHistogramMWM:
+		return errors.Wrap(ErrInvalidLimits, "maxMwm must be between 0 and 243")
+	case l.HashBudget < 0:
+		return errors.Wrap(ErrInvalidLimits, "hashBudget must not be negative")
+	case l.PoWProcs <= 0:
+		return errors.Wrap(ErrInvalidLimits, "powProcs must be positive")
+	}
+	for name, n := range l.KeyRateLimits {
+		if keys == nil || !keys.Has(name) {
+			return errors.Wrapf(ErrInvalidLimits, "unknown API key %s", name)
+		}
+		if n < 0 {
+			return errors.Wrapf(ErrInvalidLimits, "rate limit of %s must not be negative", name)
+		}
+	}
+	return nil
+}
+
+// applyLimits swaps in the patched limits, concurrent patches don't overwrite each other.
+var applyMu sync.Mutex
+
+func (s *site) applyLimits(base *runtimeLimits, patch []byte) (*runtimeLimits, error) {
+	applyMu.Lock()
+	defer applyMu.Unlock()
+	if base == nil {
+		base = s.limits()
+	}
+	next, err := base.patched(patch, s.apiKeys)
+	if err != nil {
+		return nil, err
+	}
+	s.liveLimits.Store(next)
+	logger.Infof("applied limits: max txs %d, max mwm %d, hash budget %g, pow procs %d\n", next.MaxTxs, next.MaxMWM, next.HashBudget, next.PoWProcs)
+	return next, nil
+}
+
+// limitsFile applies a JSON file with limits on top of the configured ones and
+// reloads it when it changes. a broken file keeps the previous limits.
+type limitsFile struct {
+	site     *site
+	file     string
+	interval time.Duration
+
+	modTime time.Time
+	cancel  context.CancelFunc
+}
+
+func newLimitsFile(args []string) (*limitsFile, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, ErrInvalidLimitsFileOption
+	}
+	f := &limitsFile{file: args[0], interval: defaultLimitsReload}
+	if len(args) == 2 {
+		var err error
+		if f.interval, err = time.ParseDuration(args[1]); err != nil || f.interval <= 0 {
+			return nil, ErrInvalidLimitsFileOption
+		}
+	}
+	return f, nil
+}
+
+func (f *limitsFile) load() error {
+	info, err := os.Stat(f.file)
+	if err != nil {
+		return err
+	}
+	contents, err := ioutil.ReadFile(f.file)
+	if err != nil {
+		return err
+	}
+	if _, err := f.site.applyLimits(f.site.baseLimits, contents); err != nil {
+		return errors.Wrap(err, f.file)
+	}
+	f.modTime = info.ModTime()
+	return nil
+}
+
+func (f *limitsFile) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	f.cancel = cancel
+	go f.watch(ctx)
+	return nil
+}
+
+func (f *limitsFile) Stop() error {
+	if f.cancel != nil {
+		f.cancel()
+	}
+	return nil
+}
+
+func (f *limitsFile) watch(ctx context.Context) {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(f.file)
+		if err != nil {
+			logger.Errorf("can't check the limits file: %s\n", err.Error())
+			continue
+		}
+		if info.ModTime().Equal(f.modTime) {
+			continue
+		}
+		if err := f.load(); err != nil {
+			logger.Errorf("keeping the previous limits, reloading failed: %s\n", err.Error())
+		}
+	}
+}
+
+func (s *site) isLimitsRequest(r *http.Request) bool {
+	return s.limitsCreds != nil && r.URL.Path == limitsPath
+}
+
+// serveLimits returns the current limits on GET and applies the JSON body as patch on PUT.
+func (s *site) serveLimits(w http.ResponseWriter, r *http.Request) (int, error) {
+	if !s.limitsCreds.Authorized(r) {
+		return requireAuth(w, "attach limits")
+	}
+	current := s.limits()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPatch:
+		patch, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			return http.StatusBadRequest, ErrMissingBody
+		}
+		if current, err = s.applyLimits(nil, patch); err != nil {
+			s.writeError(w, http.StatusBadRequest, err)
+			return 0, nil
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, PATCH")
+		return http.StatusMethodNotAllowed, nil
+	}
+	resBytes, err := json.Marshal(current)
+	if err != nil {
+		return http.StatusInternalServerError, ErrBuildingRes
+	}
+	w.Header().Set(contentType, contentTypeJSON)
+	w.Write(resBytes)
+	return http.StatusOK, nil
+}
@@ -0,0 +1,193 @@
+package attach
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidLogLevel = errors.New("invalid log level, expected debug, info, warn or error")
+var ErrInvalidLogOutput = errors.New("invalid log output, expected stdout, stderr, file <path> or syslog [<network> <address>]")
+var ErrSyslogUnsupported = errors.New("syslog is not supported on this platform")
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+func parseLogLevel(name string) (logLevel, error) {
+	level, ok := logLevelNames[strings.ToLower(name)]
+	if !ok {
+		return levelInfo, ErrInvalidLogLevel
+	}
+	return level, nil
+}
+
+// leveledLogger filters messages by level. in quiet mode the per-request
+// chatter is suppressed while warnings and startup messages are still written.
+type leveledLogger struct {
+	out   *log.Logger
+	level logLevel
+	quiet bool
+}
+
+func (l *leveledLogger) logf(level logLevel, format string, args ...interface{}) {
+	if level < l.level {
+		return
+	}
+	l.out.Printf(format, args...)
+}
+
+func (l *leveledLogger) Debugf(format string, args ...interface{}) {
+	l.logf(levelDebug, format, args...)
+}
+
+func (l *leveledLogger) Infof(format string, args ...interface{}) {
+	l.logf(levelInfo, format, args...)
+}
+
+func (l *leveledLogger) Warnf(format string, args ...interface{}) {
+	l.logf(levelWarn, format, args...)
+}
+
+func (l *leveledLogger) Errorf(format string, args ...interface{}) {
+	l.logf(levelError, format, args...)
+}
+
+// Requestf logs per-request information at info level unless quiet mode is on.
+func (l *leveledLogger) Requestf(format string, args ...interface{}) {
+	if l.quiet {
+		return
+	}
+	l.logf(levelInfo, format, args...)
+}
+
+// defaultLogOutput is where the log is written as long as no log_output is configured.
+var defaultLogOutput io.Writer = os.Stdout
+
+// useDefaultLogOutput writes the log to the default output again, e.g. after a reload
+// dropped the log_output option.
+func useDefaultLogOutput() error {
+	logger.out.SetOutput(defaultLogOutput)
+	return nil
+}
+
+// logOutputs collects the destinations configured via log_output. the rotate_*
+// options known from Caddy's log directive apply to all file outputs. the outputs
+// are opened on startup and closed on shutdown, so that a reload doesn't leak them.
+type logOutputs struct {
+	// the configured outputs, e.g. "file /var/log/attach.log"
+	specs   []string
+	writers []io.Writer
+	files   []string
+	syslogs [][2]string
+	roller  *httpserver.LogRoller
+
+	// the writer over the opened outputs and the ones to close
+	writer  io.Writer
+	closers []io.Closer
+}
+
+func newLogOutputs() *logOutputs {
+	return &logOutputs{roller: httpserver.DefaultLogRoller()}
+}
+
+func (o *logOutputs) Add(args []string) error {
+	if len(args) == 0 {
+		return ErrInvalidLogOutput
+	}
+	switch {
+	case args[0] == "stdout" && len(args) == 1:
+		o.writers = append(o.writers, os.Stdout)
+	case args[0] == "stderr" && len(args) == 1:
+		o.writers = append(o.writers, os.Stderr)
+	case args[0] == "file" && len(args) == 2:
+		o.files = append(o.files, args[1])
+	case args[0] == "syslog" && (len(args) == 1 || len(args) == 3):
+		if !syslogSupported {
+			return ErrSyslogUnsupported
+		}
+		var network, addr string
+		if len(args) == 3 {
+			network, addr = args[1], args[2]
+		}
+		o.syslogs = append(o.syslogs, [2]string{network, addr})
+	default:
+		return ErrInvalidLogOutput
+	}
+	o.specs = append(o.specs, strings.Join(args, " "))
+	return nil
+}
+
+// Configured reports whether any output was configured.
+func (o *logOutputs) Configured() bool {
+	return len(o.specs) > 0
+}
+
+// String describes the outputs and the rotation of the files, sites sharing the
+// log have to configure the same.
+func (o *logOutputs) String() string {
+	return fmt.Sprintf("%s %+v", strings.Join(o.specs, ", "), *o.roller)
+}
+
+// Start opens the outputs and writes the log to them.
+func (o *logOutputs) Start() error {
+	writers := append([]io.Writer{}, o.writers...)
+	for _, target := range o.syslogs {
+		w, err := newSyslogWriter(target[0], target[1])
+		if err != nil {
+			o.Stop()
+			return err
+		}
+		writers = append(writers, w)
+		o.closers = append(o.closers, w)
+	}
+	for _, file := range o.files {
+		roller := *o.roller
+		roller.Filename = file
+		if roller.Disabled {
+			f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+			if err != nil {
+				logger.Errorf("unable to open log file %s: %s\n", file, err.Error())
+				continue
+			}
+			writers = append(writers, f)
+			o.closers = append(o.closers, f)
+			continue
+		}
+		// the rolling writers are kept open by Caddy for its own log directive too
+		writers = append(writers, roller.GetLogWriter())
+	}
+	o.writer = io.MultiWriter(writers...)
+	logger.out.SetOutput(o.writer)
+	return nil
+}
+
+// Stop closes the opened outputs. the log goes back to the default output unless the
+// config it was reloaded with already switched it to other outputs.
+func (o *logOutputs) Stop() error {
+	if o.writer != nil && logger.out.Writer() == o.writer {
+		useDefaultLogOutput()
+	}
+	for _, c := range o.closers {
+		c.Close()
+	}
+	o.writer, o.closers = nil, nil
+	return nil
+}
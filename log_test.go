@@ -0,0 +1,100 @@
+package attach
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyfile"
+)
+
+func TestLogOutputsAdd(t *testing.T) {
+	o := newLogOutputs()
+	for _, args := range [][]string{{"stdout"}, {"file", "attach.log"}} {
+		if err := o.Add(args); err != nil {
+			t.Fatalf("%q: %s", args, err.Error())
+		}
+	}
+	for _, args := range [][]string{nil, {"stdout", "stderr"}, {"file"}, {"syslog", "udp"}, {"kafka"}} {
+		if err := newLogOutputs().Add(args); err != ErrInvalidLogOutput {
+			t.Errorf("%q: expected %v, got %v", args, ErrInvalidLogOutput, err)
+		}
+	}
+	if !o.Configured() || newLogOutputs().Configured() {
+		t.Fatal("expected only the outputs with a log_output to be configured")
+	}
+	// sites sharing the log have to agree on the outputs and their rotation
+	other := newLogOutputs()
+	other.Add([]string{"stdout"})
+	other.Add([]string{"file", "attach.log"})
+	if other.String() != o.String() {
+		t.Fatalf("expected the same outputs to be described the same, got %q and %q", o.String(), other.String())
+	}
+	other.roller.Disabled = true
+	if other.String() == o.String() {
+		t.Fatal("expected outputs with another rotation to differ")
+	}
+}
+
+func TestLogOutputsStartStop(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "attach.log")
+	o := newLogOutputs()
+	o.roller.Disabled = true
+	if err := o.Add([]string{"file", file}); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Start(); err != nil {
+		t.Fatal(err)
+	}
+	logger.Warnf("to the file\n")
+	o.Stop()
+	if len(o.closers) != 0 || logger.out.Writer() != defaultLogOutput {
+		t.Fatal("expected the file to be closed and the log to go to the default output again")
+	}
+	logger.Warnf("to the default output\n")
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(contents), "to the file") || strings.Contains(string(contents), "to the default output") {
+		t.Fatalf("unexpected log file contents %q", contents)
+	}
+}
+
+func TestLogOutputsStopAfterReload(t *testing.T) {
+	previous, reloaded := newLogOutputs(), newLogOutputs()
+	previous.Add([]string{"stderr"})
+	reloaded.Add([]string{"stdout"})
+	previous.Start()
+	// caddy starts the reloaded config before stopping the previous one
+	reloaded.Start()
+	previous.Stop()
+	if logger.out.Writer() != reloaded.writer {
+		t.Fatal("expected the log to stay with the outputs of the reloaded config")
+	}
+	reloaded.Stop()
+	if logger.out.Writer() != defaultLogOutput {
+		t.Fatal("expected the log to go to the default output again")
+	}
+}
+
+func TestLogOutputSharedBySites(t *testing.T) {
+	first := caddy.NewTestController("http", "attach 10 {\n pow mock\n log_output stdout\n}")
+	if err := setup(first); err != nil {
+		t.Fatal(err)
+	}
+	// another site of the same config
+	site := func(output string) error {
+		c := *first
+		c.Dispenser = caddyfile.NewDispenser("Testfile", strings.NewReader("attach 10 {\n pow mock\n log_output "+output+"\n}"))
+		return setup(&c)
+	}
+	if err := site("stdout"); err != nil {
+		t.Fatalf("expected a site with the same output to be fine, got %v", err)
+	}
+	if err := site("stderr"); err == nil || !strings.Contains(err.Error(), ErrConflictingSharedOption.Error()) {
+		t.Fatalf("expected %v, got %v", ErrConflictingSharedOption, err)
+	}
+}
@@ -0,0 +1,95 @@
+package attach
+
+import (
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidMethodsOption = errors.New("expected HTTP methods other than HEAD and OPTIONS after the methods option")
+var ErrInvalidInterceptPathOption = errors.New("expected absolute paths after the intercept_path option")
+var ErrUnsupportedContentType = errors.New("the content type of API requests must be application/json")
+
+// parseMethods parses the methods whose requests are inspected besides POST. HEAD and
+// OPTIONS are never inspected, they are answered on the intercepted paths.
+func parseMethods(args []string) (map[string]bool, error) {
+	if len(args) == 0 {
+		return nil, ErrInvalidMethodsOption
+	}
+	methods := map[string]bool{http.MethodPost: true}
+	for _, method := range args {
+		method = strings.ToUpper(method)
+		if method == http.MethodHead || method == http.MethodOptions {
+			return nil, ErrInvalidMethodsOption
+		}
+		methods[method] = true
+	}
+	return methods, nil
+}
+
+func parseInterceptPaths(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return nil, ErrInvalidInterceptPathOption
+	}
+	for _, path := range args {
+		if !strings.HasPrefix(path, "/") {
+			return nil, ErrInvalidInterceptPathOption
+		}
+	}
+	return args, nil
+}
+
+// onInterceptedPath reports whether the plugin is in charge of the path, which are all
+// paths unless the intercept_path option names some.
+func (s *site) onInterceptedPath(r *http.Request) bool {
+	if len(s.interceptPaths) == 0 {
+		return true
+	}
+	for _, path := range s.interceptPaths {
+		if r.URL.Path == path || strings.HasPrefix(r.URL.Path, strings.TrimSuffix(path, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// inspected reports whether the request is parsed as an API command.
+func (s *site) inspected(r *http.Request) bool {
+	return s.methods[r.Method] && s.onInterceptedPath(r)
+}
+
+// answersMethod reports whether a HEAD or OPTIONS request is answered by the plugin
+// instead of being passed on, which needs explicitly intercepted paths.
+func (s *site) answersMethod(r *http.Request) bool {
+	return len(s.interceptPaths) > 0 && (r.Method == http.MethodHead || r.Method == http.MethodOptions) && s.onInterceptedPath(r)
+}
+
+// serveMethod answers OPTIONS with the allowed methods and HEAD as not allowed,
+// the API has no resources to describe.
+func (s *site) serveMethod(w http.ResponseWriter, r *http.Request) (int, error) {
+	allowed := make([]string, 0, len(s.methods)+1)
+	for method := range s.methods {
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+	allowed = append(allowed, http.MethodOptions)
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return 0, nil
+	}
+	return http.StatusMethodNotAllowed, nil
+}
+
+// acceptedContentType reports whether the request declares a JSON body, or MessagePack
+// if it's enabled.
+func (s *site) acceptedContentType(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get(contentType))
+	if err != nil {
+		return false
+	}
+	return mediaType == contentTypeJSON || (s.msgpackEnabled && mediaType == contentTypeMsgpack)
+}
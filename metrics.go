@@ -0,0 +1,254 @@
+package attach
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrUnknownMetricsExporter = errors.New("unknown metrics exporter, expected statsd, influxdb or graphite")
+var ErrMissingMetricsAddr = errors.New("expected exporter type and address after the metrics option")
+var ErrInvalidMetricsInterval = errors.New("metrics_interval must be a positive duration")
+
+const (
+	metricAttachRequests = "attach.requests"
+	metricAttachRejected = "attach.rejected"
+	metricAttachErrors   = "attach.errors"
+	metricAttachTxs      = "attach.txs"
+	metricAttachPoWTime  = "attach.pow_ms"
+)
+
+const defaultMetricsInterval = 10 * time.Second
+
+// metricsRegistry keeps the cumulative counters since startup. the pushers send the
+// deltas since their own last push, so that the exporters of every site see all of them.
+type metricsRegistry struct {
+	mu       sync.Mutex
+	counters map[string]int64
+}
+
+var metricsReg = &metricsRegistry{counters: map[string]int64{}}
+
+func (m *metricsRegistry) Add(name string, delta int64) {
+	m.mu.Lock()
+	m.counters[name] += delta
+	m.mu.Unlock()
+}
+
+func (m *metricsRegistry) Inc(name string) {
+	m.Add(name, 1)
+}
+
+// Restore adds saved totals to the cumulative counters. the pushers take the restored
+// counters as their starting point, so they aren't pushed to the exporters again.
+func (m *metricsRegistry) Restore(totals map[string]int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, v := range totals {
+		m.counters[name] += v
+	}
+}
+
+// Totals returns a copy of the cumulative counters.
+func (m *metricsRegistry) Totals() map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	totals := make(map[string]int64, len(m.counters))
+	for name, v := range m.counters {
+		totals[name] = v
+	}
+	return totals
+}
+
+// metricsExporter pushes a snapshot of counter deltas to an external metrics system.
+type metricsExporter interface {
+	Export(snapshot map[string]int64, ts time.Time) error
+	Close() error
+}
+
+func newMetricsExporter(kind string, addr string, prefix string) (metricsExporter, error) {
+	switch kind {
+	case "statsd":
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return &statsdExporter{conn: conn, prefix: prefix}, nil
+	case "influxdb":
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return &influxExporter{conn: conn, prefix: prefix}, nil
+	case "graphite":
+		return &graphiteExporter{addr: addr, prefix: prefix}, nil
+	}
+	return nil, ErrUnknownMetricsExporter
+}
+
+func sortedMetricNames(snapshot map[string]int64) []string {
+	names := make([]string, 0, len(snapshot))
+	for name := range snapshot {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func prefixed(prefix string, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+// statsdExporter sends counters as statsd counter packets over UDP.
+type statsdExporter struct {
+	conn   net.Conn
+	prefix string
+}
+
+func (e *statsdExporter) Export(snapshot map[string]int64, ts time.Time) error {
+	buf := &bytes.Buffer{}
+	for _, name := range sortedMetricNames(snapshot) {
+		fmt.Fprintf(buf, "%s:%d|c\n", prefixed(e.prefix, name), snapshot[name])
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	_, err := e.conn.Write(buf.Bytes())
+	return err
+}
+
+func (e *statsdExporter) Close() error {
+	return e.conn.Close()
+}
+
+// influxExporter writes all counters as fields of a single InfluxDB line protocol point over UDP.
+type influxExporter struct {
+	conn   net.Conn
+	prefix string
+}
+
+func (e *influxExporter) Export(snapshot map[string]int64, ts time.Time) error {
+	if len(snapshot) == 0 {
+		return nil
+	}
+	measurement := e.prefix
+	if measurement == "" {
+		measurement = "attach"
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteString(measurement)
+	buf.WriteByte(' ')
+	for i, name := range sortedMetricNames(snapshot) {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(buf, "%s=%di", name, snapshot[name])
+	}
+	fmt.Fprintf(buf, " %d\n", ts.UnixNano())
+	_, err := e.conn.Write(buf.Bytes())
+	return err
+}
+
+func (e *influxExporter) Close() error {
+	return e.conn.Close()
+}
+
+// graphiteExporter sends counters using the Graphite plaintext protocol over TCP.
+// a new connection is made for every push as Graphite closes idle connections.
+type graphiteExporter struct {
+	addr   string
+	prefix string
+}
+
+func (e *graphiteExporter) Export(snapshot map[string]int64, ts time.Time) error {
+	if len(snapshot) == 0 {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", e.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	buf := &bytes.Buffer{}
+	for _, name := range sortedMetricNames(snapshot) {
+		fmt.Fprintf(buf, "%s %d %d\n", prefixed(e.prefix, name), snapshot[name], ts.Unix())
+	}
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
+
+func (e *graphiteExporter) Close() error {
+	return nil
+}
+
+// metricsPusher periodically pushes the changes of the counters to all configured exporters.
+type metricsPusher struct {
+	exporters []metricsExporter
+	interval  time.Duration
+	// the counters at the last push
+	pushed map[string]int64
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func (p *metricsPusher) Start() error {
+	if len(p.exporters) == 0 {
+		return nil
+	}
+	p.pushed = metricsReg.Totals()
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.push()
+			case <-p.stop:
+				p.push()
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (p *metricsPusher) push() {
+	totals := metricsReg.Totals()
+	snapshot := map[string]int64{}
+	for name, v := range totals {
+		if delta := v - p.pushed[name]; delta != 0 {
+			snapshot[name] = delta
+		}
+	}
+	p.pushed = totals
+	now := time.Now()
+	for _, exp := range p.exporters {
+		if err := exp.Export(snapshot, now); err != nil {
+			logger.Warnf("unable to push metrics: %s\n", err.Error())
+		}
+	}
+}
+
+func (p *metricsPusher) Stop() error {
+	if p.stop == nil {
+		return nil
+	}
+	close(p.stop)
+	<-p.done
+	p.stop = nil
+	for _, exp := range p.exporters {
+		exp.Close()
+	}
+	return nil
+}
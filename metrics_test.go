@@ -0,0 +1,67 @@
+package attach
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+// recordingExporter keeps the snapshots pushed to it.
+type recordingExporter struct {
+	snapshots []map[string]int64
+}
+
+func (e *recordingExporter) Export(snapshot map[string]int64, ts time.Time) error {
+	e.snapshots = append(e.snapshots, snapshot)
+	return nil
+}
+
+func (e *recordingExporter) Close() error {
+	return nil
+}
+
+// pushed returns the deltas of the counter in the pushed snapshots.
+func (e *recordingExporter) pushed(name string) []int64 {
+	var deltas []int64
+	for _, snapshot := range e.snapshots {
+		if delta, ok := snapshot[name]; ok {
+			deltas = append(deltas, delta)
+		}
+	}
+	return deltas
+}
+
+func TestMetricsPushers(t *testing.T) {
+	const counter = "test.pushers"
+	metricsReg.Add(counter, 1)
+	// the pushers of two sites
+	first, second := &recordingExporter{}, &recordingExporter{}
+	p1 := &metricsPusher{exporters: []metricsExporter{first}, interval: time.Hour}
+	p2 := &metricsPusher{exporters: []metricsExporter{second}, interval: time.Hour}
+	p1.Start()
+	p2.Start()
+	metricsReg.Add(counter, 3)
+	p1.push()
+	metricsReg.Add(counter, 2)
+	p1.Stop()
+	p2.Stop()
+
+	// the counters before the start aren't pushed, the ones after are pushed to both
+	if deltas := first.pushed(counter); len(deltas) != 2 || deltas[0] != 3 || deltas[1] != 2 {
+		t.Fatalf("expected the first pusher to push 3 and 2, got %v", deltas)
+	}
+	if deltas := second.pushed(counter); len(deltas) != 1 || deltas[0] != 5 {
+		t.Fatalf("expected the second pusher to push 5, got %v", deltas)
+	}
+}
+
+func TestMetricsIntervalOption(t *testing.T) {
+	for _, interval := range []string{"0s", "-1m", "often"} {
+		c := caddy.NewTestController("http", "attach 10 {\n metrics_interval "+interval+"\n}")
+		if err := setup(c); err == nil || !strings.Contains(err.Error(), ErrInvalidMetricsInterval.Error()) {
+			t.Errorf("%s: expected %v, got %v", interval, ErrInvalidMetricsInterval, err)
+		}
+	}
+}
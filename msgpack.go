@@ -0,0 +1,331 @@
+package attach
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+var ErrMsgpackUnparsable = errors.New("the MessagePack body is invalid or uses unsupported types")
+
+const contentTypeMsgpack = "application/msgpack"
+
+// isMsgpack reports whether the request body is MessagePack encoded.
+func isMsgpack(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get(contentType))
+	return err == nil && mediaType == contentTypeMsgpack
+}
+
+// serveMsgpack translates a MessagePack encoded command into JSON, runs it through
+// the handler and encodes the response as MessagePack again.
+func (h AttachToTangleHandler) serveMsgpack(w http.ResponseWriter, r *http.Request, body []byte) (int, error) {
+	value, rest, err := (&msgpackDecoder{}).decode(body)
+	if err != nil || len(rest) != 0 {
+		return http.StatusBadRequest, ErrMsgpackUnparsable
+	}
+	inner, err := json.Marshal(value)
+	if err != nil {
+		return http.StatusBadRequest, ErrMsgpackUnparsable
+	}
+
+	sub := r.WithContext(r.Context())
+	sub.Header = http.Header{}
+	for name, values := range r.Header {
+		sub.Header[name] = values
+	}
+	sub.Header.Set(contentType, contentTypeJSON)
+	sub.Body = ioutil.NopCloser(bytes.NewReader(inner))
+	sub.ContentLength = int64(len(inner))
+	rec := &bufferedResponse{header: http.Header{}, status: http.StatusOK}
+	status, err := h.serveAttach(rec, sub)
+	if err != nil || status >= http.StatusBadRequest {
+		return status, err
+	}
+
+	var res interface{}
+	dec := json.NewDecoder(&rec.body)
+	dec.UseNumber()
+	if err := dec.Decode(&res); err != nil {
+		return http.StatusBadGateway, ErrBuildingRes
+	}
+	if rec.header.Get(tryteEncodingHeader) == tryteEncodingT5B1 {
+		binaryTryteFields(res)
+	}
+	resBytes, err := appendMsgpack(nil, res)
+	if err != nil {
+		return http.StatusInternalServerError, ErrBuildingRes
+	}
+	for name, values := range rec.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set(contentType, contentTypeMsgpack)
+	w.WriteHeader(rec.status)
+	w.Write(resBytes)
+	return 0, nil
+}
+
+// nested arrays and maps deeper than this are refused
+const maxMsgpackDepth = 32
+
+// msgpackDecoder decodes MessagePack into the types encoding/json works with.
+// extension types are not supported.
+type msgpackDecoder struct {
+	depth int
+}
+
+// decode decodes the first MessagePack value of b.
+func (d *msgpackDecoder) decode(b []byte) (interface{}, []byte, error) {
+	if len(b) == 0 {
+		return nil, nil, ErrMsgpackUnparsable
+	}
+	c, b := b[0], b[1:]
+	switch {
+	case c <= 0x7f:
+		return float64(c), b, nil
+	case c >= 0xe0:
+		return float64(int8(c)), b, nil
+	case c&0xf0 == 0x80:
+		return d.decodeMap(b, int(c&0x0f))
+	case c&0xf0 == 0x90:
+		return d.decodeArray(b, int(c&0x0f))
+	case c&0xe0 == 0xa0:
+		return d.decodeString(b, int(c&0x1f))
+	}
+	switch c {
+	case 0xc0:
+		return nil, b, nil
+	case 0xc2:
+		return false, b, nil
+	case 0xc3:
+		return true, b, nil
+	case 0xd9:
+		return d.decodeSized(b, 1, d.decodeString)
+	case 0xda:
+		return d.decodeSized(b, 2, d.decodeString)
+	case 0xdb:
+		return d.decodeSized(b, 4, d.decodeString)
+	case 0xc4:
+		return d.decodeSized(b, 1, d.decodeBinary)
+	case 0xc5:
+		return d.decodeSized(b, 2, d.decodeBinary)
+	case 0xc6:
+		return d.decodeSized(b, 4, d.decodeBinary)
+	case 0xdc:
+		return d.decodeSized(b, 2, d.decodeArray)
+	case 0xdd:
+		return d.decodeSized(b, 4, d.decodeArray)
+	case 0xde:
+		return d.decodeSized(b, 2, d.decodeMap)
+	case 0xdf:
+		return d.decodeSized(b, 4, d.decodeMap)
+	case 0xca:
+		n, b, err := msgpackUint(b, 4)
+		return float64(math.Float32frombits(uint32(n))), b, err
+	case 0xcb:
+		n, b, err := msgpackUint(b, 8)
+		return math.Float64frombits(n), b, err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, b, err := msgpackUint(b, 1<<(c-0xcc))
+		return float64(n), b, err
+	case 0xd0:
+		n, b, err := msgpackUint(b, 1)
+		return float64(int8(n)), b, err
+	case 0xd1:
+		n, b, err := msgpackUint(b, 2)
+		return float64(int16(n)), b, err
+	case 0xd2:
+		n, b, err := msgpackUint(b, 4)
+		return float64(int32(n)), b, err
+	case 0xd3:
+		n, b, err := msgpackUint(b, 8)
+		return float64(int64(n)), b, err
+	}
+	return nil, nil, ErrMsgpackUnparsable
+}
+
+func msgpackUint(b []byte, size int) (uint64, []byte, error) {
+	if len(b) < size {
+		return 0, nil, ErrMsgpackUnparsable
+	}
+	var n uint64
+	for _, c := range b[:size] {
+		n = n<<8 | uint64(c)
+	}
+	return n, b[size:], nil
+}
+
+func (d *msgpackDecoder) decodeSized(b []byte, size int, decode func([]byte, int) (interface{}, []byte, error)) (interface{}, []byte, error) {
+	n, b, err := msgpackUint(b, size)
+	if err != nil || n > uint64(len(b)) {
+		return nil, nil, ErrMsgpackUnparsable
+	}
+	return decode(b, int(n))
+}
+
+func (d *msgpackDecoder) decodeString(b []byte, n int) (interface{}, []byte, error) {
+	if len(b) < n {
+		return nil, nil, ErrMsgpackUnparsable
+	}
+	return string(b[:n]), b[n:], nil
+}
+
+// decodeBinary returns bytes which encoding/json encodes as base64, e.g. packed trytes.
+func (d *msgpackDecoder) decodeBinary(b []byte, n int) (interface{}, []byte, error) {
+	if len(b) < n {
+		return nil, nil, ErrMsgpackUnparsable
+	}
+	return append([]byte(nil), b[:n]...), b[n:], nil
+}
+
+func (d *msgpackDecoder) decodeArray(b []byte, n int) (interface{}, []byte, error) {
+	// every element takes at least one byte
+	if n > len(b) || d.depth >= maxMsgpackDepth {
+		return nil, nil, ErrMsgpackUnparsable
+	}
+	d.depth++
+	defer func() { d.depth-- }()
+	arr := make([]interface{}, n)
+	var err error
+	for i := range arr {
+		if arr[i], b, err = d.decode(b); err != nil {
+			return nil, nil, err
+		}
+	}
+	return arr, b, nil
+}
+
+func (d *msgpackDecoder) decodeMap(b []byte, n int) (interface{}, []byte, error) {
+	if 2*n > len(b) || d.depth >= maxMsgpackDepth {
+		return nil, nil, ErrMsgpackUnparsable
+	}
+	d.depth++
+	defer func() { d.depth-- }()
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, rest, err := d.decode(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			return nil, nil, ErrMsgpackUnparsable
+		}
+		if m[name], b, err = d.decode(rest); err != nil {
+			return nil, nil, err
+		}
+	}
+	return m, b, nil
+}
+
+// appendMsgpack appends the MessagePack encoding of a value decoded by encoding/json
+// with UseNumber. bytes are encoded as binary.
+func appendMsgpack(b []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if v {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return appendMsgpackInt(b, n), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, 0xcb)
+		return appendBigEndian(b, math.Float64bits(f), 8), nil
+	case string:
+		n := len(v)
+		switch {
+		case n < 32:
+			b = append(b, 0xa0|byte(n))
+		case n <= math.MaxUint8:
+			b = append(b, 0xd9, byte(n))
+		case n <= math.MaxUint16:
+			b = appendBigEndian(append(b, 0xda), uint64(n), 2)
+		default:
+			b = appendBigEndian(append(b, 0xdb), uint64(n), 4)
+		}
+		return append(b, v...), nil
+	case []byte:
+		n := len(v)
+		switch {
+		case n <= math.MaxUint8:
+			b = append(b, 0xc4, byte(n))
+		case n <= math.MaxUint16:
+			b = appendBigEndian(append(b, 0xc5), uint64(n), 2)
+		default:
+			b = appendBigEndian(append(b, 0xc6), uint64(n), 4)
+		}
+		return append(b, v...), nil
+	case []interface{}:
+		b = appendMsgpackHeader(b, len(v), 0x90, 0xdc)
+		var err error
+		for _, elem := range v {
+			if b, err = appendMsgpack(b, elem); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]interface{}:
+		b = appendMsgpackHeader(b, len(v), 0x80, 0xde)
+		// sorted keys keep the encoding deterministic
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var err error
+		for _, key := range keys {
+			if b, err = appendMsgpack(b, key); err != nil {
+				return nil, err
+			}
+			if b, err = appendMsgpack(b, v[key]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, errors.Errorf("can't encode %T as MessagePack", v)
+}
+
+// appendMsgpackHeader appends the header of an array or map with n elements, fix is
+// the code of the fix size variant and code16 the one of the 16 bit variant.
+func appendMsgpackHeader(b []byte, n int, fix byte, code16 byte) []byte {
+	switch {
+	case n < 16:
+		return append(b, fix|byte(n))
+	case n <= math.MaxUint16:
+		return appendBigEndian(append(b, code16), uint64(n), 2)
+	}
+	return appendBigEndian(append(b, code16+1), uint64(n), 4)
+}
+
+func appendMsgpackInt(b []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n <= 0x7f:
+		return append(b, byte(n))
+	case n < 0 && n >= -32:
+		return append(b, byte(int8(n)))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		return appendBigEndian(append(b, 0xd2), uint64(uint32(int32(n))), 4)
+	}
+	return appendBigEndian(append(b, 0xd3), uint64(n), 8)
+}
+
+func appendBigEndian(b []byte, n uint64, size int) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], n)
+	return append(b, buf[8-size:]...)
+}
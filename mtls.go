@@ -0,0 +1,74 @@
+package attach
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strconv"
+
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"github.com/pkg/errors"
+)
+
+var ErrClientCertRequired = errors.New("a verified TLS client certificate is required for attachToTangle")
+var ErrClientCertNotAllowed = errors.New("the TLS client certificate is not allowed to use attachToTangle")
+var ErrInvalidClientCertOption = errors.New("expected subject common name and optional max bundle txs after the client_cert option")
+var ErrMTLSWithoutTLS = errors.New("client_ca requires TLS to be enabled for the site")
+
+// certProfile is the quota profile a client certificate subject is mapped to.
+type certProfile struct {
+	maxTxInBundle int
+}
+
+// clientCertAuth requires a verified client certificate for intercepted
+// attachToTangle calls. if subjects are configured, only those are accepted.
+type clientCertAuth struct {
+	caFiles  []string
+	subjects map[string]certProfile
+}
+
+func (a *clientCertAuth) AddSubject(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return ErrInvalidClientCertOption
+	}
+	profile := certProfile{}
+	if len(args) == 2 {
+		limit, err := strconv.Atoi(args[1])
+		if err != nil || limit <= 0 {
+			return errors.Wrapf(ErrInvalidClientCertOption, "invalid max bundle txs for %s", args[0])
+		}
+		profile.maxTxInBundle = limit
+	}
+	a.subjects[args[0]] = profile
+	return nil
+}
+
+// Apply makes the site ask for client certificates signed by the configured CAs.
+// certificates stay optional on the TLS level so that the rest of the API keeps working
+// without one, the attach interception then enforces their presence.
+func (a *clientCertAuth) Apply(cfg *httpserver.SiteConfig) error {
+	if cfg.TLS == nil || !cfg.TLS.Enabled {
+		return ErrMTLSWithoutTLS
+	}
+	cfg.TLS.ClientCerts = append(cfg.TLS.ClientCerts, a.caFiles...)
+	if cfg.TLS.ClientAuth == tls.NoClientCert || cfg.TLS.ClientAuth == tls.RequestClientCert {
+		cfg.TLS.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return nil
+}
+
+// Authorize checks the request's verified certificate chain and returns the
+// quota profile of the certificate's subject.
+func (a *clientCertAuth) Authorize(r *http.Request) (certProfile, string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return certProfile{}, "", ErrClientCertRequired
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if len(a.subjects) == 0 {
+		return certProfile{}, subject, nil
+	}
+	profile, ok := a.subjects[subject]
+	if !ok {
+		return certProfile{}, subject, ErrClientCertNotAllowed
+	}
+	return profile, subject, nil
+}
@@ -0,0 +1,110 @@
+package attach
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+var ErrUnknownNetwork = errors.New("unknown network, expected mainnet, devnet or private")
+var ErrInvalidNetworkMWM = errors.New("invalid min weight magnitude for the network")
+var ErrInvalidTips = errors.New("trunk and branch transaction must be valid 81 trytes hashes")
+var ErrEmptyTips = errors.New("trunk and branch transaction must not be empty hashes on this network")
+
+// networkProfile bundles the attach parameters of a specific tangle.
+type networkProfile struct {
+	name string
+	// the MWM used when the requested one is outside of [minMWM, maxMWM]
+	defaultMWM int
+	minMWM     int
+	maxMWM     int
+	// attachment timestamp bounds written into the transactions
+	timestampLowerBound Trytes
+	timestampUpperBound Trytes
+	// private tangles start from the empty hash as trunk and branch
+	allowEmptyTips bool
+}
+
+func networkProfileFor(name string, mwmArg string) (*networkProfile, error) {
+	var profile networkProfile
+	switch name {
+	case "mainnet":
+		profile = networkProfile{name: name, defaultMWM: 14, minMWM: 14, maxMWM: 14}
+	case "devnet":
+		profile = networkProfile{name: name, defaultMWM: 9, minMWM: 9, maxMWM: 9}
+	case "private":
+		profile = networkProfile{name: name, defaultMWM: 9, minMWM: 1, maxMWM: 9, allowEmptyTips: true}
+	default:
+		return nil, ErrUnknownNetwork
+	}
+	profile.timestampUpperBound = maxTimestampTrytes
+	if mwmArg != "" {
+		mwm, err := strconv.Atoi(mwmArg)
+		if err != nil || mwm < 1 || mwm > hashTrinarySize {
+			return nil, ErrInvalidNetworkMWM
+		}
+		profile.defaultMWM = mwm
+		if mwm < profile.minMWM {
+			profile.minMWM = mwm
+		}
+		if mwm > profile.maxMWM {
+			profile.maxMWM = mwm
+		}
+	}
+	return &profile, nil
+}
+
+// mwmLimitError is ErrMWMNotAllowed carrying the max MWM, so that the error response
+// can advertise it to clients negotiating their MWM.
+type mwmLimitError struct {
+	max int
+}
+
+func errMWMAbove(max int) error {
+	return &mwmLimitError{max: max}
+}
+
+func (e *mwmLimitError) Error() string {
+	return fmt.Sprintf("%s: max allowed is %d", ErrMWMNotAllowed.Error(), e.max)
+}
+
+func (e *mwmLimitError) Cause() error {
+	return ErrMWMNotAllowed
+}
+
+// maxMWMOf returns the max MWM carried by the error, also if it was wrapped.
+func maxMWMOf(err error) (int, bool) {
+	for err != nil {
+		if limit, ok := err.(*mwmLimitError); ok {
+			return limit.max, true
+		}
+		causer, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = causer.Cause()
+	}
+	return 0, false
+}
+
+// MWM returns the min weight magnitude to do the PoW with.
+func (n *networkProfile) MWM(requested int) int {
+	if requested < n.minMWM || requested > n.maxMWM {
+		return n.defaultMWM
+	}
+	return requested
+}
+
+// ValidateTips checks the trunk and branch transaction hashes supplied by the client.
+func (n *networkProfile) ValidateTips(trunk, branch Trytes) error {
+	for _, tip := range []Trytes{trunk, branch} {
+		if len(tip) != hashTrinarySize/3 || tip.IsValid() != nil {
+			return ErrInvalidTips
+		}
+		if !n.allowEmptyTips && tip == emptyHash {
+			return ErrEmptyTips
+		}
+	}
+	return nil
+}
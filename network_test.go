@@ -0,0 +1,94 @@
+package attach
+
+import (
+	"testing"
+)
+
+const (
+	testEmptyTip = "999999999999999999999999999999999999999999999999999999999999999999999999999999999"
+	testTip      = "ABCDEFGHIJKLMNOPQRSTUVWXYZ9ABCDEFGHIJKLMNOPQRSTUVWXYZ9ABCDEFGHIJKLMNOPQRSTUVWXYZ9"
+)
+
+func TestNetworkProfileFor(t *testing.T) {
+	tests := []struct {
+		name, mwm      string
+		def, min, max  int
+		allowEmptyTips bool
+	}{
+		{"mainnet", "", 14, 14, 14, false},
+		{"devnet", "", 9, 9, 9, false},
+		{"private", "", 9, 1, 9, true},
+		// a custom MWM widens the allowed range
+		{"mainnet", "9", 9, 9, 14, false},
+		{"devnet", "16", 16, 9, 16, false},
+	}
+	for _, test := range tests {
+		profile, err := networkProfileFor(test.name, test.mwm)
+		if err != nil {
+			t.Errorf("%s %s: %v", test.name, test.mwm, err)
+			continue
+		}
+		if profile.defaultMWM != test.def || profile.minMWM != test.min || profile.maxMWM != test.max || profile.allowEmptyTips != test.allowEmptyTips {
+			t.Errorf("%s %s: unexpected profile %+v", test.name, test.mwm, profile)
+		}
+	}
+
+	errs := []struct {
+		name, mwm string
+		err       error
+	}{
+		{"testnet", "", ErrUnknownNetwork},
+		{"mainnet", "0", ErrInvalidNetworkMWM},
+		{"mainnet", "244", ErrInvalidNetworkMWM},
+		{"mainnet", "high", ErrInvalidNetworkMWM},
+	}
+	for _, test := range errs {
+		if _, err := networkProfileFor(test.name, test.mwm); err != test.err {
+			t.Errorf("%s %s: expected %v, got %v", test.name, test.mwm, test.err, err)
+		}
+	}
+}
+
+func TestNetworkProfileMWM(t *testing.T) {
+	mainnet, _ := networkProfileFor("mainnet", "")
+	private, _ := networkProfileFor("private", "")
+	tests := []struct {
+		profile   *networkProfile
+		requested int
+		mwm       int
+	}{
+		{mainnet, 14, 14},
+		// requests outside of the allowed range use the default
+		{mainnet, 9, 14},
+		{mainnet, 18, 14},
+		{private, 5, 5},
+		{private, 0, 9},
+		{private, 12, 9},
+	}
+	for _, test := range tests {
+		if mwm := test.profile.MWM(test.requested); mwm != test.mwm {
+			t.Errorf("%s %d: expected %d, got %d", test.profile.name, test.requested, test.mwm, mwm)
+		}
+	}
+}
+
+func TestNetworkProfileValidateTips(t *testing.T) {
+	mainnet, _ := networkProfileFor("mainnet", "")
+	private, _ := networkProfileFor("private", "")
+	tests := []struct {
+		profile       *networkProfile
+		trunk, branch string
+		err           error
+	}{
+		{mainnet, testTip, testTip, nil},
+		{mainnet, testEmptyTip, testTip, ErrEmptyTips},
+		{private, testEmptyTip, testEmptyTip, nil},
+		{mainnet, testTip[:80], testTip, ErrInvalidTips},
+		{private, testTip, "a" + testTip[1:], ErrInvalidTips},
+	}
+	for i, test := range tests {
+		if err := test.profile.ValidateTips(Trytes(test.trunk), Trytes(test.branch)); err != test.err {
+			t.Errorf("%d: expected %v, got %v", i, test.err, err)
+		}
+	}
+}
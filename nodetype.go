@@ -0,0 +1,160 @@
+package attach
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrUnknownNodeType = errors.New("unknown node type, expected iri, hornet or bee")
+
+// nodeProfile describes the API differences of the supported node software.
+type nodeProfile struct {
+	name string
+	// healthPath is probed with a GET request, if empty getNodeInfo is used instead
+	healthPath string
+	// unsupported commands are answered by the plugin instead of being forwarded
+	unsupported map[string]bool
+	// statusMapping translates upstream response codes into the ones IRI would use
+	statusMapping map[int]int
+}
+
+var nodeProfiles = map[string]*nodeProfile{
+	"iri": {name: "iri"},
+	"hornet": {
+		name:       "hornet",
+		healthPath: "/health",
+		unsupported: map[string]bool{
+			"interruptAttachingToTangle": true,
+			"getMissingTransactions":     true,
+		},
+		// Hornet refuses non-permitted remote commands with 403 where IRI uses 401
+		statusMapping: map[int]int{http.StatusForbidden: http.StatusUnauthorized},
+	},
+	"bee": {
+		name:       "bee",
+		healthPath: "/health",
+		unsupported: map[string]bool{
+			"interruptAttachingToTangle": true,
+			"getMissingTransactions":     true,
+			"addNeighbors":               true,
+			"removeNeighbors":            true,
+			"getNeighbors":               true,
+		},
+		statusMapping: map[int]int{http.StatusForbidden: http.StatusUnauthorized},
+	},
+}
+
+func (n *nodeProfile) Unsupported(command string) bool {
+	return n.unsupported[command]
+}
+
+func (n *nodeProfile) MapResponse(res *http.Response) {
+	if mapped, ok := n.statusMapping[res.StatusCode]; ok {
+		res.StatusCode = mapped
+		res.Status = fmt.Sprintf("%d %s", mapped, http.StatusText(mapped))
+	}
+}
+
+// iriErrorRes mirrors the error responses of IRI.
+type iriErrorRes struct {
+	Error    string `json:"error"`
+	Duration int64  `json:"duration"`
+	// Code is the stable error code if error_codes is enabled
+	Code string `json:"code,omitempty"`
+	// MaxMWM is the max MWM the client may request instead, if mwm_negotiation is enabled
+	MaxMWM int `json:"maxMWM,omitempty"`
+}
+
+// healthChecker periodically probes the upstream node and reports it as
+// unavailable while the probes fail, so requests fail fast instead of piling up.
+type healthChecker struct {
+	node     *upstreamNode
+	profile  *nodeProfile
+	interval time.Duration
+	client   *http.Client
+
+	mu      sync.RWMutex
+	healthy bool
+	stop    chan struct{}
+}
+
+func (h *healthChecker) Healthy() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.healthy
+}
+
+func (h *healthChecker) probe() error {
+	var req *http.Request
+	var err error
+	if h.profile.healthPath != "" {
+		req, err = http.NewRequest(http.MethodGet, h.node.url.Scheme+"://"+h.node.url.Host+h.profile.healthPath, nil)
+	} else {
+		req, err = http.NewRequest(http.MethodPost, h.node.url.String(), bytes.NewReader([]byte(`{"command":"getNodeInfo"}`)))
+		if err == nil {
+			req.Header.Set(contentType, contentTypeJSON)
+			req.Header.Set(apiVersionHeader, defaultAPIVersion)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	res, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("health check responded with http status %d", res.StatusCode)
+	}
+	return nil
+}
+
+func (h *healthChecker) check() {
+	err := h.probe()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case err != nil && h.healthy:
+		logger.Warnf("upstream %s node is unhealthy: %s\n", h.profile.name, err.Error())
+		alerts.Fire(eventUpstreamDown, "upstream %s node is unhealthy: %s", h.profile.name, err.Error())
+	case err == nil && !h.healthy:
+		logger.Infof("upstream %s node is healthy\n", h.profile.name)
+	}
+	h.healthy = err == nil
+}
+
+func (h *healthChecker) Start() error {
+	h.client = h.node.Client()
+	h.client.Timeout = h.interval
+	h.stop = make(chan struct{})
+	h.check()
+	go func() {
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				h.check()
+			case <-h.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (h *healthChecker) Stop() error {
+	if h.stop != nil {
+		close(h.stop)
+		h.stop = nil
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package attach
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInconsistentBundle = errors.New("the transactions don't form a consistent bundle")
+
+// the parsing and validation layer of attach requests. every request body and all trytes
+// are controlled by the client, these funcs must refuse any input with an error and never
+// panic, they are exported to be exercised by tests and fuzzers.
+
+// ParseAttachToTangleCmd parses the JSON body of an attachToTangle command.
+func ParseAttachToTangleCmd(body []byte) (*AttachToTangleCmd, error) {
+	command := &AttachToTangleCmd{}
+	if err := json.Unmarshal(body, command); err != nil {
+		return nil, ErrBodyUnparsable
+	}
+	return command, nil
+}
+
+// ParseTransactions parses the trytes of the transactions of a bundle.
+func ParseTransactions(trytes []Trytes) ([]Tx, error) {
+	txs := make([]Tx, 0, len(trytes))
+	for i := range trytes {
+		field := "trytes[" + strconv.Itoa(i) + "]"
+		if err := CheckTrytes(field, trytes[i]); err != nil {
+			return nil, err
+		}
+		tx, err := parseTransaction(trytes[i])
+		if err != nil {
+			return nil, errors.Wrapf(ErrBuildingTx, "%s: %s", field, err.Error())
+		}
+		txs = append(txs, *tx)
+	}
+	return txs, nil
+}
+
+// CheckBundle checks that the transactions share the bundle hash, are indexed without
+// gaps, balance to zero, are signed correctly and hash to the bundle hash.
+func CheckBundle(txs []Tx) error {
+	if len(txs) == 0 {
+		return errors.Wrap(ErrInconsistentBundle, "no transactions")
+	}
+	bundle := make([]Tx, len(txs))
+	copy(bundle, txs)
+	sort.Slice(bundle, func(i, j int) bool { return bundle[i].CurrentIndex < bundle[j].CurrentIndex })
+	for i := range bundle {
+		if bundle[i].Bundle != bundle[0].Bundle {
+			return errors.Wrapf(ErrInconsistentBundle, "transaction %d has another bundle hash", bundle[i].CurrentIndex)
+		}
+	}
+	if err := validBundle(bundle); err != nil {
+		return errors.Wrap(ErrInconsistentBundle, err.Error())
+	}
+	return nil
+}
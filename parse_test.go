@@ -0,0 +1,168 @@
+package attach
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iotaledger/iota.go/bundle"
+	"github.com/iotaledger/iota.go/transaction"
+	"github.com/pkg/errors"
+)
+
+// testBundle returns the trytes of a finalized zero-value bundle of n transactions.
+func testBundle(t *testing.T, n int, tag string) []Trytes {
+	var txs bundle.Bundle
+	for i := 0; i < n; i++ {
+		txs = bundle.AddEntry(txs, bundle.BundleEntry{
+			Address:   strings.Repeat(string(rune('A'+i)), 81),
+			Tag:       tag,
+			Timestamp: uint64(time.Now().Unix()),
+		})
+	}
+	txs, err := bundle.Finalize(txs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trytes := make([]Trytes, len(txs))
+	for i := range txs {
+		trytes[i] = Trytes(transaction.MustTransactionToTrytes(&txs[i]))
+	}
+	return trytes
+}
+
+func TestParseAttachToTangleCmd(t *testing.T) {
+	command, err := ParseAttachToTangleCmd([]byte(`{"command":"attachToTangle","trunkTransaction":"A","branchTransaction":"B","minWeightMagnitude":14,"trytes":["C"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if command.Command != attachToTangleCommand || command.TrunkTxHash != "A" || command.BranchTxHash != "B" ||
+		command.MWM != 14 || len(command.Trytes) != 1 || command.Trytes[0] != "C" {
+		t.Fatalf("unexpected command %+v", command)
+	}
+	for _, body := range []string{``, `[]`, `{"minWeightMagnitude":"14"}`, `{"trytes":"C"}`} {
+		if _, err := ParseAttachToTangleCmd([]byte(body)); err != ErrBodyUnparsable {
+			t.Errorf("%q: expected %v, got %v", body, ErrBodyUnparsable, err)
+		}
+	}
+}
+
+func TestParseTransactions(t *testing.T) {
+	trytes := testBundle(t, 2, "ATTACH")
+	txs, err := ParseTransactions(trytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range txs {
+		if txs[i].CurrentIndex != int64(i) || txs[i].LastIndex != 1 || txs[i].Trytes() != trytes[i] {
+			t.Fatalf("transaction %d doesn't round trip: %+v", i, txs[i])
+		}
+	}
+
+	tests := []struct {
+		name   string
+		trytes Trytes
+		err    error
+	}{
+		{"lower case", Trytes(strings.ToLower(string(trytes[0]))), ErrMalformedTrytes},
+		{"whitespace", " " + trytes[0][1:], ErrMalformedTrytes},
+		{"too short", trytes[0][1:], ErrBuildingTx},
+		{"too long", trytes[0] + "9", ErrBuildingTx},
+		{"value above the supply", trytes[0][:2279] + "MMMMMMMMMMMMMMMM" + trytes[0][2295:], ErrBuildingTx},
+	}
+	for _, test := range tests {
+		if _, err := ParseTransactions([]Trytes{trytes[1], test.trytes}); errors.Cause(err) != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		} else if !strings.Contains(err.Error(), "trytes[1]") {
+			t.Errorf("%s: expected the error to name the transaction: %s", test.name, err.Error())
+		}
+	}
+}
+
+func TestCheckBundle(t *testing.T) {
+	txs, err := ParseTransactions(testBundle(t, 3, "ATTACH"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckBundle(txs); err != nil {
+		t.Fatalf("expected the bundle to be consistent: %s", err.Error())
+	}
+	// the bundle is checked in index order, whatever order the client sent it in
+	if err := CheckBundle([]Tx{txs[2], txs[0], txs[1]}); err != nil {
+		t.Fatalf("expected the shuffled bundle to be consistent: %s", err.Error())
+	}
+
+	other, err := ParseTransactions(testBundle(t, 3, "OTHER"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	valued := append([]Tx{}, txs...)
+	valued[0].Value = 1
+	tag := append([]Tx{}, txs...)
+	tag[1].ObsoleteTag = "TAMPERED" + Trytes(strings.Repeat("9", 19))
+	tests := []struct {
+		name string
+		txs  []Tx
+	}{
+		{"empty", nil},
+		{"missing transaction", txs[:2]},
+		{"mixed bundles", []Tx{txs[0], other[1], txs[2]}},
+		{"unbalanced", valued},
+		{"not hashing to the bundle hash", tag},
+	}
+	for _, test := range tests {
+		if err := CheckBundle(test.txs); errors.Cause(err) != ErrInconsistentBundle {
+			t.Errorf("%s: expected %v, got %v", test.name, ErrInconsistentBundle, err)
+		}
+	}
+}
+
+func TestSanitizeTrytes(t *testing.T) {
+	trytes := testBundle(t, 1, "ATTACH")[0]
+	sloppy := func() *AttachToTangleCmd {
+		return &AttachToTangleCmd{
+			TrunkTxHash:  Trytes(strings.ToLower(string(emptyHash))),
+			BranchTxHash: emptyHash + "\n",
+			Trytes:       []Trytes{Trytes(strings.ToLower(string(trytes[:100])) + " \t" + string(trytes[100:]))},
+		}
+	}
+
+	s := &site{}
+	if err := s.sanitizeTrytes(sloppy()); errors.Cause(err) != ErrMalformedTrytes {
+		t.Fatalf("expected %v in strict mode, got %v", ErrMalformedTrytes, err)
+	}
+
+	s.lenientTrytes = true
+	command := sloppy()
+	if err := s.sanitizeTrytes(command); err != nil {
+		t.Fatalf("expected lenient mode to repair the trytes: %s", err.Error())
+	}
+	if command.TrunkTxHash != emptyHash || command.BranchTxHash != emptyHash || command.Trytes[0] != trytes {
+		t.Fatalf("unexpected normalized command %+v", command)
+	}
+	command = sloppy()
+	command.Trytes[0] = "ÄBC"
+	if err := s.sanitizeTrytes(command); errors.Cause(err) != ErrMalformedTrytes {
+		t.Fatalf("expected %v for characters outside of the alphabet, got %v", ErrMalformedTrytes, err)
+	}
+}
+
+func TestCheckTrytesSize(t *testing.T) {
+	trytes := testBundle(t, 2, "ATTACH")
+	s := &site{}
+	if err := s.checkTrytesSize(append(trytes, trytes[0]+trytes[0]), 1); err != nil {
+		t.Fatalf("expected no check unless enabled: %s", err.Error())
+	}
+
+	s.trytesSizeCheck = true
+	if err := s.checkTrytesSize(trytes, 1); err != nil {
+		t.Fatalf("expected the slack to allow another transaction: %s", err.Error())
+	}
+	if err := s.checkTrytesSize(append(trytes, "9"), 1); errors.Cause(err) != ErrTrytesSizeExceeded {
+		t.Fatalf("expected %v, got %v", ErrTrytesSizeExceeded, err)
+	}
+	s.maxTrytes = txTrytesSize
+	if err := s.checkTrytesSize(trytes, 10); errors.Cause(err) != ErrTrytesSizeExceeded {
+		t.Fatalf("expected the fixed cap to apply, got %v", err)
+	}
+}
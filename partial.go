@@ -0,0 +1,134 @@
+package attach
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidPartialResultsOption = errors.New("expected nothing or a retention after the partial_results option")
+var ErrNoPartialResult = errors.New("no partial attach result for the request id within the retention")
+var ErrInvalidResumeCmd = errors.New("resumeAttach requires the request id of the failed attach request")
+
+const defaultPartialRetention = time.Hour
+
+// the command continuing the PoW of a bundle which failed midway
+const resumeAttachCommand = "resumeAttach"
+
+// ResumeAttachCmd continues the attach request with the request id from where its PoW failed.
+type ResumeAttachCmd struct {
+	Command   string `json:"command"`
+	RequestID string `json:"requestId"`
+}
+
+// partialResult is an attach job whose PoW failed after some transactions were attached.
+type partialResult struct {
+	identity string
+	// the command with the tips the job used
+	command *AttachToTangleCmd
+	done    map[int]Trytes
+	expires time.Time
+}
+
+// partialResults keeps the attached transactions of failed jobs, so that resumeAttach
+// only does the PoW of the remaining transactions.
+type partialResults struct {
+	retention time.Duration
+
+	mu        sync.Mutex
+	byRequest map[string]*partialResult
+}
+
+func newPartialResults(args []string) (*partialResults, error) {
+	p := &partialResults{retention: defaultPartialRetention, byRequest: map[string]*partialResult{}}
+	switch len(args) {
+	case 0:
+	case 1:
+		var err error
+		if p.retention, err = time.ParseDuration(args[0]); err != nil || p.retention <= 0 {
+			return nil, ErrInvalidPartialResultsOption
+		}
+	default:
+		return nil, ErrInvalidPartialResultsOption
+	}
+	return p, nil
+}
+
+// Add stores the attached transactions of a failed job.
+func (p *partialResults) Add(requestID string, identity string, command *AttachToTangleCmd, done map[int]Trytes) {
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, partial := range p.byRequest {
+		if now.After(partial.expires) {
+			delete(p.byRequest, id)
+		}
+	}
+	p.byRequest[requestID] = &partialResult{identity: identity, command: command, done: done, expires: now.Add(p.retention)}
+}
+
+// Get returns the partial result of a request.
+func (p *partialResults) Get(requestID string) *partialResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	partial, ok := p.byRequest[requestID]
+	if !ok || time.Now().After(partial.expires) {
+		return nil
+	}
+	return partial
+}
+
+// Remove drops the partial result of a request once it was resumed successfully.
+func (p *partialResults) Remove(requestID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.byRequest, requestID)
+}
+
+type resumeKey struct{}
+
+// resumeInfo is the partial result an attach request continues.
+type resumeInfo struct {
+	requestID string
+	done      map[int]Trytes
+}
+
+// resumeOf returns what the attach request resumes, nil for new requests.
+func resumeOf(ctx context.Context) *resumeInfo {
+	resume, _ := ctx.Value(resumeKey{}).(*resumeInfo)
+	return resume
+}
+
+// serveResumeAttach runs the attach request of a partial result again, the transactions
+// which were already attached are taken over. partial results are only resumed by the
+// client whose request they are.
+func (h AttachToTangleHandler) serveResumeAttach(w http.ResponseWriter, r *http.Request, body []byte) (int, error) {
+	s := h.site
+	command := &ResumeAttachCmd{}
+	if err := json.Unmarshal(body, command); err != nil {
+		return http.StatusBadRequest, ErrBodyUnparsable
+	}
+	if command.RequestID == "" {
+		return http.StatusBadRequest, ErrInvalidResumeCmd
+	}
+	partial := s.partials.Get(jobKey(s.callerOwner(r), command.RequestID))
+	if partial == nil {
+		s.writeError(w, http.StatusNotFound, ErrNoPartialResult)
+		return 0, nil
+	}
+	attachBody, err := json.Marshal(partial.command)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	logger.Requestf("resuming attach request %s with %d of %d transactions attached\n", command.RequestID, len(partial.done), len(partial.command.Trytes))
+	sub := r.WithContext(context.WithValue(r.Context(), resumeKey{}, &resumeInfo{requestID: command.RequestID, done: partial.done}))
+	sub.Body = ioutil.NopCloser(bytes.NewReader(attachBody))
+	sub.ContentLength = int64(len(attachBody))
+	return h.serveAttach(w, sub)
+}
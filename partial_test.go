@@ -0,0 +1,44 @@
+package attach
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResumeAttachOwnership(t *testing.T) {
+	s := newSite()
+	var err error
+	if s.partials, err = newPartialResults(nil); err != nil {
+		t.Fatal(err)
+	}
+	s.apiKeys = newAPIKeyAuth()
+	s.apiKeys.Add([]string{"wallet", "wallet-key"})
+	s.apiKeys.Add([]string{"other", "other-key"})
+	command := &AttachToTangleCmd{Command: attachToTangleCommand, Trytes: []Trytes{"A", "B"}}
+	s.partials.Add(jobKey("key:wallet", "req"), "key:wallet", command, map[int]Trytes{0: "A"})
+
+	request := func(key string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		if key != "" {
+			r.Header.Set(apiKeyHeader, key)
+		}
+		return r
+	}
+	// the partial result is found under the key of its owner only
+	if partial := s.partials.Get(jobKey(s.callerOwner(request("wallet-key")), "req")); partial == nil || partial.command != command {
+		t.Fatalf("expected the owner to find the partial result, got %+v", partial)
+	}
+	h := AttachToTangleHandler{site: s}
+	for _, key := range []string{"other-key", "", "guess"} {
+		w := httptest.NewRecorder()
+		status, err := h.serveResumeAttach(w, request(key), []byte(`{"command":"resumeAttach","requestId":"req"}`))
+		if status != 0 || err != nil || w.Code != http.StatusNotFound {
+			t.Errorf("%q: expected the partial result not to be found, got %d %d %v", key, status, w.Code, err)
+		}
+	}
+	if status, err := h.serveResumeAttach(httptest.NewRecorder(), request("wallet-key"), []byte(`{"command":"resumeAttach"}`)); status != http.StatusBadRequest || err != ErrInvalidResumeCmd {
+		t.Fatalf("expected %v without a request id, got %d %v", ErrInvalidResumeCmd, status, err)
+	}
+}
@@ -0,0 +1,78 @@
+package attach
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var ErrUnsetEnvVar = errors.New("environment variable is not set")
+
+// the placeholders in option values which are replaced during setup:
+//
+//	{$VAR} and {%VAR%}   the value of an environment variable, unset ones are an error
+//	{$VAR:default}       the value of an environment variable or the default
+//	{file:/path}         the trimmed contents of a file, e.g. for secrets
+//	{hostname}           the host name of the machine
+//
+// Caddy itself already replaces the plain {$VAR} form of set variables while parsing.
+var placeholderPattern = regexp.MustCompile(`\{(\$[A-Za-z_][A-Za-z0-9_]*(?::[^}]*)?|%[A-Za-z_][A-Za-z0-9_]*%|file:[^}]+|hostname)\}`)
+
+// optionExpander replaces the placeholders in option values and collects the errors,
+// so that the setup doesn't need to check every single value.
+type optionExpander struct {
+	errs []error
+}
+
+// Val returns the value with its placeholders replaced.
+func (e *optionExpander) Val(value string) string {
+	if !strings.Contains(value, "{") {
+		return value
+	}
+	return placeholderPattern.ReplaceAllStringFunc(value, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		switch {
+		case name == "hostname":
+			host, err := os.Hostname()
+			if err != nil {
+				e.errs = append(e.errs, err)
+			}
+			return host
+		case strings.HasPrefix(name, "file:"):
+			contents, err := ioutil.ReadFile(name[len("file:"):])
+			if err != nil {
+				e.errs = append(e.errs, err)
+				return ""
+			}
+			return strings.TrimSpace(string(contents))
+		case strings.HasPrefix(name, "%"):
+			name = strings.Trim(name, "%")
+		default:
+			name = name[1:]
+		}
+		var def *string
+		if i := strings.IndexByte(name, ':'); i >= 0 {
+			value := name[i+1:]
+			name, def = name[:i], &value
+		}
+		if value, ok := os.LookupEnv(name); ok {
+			return value
+		}
+		if def != nil {
+			return *def
+		}
+		e.errs = append(e.errs, errors.Wrap(ErrUnsetEnvVar, name))
+		return ""
+	})
+}
+
+// Args returns the values with their placeholders replaced.
+func (e *optionExpander) Args(args []string) []string {
+	for i := range args {
+		args[i] = e.Val(args[i])
+	}
+	return args
+}
@@ -3,7 +3,6 @@ package attach
 import (
 	"github.com/mholt/caddy"
 	"github.com/mholt/caddy/caddyhttp/httpserver"
-	"github.com/cwarner818/giota"
 	"github.com/pkg/errors"
 	"net/http"
 	"encoding/json"
@@ -11,12 +10,16 @@ import (
 	"io/ioutil"
 	"log"
 	"bytes"
-	"sync"
 	"strconv"
 	"math"
 	"os"
 	"io"
 	"fmt"
+	"context"
+	"math/rand"
+	"strings"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
 )
 
 var ErrMissingBody = errors.New("missing body")
@@ -26,8 +29,11 @@ var ErrBuildingTx = errors.New("couldn't build transaction from trytes")
 var ErrBuildingRes = errors.New("couldn't build response")
 var ErrMissingTxBundleLimit = errors.New("expected tx bundle limit after the attach directive")
 var ErrTxBundleLimitExceeded = errors.New("the number of transactions in the bundle exceed the attachToTangle limit")
+var ErrInvalidSamplePercent = errors.New("sample_percent must be a number between 0 and 100")
+var ErrPoWFailed = errors.New("proof of work failed")
+var ErrImplausibleTimestamp = errors.New("transaction timestamp is too far off the server clock")
 
-var logger *log.Logger
+var logger = &leveledLogger{level: levelInfo}
 
 func init() {
 	caddy.RegisterPlugin("attach", caddy.Plugin{
@@ -40,33 +46,909 @@ func init() {
 		panic(err)
 	}
 	// we don't buffer writes to the log file because write frequency is very log
-	multiWriter := io.MultiWriter(os.Stdout, logfile)
-	logger = log.New(multiWriter, "middleware", log.Ldate|log.Ltime)
+	defaultLogOutput = io.MultiWriter(os.Stdout, logfile)
+	logger.out = log.New(defaultLogOutput, "middleware", log.Ldate|log.Ltime)
 }
 
-var powFn giota.PowFunc
-var maxTxInBundle = 200
-
 func setup(c *caddy.Controller) error {
-	name, powfunc := giota.GetBestPoW()
-	powFn = powfunc
+	name, powfunc := bestPoWFunc()
+	s := newSite()
+	s.powFn = powfunc
+	powConfigured := false
 	var err error
+	opts := &optionExpander{}
+	cfgErrs := &configErrors{}
+	pusher := &metricsPusher{interval: defaultMetricsInterval}
+	tracing := &tracingExporter{}
+	outputs := newLogOutputs()
+	var metricsPrefix string
+	var metricsTargets [][2]string
+	// the hooks are registered on the directive, imported files have no instance of their own
+	var persistedStats []*statsFile
+	var upstreamURL string
+	var healthInterval time.Duration
+	schedulerName, schedulerJobs := defaultSchedulerName, 0
+	admissionOpts := &admissionController{}
+	chaosOpts := &chaosInjector{}
+	alertOpts := newAlerter()
+	shared, first := sharedOptionsOf(c)
+	if first {
+		alerts = nil
+		logger.level, logger.quiet = levelInfo, false
+		c.OnStartup(useDefaultLogOutput)
+	}
+	// parseBlock parses the options of a directive block, also of imported config files.
+	// the errors of all options are collected instead of stopping at the first one.
+	var parseBlock func(c *caddy.Controller)
+	parseOption := func(c *caddy.Controller) error {
+		switch c.Val() {
+		case "import":
+			file, err := newConfigFile(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+			block, err := file.Block()
+			if err != nil {
+				return err
+			}
+			parseBlock(block)
+			s.configFiles = append(s.configFiles, file)
+		case "metrics":
+			args := opts.Args(c.RemainingArgs())
+			if len(args) != 2 {
+				return ErrMissingMetricsAddr
+			}
+			metricsTargets = append(metricsTargets, [2]string{args[0], args[1]})
+		case "metrics_interval":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			pusher.interval, err = time.ParseDuration(opts.Val(c.Val()))
+			if err != nil || pusher.interval <= 0 {
+				return ErrInvalidMetricsInterval
+			}
+		case "persist_stats":
+			file, err := statsFileFor(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+			persistedStats = append(persistedStats, file)
+		case "metrics_prefix":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			metricsPrefix = opts.Val(c.Val())
+		case "tracing":
+			args := opts.Args(c.RemainingArgs())
+			if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[1] != "insecure") {
+				return c.ArgErr()
+			}
+			tracing.endpoint = args[0]
+			tracing.insecure = len(args) == 2
+		case "log_level":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			value := opts.Val(c.Val())
+			if logger.level, err = parseLogLevel(value); err != nil {
+				return err
+			}
+			if err := shared.Set("log_level", value); err != nil {
+				return err
+			}
+		case "quiet":
+			if err := shared.Set("quiet", "on"); err != nil {
+				return err
+			}
+			logger.quiet = true
+		case "log_output":
+			if err := outputs.Add(opts.Args(c.RemainingArgs())); err != nil {
+				return err
+			}
+		case "anonymize_ips":
+			s.anonymizer, err = newIPAnonymizer(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "stats":
+			args := opts.Args(c.RemainingArgs())
+			if len(args) != 2 {
+				return ErrMissingStatsCredentials
+			}
+			s.statsCreds = &basicCredentials{user: args[0], password: args[1]}
+		case "client_ca":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			if s.certAuth == nil {
+				s.certAuth = &clientCertAuth{subjects: map[string]certProfile{}}
+			}
+			s.certAuth.caFiles = append(s.certAuth.caFiles, opts.Val(c.Val()))
+		case "client_cert":
+			if s.certAuth == nil {
+				s.certAuth = &clientCertAuth{subjects: map[string]certProfile{}}
+			}
+			if err := s.certAuth.AddSubject(opts.Args(c.RemainingArgs())); err != nil {
+				return err
+			}
+		case "jwt_secret", "jwt_jwks", "jwt_issuer", "jwt_audience":
+			option := c.Val()
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			if s.jwtAuthz == nil {
+				s.jwtAuthz = newJWTAuth()
+			}
+			switch option {
+			case "jwt_secret":
+				s.jwtAuthz.secret = []byte(opts.Val(c.Val()))
+			case "jwt_jwks":
+				s.jwtAuthz.jwksURL = opts.Val(c.Val())
+			case "jwt_issuer":
+				s.jwtAuthz.issuer = opts.Val(c.Val())
+			case "jwt_audience":
+				s.jwtAuthz.audience = opts.Val(c.Val())
+			}
+		case "hmac_secret":
+			s.signer, err = newRequestSigner(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "upstream":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			upstreamURL = opts.Val(c.Val())
+		case "upstream_header", "upstream_basic_auth", "upstream_tls_cert", "upstream_tls_ca", "upstream_tls_insecure",
+			"upstream_retries", "upstream_breaker":
+			if err := s.upstreamOpts.ParseOption(c.Val(), opts.Args(c.RemainingArgs())); err != nil {
+				return err
+			}
+		case "node_type":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			profile, ok := nodeProfiles[opts.Val(c.Val())]
+			if !ok {
+				return ErrUnknownNodeType
+			}
+			s.nodeType = profile
+		case "health_check":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			healthInterval, err = time.ParseDuration(opts.Val(c.Val()))
+			if err != nil {
+				return err
+			}
+		case "network":
+			args := opts.Args(c.RemainingArgs())
+			if len(args) < 1 || len(args) > 2 {
+				return c.ArgErr()
+			}
+			var mwmArg string
+			if len(args) == 2 {
+				mwmArg = args[1]
+			}
+			s.network, err = networkProfileFor(args[0], mwmArg)
+			if err != nil {
+				return err
+			}
+		case "tip_check":
+			s.tipCheck, err = newTipChecker(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "tip_fallback":
+			s.tipFallback, err = newTipFallback(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "tip_headers":
+			s.tipHeaders = &tipHeaders{}
+		case "timestamp_window":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			s.timestampWindow, err = time.ParseDuration(opts.Val(c.Val()))
+			if err != nil {
+				return err
+			}
+		case "replay_protection":
+			s.replay, err = newReplayGuard(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "response_hashes":
+			s.responseHashes = true
+		case "response_timings":
+			s.responseTimings = timingsInBody
+			if c.NextArg() {
+				switch c.Val() {
+				case "body":
+				case "headers":
+					s.responseTimings = timingsInHeaders
+				default:
+					return c.ArgErr()
+				}
+			}
+		case "response_order":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			switch c.Val() {
+			case "iri":
+				s.responseOrder = orderIRI
+			case "submitted":
+				s.responseOrder = orderSubmitted
+			default:
+				return c.ArgErr()
+			}
+		case "duration":
+			s.durationCovers, s.durationUnit, err = parseDurationOption(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "fallback_to_node":
+			s.nodeFallback, err = newNodeFallback(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "max_jobs_per_client":
+			s.jobLimits, err = newJobLimiter(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "partial_results":
+			s.partials, err = newPartialResults(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "progress_stream":
+			s.progress = newProgressStream()
+		case "duration_fields":
+			s.durationFields = true
+		case "strict_iri":
+			s.strictIRI = true
+		case "sample_percent":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			s.samplePercent, err = strconv.ParseFloat(opts.Val(c.Val()), 64)
+			if err != nil || s.samplePercent < 0 || s.samplePercent > 100 {
+				return ErrInvalidSamplePercent
+			}
+		case "shadow":
+			s.shadowPrimary = shadowPrimaryLocal
+			if c.NextArg() {
+				if c.Val() != shadowPrimaryLocal && c.Val() != shadowPrimaryNode {
+					return c.ArgErr()
+				}
+				s.shadowPrimary = c.Val()
+			}
+		case "pow":
+			args := opts.Args(c.RemainingArgs())
+			if len(args) == 0 {
+				return c.ArgErr()
+			}
+			name, powConfigured = args[0], true
+			if name == powAuto {
+				if len(args) != 1 {
+					return c.ArgErr()
+				}
+				powConfigured = false
+			} else if name == powMock {
+				if len(args) > 2 {
+					return c.ArgErr()
+				}
+				var nonce Trytes
+				if len(args) == 2 {
+					nonce = Trytes(args[1])
+				}
+				s.powFn, err = newMockPoW(nonce)
+			} else if names := parsePoWBackends(args); len(names) > 1 {
+				name = strings.Join(names, ",")
+				if s.powChain, err = newPoWChain(names, s.powProcs); err == nil {
+					s.powFn = s.powChain.Pow
+				}
+			} else {
+				if len(names) != 1 {
+					return c.ArgErr()
+				}
+				name = names[0]
+				s.powFn, err = lookupPoWFunc(name)
+			}
+			if err != nil {
+				return err
+			}
+		case "capture":
+			s.capture, err = newRequestCapture(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "pow_checkpoints":
+			s.checkpoints, err = newPoWCheckpoints(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "pow_workers":
+			s.powWorkers, err = newPoWWorkers(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "hash_budget":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			s.hashBudget, err = strconv.ParseFloat(opts.Val(c.Val()), 64)
+			if err != nil || s.hashBudget <= 0 {
+				return ErrInvalidHashBudget
+			}
+		case "dynamic_bundle_limit":
+			if err := s.dynamicLimit.ParseOption(opts.Args(c.RemainingArgs())); err != nil {
+				return err
+			}
+		case "authz":
+			s.authz, err = newExternalAuthz(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "bundle_rule":
+			rule, err := parseBundleRule(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+			s.bundleRules = append(s.bundleRules, rule)
+		case "policy_hook":
+			s.policyHook, err = newPolicyHook(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "spam_detection":
+			s.spam, err = newSpamDetector(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "early_rejection":
+			s.earlyRejection, err = newEarlyRejection(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "pow_scheduler":
+			schedulerName, schedulerJobs, err = parseSchedulerOption(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "pool":
+			pool, shares, isDefault, err := parsePoolOption(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+			s.pools[pool] = shares
+			if isDefault {
+				s.pool = pool
+			}
+		case "tryte_encoding":
+			s.tryteEncodingEnabled = true
+		case "msgpack":
+			s.msgpackEnabled = true
+		case "methods":
+			s.methods, err = parseMethods(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "intercept_path":
+			paths, err := parseInterceptPaths(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+			s.interceptPaths = append(s.interceptPaths, paths...)
+		case "api_versions":
+			s.apiVersions, err = parseAPIVersions(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "require_json":
+			s.requireJSON = true
+		case "lenient_trytes":
+			s.lenientTrytes = true
+		case "max_trytes":
+			s.trytesSizeCheck = true
+			args := opts.Args(c.RemainingArgs())
+			if len(args) > 1 {
+				return ErrInvalidMaxTrytes
+			}
+			if len(args) == 1 {
+				s.maxTrytes, err = strconv.Atoi(args[0])
+				if err != nil || s.maxTrytes <= 0 {
+					return ErrInvalidMaxTrytes
+				}
+			}
+		case "attachment_timestamp":
+			s.attachTimestamps, err = newTimestampSource(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "ntp_check":
+			s.clockCheck, err = newNTPCheck(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "trusted_proxies":
+			nets, err := parseCIDRs(opts.Args(c.RemainingArgs()))
+			if err != nil || len(nets) == 0 {
+				return ErrInvalidTrustedProxy
+			}
+			s.trustedProxies = append(s.trustedProxies, nets...)
+		case "ip_rules":
+			s.clientRules, err = newIPRules(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "user_agent":
+			if s.agentRules == nil {
+				s.agentRules = &userAgentRules{}
+			}
+			if err := s.agentRules.Add(opts.Args(c.RemainingArgs())); err != nil {
+				return err
+			}
+		case "attach_history":
+			s.history, err = newAttachHistory(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "bundle_db":
+			s.bundleDB, err = newBundleDB(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "events":
+			if s.events == nil {
+				s.events = &eventStream{}
+			}
+			if err := s.events.Add(opts.Args(c.RemainingArgs())); err != nil {
+				return err
+			}
+		case "powered_by":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			switch c.Val() {
+			case "on":
+				s.poweredBy = true
+			case "off":
+				s.poweredBy = false
+			default:
+				return c.ArgErr()
+			}
+		case "cache":
+			if s.cache == nil {
+				s.cache = &responseCache{}
+			}
+			if err := s.cache.Add(opts.Args(c.RemainingArgs())); err != nil {
+				return err
+			}
+		case "validate_commands":
+			s.maxArraySize, err = parseValidateOption(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "max_array":
+			command, n, err := parseMaxArray(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+			s.arrayLimits[command] = n
+		case "rejection_alert":
+			s.rejections, err = newRejectionAlert(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "info":
+			s.infoEnabled = true
+		case "keep_results":
+			s.results, err = newResultStore(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "geoip":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			s.geoIP, err = openGeoIPDB(opts.Val(c.Val()))
+			if err != nil {
+				return err
+			}
+		case "geo_policy":
+			country, policy, err := s.parseGeoPolicy(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+			s.geoPolicies[country] = policy
+		case "api_key":
+			if s.apiKeys == nil {
+				s.apiKeys = newAPIKeyAuth()
+			}
+			if err := s.apiKeys.Add(opts.Args(c.RemainingArgs())); err != nil {
+				return err
+			}
+		case "promote_reattach":
+			s.helperCommands = true
+		case "broadcast_retries":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			s.broadcastRetries, err = strconv.Atoi(opts.Val(c.Val()))
+			if err != nil || s.broadcastRetries < 0 {
+				return ErrInvalidBroadcastRetries
+			}
+		case "preattach_pool":
+			s.preattach, err = newPreattachPool(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "sign_responses":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			s.respSigner, err = newResponseSigner(opts.Val(c.Val()))
+			if err != nil {
+				return err
+			}
+		case "grpc":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			s.grpcFront = &grpcFrontend{addr: opts.Val(c.Val())}
+		case "jsonrpc":
+			s.jsonRPC = true
+		case "batch_attach":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			s.maxBatchBundles, err = strconv.Atoi(opts.Val(c.Val()))
+			if err != nil || s.maxBatchBundles <= 0 {
+				return c.ArgErr()
+			}
+		case "error_codes":
+			s.errorCodes = true
+		case "mwm_negotiation":
+			s.mwmNegotiation = true
+		case "validate_bundle":
+			s.validateBundleEnabled = true
+		case "can_attach":
+			s.canAttachEnabled = true
+			if c.NextArg() {
+				ttl, err := time.ParseDuration(opts.Val(c.Val()))
+				if err != nil {
+					return err
+				}
+				s.reservations = newReservationStore(ttl)
+			}
+		case "schedule":
+			win, err := parseScheduleWindow(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+			s.schedule = append(s.schedule, win)
+		case "max_load", "min_free_memory", "max_cpu_temp", "overload_max_txs":
+			if err := admissionOpts.ParseOption(c.Val(), opts.Args(c.RemainingArgs())); err != nil {
+				return err
+			}
+		case "chaos", "chaos_delay", "chaos_errors", "chaos_truncate":
+			if err := chaosOpts.ParseOption(c.Val(), opts.Args(c.RemainingArgs())); err != nil {
+				return err
+			}
+		case "alert", "alert_cooldown", "alert_queue", "alert_errors":
+			if err := alertOpts.ParseOption(c.Val(), opts.Args(c.RemainingArgs())); err != nil {
+				return err
+			}
+		case "limits_file":
+			s.limitsWatcher, err = newLimitsFile(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "limits_admin":
+			args := opts.Args(c.RemainingArgs())
+			if len(args) != 2 {
+				return ErrMissingLimitsCredentials
+			}
+			s.limitsCreds = &basicCredentials{user: args[0], password: args[1]}
+		case "verify_with":
+			s.verifier, err = newPoWVerifier(opts.Args(c.RemainingArgs()))
+			if err != nil {
+				return err
+			}
+		case "debug":
+			args := opts.Args(c.RemainingArgs())
+			if len(args) != 2 {
+				return ErrMissingDebugCredentials
+			}
+			s.debugCreds = &basicCredentials{user: args[0], password: args[1]}
+		default:
+			if !httpserver.IsLogRollerSubdirective(c.Val()) {
+				return ErrUnknownOption
+			}
+			if err := httpserver.ParseRoller(outputs.roller, c.Val(), opts.Args(c.RemainingArgs())...); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	parseBlock = func(c *caddy.Controller) {
+		for c.NextBlock() {
+			option := c.Val()
+			if err := parseOption(c); err != nil {
+				cfgErrs.At(c, option, err)
+				// skip what's left of the broken line
+				c.RemainingArgs()
+			}
+		}
+	}
 	for c.Next() {
-		if !c.NextArg() {
-			break
+		if c.NextArg() {
+			s.maxTxInBundle, err = strconv.Atoi(opts.Val(c.Val()))
+			if err != nil || s.maxTxInBundle <= 0 {
+				cfgErrs.At(c, "attach", ErrInvalidTxBundleLimit)
+			}
 		}
-		maxTxInBundle, err = strconv.Atoi(c.Val())
+		parseBlock(c)
+	}
+	for _, err := range opts.errs {
+		cfgErrs.Add(err)
+	}
+	if upstreamURL != "" {
+		s.upstream, err = newUpstreamNode(upstreamURL, s.upstreamOpts)
 		if err != nil {
-			logger.Printf("setting default max bundle txs to %d\n", 200)
-			maxTxInBundle = 200
+			cfgErrs.Add(errors.Wrap(err, "upstream"))
+			s.upstream = nil
+		} else {
+			s.upstream.profile = s.nodeType
+			logger.Infof("forwarding non-intercepted commands to %s node at %s\n", s.nodeType.name, upstreamURL)
+			if healthInterval > 0 {
+				s.upstream.health = &healthChecker{node: s.upstream, profile: s.nodeType, interval: healthInterval}
+				c.OnStartup(s.upstream.health.Start)
+				c.OnShutdown(s.upstream.health.Stop)
+			}
+		}
+	} else if healthInterval > 0 {
+		logger.Warnf("health_check requires the upstream option, not checking node health\n")
+	}
+	if s.strictIRI && (s.responseHashes || s.responseTimings != timingsOff || s.responseOrder != orderIRI || s.durationFields || s.errorCodes) {
+		cfgErrs.Add(ErrStrictIRIConflict)
+	}
+	if admissionOpts.Enabled() {
+		s.admission = admissionOpts
+	} else if admissionOpts.shedAbove > 0 {
+		logger.Warnf("overload_max_txs has no effect without max_load, min_free_memory or max_cpu_temp\n")
+	}
+	if chaosOpts.enabled {
+		s.chaos = chaosOpts
+		logger.Warnf("chaos mode is enabled, attachToTangle requests will be delayed, failed and truncated on purpose\n")
+	} else if *chaosOpts != (chaosInjector{}) {
+		cfgErrs.Add(ErrChaosNotEnabled)
+	}
+	if len(s.geoPolicies) > 0 && s.geoIP == nil {
+		cfgErrs.Add(ErrGeoPolicyWithoutGeoIP)
+	}
+	if s.dynamicLimit.minTxs > s.maxTxInBundle {
+		cfgErrs.Add(errors.Wrapf(ErrImpossibleDynamicLimit, "%d>%d", s.dynamicLimit.minTxs, s.maxTxInBundle))
+	}
+	s.baseLimits = &runtimeLimits{MaxTxs: s.maxTxInBundle, HashBudget: s.hashBudget, PoWProcs: defaultPowProcs}
+	s.liveLimits.Store(s.baseLimits)
+	if s.limitsWatcher != nil {
+		s.limitsWatcher.site = s
+		cfgErrs.Add(s.limitsWatcher.load())
+		c.OnStartup(s.limitsWatcher.Start)
+		c.OnShutdown(s.limitsWatcher.Stop)
+	}
+	if len(alertOpts.sinks) > 0 || alertOpts.queueMax > 0 || alertOpts.errorsMax > 0 {
+		// the alert options of two sites aren't compared, only one may configure them
+		cfgErrs.Add(shared.Set("alerts", "in "+c.Key))
+		alerts = alertOpts
+		if len(alerts.sinks) == 0 {
+			logger.Warnf("no alert sinks configured, alerts are only logged\n")
+		}
+		c.OnStartup(alerts.Start)
+		c.OnShutdown(alerts.Stop)
+	}
+	if s.tipCheck != nil {
+		if upstreamURL == "" {
+			cfgErrs.Add(ErrTipCheckWithoutUpstream)
+		}
+		s.tipCheck.upstream = s.upstream
+	}
+	if s.tipFallback != nil {
+		if upstreamURL == "" {
+			cfgErrs.Add(ErrTipFallbackWithoutUpstream)
+		}
+		s.tipFallback.upstream = s.upstream
+		if s.tipFallback.secondaryURL != "" {
+			s.tipFallback.secondary, err = newUpstreamNode(s.tipFallback.secondaryURL, s.upstreamOpts)
+			if err != nil {
+				cfgErrs.Add(errors.Wrap(err, "tip_fallback"))
+			} else {
+				s.tipFallback.secondary.profile = s.nodeType
+			}
+		}
+	}
+	if s.tipHeaders != nil {
+		if upstreamURL == "" {
+			cfgErrs.Add(ErrTipHeadersWithoutUpstream)
+		}
+		s.tipHeaders.upstream = s.upstream
+	}
+	if s.helperCommands && upstreamURL == "" {
+		cfgErrs.Add(ErrHelpersWithoutUpstream)
+	}
+	if s.preattach != nil {
+		s.preattach.site = s
+		if upstreamURL == "" {
+			cfgErrs.Add(ErrPreattachWithoutUpstream)
+		}
+		c.OnStartup(s.preattach.Start)
+		c.OnShutdown(s.preattach.Stop)
+		logger.Infof("keeping a pool of %d pre-attached zero-value transactions\n", s.preattach.size)
+	}
+	if s.shadowPrimary != "" {
+		if upstreamURL == "" {
+			cfgErrs.Add(ErrShadowWithoutUpstream)
+		}
+		logger.Infof("shadowing attachToTangle requests to the node, serving the %s result\n", s.shadowPrimary)
+	}
+	if s.replay != nil {
+		c.OnStartup(s.replay.Start)
+		c.OnShutdown(s.replay.Stop)
+	}
+	if outputs.Configured() {
+		// the outputs are shared by all sites, the first site configuring them opens them
+		opened := shared.Has("log_output")
+		cfgErrs.Add(shared.Set("log_output", outputs.String()))
+		if !opened {
+			c.OnStartup(outputs.Start)
+			c.OnShutdown(outputs.Stop)
+		}
+	}
+	for _, target := range metricsTargets {
+		exporter, err := newMetricsExporter(target[0], target[1], metricsPrefix)
+		if err != nil {
+			cfgErrs.Add(errors.Wrapf(err, "metrics %s %s", target[0], target[1]))
 			continue
 		}
+		pusher.exporters = append(pusher.exporters, exporter)
+		logger.Infof("pushing metrics to %s at %s every %s\n", target[0], target[1], pusher.interval)
+	}
+	c.OnStartup(pusher.Start)
+	c.OnShutdown(pusher.Stop)
+	c.OnStartup(tracing.Start)
+	c.OnShutdown(tracing.Stop)
+	logger.Infof("attachToTangle interception configured with max bundle txs limit of %d\n", s.maxTxInBundle)
+	if !powConfigured {
+		name, s.powFn = fastestPoWFunc()
+	}
+	s.powName = name
+	logger.Infof("using proof of work method: %s\n", name)
+	if name == powMock {
+		logger.Warnf("the mock PoW backend doesn't produce valid nonces, don't use it in production\n")
+	}
+	if s.powChain != nil {
+		s.powInterrupt = s.powChain.Interrupt
+	} else {
+		s.powInterrupt = backendStopper(name)
+		s.powFn = lockedPoW(name, s.powFn, s.powProcs)
+	}
+	cfgErrs.Add(s.selfTestPoW())
+	if s.checkpoints != nil {
+		c.OnStartup(s.checkpoints.Start)
+	}
+	if s.capture != nil {
+		c.OnStartup(s.capture.Start)
+	}
+	if s.powWorkers != nil {
+		s.powWorkers.name, s.powWorkers.pow = name, s.powFn
+		s.powFn = s.powWorkers.Pow
+		c.OnStartup(s.powWorkers.Start)
+		c.OnShutdown(s.powWorkers.Stop)
+	}
+	if s.verifier != nil {
+		logger.Infof("verifying %v%% of the computed nonces with %s\n", s.verifier.percent, s.verifier.backend)
+	}
+	if s.samplePercent < 100 {
+		logger.Infof("handling %v%% of attachToTangle requests locally, forwarding the rest\n", s.samplePercent)
+	}
+	logger.Infof("attaching for %s with min weight magnitude %d (allowed %d-%d)\n", s.network.name, s.network.defaultMWM, s.network.minMWM, s.network.maxMWM)
+	if s.signer != nil {
+		logger.Infof("attachToTangle requires HMAC signed requests\n")
+	}
+	if s.debugCreds != nil {
+		logger.Infof("debug endpoints enabled under %s\n", debugPathPrefix)
+	}
+	if s.jwtAuthz != nil {
+		if (s.jwtAuthz.secret == nil) == (s.jwtAuthz.jwksURL == "") {
+			cfgErrs.Add(ErrJWTKeySource)
+		}
+		logger.Infof("attachToTangle requires a bearer token\n")
+	}
+	if s.apiKeys != nil {
+		logger.Infof("attachToTangle requires one of %d API keys\n", len(s.apiKeys.keys))
+	}
+	if s.apiKeys != nil {
+		for _, key := range s.apiKeys.keys {
+			if _, ok := s.pools[key.pool]; key.pool != "" && !ok {
+				cfgErrs.Add(errors.Wrapf(ErrUnknownPool, "%s of key %s", key.pool, key.name))
+			}
+		}
+	}
+	if s.bundleDB != nil {
+		if s.statsCreds == nil {
+			cfgErrs.Add(ErrBundleDBWithoutStats)
+		}
+		c.OnStartup(s.bundleDB.Start)
+		c.OnShutdown(s.bundleDB.Stop)
+		logger.Infof("storing attached bundles in %s, queryable under %s\n", s.bundleDB.path, bundlesPath)
+	}
+	if s.events != nil {
+		c.OnStartup(s.events.Start)
+		c.OnShutdown(s.events.Stop)
+		for _, sink := range s.events.sinks {
+			logger.Infof("publishing attach events to %s\n", sink.String())
+		}
+	}
+	if s.history != nil {
+		if s.apiKeys == nil {
+			cfgErrs.Add(ErrHistoryWithoutAPIKeys)
+		}
+		logger.Infof("keeping the last %d attach jobs per API key under %s\n", s.history.entries, historyPath)
+	}
+	if err := cfgErrs.Err(); err != nil {
+		return err
+	}
+	s.scheduler = schedulerFor(schedulerName, schedulerJobs)
+	for pool, shares := range s.pools {
+		s.scheduler.SetPool(pool, shares)
+		logger.Infof("giving the %s pool %d CPU shares in the %s scheduler\n", pool, shares, schedulerName)
+	}
+	if schedulerName != defaultSchedulerName {
+		logger.Infof("queueing PoW jobs in the %s scheduler\n", schedulerName)
 	}
-	logger.Printf("attachToTangle interception configured with max bundle txs limit of %d\n", maxTxInBundle)
-	logger.Printf("using proof of work method: %s\n", name)
 	cfg := httpserver.GetConfig(c)
+	if s.certAuth != nil {
+		if err := s.certAuth.Apply(cfg); err != nil {
+			return err
+		}
+		logger.Infof("attachToTangle requires a TLS client certificate (%d allowed subjects)\n", len(s.certAuth.subjects))
+	}
+	if s.clockCheck != nil {
+		c.OnStartup(s.clockCheck.Start)
+	}
+	if s.results != nil {
+		s.results.history, s.results.reservations = s.history, s.reservations
+		c.OnStartup(s.results.Start)
+		c.OnShutdown(s.results.Stop)
+	}
+	for _, file := range s.configFiles {
+		c.OnStartup(file.Start)
+		c.OnShutdown(file.Stop)
+	}
+	for _, file := range persistedStats {
+		c.OnStartup(file.Start)
+		c.OnShutdown(file.Stop)
+	}
+	if s.clientRules != nil {
+		c.OnStartup(s.clientRules.Start)
+		c.OnShutdown(s.clientRules.Stop)
+	}
+	front := s.grpcFront
+	if front != nil {
+		c.OnStartup(front.Start)
+		c.OnShutdown(front.Stop)
+	}
 	mid := func(next httpserver.Handler) httpserver.Handler {
-		return AttachToTangleHandler{Next: next}
+		handler := AttachToTangleHandler{Next: next, site: s}
+		if front != nil {
+			front.handler = &handler
+		}
+		return handler
 	}
 	cfg.AddMiddleware(mid)
 	return nil
@@ -74,82 +956,429 @@ func setup(c *caddy.Controller) error {
 
 type AttachToTangleHandler struct {
 	Next httpserver.Handler
+	site *site
 }
 
-type AttachToTangleCmd struct {
-	Command      string         `json:"command"`
-	TrunkTxHash  giota.Trytes   `json:"trunkTransaction"`
-	BranchTxHash giota.Trytes   `json:"branchTransaction"`
-	MWM          int            `json:"minWeightMagnitude"`
-	Trytes       []giota.Trytes `json:"trytes"`
+// forward hands a request which isn't handled by the plugin to the upstream node.
+func (h AttachToTangleHandler) forward(w http.ResponseWriter, r *http.Request) (int, error) {
+	if h.site.upstream != nil {
+		return h.site.upstream.ServeHTTP(w, r)
+	}
+	h.site.upstreamOpts.Authorize(r)
+	return h.Next.ServeHTTP(w, r)
 }
 
-type AttachToTangleRes struct {
-	Trytes   []giota.Trytes `json:"trytes"`
-	Duration int64          `json:"duration"`
+type AttachToTangleCmd struct {
+	Command      string   `json:"command"`
+	TrunkTxHash  Trytes   `json:"trunkTransaction"`
+	BranchTxHash Trytes   `json:"branchTransaction"`
+	MWM          int      `json:"minWeightMagnitude"`
+	Trytes       []Trytes `json:"trytes"`
+	// Force skips the replay protection for bundles which were already attached
+	Force bool `json:"force,omitempty"`
+	// Reservation is a token obtained via canAttach
+	Reservation string `json:"reservation,omitempty"`
 }
 
+// includeHashesHeader lets clients ask for the transaction and bundle hashes in the response
+const includeHashesHeader = "X-Attach-Include-Hashes"
+
 const attachToTangleCommand = "attachToTangle"
 
-var mu = sync.Mutex{}
+// handledLocally reports whether the command is answered by the plugin instead of the node.
+func (s *site) handledLocally(command string) bool {
+	return command == attachToTangleCommand || (s.canAttachEnabled && command == canAttachCommand) ||
+		(s.validateBundleEnabled && command == validateBundleCommand) ||
+		(s.preattach != nil && command == getPreattachedCommand) ||
+		(s.results != nil && command == getAttachResultCommand) || s.cache.Cached(command) ||
+		(s.partials != nil && command == resumeAttachCommand) ||
+		(s.helperCommands && (command == promoteTransactionCommand || command == reattachCommand)) ||
+		(s.maxBatchBundles > 0 && command == attachToTangleBatchCommand) || s.nodeType.Unsupported(command)
+}
+
+func (h AttachToTangleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) (status int, err error) {
+	requestID(r)
+	h.site.stampPoweredBy(w)
+	defer h.site.recoverAttach(w, r, &status, &err)
+	status, err = h.serveAttach(w, r)
+	if status >= http.StatusBadRequest {
+		// a refused MWM is answered as JSON so that clients can read the max to retry with
+		if _, ok := maxMWMOf(err); h.site.errorCodes || (h.site.mwmNegotiation && ok) {
+			h.site.writeCodedError(w, r, status, err)
+			return 0, nil
+		}
+	}
+	return status, err
+}
+
+func (h AttachToTangleHandler) serveAttach(w http.ResponseWriter, r *http.Request) (status int, err error) {
+	s := h.site
+	requestStart := time.Now()
+	if s.isDebugRequest(r) {
+		return s.serveDebug(w, r)
+	}
+
+	if s.isStatsRequest(r) {
+		return s.serveStats(w, r)
+	}
+
+	if s.isPublicKeyRequest(r) {
+		return s.servePublicKey(w)
+	}
+
+	if s.isLimitsRequest(r) {
+		return s.serveLimits(w, r)
+	}
 
-func (h AttachToTangleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
-	if r.Method != http.MethodPost {
+	if s.isInfoRequest(r) {
+		return s.serveInfo(w)
+	}
+
+	if s.isHistoryRequest(r) {
+		return s.serveHistory(w, r)
+	}
+
+	if s.isBundlesRequest(r) {
+		return s.serveBundles(w, r)
+	}
+
+	if s.isProgressRequest(r) {
+		return s.serveProgress(w, r)
+	}
+
+	if s.answersMethod(r) {
+		return s.serveMethod(w, r)
+	}
+
+	if !s.inspected(r) {
 		return h.Next.ServeHTTP(w, r)
 	}
 
+	if s.requireJSON && !s.acceptedContentType(r) {
+		return http.StatusUnsupportedMediaType, ErrUnsupportedContentType
+	}
+
 	if r.Body == nil {
 		return http.StatusBadRequest, ErrMissingBody
 	}
 
-	contents, err := ioutil.ReadAll(r.Body)
-	if err != nil {
+	br := getBodyReader(r.Body)
+	defer putBodyReader(br)
+
+	if s.msgpackEnabled && isMsgpack(r) {
+		contents, err := ioutil.ReadAll(br)
+		if err != nil {
+			return http.StatusBadRequest, ErrMissingBody
+		}
+		return h.serveMsgpack(w, r, contents)
+	}
+
+	if s.tryteEncodingEnabled && r.Header.Get(tryteEncodingHeader) != "" {
+		contents, err := ioutil.ReadAll(br)
+		if err != nil {
+			return http.StatusBadRequest, ErrMissingBody
+		}
+		return h.serveTryteEncoded(w, r, contents)
+	}
+
+	if s.jsonRPC {
+		if version, ok := peekField(br, "jsonrpc"); ok && version == jsonRPCVersion {
+			contents, err := ioutil.ReadAll(br)
+			if err != nil {
+				return http.StatusBadRequest, ErrMissingBody
+			}
+			return h.serveJSONRPC(w, r, contents)
+		}
+	}
+
+	// other commands are passed through without buffering the whole body unless they are validated
+	if cmd, ok := peekCommand(br); ok && !s.handledLocally(cmd) && (s.maxArraySize == 0 || commandSchemas[cmd] == nil) && s.arrayLimits[cmd] == 0 {
+		r.Body = peekedBody{br, r.Body}
+		return h.forward(w, r)
+	}
+
+	buf := getBodyBuffer()
+	defer putBodyBuffer(buf)
+	if _, err := buf.ReadFrom(br); err != nil {
 		return http.StatusBadRequest, ErrMissingBody
 	}
+	// contents is only valid until the buffer goes back to the pool
+	contents := buf.Bytes()
 
-	command := &AttachToTangleCmd{}
-	err = json.NewDecoder(bytes.NewReader(contents)).Decode(&command);
+	if s.maxArraySize > 0 {
+		if err := s.validateCommand(contents); err != nil {
+			return s.rejectInvalidCommand(w, err)
+		}
+	} else if len(s.arrayLimits) > 0 {
+		if err := s.checkArraySizes(contents); err != nil {
+			return s.rejectInvalidCommand(w, err)
+		}
+	}
+
+	ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, parseSpan := startSpan(ctx, "attach.parse", attribute.Int("http.request_content_length", len(contents)))
+	command, err := ParseAttachToTangleCmd(contents)
 	// re-add body
 	r.Body = ioutil.NopCloser(bytes.NewReader(contents))
+	parseSpan.End()
 	if err != nil {
 		// instead of aborting, send it further to IRI
-		return h.Next.ServeHTTP(w, r)
+		return h.forward(w, r)
+	}
+
+	if s.capture != nil && s.handledLocally(command.Command) {
+		var rec *captureRecorder
+		if rec, ctx = s.capture.Begin(ctx, w, r, command.Command, contents); rec != nil {
+			w, r = rec, r.WithContext(ctx)
+			defer func() { s.capture.Finish(rec, status, err) }()
+		}
+	}
+
+	if s.handledLocally(command.Command) && !s.negotiateAPIVersion(w, r) {
+		return 0, nil
+	}
+
+	if s.nodeType.Unsupported(command.Command) {
+		logger.Debugf("answering unsupported %s command %s locally\n", s.nodeType.name, command.Command)
+		s.writeError(w, http.StatusBadRequest, errors.Errorf("Command [%s] is unknown", command.Command))
+		return 0, nil
+	}
+
+	if s.cache.Cached(command.Command) {
+		return h.serveCached(w, r, command.Command, contents)
+	}
+
+	if s.canAttachEnabled && command.Command == canAttachCommand {
+		ctx, span := startSpan(ctx, canAttachCommand)
+		defer span.End()
+		return s.serveCanAttach(w, r.WithContext(ctx), span, contents)
+	}
+
+	if s.validateBundleEnabled && command.Command == validateBundleCommand {
+		ctx, span := startSpan(ctx, validateBundleCommand)
+		defer span.End()
+		return s.serveValidateBundle(w, r.WithContext(ctx), span, contents)
+	}
+
+	if s.helperCommands && (command.Command == promoteTransactionCommand || command.Command == reattachCommand) {
+		ctx, span := startSpan(ctx, command.Command)
+		defer span.End()
+		return s.servePromote(w, r.WithContext(ctx), span, contents)
+	}
+
+	if s.preattach != nil && command.Command == getPreattachedCommand {
+		ctx, span := startSpan(ctx, getPreattachedCommand)
+		defer span.End()
+		return s.serveGetPreattached(w, r.WithContext(ctx), span, contents)
+	}
+
+	if s.results != nil && command.Command == getAttachResultCommand {
+		return s.serveGetAttachResult(w, r, contents)
+	}
+
+	if s.partials != nil && command.Command == resumeAttachCommand {
+		return h.serveResumeAttach(w, r, contents)
+	}
+
+	if s.maxBatchBundles > 0 && command.Command == attachToTangleBatchCommand {
+		ctx, span := startSpan(ctx, attachToTangleBatchCommand)
+		defer span.End()
+		return h.serveBatch(w, r.WithContext(ctx), span, contents)
 	}
 
 	// only intercept attachToTangle command
 	if command.Command != attachToTangleCommand {
-		return h.Next.ServeHTTP(w, r)
+		return h.forward(w, r)
 	}
 
-	// only allow one PoW at a time
-	// we could lock later but for keeping log order we do it from here
-	mu.Lock()
-	defer mu.Unlock()
+	// during a gradual rollout only a share of the requests is handled locally
+	if s.samplePercent < 100 && rand.Float64()*100 >= s.samplePercent {
+		logger.Debugf("forwarding attachToTangle request to the node (sample_percent %v)\n", s.samplePercent)
+		return h.forward(w, r)
+	}
+
+	window := s.activeWindow(time.Now())
+	if window != nil && window.passthrough {
+		logger.Debugf("forwarding attachToTangle request to the node during a passthrough schedule window\n")
+		return h.forward(w, r)
+	}
 
+	ctx, span := startSpan(ctx, "attachToTangle", attribute.String("net.peer.addr", s.anonymizer.Addr(s.clientHost(r))))
+	defer span.End()
 
 	trunkTxHash := command.TrunkTxHash
 	branchTxHash := command.BranchTxHash
 	txTrytes := command.Trytes
 
 	if len(txTrytes) == 0 {
-		return h.Next.ServeHTTP(w, r)
+		return h.forward(w, r)
+	}
+
+	metricsReg.Inc(metricAttachRequests)
+	histograms.Observe(command.MWM, len(txTrytes))
+	source := s.clientHost(r)
+	agent := userAgentProduct(r)
+	agentStats.Request(agent)
+	// the activity is recorded once it is known who the client is, authenticated
+	// clients by their identity and others by their address
+	sources, statsSource, rejected := s.sourceStatsOf(), source, false
+	defer func() {
+		sources.Request(statsSource)
+		if rejected {
+			sources.Rejected(statsSource)
+		}
+	}()
+
+	// reject accounts for a refused request before returning the error
+	reject := func(status int, err error) (int, error) {
+		s.countRejection(err)
+		rejected = true
+		agentStats.Rejected(agent)
+		spanError(span, err)
+		return status, err
+	}
+
+	// authorization and quotas are checked before queueing up for the PoW lock
+	grant, batched := batchGrant(r)
+	if !batched {
+		mode := admitCharge
+		if command.Reservation != "" {
+			if !s.reservations.Redeem(command.Reservation, len(txTrytes), s.network.MWM(command.MWM)) {
+				return reject(http.StatusForbidden, ErrInvalidReservation)
+			}
+			mode = admitReserved
+		}
+		grant, status, err = s.admitAttach(w, r, span, contents, attachToTangleCommand, len(txTrytes), command.MWM, mode)
+		if err != nil {
+			return reject(status, err)
+		}
+	}
+	if grant.identity != "" {
+		statsSource = grant.identity
 	}
 
-	logger.Printf("new attachToTangle request from %s\n", r.RemoteAddr)
-	if len(txTrytes) > maxTxInBundle {
-		logger.Printf("canceling request as it exceeds the txs limit (%d>%d)\n", len(txTrytes), maxTxInBundle)
-		return http.StatusBadRequest, errors.Wrapf(ErrTxBundleLimitExceeded, "max allowed is %d", maxTxInBundle)
+	if status, err = s.authorizeExternally(r, grant, source, command.MWM, txTrytes); err != nil {
+		return reject(status, err)
 	}
-	start := time.Now().UnixNano()
+	if grant, err = s.applyBundleRules(grant, txTrytes); err != nil {
+		return reject(http.StatusForbidden, err)
+	}
+	if grant, err = s.checkSpam(grant, source, txTrytes); err != nil {
+		return reject(http.StatusTooManyRequests, err)
+	}
+	if grant, status, err = s.applyPolicyHook(r, grant, source, command.MWM, txTrytes); err != nil {
+		return reject(status, err)
+	}
+
+	releaseJob, err := s.acquireJob(command.Command, grant.identity, source)
+	if err != nil {
+		return reject(http.StatusTooManyRequests, err)
+	}
+	defer releaseJob()
+
+	// the result, partial result and progress of the job are the client's, under the
+	// request ID it sent or the one generated for it, which is handed back
+	owner := s.jobOwner(grant.identity, r)
+	w.Header().Set(requestIDHeader, requestID(r))
+	job := s.history.Start(grant.identity, requestID(r), len(txTrytes))
+	if s.progress != nil {
+		s.progress.Begin(jobKey(owner, requestID(r)), owner, len(txTrytes))
+	}
+	defer func() {
+		s.history.Finish(job, status, err)
+		if s.progress != nil {
+			s.progress.Finish(jobKey(owner, requestID(r)), jobStatus(status, err))
+		}
+	}()
+
+	if s.chaos != nil {
+		if status := s.chaos.Fail(); status != 0 {
+			s.writeError(w, status, ErrChaos)
+			return 0, nil
+		}
+		s.chaos.Delay()
+	}
+
+	// only allow as many PoWs at a time as the scheduler runs
+	// we could lock later but for keeping log order we do it from here
+	_, queueSpan := startSpan(ctx, "attach.queue_wait")
+	queueStart := time.Now()
+	s.scheduler.Acquire(grant.priority, grant.pool, len(txTrytes))
+	defer s.scheduler.Release()
+	queueSpan.End()
+	queueWait := time.Since(queueStart)
+
+	logger.Requestf("new attachToTangle request %s from %s\n", requestID(r), s.anonymizer.Addr(s.clientHost(r)))
+	logger.Debugf("parsed command: trunk=%s branch=%s mwm=%d txs=%d body=%d bytes\n",
+		trunkTxHash, branchTxHash, command.MWM, len(txTrytes), len(contents))
+	span.SetAttributes(attribute.Int("attach.txs", len(txTrytes)))
+	_, validateSpan := startSpan(ctx, "attach.validate")
+	if len(txTrytes) > grant.txLimit {
+		logger.Warnf("canceling request as it exceeds the txs limit (%d>%d)\n", len(txTrytes), grant.txLimit)
+		validateSpan.End()
+		return reject(http.StatusBadRequest, errors.Wrapf(ErrTxBundleLimitExceeded, "max allowed is %d", grant.txLimit))
+	}
+	if err := s.checkTrytesSize(txTrytes, grant.txLimit); err != nil {
+		logger.Warnf("canceling request as its trytes exceed the size limit\n")
+		validateSpan.End()
+		return reject(http.StatusBadRequest, err)
+	}
+	if err := s.sanitizeTrytes(command); err != nil {
+		validateSpan.End()
+		return reject(http.StatusBadRequest, err)
+	}
+	trunkTxHash, branchTxHash = command.TrunkTxHash, command.BranchTxHash
+	if err := s.network.ValidateTips(trunkTxHash, branchTxHash); err != nil {
+		validateSpan.End()
+		return reject(http.StatusBadRequest, err)
+	}
+	tipsStatus := tipsUnchecked
+	if s.tipCheck != nil {
+		fresh, err := s.tipCheck.Fresh(trunkTxHash, branchTxHash)
+		switch {
+		case err != nil:
+			tipsStatus = tipsCheckFailed
+			// don't block attaching because of upstream hiccups
+			logger.Warnf("unable to check tips freshness: %s\n", err.Error())
+		case !fresh && !s.tipCheck.reselect:
+			validateSpan.End()
+			return reject(http.StatusBadRequest, ErrStaleTips)
+		case !fresh:
+			trunk, branch, err := s.selectTips(s.tipCheck.depth)
+			if err != nil {
+				validateSpan.End()
+				logger.Warnf("unable to select fresh tips: %s\n", err.Error())
+				return reject(http.StatusBadGateway, errors.Wrap(ErrStaleTips, err.Error()))
+			}
+			logger.Requestf("replaced stale tips with trunk %s and branch %s\n", trunk, branch)
+			trunkTxHash, branchTxHash = trunk, branch
+			tipsStatus = tipsReselected
+			span.SetAttributes(attribute.Bool("attach.tips_reselected", true))
+		default:
+			tipsStatus = tipsValidated
+		}
+	}
+	if s.tipHeaders != nil {
+		s.tipHeaders.Set(w, tipsStatus)
+	}
+	start := time.Now()
 
 	var isValueTransaction bool
 	var inputValue int64
-	transactions := []giota.Transaction{}
-	logger.Printf("transactions:\n")
+	transactions := []Tx{}
+	logger.Requestf("transactions:\n")
 	for i := len(txTrytes) - 1; i >= 0; i-- {
-		tx, err := giota.NewTransaction(txTrytes[i])
+		tx, err := parseTransaction(txTrytes[i])
 		if err != nil {
-			return http.StatusBadRequest, ErrBuildingTx
+			validateSpan.End()
+			return reject(http.StatusBadRequest, ErrBuildingTx)
+		}
+		if s.timestampWindow > 0 {
+			if skew := time.Since(tx.Timestamp); skew > s.timestampWindow || skew < -s.timestampWindow {
+				validateSpan.End()
+				logger.Warnf("canceling request as tx %d has an implausible timestamp (%s)\n", tx.CurrentIndex, tx.Timestamp)
+				return reject(http.StatusBadRequest, errors.Wrapf(ErrImplausibleTimestamp, "allowed window is %s", s.timestampWindow))
+			}
 		}
 		if tx.Value > 0 {
 			isValueTransaction = true
@@ -158,15 +1387,32 @@ func (h AttachToTangleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 			inputValue += tx.Value
 		}
 		// print out address
-		logger.Printf("%s - %d\n", tx.Address, tx.Value)
+		logger.Requestf("%s - %d\n", tx.Address, tx.Value)
 		transactions = append(transactions, *tx)
 	}
 
 	if isValueTransaction {
-		logger.Printf("bundle is using %d IOTAs as input\n", int64(math.Abs(float64(inputValue))))
+		logger.Requestf("bundle is using %d IOTAs as input\n", int64(math.Abs(float64(inputValue))))
 	}
 
-	logger.Printf("bundle: %s\n", transactions[0].Bundle)
+	logger.Requestf("bundle: %s\n", transactions[0].Bundle)
+	bundleHash := string(transactions[0].Bundle)
+	if job != nil {
+		job.Bundle = bundleHash
+	}
+	if s.replay != nil && !command.Force {
+		seen, err := s.replay.store.Seen(bundleHash)
+		if err != nil {
+			logger.Warnf("unable to look up attached bundles: %s\n", err.Error())
+		}
+		if seen {
+			validateSpan.End()
+			logger.Warnf("canceling request as bundle %s was already attached\n", bundleHash)
+			return reject(http.StatusBadRequest, ErrBundleAlreadyAttached)
+		}
+	}
+	validateSpan.End()
+	span.SetAttributes(attribute.String("attach.bundle", bundleHash))
 
 
 	bundle := &Transaction{
@@ -175,24 +1421,169 @@ func (h AttachToTangleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		Transactions: transactions,
 	}
 
-	logger.Printf("doing pow for bundle with %d txs (value tx=%v)\n", len(transactions), isValueTransaction)
-	s := time.Now().UnixNano()
-	doPow(bundle, bundle.Transactions, 14, powFn)
-	logger.Printf("took %dms to do pow for bundle with %d txs\n", (time.Now().UnixNano()-s)/1000000, len(transactions))
+	mwm := s.network.MWM(command.MWM)
+	logger.Requestf("doing pow for bundle with %d txs (value tx=%v, mwm=%d)\n", len(transactions), isValueTransaction, mwm)
+	var shadowCh <-chan *shadowResult
+	if s.shadowPrimary != "" {
+		// the shadow request may outlive the handler and with it the pooled body
+		shadowCh = s.shadowAttach(r, append([]byte(nil), contents...))
+	}
+	powStart := time.Now().UnixNano()
+	powCtx, powSpan := startSpan(ctx, "attach.pow")
+	if s.results != nil {
+		// the result is kept for the client even if it goes away meanwhile
+		powCtx = detachContext(powCtx)
+	}
+	resume := resumeOf(r.Context())
+	var cp *checkpoint
+	if s.checkpoints != nil {
+		cp = s.checkpoints.Open(bundle, bundle.Transactions, int64(mwm))
+	} else if s.partials != nil {
+		cp = newCheckpoint()
+	}
+	if cp != nil {
+		if resume != nil {
+			cp.Merge(resume.done)
+		}
+		powCtx = withCheckpoint(powCtx, cp)
+	}
+	txPoWMs := make([]int64, len(bundle.Transactions))
+	progress := attachProgress(r.Context())
+	var powDone int
+	onTx := func(i int, took time.Duration) {
+		txPoWMs[i] = int64(took / time.Millisecond)
+		powDone++
+		s.history.Progress(job, powDone)
+		if s.progress != nil {
+			s.progress.Progress(jobKey(owner, requestID(r)), powDone)
+		}
+		if progress != nil {
+			progress(powDone, len(txPoWMs))
+		}
+	}
+	powFn := s.doPow
+	if s.nodeFallback != nil {
+		var cancel context.CancelFunc
+		powCtx, cancel = s.nodeFallback.powContext(powCtx)
+		defer cancel()
+		powFn = s.doPowRecovered
+	}
+	if err := powFn(powCtx, bundle, bundle.Transactions, int64(mwm), s.powFn, onTx); err != nil {
+		failSpan(powSpan, err)
+		metricsReg.Inc(metricAttachErrors)
+		logger.Errorf("pow for bundle %s failed: %s\n", bundleHash, err.Error())
+		alerts.Fire(eventPoWFailed, "pow for bundle %s failed with backend %s: %s", bundleHash, s.activePoW(), err.Error())
+		if s.partials != nil && len(cp.done) > 0 {
+			id := requestID(r)
+			if resume != nil {
+				id = resume.requestID
+			}
+			partial := &AttachToTangleCmd{Command: attachToTangleCommand, TrunkTxHash: bundle.Trunk, BranchTxHash: bundle.Branch, MWM: command.MWM, Trytes: command.Trytes}
+			s.partials.Add(jobKey(owner, id), owner, partial, cp.Attached())
+			s.history.Attached(job, cp.Attached())
+			err = errors.Wrapf(err, "%d of %d transactions attached, continue with %s for request %s", len(cp.done), len(transactions), resumeAttachCommand, id)
+		}
+		if shadowCh != nil && s.shadowPrimary == shadowPrimaryNode {
+			if nodeRes := <-shadowCh; nodeRes.err == nil && nodeRes.status == http.StatusOK {
+				w.Header().Set(contentType, contentTypeJSON)
+				w.Header().Set("access-control-allow-origin", "*")
+				w.Write(nodeRes.body)
+				return http.StatusOK, nil
+			}
+		}
+		if s.nodeFallback != nil {
+			return h.forwardAfterFailure(w, r)
+		}
+		return http.StatusInternalServerError, errors.Wrap(ErrPoWFailed, err.Error())
+	}
+	if s.verifier != nil {
+		if err := s.verifier.Verify(bundle.Transactions, mwm); err != nil {
+			failSpan(powSpan, err)
+			metricsReg.Inc(metricAttachErrors)
+			if s.nodeFallback != nil {
+				return h.forwardAfterFailure(w, r)
+			}
+			return http.StatusInternalServerError, err
+		}
+	}
+	powSpan.End()
+	powMs := (time.Now().UnixNano() - powStart) / 1000000
+	logger.Requestf("took %dms to do pow for bundle with %d txs\n", powMs, len(transactions))
+	metricsReg.Inc(metricAttachBundles)
+	metricsReg.Add(metricAttachTxs, int64(len(transactions)))
+	metricsReg.Add(metricAttachPoWTime, powMs)
+	recordKeyUsage(grant.identity, len(transactions), powMs)
+	s.scheduler.pressure.Observe(len(transactions), time.Duration(powMs)*time.Millisecond)
+	hashRate.Observe(estimatedHashes(len(transactions), mwm), time.Duration(powMs)*time.Millisecond)
+	sources.PoW(statsSource, powMs)
+	agentStats.PoW(agent, powMs)
+	if s.replay != nil {
+		if err := s.replay.store.Add(bundleHash, s.replay.ttl); err != nil {
+			logger.Warnf("unable to remember attached bundle %s: %s\n", bundleHash, err.Error())
+		}
+	}
+	client := grant.identity
+	if client == "" {
+		client = s.anonymizer.Addr(source)
+	}
+	if s.bundleDB != nil {
+		if err := s.bundleDB.Add(bundleHash, client, mwm, bundle.Transactions); err != nil {
+			logger.Warnf("unable to store attached bundle %s: %s\n", bundleHash, err.Error())
+		}
+	}
+	if s.events != nil {
+		s.events.Publish(newAttachEvent(bundleHash, client, mwm, bundle.Transactions, time.Since(requestStart)))
+	}
 
 	// construct response
-	trytesRes := []giota.Trytes{}
-	for _, tx := range bundle.Transactions {
-		trytesRes = append(trytesRes, tx.Trytes())
+	_, resSpan := startSpan(ctx, "attach.build_response")
+	defer resSpan.End()
+	durations := &attachDurations{
+		body:  time.Since(start),
+		total: time.Since(requestStart),
+		queue: queueWait,
+		pow:   time.Duration(powMs) * time.Millisecond,
 	}
-
-	res := &AttachToTangleRes{Trytes: trytesRes, Duration: (time.Now().UnixNano() - start) / 1000000}
+	res := s.newAttachResponse(w, r, bundle.Transactions, durations, txPoWMs)
 
 	resBytes, err := json.Marshal(res)
 	if err != nil {
+		metricsReg.Inc(metricAttachErrors)
+		resSpan.RecordError(err)
 		return http.StatusInternalServerError, ErrBuildingRes
 	}
 
+	if shadowCh != nil {
+		localTrytes := make([]Trytes, len(bundle.Transactions))
+		for i := range bundle.Transactions {
+			localTrytes[i] = bundle.Transactions[i].Trytes()
+		}
+		if s.shadowPrimary == shadowPrimaryLocal {
+			go func() {
+				compareShadow(bundleHash, localTrytes, <-shadowCh, mwm)
+			}()
+		} else {
+			nodeRes := <-shadowCh
+			compareShadow(bundleHash, localTrytes, nodeRes, mwm)
+			// the local result stands in if the node failed
+			if nodeRes.err == nil && nodeRes.status == http.StatusOK {
+				resBytes = nodeRes.body
+			}
+		}
+	}
+
+	if s.chaos != nil {
+		resBytes = s.chaos.Truncate(resBytes)
+	}
+
+	if s.results != nil {
+		s.results.Add(owner, jobKey(owner, requestID(r)), bundleHash, resBytes)
+	}
+	if resume != nil {
+		s.partials.Remove(jobKey(owner, resume.requestID))
+	}
+
+	s.signResponse(w, resBytes)
 	w.Header().Set(contentType, contentTypeJSON)
 	w.Header().Set("access-control-allow-origin", "*")
 	w.Write(resBytes)
@@ -206,39 +1597,69 @@ const (
 )
 
 type Tips struct {
-	Trunk, Branch         giota.Transaction
-	TrunkHash, BranchHash giota.Trytes
+	Trunk, Branch         Tx
+	TrunkHash, BranchHash Trytes
 }
 
 type Transaction struct {
-	Trunk, Branch giota.Trytes
-	Transactions  []giota.Transaction
+	Trunk, Branch Trytes
+	Transactions  []Tx
 }
 
-func doPow(tra *Transaction, tx []giota.Transaction, mwm int64, pow giota.PowFunc) error {
-	var prev giota.Trytes
+// doPow attaches the transactions in tx to the tips in tra. onTx, if not nil, is called
+// with the index and PoW duration after each transaction is done. the PoW stops between
+// transactions and within the nonce search of the backend once ctx is done.
+func (s *site) doPow(ctx context.Context, tra *Transaction, tx []Tx, mwm int64, pow PowFunc, onTx func(i int, took time.Duration)) error {
+	cp := checkpointOf(ctx)
+	if cp == nil && s.checkpoints != nil {
+		cp = s.checkpoints.Open(tra, tx, mwm)
+	}
+	var prev Trytes
 	var err error
 	for i := len(tx) - 1; i >= 0; i-- {
-		switch {
-		case i == len(tx)-1:
-			tx[i].TrunkTransaction = tra.Trunk
-			tx[i].BranchTransaction = tra.Branch
-		default:
-			tx[i].TrunkTransaction = prev
-			tx[i].BranchTransaction = tra.Trunk
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		trunk, branch := prev, tra.Trunk
+		if i == len(tx)-1 {
+			trunk, branch = tra.Trunk, tra.Branch
+		}
+		if cp != nil {
+			if restored, ok := cp.Restore(i, trunk, branch, mwm); ok {
+				tx[i] = *restored
+				if onTx != nil {
+					onTx(i, 0)
+				}
+				prev = tx[i].Hash()
+				continue
+			}
 		}
+		tx[i].TrunkTransaction = trunk
+		tx[i].BranchTransaction = branch
 
-		timestamp := giota.Int2Trits(time.Now().UnixNano()/1000000, giota.TimestampTrinarySize).Trytes()
-		tx[i].AttachmentTimestamp = timestamp
-		tx[i].AttachmentTimestampLowerBound = ""
-		tx[i].AttachmentTimestampUpperBound = maxTimestampTrytes
-		tx[i].Nonce, err = pow(tx[i].Trytes(), int(mwm))
+		tx[i].AttachmentTimestamp = intToTrytes(s.attachTimestamps.Timestamp(&tx[i]), timestampTrinarySize/3)
+		tx[i].AttachmentTimestampLowerBound = s.network.timestampLowerBound
+		tx[i].AttachmentTimestampUpperBound = s.network.timestampUpperBound
+		_, txSpan := startSpan(ctx, "attach.pow_tx", attribute.Int("attach.tx_index", i))
+		txStart := time.Now()
+		tx[i].Nonce, err = s.interruptiblePow(ctx, pow, tx[i].Trytes(), int(mwm))
 
 		if err != nil {
+			failSpan(txSpan, err)
 			return err
 		}
+		txSpan.End()
+		if cp != nil {
+			cp.Save(i, &tx[i])
+		}
+		if onTx != nil {
+			onTx(i, time.Since(txStart))
+		}
 
 		prev = tx[i].Hash()
 	}
+	if cp != nil {
+		cp.Remove()
+	}
 	return nil
 }
@@ -0,0 +1,173 @@
+package attach
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrPolicyDenied = errors.New("the bundle is denied by the policy hook")
+var ErrPolicyHookFailed = errors.New("the policy hook failed, try again later")
+var ErrInvalidPolicyHookOption = errors.New("expected a timeout and exec <program> [args] or http <url> after the policy_hook option")
+
+const metricPolicyHookErrors = "attach.policy_hook_errors"
+
+// the max size of the answer of a hook
+const maxPolicyAnswerSize = 64 * 1024
+
+// bundleMetadata describes an attach request to policy hooks and authorization services.
+type bundleMetadata struct {
+	Command   string   `json:"command"`
+	Identity  string   `json:"identity,omitempty"`
+	Source    string   `json:"source"`
+	UserAgent string   `json:"userAgent,omitempty"`
+	MWM       int      `json:"mwm"`
+	Txs       int      `json:"txs"`
+	ZeroValue bool     `json:"zeroValue"`
+	Addresses []string `json:"addresses"`
+	Tags      []string `json:"tags"`
+}
+
+func newBundleMetadata(r *http.Request, command string, identity string, source string, mwm int, trytes []Trytes) *bundleMetadata {
+	m := &bundleMetadata{Command: command, Identity: identity, Source: source, UserAgent: r.UserAgent(),
+		MWM: mwm, Txs: len(trytes), ZeroValue: true, Addresses: []string{}, Tags: []string{}}
+	addresses, tags := map[string]bool{}, map[string]bool{}
+	for _, tx := range trytes {
+		if len(tx) < txTrytesSize {
+			continue
+		}
+		if tx[txAddressEnd:txValueEnd] != zeroValueTrytes {
+			m.ZeroValue = false
+		}
+		if address := string(tx[txMessageEnd:txAddressEnd]); !addresses[address] {
+			addresses[address] = true
+			m.Addresses = append(m.Addresses, address)
+		}
+		if tag := string(tx[txTagOffset:txTagEnd]); !tags[tag] {
+			tags[tag] = true
+			m.Tags = append(m.Tags, tag)
+		}
+	}
+	return m
+}
+
+// policyDecision is the answer of a hook, e.g. {"decision": "allow", "priority": "low"}.
+type policyDecision struct {
+	// allow or deny
+	Decision string `json:"decision"`
+	// optionally overrides the priority of allowed bundles
+	Priority string `json:"priority,omitempty"`
+	// told to the client of denied bundles
+	Reason string `json:"reason,omitempty"`
+}
+
+// policyHook asks an external program or HTTP endpoint to allow, deny or prioritize each
+// bundle, which enables custom policies without forking the plugin. programs get the
+// bundle metadata as JSON on stdin and answer on stdout, endpoints get it POSTed.
+// bundles are rejected if the hook fails.
+type policyHook struct {
+	timeout time.Duration
+	program []string
+	url     string
+	client  *http.Client
+}
+
+// newPolicyHook parses "<timeout> exec <program> [args]" or "<timeout> http <url>".
+func newPolicyHook(args []string) (*policyHook, error) {
+	if len(args) < 3 {
+		return nil, ErrInvalidPolicyHookOption
+	}
+	timeout, err := time.ParseDuration(args[0])
+	if err != nil || timeout <= 0 {
+		return nil, ErrInvalidPolicyHookOption
+	}
+	h := &policyHook{timeout: timeout}
+	switch {
+	case args[1] == "exec":
+		h.program = args[2:]
+	case args[1] == "http" && len(args) == 3:
+		h.url = args[2]
+		h.client = &http.Client{Timeout: timeout}
+	default:
+		return nil, ErrInvalidPolicyHookOption
+	}
+	return h, nil
+}
+
+func (h *policyHook) ask(input []byte) ([]byte, error) {
+	if h.url != "" {
+		res, err := h.client.Post(h.url, contentTypeJSON, bytes.NewReader(input))
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, errors.Errorf("the hook answered with status %d", res.StatusCode)
+		}
+		return ioutil.ReadAll(http.MaxBytesReader(nil, res.Body, maxPolicyAnswerSize))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, h.program[0], h.program[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	return cmd.Output()
+}
+
+// Decide asks the hook about the bundle.
+func (h *policyHook) Decide(m *bundleMetadata) (*policyDecision, error) {
+	input, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	output, err := h.ask(input)
+	if err != nil {
+		return nil, err
+	}
+	decision := &policyDecision{}
+	if err := json.Unmarshal(output, decision); err != nil {
+		return nil, errors.Wrap(err, "unable to parse the answer of the hook")
+	}
+	if decision.Decision != "allow" && decision.Decision != "deny" {
+		return nil, errors.Errorf("the hook decided %q instead of allow or deny", decision.Decision)
+	}
+	return decision, nil
+}
+
+// applyPolicyHook asks the hook about the bundle and applies its decision to the grant.
+func (s *site) applyPolicyHook(r *http.Request, grant *attachGrant, source string, mwm int, trytes []Trytes) (*attachGrant, int, error) {
+	if s.policyHook == nil {
+		return grant, 0, nil
+	}
+	decision, err := s.policyHook.Decide(newBundleMetadata(r, attachToTangleCommand, grant.identity, source, mwm, trytes))
+	if err != nil {
+		metricsReg.Inc(metricPolicyHookErrors)
+		logger.Errorf("policy hook failed: %s\n", err.Error())
+		return nil, http.StatusServiceUnavailable, ErrPolicyHookFailed
+	}
+	if decision.Decision == "deny" {
+		logger.Warnf("denying bundle of %s by the policy hook: %s\n", s.anonymizer.Addr(source), decision.Reason)
+		if decision.Reason != "" {
+			return nil, http.StatusForbidden, errors.Wrap(ErrPolicyDenied, decision.Reason)
+		}
+		return nil, http.StatusForbidden, ErrPolicyDenied
+	}
+	if decision.Priority == "" {
+		return grant, 0, nil
+	}
+	priority, err := parsePriority(decision.Priority)
+	if err != nil {
+		metricsReg.Inc(metricPolicyHookErrors)
+		logger.Errorf("policy hook failed: %s\n", err.Error())
+		return nil, http.StatusServiceUnavailable, ErrPolicyHookFailed
+	}
+	// the grant may be shared by the bundles of a batch
+	decided := *grant
+	decided.priority = priority
+	return &decided, 0, nil
+}
@@ -0,0 +1,64 @@
+package attach
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var ErrUnknownPoWBackend = errors.New("unknown PoW backend")
+var ErrInvalidMockNonce = errors.New("mock nonce must be 27 valid trytes")
+
+// the PoW backend name of the mock implementation
+const powMock = "mock"
+
+var powRegistryMu sync.Mutex
+
+// custom PoW implementations registered via RegisterPoWFunc
+var customPoWFuncs = map[string]PowFunc{}
+
+// RegisterPoWFunc makes a custom PoW implementation selectable via the pow option.
+// it is the seam for injecting own implementations, e.g. in integration tests. like the
+// built-in ones, implementations should search on a precomputed Curl mid-state, see builtinPoWFuncs.
+func RegisterPoWFunc(name string, fn PowFunc) {
+	powRegistryMu.Lock()
+	defer powRegistryMu.Unlock()
+	customPoWFuncs[name] = fn
+}
+
+// lookupPoWFunc returns the PoW implementation with the given name. custom
+// registrations take precedence over the built-in ones.
+func lookupPoWFunc(name string) (PowFunc, error) {
+	powRegistryMu.Lock()
+	fn, ok := customPoWFuncs[name]
+	powRegistryMu.Unlock()
+	if ok {
+		return fn, nil
+	}
+	if fn, ok := builtinPoWFuncs()[name]; ok {
+		return fn, nil
+	}
+	return nil, errors.Wrap(ErrUnknownPoWBackend, name)
+}
+
+// newMockPoW returns a PoW func which returns instantly. with a fixed nonce every
+// transaction gets that nonce, otherwise the nonce is derived from the transaction's
+// trytes so that the same input always yields the same output. the nonces don't
+// satisfy the min weight magnitude, the mock is only meant for testing clients.
+func newMockPoW(fixedNonce Trytes) (PowFunc, error) {
+	if fixedNonce != "" {
+		if len(fixedNonce) != nonceTrinarySize/3 || fixedNonce.IsValid() != nil {
+			return nil, ErrInvalidMockNonce
+		}
+		return func(Trytes, int) (Trytes, error) {
+			return fixedNonce, nil
+		}, nil
+	}
+	return func(trytes Trytes, mwm int) (Trytes, error) {
+		hash, err := hashTrytes(trytes)
+		if err != nil {
+			return "", err
+		}
+		return hash[:nonceTrinarySize/3], nil
+	}, nil
+}
@@ -0,0 +1,357 @@
+//go:build cgo && (c128_pow || neon_pow)
+// +build cgo
+// +build c128_pow neon_pow
+
+package attach
+
+// the nonce search of PowSSE written with the vector extensions of GCC and clang instead
+// of x86 intrinsics, so that it searches 128 nonces at once on any CPU with 128 bit
+// vectors: SSE2 on amd64 and NEON on ARM, e.g. the Raspberry Pis many powboxes run on.
+
+// #cgo CFLAGS: -O3 -Wall
+/*
+#include <string.h>
+
+typedef unsigned long long v128 __attribute__((vector_size(16)));
+
+#define HBITS 0xFFFFFFFFFFFFFFFFuLL
+#define LBITS 0x0000000000000000uLL
+#define HASH_LENGTH 243
+#define NONCE_LENGTH 81
+#define STATE_LENGTH 3 * HASH_LENGTH
+#define TX_LENGTH 8019
+#define ROUNDS 81
+#define INCR_START HASH_LENGTH - NONCE_LENGTH + 4 + 27
+
+#define LOW00 0xDB6DB6DB6DB6DB6DuLL
+#define HIGH00 0xB6DB6DB6DB6DB6DBuLL
+#define LOW10 0xF1F8FC7E3F1F8FC7uLL
+#define HIGH10 0x8FC7E3F1F8FC7E3FuLL
+#define LOW20 0x7FFFE00FFFFC01FFuLL
+#define HIGH20 0xFFC01FFFF803FFFFuLL
+#define LOW30 0xFFC0000007FFFFFFuLL
+#define HIGH30 0x003FFFFFFFFFFFFFuLL
+#define LOW40 0xFFFFFFFFFFFFFFFFuLL
+#define HIGH40 0xFFFFFFFFFFFFFFFFuLL
+
+#define LOW01 0x6DB6DB6DB6DB6DB6uLL
+#define HIGH01 0xDB6DB6DB6DB6DB6DuLL
+#define LOW11 0xF8FC7E3F1F8FC7E3uLL
+#define HIGH11 0xC7E3F1F8FC7E3F1FuLL
+#define LOW21 0xC01FFFF803FFFF00uLL
+#define HIGH21 0x3FFFF007FFFE00FFuLL
+#define LOW31 0x00000FFFFFFFFFFFuLL
+#define HIGH31 0xFFFFFFFFFFFE0000uLL
+#define LOW41 0x000000000001FFFFuLL
+#define HIGH41 0xFFFFFFFFFFFFFFFFuLL
+
+#define V128(hi, lo) ((v128){(lo), (hi)})
+
+static int indices[STATE_LENGTH + 1];
+
+static void init_indices(void)
+{
+  int i;
+  for (i = 0; i < STATE_LENGTH; i++)
+  {
+    indices[i + 1] = indices[i] + (indices[i] < 365 ? 364 : -365);
+  }
+}
+
+// the transform of a single state of balanced trits
+static void transform(signed char *state)
+{
+  static const signed char truth[11] = {1, 0, -1, 2, 1, -1, 0, 2, -1, 1, 0};
+  signed char cpy[STATE_LENGTH];
+  int r, i;
+  for (r = 0; r < ROUNDS; r++)
+  {
+    memcpy(cpy, state, STATE_LENGTH);
+    for (i = 0; i < STATE_LENGTH; i++)
+    {
+      state[i] = truth[cpy[indices[i]] + (cpy[indices[i + 1]] << 2) + 5];
+    }
+  }
+}
+
+// midstateVec128 absorbs the transaction trits up to the last chunk, which holds the nonce
+void midstateVec128(const signed char *trits, signed char *state)
+{
+  int i;
+  if (indices[1] == 0)
+  {
+    init_indices();
+  }
+  memset(state, 0, STATE_LENGTH);
+  for (i = 0; i < TX_LENGTH - HASH_LENGTH; i += HASH_LENGTH)
+  {
+    memcpy(state, trits + i, HASH_LENGTH);
+    transform(state);
+  }
+  memcpy(state, trits + TX_LENGTH - HASH_LENGTH, HASH_LENGTH);
+}
+
+static void transform128(v128 *lmid, v128 *hmid)
+{
+  int j, r, t1, t2;
+  v128 alpha, beta, gamma, delta;
+  v128 *lto = lmid + STATE_LENGTH, *hto = hmid + STATE_LENGTH;
+  v128 *lfrom = lmid, *hfrom = hmid;
+  for (r = 0; r < ROUNDS - 1; r++)
+  {
+    for (j = 0; j < STATE_LENGTH; j++)
+    {
+      t1 = indices[j];
+      t2 = indices[j + 1];
+      alpha = lfrom[t1];
+      beta = hfrom[t1];
+      gamma = hfrom[t2];
+      delta = (alpha | (~gamma)) & (lfrom[t2] ^ beta);
+      lto[j] = ~delta;
+      hto[j] = (alpha ^ gamma) | delta;
+    }
+    v128 *lswap = lfrom, *hswap = hfrom;
+    lfrom = lto;
+    hfrom = hto;
+    lto = lswap;
+    hto = hswap;
+  }
+  // only the hash part of the last round is checked
+  for (j = 0; j < HASH_LENGTH; j++)
+  {
+    t1 = indices[j];
+    t2 = indices[j + 1];
+    alpha = lfrom[t1];
+    beta = hfrom[t1];
+    gamma = hfrom[t2];
+    delta = (alpha | (~gamma)) & (lfrom[t2] ^ beta);
+    lto[j] = ~delta;
+    hto[j] = (alpha ^ gamma) | delta;
+  }
+}
+
+static int incr128(v128 *mid_low, v128 *mid_high)
+{
+  int i;
+  v128 carry = V128(LOW00, LOW01);
+  for (i = INCR_START; i < HASH_LENGTH && (i == INCR_START || carry[0]); i++)
+  {
+    v128 low = mid_low[i], high = mid_high[i];
+    mid_low[i] = high ^ low;
+    mid_high[i] = low;
+    carry = high & (~low);
+  }
+  return i == HASH_LENGTH;
+}
+
+static void seri128(v128 *low, v128 *high, int n, signed char *r)
+{
+  int i, index = 0;
+  if (n > 63)
+  {
+    n -= 64;
+    index = 1;
+  }
+  for (i = HASH_LENGTH - NONCE_LENGTH; i < HASH_LENGTH; i++)
+  {
+    unsigned long long ll = (low[i][index] >> n) & 1;
+    unsigned long long hh = (high[i][index] >> n) & 1;
+    if (hh == 0 && ll == 1)
+    {
+      r[i + NONCE_LENGTH - HASH_LENGTH] = -1;
+    }
+    if (hh == 1 && ll == 1)
+    {
+      r[i + NONCE_LENGTH - HASH_LENGTH] = 0;
+    }
+    if (hh == 1 && ll == 0)
+    {
+      r[i + NONCE_LENGTH - HASH_LENGTH] = 1;
+    }
+  }
+}
+
+static int check128(v128 *l, v128 *h, int m)
+{
+  int i, j;
+  v128 nonce_probe = V128(HBITS, HBITS);
+  for (i = HASH_LENGTH - m; i < HASH_LENGTH; i++)
+  {
+    nonce_probe &= ~(l[i] ^ h[i]);
+    if (nonce_probe[0] == LBITS && nonce_probe[1] == LBITS)
+    {
+      return -1;
+    }
+  }
+  for (j = 0; j < 2; j++)
+  {
+    for (i = 0; i < 64; i++)
+    {
+      if ((nonce_probe[j] >> i) & 1)
+      {
+        return i + j * 64;
+      }
+    }
+  }
+  return -2;
+}
+
+volatile int stopC128 = 1;
+
+static long long loop128(v128 *lmid, v128 *hmid, int m, signed char *nonce)
+{
+  int n = 0, j = 0;
+  long long i = 0;
+  v128 lcpy[STATE_LENGTH * 2], hcpy[STATE_LENGTH * 2];
+  for (i = 0; !incr128(lmid, hmid) && !stopC128; i++)
+  {
+    for (j = 0; j < STATE_LENGTH; j++)
+    {
+      lcpy[j] = lmid[j];
+      hcpy[j] = hmid[j];
+    }
+    transform128(lcpy, hcpy);
+    if ((n = check128(lcpy + STATE_LENGTH, hcpy + STATE_LENGTH, m)) >= 0)
+    {
+      seri128(lmid, hmid, n, nonce);
+      return i * 128;
+    }
+  }
+  return -i * 128 - 1;
+}
+
+// 01:-1 11:0 10:1
+static void para128(const signed char *in, v128 *l, v128 *h)
+{
+  int i;
+  for (i = 0; i < STATE_LENGTH; i++)
+  {
+    switch (in[i])
+    {
+    case 0:
+      l[i] = V128(HBITS, HBITS);
+      h[i] = V128(HBITS, HBITS);
+      break;
+    case 1:
+      l[i] = V128(LBITS, LBITS);
+      h[i] = V128(HBITS, HBITS);
+      break;
+    case -1:
+      l[i] = V128(HBITS, HBITS);
+      h[i] = V128(LBITS, LBITS);
+      break;
+    }
+  }
+}
+
+// incrN128 moves the start of the nonce search of thread n
+static void incrN128(int n, v128 *mid_low, v128 *mid_high)
+{
+  int i, j;
+  for (j = 0; j < n; j++)
+  {
+    v128 carry = V128(HBITS, HBITS);
+    for (i = HASH_LENGTH * 2 / 3 + 4; i < HASH_LENGTH * 2 / 3 + 4 + 27 && carry[0]; i++)
+    {
+      v128 low = mid_low[i], high = mid_high[i];
+      mid_low[i] = high ^ low;
+      mid_high[i] = low;
+      carry = high & (~low);
+    }
+  }
+}
+
+long long pworkVec128(const signed char *mid, int mwm, signed char *nonce, int n)
+{
+  v128 lmid[STATE_LENGTH], hmid[STATE_LENGTH];
+  int offset = HASH_LENGTH - NONCE_LENGTH;
+
+  para128(mid, lmid, hmid);
+  lmid[offset] = V128(LOW00, LOW01);
+  hmid[offset] = V128(HIGH00, HIGH01);
+  lmid[offset + 1] = V128(LOW10, LOW11);
+  hmid[offset + 1] = V128(HIGH10, HIGH11);
+  lmid[offset + 2] = V128(LOW20, LOW21);
+  hmid[offset + 2] = V128(HIGH20, HIGH21);
+  lmid[offset + 3] = V128(LOW30, LOW31);
+  hmid[offset + 3] = V128(HIGH30, HIGH31);
+  lmid[offset + 4] = V128(LOW40, LOW41);
+  hmid[offset + 4] = V128(HIGH40, HIGH41);
+
+  incrN128(n, lmid, hmid);
+  return loop128(lmid, hmid, mwm, nonce);
+}
+*/
+import "C"
+import (
+	"sync"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+const powC128 = "PowC128"
+
+func init() {
+	registerNativePoW(powC128, powVector128, stopVector128)
+}
+
+var vector128Mu sync.Mutex
+
+// powVector128 searches the nonce on all PoW threads. calling it while a search is
+// running stops that search, which then returns an empty nonce.
+func powVector128(trytes Trytes, mwm int) (Trytes, error) {
+	vector128Mu.Lock()
+	if C.stopC128 == 0 {
+		C.stopC128 = 1
+		vector128Mu.Unlock()
+		return "", errors.New("pow is already running, stopped")
+	}
+	if len(trytes) != txTrytesSize {
+		vector128Mu.Unlock()
+		return "", errors.New("invalid trytes")
+	}
+	C.stopC128 = 0
+	vector128Mu.Unlock()
+
+	trits := trytes.Trits()
+	state := make(Trits, 3*hashTrinarySize)
+	C.midstateVec128((*C.schar)(unsafe.Pointer(&trits[0])), (*C.schar)(unsafe.Pointer(&state[0])))
+
+	var (
+		result Trytes
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+	)
+	for n := 0; n < powThreads(); n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			nonce := make(Trits, nonceTrinarySize)
+			r := C.pworkVec128((*C.schar)(unsafe.Pointer(&state[0])), C.int(mwm), (*C.schar)(unsafe.Pointer(&nonce[0])), C.int(n))
+			if r >= 0 {
+				mu.Lock()
+				result = nonce.Trytes()
+				mu.Unlock()
+				C.stopC128 = 1
+			}
+		}(n)
+	}
+	wg.Wait()
+
+	vector128Mu.Lock()
+	C.stopC128 = 1
+	vector128Mu.Unlock()
+	return result, nil
+}
+
+// stopVector128 stops the running search, which then returns an empty nonce.
+func stopVector128() bool {
+	vector128Mu.Lock()
+	defer vector128Mu.Unlock()
+	if C.stopC128 != 0 {
+		return false
+	}
+	C.stopC128 = 1
+	return true
+}
@@ -0,0 +1,125 @@
+package attach
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+
+	"github.com/iotaledger/iota.go/consts"
+	"github.com/iotaledger/iota.go/curl"
+	"github.com/iotaledger/iota.go/pow"
+	"github.com/iotaledger/iota.go/trinary"
+	"github.com/pkg/errors"
+)
+
+const powGo = "PowGo"
+
+// the trits of the last chunk holding the nonce, the first 4 stay zero and the next
+// 27 tell the threads apart
+const (
+	nonceOffset         = consts.HashTrinarySize - consts.NonceTrinarySize
+	nonceInitStart      = nonceOffset + 4
+	nonceIncrementStart = nonceInitStart + consts.NonceTrinarySize/3
+)
+
+func init() {
+	powStoppers[powGo] = stopPowGoSearch
+}
+
+// the stop flag of the running PowGo search, nil while none runs
+var powGoRunning struct {
+	mu        sync.Mutex
+	cancelled *int32
+}
+
+// powGoSearch searches the nonce like the Go backend of iota.go, with its transform, but
+// on the configured number of threads and so that stopPowGoSearch can stop it.
+func powGoSearch(trytes Trytes, mwm int) (Trytes, error) {
+	if len(trytes) != txTrytesSize || trytes.IsValid() != nil {
+		return "", errors.New("invalid trytes")
+	}
+	trits := trinary.MustTrytesToTrits(string(trytes))
+	c := curl.NewCurlP81().(*curl.Curl)
+	if err := c.Absorb(trits[:consts.TransactionTrinarySize-consts.HashTrinarySize]); err != nil {
+		return "", err
+	}
+	var state [curl.StateSize]int8
+	c.CopyState(state[:])
+	copy(state[:], trits[consts.TransactionTrinarySize-consts.HashTrinarySize:])
+
+	cancelled := new(int32)
+	powGoRunning.mu.Lock()
+	powGoRunning.cancelled = cancelled
+	powGoRunning.mu.Unlock()
+	defer func() {
+		powGoRunning.mu.Lock()
+		powGoRunning.cancelled = nil
+		powGoRunning.mu.Unlock()
+	}()
+
+	threads := powThreads()
+	nonces := make(chan trinary.Trits, threads)
+	var wg sync.WaitGroup
+	for n := 0; n < threads; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			lmid, hmid := pow.Para(&state)
+			lmid[nonceOffset], hmid[nonceOffset] = pow.PearlDiverMidStateLow0, pow.PearlDiverMidStateHigh0
+			lmid[nonceOffset+1], hmid[nonceOffset+1] = pow.PearlDiverMidStateLow1, pow.PearlDiverMidStateHigh1
+			lmid[nonceOffset+2], hmid[nonceOffset+2] = pow.PearlDiverMidStateLow2, pow.PearlDiverMidStateHigh2
+			lmid[nonceOffset+3], hmid[nonceOffset+3] = pow.PearlDiverMidStateLow3, pow.PearlDiverMidStateHigh3
+			incrN(n, lmid, hmid)
+			if nonce, _, _ := pow.Loop(lmid, hmid, mwm, cancelled, checkMWM, curl.NumRounds); nonce != nil {
+				atomic.StoreInt32(cancelled, 1)
+				nonces <- nonce
+			}
+		}(n)
+	}
+	wg.Wait()
+
+	select {
+	case nonce := <-nonces:
+		return Trytes(trinary.MustTritsToTrytes(nonce)), nil
+	default:
+		// stopped
+		return "", nil
+	}
+}
+
+// stopPowGoSearch stops the running PowGo search, which then returns an empty nonce.
+func stopPowGoSearch() bool {
+	powGoRunning.mu.Lock()
+	defer powGoRunning.mu.Unlock()
+	if powGoRunning.cancelled == nil {
+		return false
+	}
+	atomic.StoreInt32(powGoRunning.cancelled, 1)
+	return true
+}
+
+// incrN moves the nonces of the nth thread to a range of their own.
+func incrN(n int, lmid *[curl.StateSize]uint64, hmid *[curl.StateSize]uint64) {
+	for j := 0; j < n; j++ {
+		carry := uint64(1)
+		for i := nonceInitStart; i < nonceIncrementStart && carry != 0; i++ {
+			low, high := lmid[i], hmid[i]
+			lmid[i] = high ^ low
+			hmid[i] = low
+			carry = high & ^low
+		}
+	}
+}
+
+// checkMWM returns which of the 64 nonces transformed at once makes the hash end with
+// mwm zero trits, -1 if none does.
+func checkMWM(l *[curl.StateSize]uint64, h *[curl.StateSize]uint64, mwm int) int {
+	probe := ^uint64(0)
+	for i := consts.HashTrinarySize - mwm; i < consts.HashTrinarySize; i++ {
+		probe &= ^(l[i] ^ h[i])
+		if probe == 0 {
+			return -1
+		}
+	}
+	return bits.TrailingZeros64(probe)
+}
@@ -0,0 +1,18 @@
+//go:build cgo && neon_pow && (arm || arm64)
+// +build cgo
+// +build neon_pow
+// +build arm arm64
+
+package attach
+
+// 32 bit ARM compilers only emit NEON instructions if asked to, arm64 always has them.
+// ARMv6 boards like the first Raspberry Pis have no NEON, use PowC128 without neon_pow there.
+
+// #cgo arm CFLAGS: -mfpu=neon
+import "C"
+
+const powNEON = "PowNEON"
+
+func init() {
+	registerNativePoW(powNEON, powVector128, stopVector128)
+}
@@ -0,0 +1,125 @@
+package attach
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const metricPoWBackendSwitches = "attach.pow_backend_switches"
+
+// the primary backend is tried again after this long, e.g. once a GPU driver recovered
+const powPrimaryRetryAfter = 5 * time.Minute
+
+// parsePoWBackends splits "avx, go" into the backend names in order of preference,
+// resolving the short names of the built-in backends.
+func parsePoWBackends(args []string) []string {
+	var names []string
+	for _, name := range strings.Split(strings.Join(args, ","), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, canonicalPoWName(name))
+		}
+	}
+	return names
+}
+
+type powBackend struct {
+	name string
+	fn   PowFunc
+	stop func(trytes Trytes)
+}
+
+// powChain is an ordered list of PoW backends. if the active backend errors, the
+// transaction is retried with the next one which stays active from then on.
+type powChain struct {
+	backends []powBackend
+
+	mu       sync.Mutex
+	active   int
+	switched time.Time
+}
+
+// the backends run under their lock with the thread count returned by threads.
+func newPoWChain(names []string, threads func() int) (*powChain, error) {
+	c := &powChain{}
+	for _, name := range names {
+		fn, err := lookupPoWFunc(name)
+		if err != nil {
+			return nil, err
+		}
+		c.backends = append(c.backends, powBackend{name: name, fn: lockedPoW(name, fn, threads), stop: backendStopper(name)})
+	}
+	return c, nil
+}
+
+// current returns the index of the active backend.
+func (c *powChain) current() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.active > 0 && time.Since(c.switched) > powPrimaryRetryAfter {
+		logger.Infof("trying the primary PoW backend %s again\n", c.backends[0].name)
+		c.active = 0
+	}
+	return c.active
+}
+
+// Active returns the name of the active backend.
+func (c *powChain) Active() string {
+	return c.backends[c.current()].name
+}
+
+// Interrupt stops the nonce search of the trytes on the active backend.
+func (c *powChain) Interrupt(trytes Trytes) {
+	if stop := c.backends[c.current()].stop; stop != nil {
+		stop(trytes)
+	}
+}
+
+// failover switches away from the failed backend, unless another job already did.
+// it reports false if there is no backend left.
+func (c *powChain) failover(failed int, err error) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.active > failed {
+		return c.active, true
+	}
+	if failed+1 >= len(c.backends) {
+		return 0, false
+	}
+	c.active, c.switched = failed+1, time.Now()
+	metricsReg.Inc(metricPoWBackendSwitches)
+	logger.Warnf("PoW backend %s failed, failing over to %s: %s\n", c.backends[failed].name, c.backends[c.active].name, err.Error())
+	alerts.Fire(eventPoWFailed, "PoW backend %s failed, failed over to %s: %s", c.backends[failed].name, c.backends[c.active].name, err.Error())
+	return c.active, true
+}
+
+// isPoWStopped reports whether the search was stopped instead of failing, which says
+// nothing about the health of the backend.
+func isPoWStopped(err error) bool {
+	return errors.Cause(err) == ErrPoWInterrupted || err.Error() == "pow is already running, stopped"
+}
+
+// activePoW returns the name of the PoW backend in use.
+func (s *site) activePoW() string {
+	if s.powChain != nil {
+		return s.powChain.Active()
+	}
+	return s.powName
+}
+
+// Pow is the PowFunc of the chain.
+func (c *powChain) Pow(trytes Trytes, mwm int) (Trytes, error) {
+	i := c.current()
+	for {
+		nonce, err := c.backends[i].fn(trytes, mwm)
+		if err == nil || isPoWStopped(err) {
+			return nonce, err
+		}
+		var ok bool
+		if i, ok = c.failover(i, err); !ok {
+			return "", err
+		}
+	}
+}
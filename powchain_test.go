@@ -0,0 +1,96 @@
+package attach
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// countingPoW returns the result and counts its calls.
+func countingPoW(calls *int, nonce Trytes, err error) PowFunc {
+	return func(trytes Trytes, mwm int) (Trytes, error) {
+		*calls++
+		return nonce, err
+	}
+}
+
+func TestParsePoWBackends(t *testing.T) {
+	names := parsePoWBackends([]string{"avx,", "go", ",PowCustom"})
+	if expected := []string{"PowAVX", "PowGo", "PowCustom"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+}
+
+func TestPoWChainFailover(t *testing.T) {
+	var primaryCalls, secondaryCalls int
+	c := &powChain{backends: []powBackend{
+		{name: "primary", fn: countingPoW(&primaryCalls, "", errors.New("driver crashed"))},
+		{name: "secondary", fn: countingPoW(&secondaryCalls, "NONCE", nil)},
+	}}
+	if nonce, err := c.Pow("TRYTES", 9); err != nil || nonce != "NONCE" {
+		t.Fatalf("expected the secondary to find the nonce, got %q, %v", nonce, err)
+	}
+	if c.Active() != "secondary" {
+		t.Fatalf("expected the secondary to stay active, got %s", c.Active())
+	}
+	if _, err := c.Pow("TRYTES", 9); err != nil || primaryCalls != 1 || secondaryCalls != 2 {
+		t.Fatalf("expected the primary not to be retried yet, got %d and %d calls, %v", primaryCalls, secondaryCalls, err)
+	}
+
+	// the primary gets another chance after a while
+	c.switched = time.Now().Add(-powPrimaryRetryAfter - time.Second)
+	c.Pow("TRYTES", 9)
+	if primaryCalls != 2 {
+		t.Fatalf("expected the primary to be retried, got %d calls", primaryCalls)
+	}
+}
+
+func TestPoWChainAllFailed(t *testing.T) {
+	var calls int
+	failure := errors.New("no device")
+	c := &powChain{backends: []powBackend{
+		{name: "primary", fn: countingPoW(&calls, "", errors.New("driver crashed"))},
+		{name: "secondary", fn: countingPoW(&calls, "", failure)},
+	}}
+	if _, err := c.Pow("TRYTES", 9); err != failure || calls != 2 {
+		t.Fatalf("expected the error of the last backend after trying both, got %v after %d calls", err, calls)
+	}
+}
+
+func TestPoWChainStoppedSearch(t *testing.T) {
+	stops := []error{ErrPoWInterrupted, errors.New("pow is already running, stopped"), nil}
+	for _, stop := range stops {
+		var primaryCalls, secondaryCalls int
+		c := &powChain{backends: []powBackend{
+			{name: "primary", fn: countingPoW(&primaryCalls, "", stop)},
+			{name: "secondary", fn: countingPoW(&secondaryCalls, "NONCE", nil)},
+		}}
+		// a stopped search says nothing about the health of the backend
+		if nonce, err := c.Pow("TRYTES", 9); nonce != "" || err != stop {
+			t.Errorf("%v: expected the stop to be returned, got %q, %v", stop, nonce, err)
+		}
+		if c.Active() != "primary" || secondaryCalls != 0 {
+			t.Errorf("%v: expected no failover", stop)
+		}
+	}
+}
+
+func TestPoWChainInterrupt(t *testing.T) {
+	var stopped []Trytes
+	stop := func(trytes Trytes) { stopped = append(stopped, trytes) }
+	c := &powChain{backends: []powBackend{
+		{name: "primary", stop: stop},
+		{name: "secondary"},
+	}}
+	c.Interrupt("TRYTES")
+	if len(stopped) != 1 || stopped[0] != "TRYTES" {
+		t.Fatalf("expected the search on the active backend to be stopped, got %v", stopped)
+	}
+	// backends which can't be stopped are left alone
+	c.active, c.switched = 1, time.Now()
+	c.Interrupt("TRYTES")
+	if len(stopped) != 1 {
+		t.Fatalf("expected no stop on the secondary, got %v", stopped)
+	}
+}
@@ -0,0 +1,143 @@
+package attach
+
+import (
+	"sync"
+	"time"
+)
+
+// the built-in PoW funcs each use all PoW threads and the stoppable ones keep the flag
+// stopping their search in a package variable. so every built-in backend runs under a
+// process-wide lock, which concurrent jobs of several schedulers, workers or sites queue
+// on instead of competing for the cores or stopping each other's search.
+type backendLock struct {
+	// holds a token while a search runs
+	run chan struct{}
+
+	mu sync.Mutex
+	// the trytes of the running search and how to stop it, nil if it can't be stopped
+	running Trytes
+	stop    func() bool
+	// closing a channel stops a search waiting for the backend
+	waiting map[Trytes][]chan struct{}
+}
+
+// the lock of the CPU backends, which share the thread count
+const cpuBackendLock = "cpu"
+
+var backendLocks = map[string]*backendLock{}
+var backendLocksMu sync.Mutex
+
+// backendLockFor returns the lock of the named built-in backend. all of them run on the
+// CPU and share one lock because of the thread count.
+func backendLockFor(name string) *backendLock {
+	group := cpuBackendLock
+	backendLocksMu.Lock()
+	defer backendLocksMu.Unlock()
+	l, ok := backendLocks[group]
+	if !ok {
+		l = &backendLock{run: make(chan struct{}, 1), waiting: map[Trytes][]chan struct{}{}}
+		backendLocks[group] = l
+	}
+	return l
+}
+
+// isBuiltinPoW reports whether the name is a built-in backend which isn't overridden
+// by a custom registration.
+func isBuiltinPoW(name string) bool {
+	powRegistryMu.Lock()
+	_, custom := customPoWFuncs[name]
+	powRegistryMu.Unlock()
+	_, ok := builtinPoWFuncs()[name]
+	return ok && !custom
+}
+
+// lockedPoW returns the PoW func running the named backend under its lock. the thread
+// count returned by threads, if given, is applied once the backend is held. custom
+// backends are returned as they are.
+func lockedPoW(name string, fn PowFunc, threads func() int) PowFunc {
+	if !isBuiltinPoW(name) {
+		return fn
+	}
+	l := backendLockFor(name)
+	stop := powStoppers[name]
+	return func(trytes Trytes, mwm int) (Trytes, error) {
+		return l.Run(fn, stop, trytes, mwm, threads)
+	}
+}
+
+// Run searches the nonce once no other search holds the backend. a search stopped
+// while waiting returns an empty nonce right away, like a stopped running one.
+func (l *backendLock) Run(fn PowFunc, stopFn func() bool, trytes Trytes, mwm int, threads func() int) (Trytes, error) {
+	stop := make(chan struct{})
+	l.mu.Lock()
+	l.waiting[trytes] = append(l.waiting[trytes], stop)
+	l.mu.Unlock()
+
+	select {
+	case l.run <- struct{}{}:
+	case <-stop:
+		return "", nil
+	}
+	defer func() { <-l.run }()
+
+	l.mu.Lock()
+	select {
+	case <-stop:
+		// stopped while getting the backend
+		l.mu.Unlock()
+		return "", nil
+	default:
+	}
+	l.removeWaiting(trytes, stop)
+	l.running, l.stop = trytes, stopFn
+	l.mu.Unlock()
+
+	if threads != nil {
+		setPoWThreads(threads())
+	}
+	nonce, err := fn(trytes, mwm)
+
+	l.mu.Lock()
+	l.running, l.stop = "", nil
+	l.mu.Unlock()
+	return nonce, err
+}
+
+// Stop stops the search of the trytes, whether it runs or waits for the backend. a
+// running search of a backend which can't be stopped goes on until it found the nonce.
+// searches of other jobs are left alone.
+func (l *backendLock) Stop(trytes Trytes) {
+	for {
+		l.mu.Lock()
+		if trytes == "" || l.running != trytes {
+			for _, stop := range l.waiting[trytes] {
+				close(stop)
+			}
+			delete(l.waiting, trytes)
+			l.mu.Unlock()
+			return
+		}
+		// the backend has nothing to stop until its search started
+		stopped := l.stop == nil || l.stop()
+		l.mu.Unlock()
+		if stopped {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (l *backendLock) removeWaiting(trytes Trytes, stop chan struct{}) {
+	waiting := l.waiting[trytes]
+	for i := range waiting {
+		if waiting[i] == stop {
+			waiting = append(waiting[:i], waiting[i+1:]...)
+			break
+		}
+	}
+	if len(waiting) == 0 {
+		delete(l.waiting, trytes)
+	} else {
+		l.waiting[trytes] = waiting
+	}
+}
@@ -0,0 +1,166 @@
+package attach
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestBackendLock() *backendLock {
+	return &backendLock{run: make(chan struct{}, 1), waiting: map[Trytes][]chan struct{}{}}
+}
+
+// blockingPoW is a backend whose searches run until released or stopped.
+type blockingPoW struct {
+	started chan Trytes
+	release chan struct{}
+	stopped chan struct{}
+}
+
+func newBlockingPoW() *blockingPoW {
+	return &blockingPoW{started: make(chan Trytes, 4), release: make(chan struct{}), stopped: make(chan struct{}, 4)}
+}
+
+func (b *blockingPoW) pow(trytes Trytes, mwm int) (Trytes, error) {
+	b.started <- trytes
+	select {
+	case <-b.release:
+		return "NONCE", nil
+	case <-b.stopped:
+		return "", nil
+	}
+}
+
+func (b *blockingPoW) stop() bool {
+	b.stopped <- struct{}{}
+	return true
+}
+
+func runLocked(l *backendLock, b *blockingPoW, trytes Trytes) chan powResult {
+	res := make(chan powResult, 1)
+	go func() {
+		nonce, err := l.Run(b.pow, b.stop, trytes, 9, nil)
+		res <- powResult{nonce, err}
+	}()
+	return res
+}
+
+func expectStarted(t *testing.T, b *blockingPoW, trytes Trytes) {
+	select {
+	case started := <-b.started:
+		if started != trytes {
+			t.Fatalf("expected the search of %s to start, got %s", trytes, started)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the search of %s to start", trytes)
+	}
+}
+
+func expectResult(t *testing.T, res chan powResult, nonce Trytes) {
+	select {
+	case r := <-res:
+		if r.err != nil || r.nonce != nonce {
+			t.Fatalf("expected the nonce %q, got %q, %v", nonce, r.nonce, r.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the search to return %q", nonce)
+	}
+}
+
+func TestBackendLockSerializes(t *testing.T) {
+	l, b := newTestBackendLock(), newBlockingPoW()
+	first := runLocked(l, b, "FIRST")
+	expectStarted(t, b, "FIRST")
+	second := runLocked(l, b, "SECOND")
+	select {
+	case trytes := <-b.started:
+		t.Fatalf("expected %s to wait for the backend", trytes)
+	case <-time.After(50 * time.Millisecond):
+	}
+	b.release <- struct{}{}
+	expectResult(t, first, "NONCE")
+	expectStarted(t, b, "SECOND")
+	b.release <- struct{}{}
+	expectResult(t, second, "NONCE")
+}
+
+func TestBackendLockStopsOnlyItsSearch(t *testing.T) {
+	l, b := newTestBackendLock(), newBlockingPoW()
+	first := runLocked(l, b, "FIRST")
+	expectStarted(t, b, "FIRST")
+	second := runLocked(l, b, "SECOND")
+	time.Sleep(10 * time.Millisecond)
+
+	// stopping a waiting search neither touches the running one nor the backend
+	l.Stop("SECOND")
+	expectResult(t, second, "")
+	if len(b.stopped) != 0 {
+		t.Fatal("expected the running search not to be stopped")
+	}
+	// neither does stopping trytes which aren't searched at all
+	l.Stop("OTHER")
+	l.Stop("")
+	if len(b.stopped) != 0 {
+		t.Fatal("expected the running search not to be stopped")
+	}
+
+	l.Stop("FIRST")
+	expectResult(t, first, "")
+	if len(l.waiting) != 0 || l.running != "" {
+		t.Fatalf("expected the lock to be idle, running %q with %d waiting", l.running, len(l.waiting))
+	}
+}
+
+func TestBackendLockUnstoppable(t *testing.T) {
+	l, b := newTestBackendLock(), newBlockingPoW()
+	res := make(chan powResult, 1)
+	go func() {
+		nonce, err := l.Run(b.pow, nil, "FIRST", 9, nil)
+		res <- powResult{nonce, err}
+	}()
+	expectStarted(t, b, "FIRST")
+	// the search of a backend which can't be stopped goes on
+	l.Stop("FIRST")
+	b.release <- struct{}{}
+	expectResult(t, res, "NONCE")
+}
+
+func TestBackendLockRetriesUntilStarted(t *testing.T) {
+	l := newTestBackendLock()
+	started := make(chan struct{})
+	stopped := make(chan struct{})
+	fn := func(trytes Trytes, mwm int) (Trytes, error) {
+		close(started)
+		<-stopped
+		return "", nil
+	}
+	attempts := 0
+	stop := func() bool {
+		// the backend only has something to stop once its search started
+		attempts++
+		select {
+		case <-started:
+			close(stopped)
+			return true
+		default:
+			return false
+		}
+	}
+	l.mu.Lock()
+	l.running, l.stop = "FIRST", stop
+	l.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		l.Stop("FIRST")
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	go fn("FIRST", 9)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the stop to be retried until the search started")
+	}
+	if attempts < 2 {
+		t.Fatalf("expected the stop to be retried, got %d attempts", attempts)
+	}
+}
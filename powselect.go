@@ -0,0 +1,101 @@
+package attach
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the pow option value which measures the built-in backends at startup and uses the fastest
+const powAuto = "auto"
+
+// the mwm and the number of runs of the startup measurement. the time of a single PoW
+// varies a lot, so the mean of a few is taken.
+const (
+	powMeasureMWM  = 9
+	powMeasureRuns = 3
+)
+
+// short names of the built-in backends for the pow and verify_with options
+var powAliases = map[string]string{
+	"avx":    "PowAVX",
+	"neon":   "PowNEON",
+	"carm64": "PowCARM64",
+	"sse":    "PowSSE",
+	"c128":   "PowC128",
+	"c":      "PowC",
+	"go":     "PowGo",
+}
+
+// canonicalPoWName resolves the short name of a built-in backend, other names are
+// returned unchanged.
+func canonicalPoWName(name string) string {
+	if canonical, ok := powAliases[strings.ToLower(name)]; ok {
+		return canonical
+	}
+	return name
+}
+
+type powMeasurement struct {
+	name  string
+	fn    PowFunc
+	perTx time.Duration
+}
+
+// measurePoWBackends times a few PoWs of every built-in backend which passes its
+// self-test. the self-test also warms up backends with a costly first call, like a
+// custom GPU backend compiling its kernel. the result is sorted from the fastest to the slowest.
+func measurePoWBackends() []powMeasurement {
+	var measured []powMeasurement
+	funcs := builtinPoWFuncs()
+measuring:
+	for _, name := range powPreference {
+		raw, ok := funcs[name]
+		if !ok {
+			continue
+		}
+		fn := lockedPoW(name, raw, nil)
+		if err := powSelfTestOnce(name, fn); err != nil {
+			logger.Warnf("%s, not measuring it\n", err.Error())
+			continue
+		}
+		tx := zeroValueBundle(emptyHash, "")[0]
+		start := time.Now()
+		for i := 0; i < powMeasureRuns; i++ {
+			tx.Timestamp = tx.Timestamp.Add(time.Second)
+			if _, err := checkedNonce(fn(tx.Trytes(), powMeasureMWM)); err != nil {
+				logger.Warnf("PoW backend %s failed while being measured, not using it: %s\n", name, err.Error())
+				continue measuring
+			}
+		}
+		// the caller locks the backend it picks
+		measured = append(measured, powMeasurement{name: name, fn: raw, perTx: time.Since(start) / powMeasureRuns})
+	}
+	sort.SliceStable(measured, func(i, j int) bool {
+		return measured[i].perTx < measured[j].perTx
+	})
+	return measured
+}
+
+// the hardware doesn't change between sites and config reloads, the backends are measured once
+var (
+	powMeasureOnce sync.Once
+	powMeasured    []powMeasurement
+)
+
+// fastestPoWFunc measures the built-in backends, reports their speed and returns the
+// fastest. it falls back to the preference order if none could be measured.
+func fastestPoWFunc() (string, PowFunc) {
+	powMeasureOnce.Do(func() {
+		powMeasured = measurePoWBackends()
+		for _, m := range powMeasured {
+			logger.Infof("PoW backend %s takes %s per tx at mwm %d\n", m.name, m.perTx, powMeasureMWM)
+		}
+	})
+	measured := powMeasured
+	if len(measured) == 0 {
+		return bestPoWFunc()
+	}
+	return measured[0].name, measured[0].fn
+}
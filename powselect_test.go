@@ -0,0 +1,50 @@
+package attach
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCanonicalPoWName(t *testing.T) {
+	for name, canonical := range map[string]string{"avx": "PowAVX", "GO": "PowGo", "PowSSE": "PowSSE", "custom": "custom"} {
+		if got := canonicalPoWName(name); got != canonical {
+			t.Errorf("%s: expected %s, got %s", name, canonical, got)
+		}
+	}
+}
+
+func TestMeasurePoWBackendsSkipsFailing(t *testing.T) {
+	// a backend which passes its self-test but fails right after, faster than any other
+	const flaky = "PowC"
+	calls := 0
+	nativePoWFuncs[flaky] = func(trytes Trytes, mwm int) (Trytes, error) {
+		if calls++; calls == 1 {
+			return powGoSearch(trytes, mwm)
+		}
+		return "", errors.New("device lost")
+	}
+	defer func() {
+		delete(nativePoWFuncs, flaky)
+		selfTestsMu.Lock()
+		delete(selfTests, flaky)
+		selfTestsMu.Unlock()
+	}()
+
+	measured := measurePoWBackends()
+	if len(measured) == 0 {
+		t.Fatal("expected the other backends to be measured")
+	}
+	for _, m := range measured {
+		if m.name == flaky {
+			t.Fatalf("expected %s not to be measured after failing", flaky)
+		}
+		if m.perTx <= 0 {
+			t.Fatalf("expected %s to take some time, got %s", m.name, m.perTx)
+		}
+	}
+	for i := 1; i < len(measured); i++ {
+		if measured[i].perTx < measured[i-1].perTx {
+			t.Fatalf("expected the fastest backend first, got %v", measured)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package attach
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var ErrInvalidPreattachOption = errors.New("expected a pool size, a max age and optionally an address and tag after the preattach_pool option")
+var ErrPreattachWithoutUpstream = errors.New("preattach_pool requires the upstream option")
+
+// the command handing out pre-attached zero-value transactions
+const getPreattachedCommand = "getPreattachedTransactions"
+
+// how often the worker looks for idle time to refill the pool
+const preattachInterval = time.Second
+
+const metricPreattachServed = "attach.preattach_served"
+
+// preattachPool keeps zero-value transactions which were attached to fresh tips during
+// idle time, so that spammers and promotion tools get them instantly. entries older
+// than maxAge are dropped since their tips are likely no longer selected by the node.
+type preattachPool struct {
+	site    *site
+	size    int
+	maxAge  time.Duration
+	address Trytes
+	tag     Trytes
+
+	mu      sync.Mutex
+	entries []preattached
+	cancel  context.CancelFunc
+}
+
+type preattached struct {
+	trytes   Trytes
+	attached time.Time
+}
+
+type GetPreattachedCmd struct {
+	Command string `json:"command"`
+	Count   int    `json:"count"`
+}
+
+type GetPreattachedRes struct {
+	Trytes   []Trytes `json:"trytes"`
+	Duration int64    `json:"duration"`
+}
+
+func newPreattachPool(args []string) (*preattachPool, error) {
+	if len(args) < 2 || len(args) > 4 {
+		return nil, ErrInvalidPreattachOption
+	}
+	size, err := strconv.Atoi(args[0])
+	if err != nil || size <= 0 {
+		return nil, ErrInvalidPreattachOption
+	}
+	maxAge, err := time.ParseDuration(args[1])
+	if err != nil || maxAge <= 0 {
+		return nil, ErrInvalidPreattachOption
+	}
+	p := &preattachPool{size: size, maxAge: maxAge, address: emptyHash}
+	if len(args) >= 3 {
+		if p.address, err = toAddress(args[2]); err != nil {
+			return nil, errors.Wrap(ErrInvalidPreattachOption, err.Error())
+		}
+	}
+	if len(args) == 4 {
+		if p.tag, err = toTrytes(args[3]); err != nil || len(p.tag) > tagTrinarySize/3 {
+			return nil, ErrInvalidPreattachOption
+		}
+	}
+	return p, nil
+}
+
+func (p *preattachPool) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	go p.refill(ctx)
+	return nil
+}
+
+func (p *preattachPool) Stop() error {
+	if p.cancel != nil {
+		p.cancel()
+	}
+	return nil
+}
+
+// Take removes up to n fresh transactions from the pool.
+func (p *preattachPool) Take(n int) []Trytes {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dropStale()
+	if n > len(p.entries) {
+		n = len(p.entries)
+	}
+	trytes := make([]Trytes, n)
+	for i := range trytes {
+		trytes[i] = p.entries[i].trytes
+	}
+	p.entries = p.entries[n:]
+	metricsReg.Add(metricPreattachServed, int64(n))
+	return trytes
+}
+
+func (p *preattachPool) dropStale() {
+	i := 0
+	for i < len(p.entries) && time.Since(p.entries[i].attached) > p.maxAge {
+		i++
+	}
+	p.entries = p.entries[i:]
+}
+
+// refill attaches new transactions while the pool isn't full and no attach requests
+// are waiting, so the pool never delays clients.
+func (p *preattachPool) refill(ctx context.Context) {
+	ticker := time.NewTicker(preattachInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for p.missing() > 0 && ctx.Err() == nil && p.site.scheduler.pressure.Idle() {
+			trytes, err := p.attachOne(ctx)
+			if err != nil {
+				logger.Warnf("couldn't pre-attach a transaction: %s\n", err.Error())
+				break
+			}
+			p.mu.Lock()
+			p.entries = append(p.entries, preattached{trytes: trytes, attached: time.Now()})
+			p.mu.Unlock()
+		}
+	}
+}
+
+func (p *preattachPool) missing() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dropStale()
+	return p.size - len(p.entries)
+}
+
+func (p *preattachPool) attachOne(ctx context.Context) (Trytes, error) {
+	s := p.site
+	trunk, branch, err := s.selectTips(defaultTipSelectionDepth)
+	if err != nil {
+		return "", err
+	}
+	bundle := zeroValueBundle(p.address, p.tag)
+
+	// pre-attaching never gets ahead of client jobs
+	s.scheduler.Acquire(priorityLow, s.pool, len(bundle))
+	defer s.scheduler.Release()
+	tra := &Transaction{Trunk: trunk, Branch: branch, Transactions: bundle}
+	if err := s.doPow(ctx, tra, tra.Transactions, int64(s.network.MWM(0)), s.powFn, nil); err != nil {
+		return "", err
+	}
+	return tra.Transactions[0].Trytes(), nil
+}
+
+// serveGetPreattached hands out pre-attached transactions, possibly fewer than requested.
+// the same authorization and quotas as for attachToTangle apply.
+func (s *site) serveGetPreattached(w http.ResponseWriter, r *http.Request, span trace.Span, body []byte) (int, error) {
+	start := time.Now()
+	command := &GetPreattachedCmd{}
+	if err := json.Unmarshal(body, command); err != nil {
+		return http.StatusBadRequest, ErrBodyUnparsable
+	}
+	if command.Count <= 0 {
+		command.Count = 1
+	}
+	if _, status, err := s.admitAttach(w, r, span, body, getPreattachedCommand, command.Count, 0, admitCharge); err != nil {
+		s.countRejection(err)
+		spanError(span, err)
+		return status, err
+	}
+	res := &GetPreattachedRes{Trytes: s.preattach.Take(command.Count)}
+	res.Duration = int64(time.Since(start) / time.Millisecond)
+	resBytes, err := json.Marshal(res)
+	if err != nil {
+		return http.StatusInternalServerError, ErrBuildingRes
+	}
+	s.signResponse(w, resBytes)
+	w.Header().Set(contentType, contentTypeJSON)
+	w.Header().Set("access-control-allow-origin", "*")
+	w.Write(resBytes)
+	return http.StatusOK, nil
+}
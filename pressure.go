@@ -0,0 +1,122 @@
+package attach
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrBundleLimitTightened = errors.New("the bundle exceeds the txs limit under the current load, try again later or split it")
+var ErrInvalidDynamicLimitOption = errors.New("expected a min txs limit and a target PoW latency per tx after the dynamic_bundle_limit option")
+
+// weight of the latest PoW in the latency average
+const latencySmoothing = 0.2
+
+// queuePressure tracks the depth and PoW latency of a scheduler's queue. they feed the
+// canAttach estimates and the dynamic bundle limits of the sites using the scheduler.
+type queuePressure struct {
+	mu sync.Mutex
+	// requests waiting for the PoW lock
+	waiting int
+	// moving average of the PoW duration per transaction
+	txLatency time.Duration
+}
+
+// dynamicLimit tightens the bundle size limit of a site while requests queue up for
+// the PoW lock or the PoW gets slow, so that during spikes huge bundles are rejected
+// first while small transfers keep flowing. the limit loosens again as the pressure drops.
+type dynamicLimit struct {
+	minTxs        int
+	targetLatency time.Duration
+}
+
+// ParseOption parses the dynamic_bundle_limit option.
+func (d *dynamicLimit) ParseOption(args []string) error {
+	if len(args) != 2 {
+		return ErrInvalidDynamicLimitOption
+	}
+	minTxs, err := strconv.Atoi(args[0])
+	if err != nil || minTxs <= 0 {
+		return ErrInvalidDynamicLimitOption
+	}
+	target, err := time.ParseDuration(args[1])
+	if err != nil || target <= 0 {
+		return ErrInvalidDynamicLimitOption
+	}
+	d.minTxs, d.targetLatency = minTxs, target
+	return nil
+}
+
+// Enter registers a request waiting for the PoW lock, Leave must be called once it got it.
+func (p *queuePressure) Enter() {
+	p.mu.Lock()
+	p.waiting++
+	p.mu.Unlock()
+}
+
+func (p *queuePressure) Leave() {
+	p.mu.Lock()
+	p.waiting--
+	p.mu.Unlock()
+}
+
+// Waiting returns the number of requests waiting for the PoW lock.
+func (p *queuePressure) Waiting() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.waiting
+}
+
+// Idle reports whether no request is waiting for the PoW lock.
+func (p *queuePressure) Idle() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.waiting == 0
+}
+
+// Observe feeds the PoW duration of a bundle into the latency average.
+func (p *queuePressure) Observe(txs int, took time.Duration) {
+	if txs == 0 {
+		return
+	}
+	perTx := took / time.Duration(txs)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.txLatency == 0 {
+		p.txLatency = perTx
+		return
+	}
+	p.txLatency = time.Duration(latencySmoothing*float64(perTx) + (1-latencySmoothing)*float64(p.txLatency))
+}
+
+// Limit returns the bundle size limit under the current pressure of the queue given the configured limit.
+func (d *dynamicLimit) Limit(p *queuePressure, limit int) int {
+	if d.minTxs == 0 {
+		return limit
+	}
+	p.mu.Lock()
+	waiting, latency := p.waiting, p.txLatency
+	p.mu.Unlock()
+	dynamic := float64(limit) / float64(1+waiting)
+	if latency > d.targetLatency {
+		dynamic *= float64(d.targetLatency) / float64(latency)
+	}
+	if int(dynamic) < d.minTxs {
+		if d.minTxs < limit {
+			return d.minTxs
+		}
+		return limit
+	}
+	return int(dynamic)
+}
+
+// Estimate roughly predicts how long attaching a bundle with the given number of txs
+// takes including the wait for the jobs already queued up. it is 0 without any PoW so far.
+func (p *queuePressure) Estimate(txs int) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// assume queued jobs are of the same size
+	return p.txLatency * time.Duration(txs*(1+p.waiting))
+}
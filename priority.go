@@ -0,0 +1,173 @@
+package attach
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidPriority = errors.New("expected high, normal or low as priority")
+
+// priorityClass decides the order in which waiting jobs get the PoW lock.
+type priorityClass int
+
+const (
+	priorityLow priorityClass = iota
+	priorityNormal
+	priorityHigh
+	priorityClasses
+)
+
+func parsePriority(s string) (priorityClass, error) {
+	switch s {
+	case "low":
+		return priorityLow, nil
+	case "normal":
+		return priorityNormal, nil
+	case "high":
+		return priorityHigh, nil
+	}
+	return priorityNormal, ErrInvalidPriority
+}
+
+func (p priorityClass) String() string {
+	return [...]string{"low", "normal", "high"}[p]
+}
+
+// priorityMutex hands the lock to waiters of the highest priority class first.
+// waiters of the same class are served in no particular order, like with sync.Mutex.
+// with more than one slot, that many holders may have the lock at the same time.
+type priorityMutex struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	slots   int
+	held    int
+	waiting [priorityClasses]int
+	pools   map[string]*sharePool
+}
+
+// sharePool is a class of clients, e.g. the customers of a plan, which gets the lock
+// in proportion to its shares while clients of other pools are waiting as well.
+type sharePool struct {
+	shares int
+	// the cost of the jobs which got the lock, relative to the shares
+	used    float64
+	waiting [priorityClasses]int
+}
+
+func (p *sharePool) idle() bool {
+	for _, n := range p.waiting {
+		if n > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func newPriorityMutex(slots int) *priorityMutex {
+	m := &priorityMutex{slots: slots, pools: map[string]*sharePool{}}
+	m.cond = sync.NewCond(&m.mu)
+	return m
+}
+
+// SetPool defines the shares of a pool, pools which aren't defined have one share.
+func (m *priorityMutex) SetPool(name string, shares int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pool(name).shares = shares
+}
+
+func (m *priorityMutex) pool(name string) *sharePool {
+	pool, ok := m.pools[name]
+	if !ok {
+		pool = &sharePool{shares: 1}
+		m.pools[name] = pool
+	}
+	return pool
+}
+
+// SetSlots changes the number of holders, current holders keep the lock.
+func (m *priorityMutex) SetSlots(slots int) {
+	m.mu.Lock()
+	m.slots = slots
+	m.mu.Unlock()
+	m.cond.Broadcast()
+}
+
+// Lock acquires the lock with normal priority.
+func (m *priorityMutex) Lock() {
+	m.LockPriority(priorityNormal)
+}
+
+func (m *priorityMutex) LockPriority(p priorityClass) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.waiting[p]++
+	for m.held >= m.slots || m.higherWaiting(p) {
+		m.cond.Wait()
+	}
+	m.waiting[p]--
+	m.held++
+}
+
+// LockShare acquires the lock like LockPriority. among the waiters of the same class the
+// ones of the pool which used the least relative to its shares go first. the cost is
+// the work of the job, e.g. its number of transactions.
+func (m *priorityMutex) LockShare(p priorityClass, name string, cost int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pool := m.pool(name)
+	if pool.idle() {
+		// pools don't save up what they didn't use while idle
+		if least, ok := m.leastUsed(); ok && pool.used < least {
+			pool.used = least
+		}
+	}
+	m.waiting[p]++
+	pool.waiting[p]++
+	for m.held >= m.slots || m.higherWaiting(p) || m.poolAhead(p, pool) {
+		m.cond.Wait()
+	}
+	pool.waiting[p]--
+	m.waiting[p]--
+	m.held++
+	pool.used += float64(cost) / float64(pool.shares)
+}
+
+// leastUsed returns the least usage of the pools with waiters.
+func (m *priorityMutex) leastUsed() (float64, bool) {
+	var least float64
+	found := false
+	for _, pool := range m.pools {
+		if !pool.idle() && (!found || pool.used < least) {
+			least, found = pool.used, true
+		}
+	}
+	return least, found
+}
+
+// poolAhead reports whether another pool with waiters of the class used less than the given one.
+func (m *priorityMutex) poolAhead(p priorityClass, pool *sharePool) bool {
+	for _, other := range m.pools {
+		if other != pool && other.waiting[p] > 0 && other.used < pool.used {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *priorityMutex) higherWaiting(p priorityClass) bool {
+	for higher := p + 1; higher < priorityClasses; higher++ {
+		if m.waiting[higher] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *priorityMutex) Unlock() {
+	m.mu.Lock()
+	m.held--
+	m.mu.Unlock()
+	m.cond.Broadcast()
+}
@@ -0,0 +1,147 @@
+package attach
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrUnknownJob = errors.New("no running or recently finished attach job with the request id")
+var ErrStreamingUnsupported = errors.New("the connection doesn't support streaming")
+
+const progressPath = "/attach/progress"
+
+// finished jobs stay visible this long, so that clients subscribing late still get the outcome
+const progressLinger = time.Minute
+
+// jobProgress is the state of an attach job as streamed to its client.
+type jobProgress struct {
+	identity string
+	Done     int    `json:"done"`
+	Total    int    `json:"total"`
+	Status   string `json:"status"`
+	// subscribers are notified of every change
+	subs map[chan struct{}]bool
+}
+
+// progressStream streams the PoW progress of attach jobs as server-sent events, e.g.
+// "7/20 transactions attached", so that clients of long bundles can show progress
+// instead of waiting on an opaque request.
+type progressStream struct {
+	mu   sync.Mutex
+	jobs map[string]*jobProgress
+}
+
+func newProgressStream() *progressStream {
+	return &progressStream{jobs: map[string]*jobProgress{}}
+}
+
+// Begin registers the job of a request.
+func (p *progressStream) Begin(requestID string, identity string, total int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.jobs[requestID] = &jobProgress{identity: identity, Total: total, Status: jobRunning, subs: map[chan struct{}]bool{}}
+}
+
+func (p *progressStream) update(requestID string, fn func(job *jobProgress)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	job, ok := p.jobs[requestID]
+	if !ok {
+		return
+	}
+	fn(job)
+	for sub := range job.subs {
+		select {
+		case sub <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Progress records the number of transactions whose PoW is done.
+func (p *progressStream) Progress(requestID string, done int) {
+	p.update(requestID, func(job *jobProgress) { job.Done = done })
+}
+
+// Finish records the outcome of the job, it is forgotten after a while.
+func (p *progressStream) Finish(requestID string, status string) {
+	p.update(requestID, func(job *jobProgress) { job.Status = status })
+	time.AfterFunc(progressLinger, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if job, ok := p.jobs[requestID]; ok && job.Status != jobRunning {
+			delete(p.jobs, requestID)
+		}
+	})
+}
+
+// subscribe returns the job and a channel notified of its changes.
+func (p *progressStream) subscribe(requestID string) (*jobProgress, chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	job, ok := p.jobs[requestID]
+	if !ok {
+		return nil, nil
+	}
+	sub := make(chan struct{}, 1)
+	job.subs[sub] = true
+	return job, sub
+}
+
+func (p *progressStream) unsubscribe(job *jobProgress, sub chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(job.subs, sub)
+}
+
+// snapshot returns the current state of the job as JSON.
+func (p *progressStream) snapshot(job *jobProgress) ([]byte, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	data, _ := json.Marshal(job)
+	return data, job.Status != jobRunning
+}
+
+func (s *site) isProgressRequest(r *http.Request) bool {
+	return s.progress != nil && r.Method == http.MethodGet && r.URL.Path == progressPath
+}
+
+// serveProgress streams the progress of the job with the requestId of the query until it
+// is done. jobs are only streamed to the client which sent them.
+func (s *site) serveProgress(w http.ResponseWriter, r *http.Request) (int, error) {
+	job, sub := s.progress.subscribe(jobKey(s.callerOwner(r), r.URL.Query().Get("requestId")))
+	if job == nil {
+		return http.StatusNotFound, ErrUnknownJob
+	}
+	defer s.progress.unsubscribe(job, sub)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return http.StatusInternalServerError, ErrStreamingUnsupported
+	}
+	w.Header().Set(contentType, "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("access-control-allow-origin", "*")
+	w.WriteHeader(http.StatusOK)
+	for {
+		data, done := s.progress.snapshot(job)
+		event := "progress"
+		if done {
+			event = "done"
+		}
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+		flusher.Flush()
+		if done {
+			return 0, nil
+		}
+		select {
+		case <-sub:
+		case <-r.Context().Done():
+			return 0, nil
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package attach
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeProgressOwnership(t *testing.T) {
+	s := newSite()
+	s.progress = newProgressStream()
+	owner := "ip:192.0.2.1"
+	s.progress.Begin(jobKey(owner, "req"), owner, 4)
+	s.progress.Progress(jobKey(owner, "req"), 4)
+	s.progress.Finish(jobKey(owner, "req"), jobAttached)
+
+	serve := func(remoteAddr string, requestID string) (int, string) {
+		r := httptest.NewRequest(http.MethodGet, progressPath+"?requestId="+requestID, nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		status, _ := s.serveProgress(w, r)
+		if status == 0 {
+			status = w.Code
+		}
+		return status, w.Body.String()
+	}
+
+	status, stream := serve("192.0.2.1:1234", "req")
+	if status != http.StatusOK || !strings.Contains(stream, "event: done\n") || !strings.Contains(stream, `"done":4,"total":4`) {
+		t.Fatalf("expected the owner to get the outcome of the job, got %d %q", status, stream)
+	}
+	// other clients sending the same request id don't see the job
+	if status, _ := serve("192.0.2.2:1234", "req"); status != http.StatusNotFound {
+		t.Fatalf("expected another client not to find the job, got %d", status)
+	}
+	if status, _ := serve("192.0.2.1:1234", "other"); status != http.StatusNotFound {
+		t.Fatalf("expected an unknown request id not to be found, got %d", status)
+	}
+}
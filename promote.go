@@ -0,0 +1,186 @@
+package attach
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var ErrHelpersWithoutUpstream = errors.New("promote_reattach requires the upstream option")
+var ErrInvalidTail = errors.New("the tail transaction is invalid or unknown to the node")
+var ErrIncompleteBundle = errors.New("the bundle of the tail transaction is incomplete on the node")
+var ErrInvalidBroadcastRetries = errors.New("expected a max number of retries after the broadcast_retries option")
+
+const metricBroadcastRetries = "attach.broadcast_retries"
+
+// parts of the node's error messages when it refuses a bundle because of its tips
+var staleTipsMessages = []string{"not consistent", "inconsistent", "stale", "max depth", "invalid transaction timestamp"}
+
+// isStaleTipsError reports whether the node refused the bundle because of old or inconsistent tips.
+func isStaleTipsError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, part := range staleTipsMessages {
+		if strings.Contains(msg, part) {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	promoteTransactionCommand = "promoteTransaction"
+	reattachCommand           = "reattach"
+)
+
+// PromoteCmd is the body of the promoteTransaction and reattach commands.
+type PromoteCmd struct {
+	Command string `json:"command"`
+	Tail    Trytes `json:"tail"`
+	MWM     int    `json:"minWeightMagnitude"`
+}
+
+// PromoteRes carries the attached and broadcast transactions, tail first.
+type PromoteRes struct {
+	Trytes   []Trytes `json:"trytes"`
+	Hashes   []Trytes `json:"hashes"`
+	Duration int64    `json:"duration"`
+}
+
+// fetchBundle fetches the bundle of the given tail from the node, in index order.
+func fetchBundle(api *nodeClient, tail Trytes, maxTxs int) ([]Tx, error) {
+	var txs []Tx
+	hash := tail
+	for {
+		res, err := api.GetTrytes([]Trytes{hash})
+		if err != nil {
+			return nil, err
+		}
+		if len(res) != 1 || res[0].Hash() != hash {
+			return nil, ErrIncompleteBundle
+		}
+		tx := res[0]
+		if len(txs) == 0 && tx.CurrentIndex != 0 {
+			return nil, ErrInvalidTail
+		}
+		if tx.CurrentIndex != int64(len(txs)) || (len(txs) > 0 && tx.Bundle != txs[0].Bundle) {
+			return nil, ErrIncompleteBundle
+		}
+		if tx.LastIndex >= int64(maxTxs) {
+			return nil, errors.Wrapf(ErrTxBundleLimitExceeded, "max allowed is %d", maxTxs)
+		}
+		txs = append(txs, tx)
+		if tx.CurrentIndex == tx.LastIndex {
+			return txs, nil
+		}
+		hash = tx.TrunkTransaction
+	}
+}
+
+// servePromote promotes or reattaches the bundle of a tail transaction: tips are
+// fetched from the node, the PoW is done locally and the result is broadcast and stored.
+// if the node refuses the bundle because of stale tips, fresh tips are fetched and the
+// PoW is redone up to broadcastRetries times, each charged like a new request.
+func (s *site) servePromote(w http.ResponseWriter, r *http.Request, span trace.Span, body []byte) (int, error) {
+	start := time.Now()
+	command := &PromoteCmd{}
+	if err := json.Unmarshal(body, command); err != nil {
+		return http.StatusBadRequest, ErrBodyUnparsable
+	}
+	if len(command.Tail) != hashTrinarySize/3 || command.Tail.IsValid() != nil {
+		return http.StatusBadRequest, ErrInvalidTail
+	}
+	span.SetAttributes(attribute.String("attach.tail", string(command.Tail)))
+	api := nodeAPI(s.upstream, s.upstream.Client())
+
+	var txs []Tx
+	if command.Command == reattachCommand {
+		var err error
+		if txs, err = fetchBundle(api, command.Tail, s.limits().MaxTxs); err != nil {
+			return http.StatusBadRequest, err
+		}
+	} else {
+		txs = zeroValueBundle(emptyHash, "")
+	}
+	approve := func() (*Transaction, error) {
+		trunk, branch, err := s.selectTips(defaultTipSelectionDepth)
+		if err != nil {
+			return nil, errors.Wrap(ErrFetchRawTips, err.Error())
+		}
+		if command.Command == promoteTransactionCommand {
+			// the promotion approves the tail and a fresh tip
+			trunk = command.Tail
+		}
+		return &Transaction{Trunk: trunk, Branch: branch, Transactions: txs}, nil
+	}
+
+	for attempt := 0; ; attempt++ {
+		tra, err := approve()
+		if err != nil {
+			return http.StatusBadGateway, err
+		}
+
+		grant, status, err := s.admitAttach(w, r, span, body, command.Command, len(txs), command.MWM, admitCharge)
+		if err != nil {
+			s.countRejection(err)
+			spanError(span, err)
+			return status, err
+		}
+
+		releaseJob, err := s.acquireJob(command.Command, grant.identity, s.clientHost(r))
+		if err != nil {
+			s.countRejection(err)
+			spanError(span, err)
+			return http.StatusTooManyRequests, err
+		}
+		s.scheduler.Acquire(grant.priority, grant.pool, len(txs))
+		powStart := time.Now()
+		err = s.doPow(r.Context(), tra, txs, int64(s.network.MWM(command.MWM)), s.powFn, nil)
+		releaseJob()
+		powTime := time.Since(powStart)
+		s.scheduler.pressure.Observe(len(txs), powTime)
+		s.scheduler.Release()
+		if err != nil {
+			metricsReg.Inc(metricAttachErrors)
+			failSpan(span, err)
+			return http.StatusInternalServerError, ErrPoWFailed
+		}
+		metricsReg.Inc(metricAttachBundles)
+		metricsReg.Add(metricAttachTxs, int64(len(txs)))
+		recordKeyUsage(grant.identity, len(txs), int64(powTime/time.Millisecond))
+
+		err = api.BroadcastTransactions(txs)
+		if err == nil {
+			err = api.StoreTransactions(txs)
+		}
+		if err == nil {
+			break
+		}
+		if attempt >= s.broadcastRetries || !isStaleTipsError(err) {
+			return http.StatusBadGateway, err
+		}
+		metricsReg.Inc(metricBroadcastRetries)
+		logger.Warnf("node refused %s of tail %s for its tips, retrying with fresh ones: %s\n", command.Command, command.Tail, err.Error())
+	}
+	logger.Requestf("%s of tail %s attached and broadcast %d txs\n", command.Command, command.Tail, len(txs))
+
+	res := &PromoteRes{Trytes: make([]Trytes, len(txs)), Hashes: make([]Trytes, len(txs))}
+	for i := range txs {
+		res.Trytes[i] = txs[i].Trytes()
+		res.Hashes[i] = txs[i].Hash()
+	}
+	res.Duration = int64(time.Since(start) / time.Millisecond)
+	resBytes, err := json.Marshal(res)
+	if err != nil {
+		return http.StatusInternalServerError, ErrBuildingRes
+	}
+	s.signResponse(w, resBytes)
+	w.Header().Set(contentType, contentTypeJSON)
+	w.Header().Set("access-control-allow-origin", "*")
+	w.Write(resBytes)
+	return http.StatusOK, nil
+}
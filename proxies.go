@@ -0,0 +1,71 @@
+package attach
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidTrustedProxy = errors.New("expected CIDRs or IPs after the trusted_proxies option")
+
+// parseCIDRs parses CIDRs and plain IPs, the latter as single host networks.
+func parseCIDRs(args []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(args))
+	for _, arg := range args {
+		if !strings.Contains(arg, "/") {
+			ip := net.ParseIP(arg)
+			if ip == nil {
+				return nil, errors.Errorf("invalid IP %s", arg)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(arg)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClient returns the client address forwarded by a trusted proxy. the
+// X-Forwarded-For chain is walked from the right as only the entries appended by
+// trusted proxies can be relied upon.
+func (s *site) forwardedClient(r *http.Request) (string, bool) {
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			if i == 0 || !containsIP(s.trustedProxies, hop) {
+				return hop, true
+			}
+		}
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP, true
+	}
+	return "", false
+}
@@ -0,0 +1,89 @@
+package attach
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := parseCIDRs([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::1", "2001:db8:1::/48"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host    string
+		trusted bool
+	}{
+		{"10.1.2.3", true},
+		{"11.0.0.1", false},
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"::ffff:192.0.2.1", true},
+		{"2001:db8::1", true},
+		{"2001:db8::2", false},
+		{"2001:db8:1::5", true},
+		{"not an ip", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if containsIP(nets, test.host) != test.trusted {
+			t.Errorf("%q: expected trusted to be %v", test.host, test.trusted)
+		}
+	}
+	for _, arg := range []string{"10.0.0.0/33", "10.0.0", "localhost"} {
+		if _, err := parseCIDRs([]string{arg}); err == nil {
+			t.Errorf("%q: expected an error", arg)
+		}
+	}
+}
+
+func TestClientHost(t *testing.T) {
+	s := newSite()
+	var err error
+	if s.trustedProxies, err = parseCIDRs([]string{"10.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		realIP     string
+		client     string
+	}{
+		{"direct", "198.51.100.7:1234", "", "", "198.51.100.7"},
+		{"spoofed by an untrusted peer", "198.51.100.7:1234", "203.0.113.9", "203.0.113.8", "198.51.100.7"},
+		{"forwarded by a trusted proxy", "10.0.0.1:1234", "203.0.113.9", "", "203.0.113.9"},
+		// the client may send its own X-Forwarded-For, only the hop appended by the proxy counts
+		{"client prepended hops", "10.0.0.1:1234", "192.0.2.66, 203.0.113.9", "", "203.0.113.9"},
+		{"chain of trusted proxies", "10.0.0.1:1234", "192.0.2.66, 203.0.113.9, 10.0.0.2", "", "203.0.113.9"},
+		{"only trusted hops", "10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "", "10.0.0.3"},
+		{"real ip of a trusted proxy", "10.0.0.1:1234", "", "203.0.113.9", "203.0.113.9"},
+		{"invalid real ip", "10.0.0.1:1234", "", "somewhere", "10.0.0.1"},
+		{"without a port", "198.51.100.7", "", "", "198.51.100.7"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.xff != "" {
+			r.Header.Set("X-Forwarded-For", test.xff)
+		}
+		if test.realIP != "" {
+			r.Header.Set("X-Real-IP", test.realIP)
+		}
+		if client := s.clientHost(r); client != test.client {
+			t.Errorf("%s: expected %s, got %s", test.name, test.client, client)
+		}
+	}
+}
+
+func TestClientHostWithoutTrustedProxies(t *testing.T) {
+	s := newSite()
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "203.0.113.9")
+	r.Header.Set("X-Real-IP", "203.0.113.9")
+	if client := s.clientHost(r); client != "10.0.0.1" {
+		t.Fatalf("expected the forwarding headers to be ignored, got %s", client)
+	}
+}
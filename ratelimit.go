@@ -0,0 +1,134 @@
+package attach
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrRateLimited = errors.New("rate limit exceeded, try again later")
+var ErrHashBudgetExceeded = errors.New("hash budget exceeded, try again later")
+var ErrInvalidHashBudget = errors.New("expected a positive number of hashes per minute after the hash_budget option")
+
+// tokenBucket refills at rate tokens per minute up to a burst of rate tokens.
+type tokenBucket struct {
+	tokens   float64
+	lastFill time.Time
+}
+
+// rateLimiter keeps a token bucket per identity.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+var limiter = &rateLimiter{buckets: map[string]*tokenBucket{}}
+
+// Allow consumes a token of the identity's bucket which holds up to perMinute tokens.
+func (l *rateLimiter) Allow(identity string, perMinute int) bool {
+	return l.AllowN(identity, 1, float64(perMinute))
+}
+
+// AllowN consumes cost tokens of the identity's bucket which holds up to perMinute tokens.
+// a cost above the bucket size is allowed once the bucket is full and leaves the bucket
+// in debt, so that it is still charged in full.
+func (l *rateLimiter) AllowN(identity string, cost float64, perMinute float64) bool {
+	return l.take(identity, cost, perMinute, true)
+}
+
+// Available reports whether AllowN would succeed without consuming any tokens.
+func (l *rateLimiter) Available(identity string, cost float64, perMinute float64) bool {
+	return l.take(identity, cost, perMinute, false)
+}
+
+func (l *rateLimiter) take(identity string, cost float64, perMinute float64, consume bool) bool {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[identity]
+	if !ok {
+		b = &tokenBucket{tokens: perMinute, lastFill: now}
+		l.buckets[identity] = b
+	}
+	b.tokens += now.Sub(b.lastFill).Minutes() * perMinute
+	if b.tokens > perMinute {
+		b.tokens = perMinute
+	}
+	b.lastFill = now
+	if b.tokens < math.Min(cost, perMinute) {
+		return false
+	}
+	if !consume {
+		return true
+	}
+	b.tokens -= cost
+	l.gc(now)
+	return true
+}
+
+// Remaining returns the tokens left in the identity's bucket and how long it takes to fill up again.
+func (l *rateLimiter) Remaining(identity string, perMinute float64) (float64, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[identity]
+	if !ok {
+		return perMinute, 0
+	}
+	tokens := math.Min(perMinute, b.tokens+now.Sub(b.lastFill).Minutes()*perMinute)
+	return tokens, time.Duration((perMinute - tokens) / perMinute * float64(time.Minute))
+}
+
+const (
+	rateLimitLimitHeader     = "X-RateLimit-Limit"
+	rateLimitRemainingHeader = "X-RateLimit-Remaining"
+	// the seconds until the full limit is available again
+	rateLimitResetHeader = "X-RateLimit-Reset"
+)
+
+// setRateLimitHeaders tells the client how much of its rate limit is left, so that it can
+// throttle itself. if several limits apply, the one with the fewest remaining requests wins.
+func setRateLimitHeaders(w http.ResponseWriter, identity string, perMinute float64) {
+	tokens, reset := limiter.Remaining(identity, perMinute)
+	remaining := int64(math.Max(0, math.Floor(tokens)))
+	if prev, err := strconv.ParseInt(w.Header().Get(rateLimitRemainingHeader), 10, 64); err == nil && prev <= remaining {
+		return
+	}
+	w.Header().Set(rateLimitLimitHeader, strconv.FormatInt(int64(perMinute), 10))
+	w.Header().Set(rateLimitRemainingHeader, strconv.FormatInt(remaining, 10))
+	w.Header().Set(rateLimitResetHeader, strconv.FormatInt(int64(math.Ceil(reset.Seconds())), 10))
+}
+
+// estimatedHashes returns the expected number of Curl hashes needed to find nonces
+// with the given min weight magnitude for txs transactions.
+func estimatedHashes(txs int, mwm int) float64 {
+	return float64(txs) * math.Pow(3, float64(mwm))
+}
+
+// the MWM at which a request costs exactly one rate limit token
+const baseCostMWM = 9
+
+// requestCost weights a request by 3^(mwm-9) since every additional MWM triples the
+// expected work. requests below MWM 9 still cost a full token.
+func requestCost(mwm int) float64 {
+	return math.Max(1, math.Pow(3, float64(mwm-baseCostMWM)))
+}
+
+// the limiter identity of the global hash budget
+const hashBudgetIdentity = "hash_budget"
+
+// gc drops buckets which have been idle long enough to be full again.
+func (l *rateLimiter) gc(now time.Time) {
+	if len(l.buckets) < 1024 {
+		return
+	}
+	for identity, b := range l.buckets {
+		if now.Sub(b.lastFill) > time.Hour {
+			delete(l.buckets, identity)
+		}
+	}
+}
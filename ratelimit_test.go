@@ -0,0 +1,104 @@
+package attach
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	l := &rateLimiter{buckets: map[string]*tokenBucket{}}
+	for i := 0; i < 3; i++ {
+		if !l.Allow("client", 3) {
+			t.Fatalf("expected request %d to be allowed", i+1)
+		}
+	}
+	if l.Allow("client", 3) {
+		t.Fatal("expected the fourth request to be rate limited")
+	}
+	if !l.Allow("other", 3) {
+		t.Fatal("expected other identities to have buckets of their own")
+	}
+
+	// a minute refills the whole bucket, but not beyond it
+	l.buckets["client"].lastFill = time.Now().Add(-2 * time.Minute)
+	for i := 0; i < 3; i++ {
+		if !l.Allow("client", 3) {
+			t.Fatalf("expected request %d after the refill to be allowed", i+1)
+		}
+	}
+	if l.Allow("client", 3) {
+		t.Fatal("expected the refill to be capped at the bucket size")
+	}
+}
+
+func TestRateLimiterAllowN(t *testing.T) {
+	l := &rateLimiter{buckets: map[string]*tokenBucket{}}
+	if !l.Available("client", 9, 10) {
+		t.Fatal("expected 9 of 10 tokens to be available")
+	}
+	if !l.AllowN("client", 9, 10) {
+		t.Fatal("expected 9 of 10 tokens to be allowed")
+	}
+	if l.Available("client", 2, 10) || l.AllowN("client", 2, 10) {
+		t.Fatal("expected 2 more tokens to be refused")
+	}
+	if tokens, _ := l.Remaining("client", 10); tokens < 1 || tokens > 1.1 {
+		t.Fatalf("expected refused and peeked requests not to consume tokens, %g left", tokens)
+	}
+
+	// a cost above the bucket size passes on a full bucket and leaves it in debt
+	if !l.AllowN("expensive", 30, 10) {
+		t.Fatal("expected the cost above the bucket size to be allowed on a full bucket")
+	}
+	l.buckets["expensive"].lastFill = time.Now().Add(-90 * time.Second)
+	if l.AllowN("expensive", 1, 10) {
+		t.Fatal("expected the debt not to be paid off after 90s")
+	}
+	l.buckets["expensive"].lastFill = time.Now().Add(-time.Minute)
+	if !l.AllowN("expensive", 1, 10) {
+		t.Fatal("expected the debt to be paid off after another minute")
+	}
+}
+
+func TestRequestCost(t *testing.T) {
+	tests := []struct {
+		mwm  int
+		cost float64
+	}{
+		{1, 1},
+		{9, 1},
+		{10, 3},
+		{11, 9},
+		// mainnet pins the MWM to 14
+		{14, 243},
+	}
+	for _, test := range tests {
+		if cost := requestCost(test.mwm); cost != test.cost {
+			t.Errorf("mwm %d: expected a cost of %g, got %g", test.mwm, test.cost, cost)
+		}
+	}
+}
+
+func TestSetRateLimitHeaders(t *testing.T) {
+	saved := limiter
+	defer func() { limiter = saved }()
+	limiter = &rateLimiter{buckets: map[string]*tokenBucket{}}
+
+	limiter.AllowN("key:wallet", 1, 10)
+	limiter.AllowN("geo:192.0.2.1", 4, 5)
+	w := httptest.NewRecorder()
+	setRateLimitHeaders(w, "key:wallet", 10)
+	if w.Header().Get(rateLimitLimitHeader) != "10" || w.Header().Get(rateLimitRemainingHeader) != "9" {
+		t.Fatalf("unexpected headers %v", w.Header())
+	}
+	// the limit with the fewest remaining requests wins, whatever the order
+	setRateLimitHeaders(w, "geo:192.0.2.1", 5)
+	setRateLimitHeaders(w, "key:wallet", 10)
+	if w.Header().Get(rateLimitLimitHeader) != "5" || w.Header().Get(rateLimitRemainingHeader) != "1" {
+		t.Fatalf("expected the tighter limit, got %v", w.Header())
+	}
+	if reset := w.Header().Get(rateLimitResetHeader); reset != "48" {
+		t.Fatalf("expected the limit to be full again in 48s, got %s", reset)
+	}
+}
@@ -0,0 +1,43 @@
+package attach
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"runtime/debug"
+)
+
+const metricAttachPanics = "attach.panics"
+
+// the header carrying the request ID, generated if the client didn't send one
+const requestIDHeader = "X-Request-ID"
+
+// requestID returns the ID under which a request shows up in the logs. a generated
+// ID is stored on the request so that it stays the same and is passed on to the node.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" {
+		return id
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	id := hex.EncodeToString(b)
+	r.Header.Set(requestIDHeader, id)
+	return id
+}
+
+// recoverAttach turns a panic in the attach pipeline into an IRI-style 500 response.
+// it must be deferred directly. the PoW lock is released by the handler's own deferred
+// unlock while the panic unwinds, so a bad bundle can't block all further requests.
+func (s *site) recoverAttach(w http.ResponseWriter, r *http.Request, status *int, err *error) {
+	rec := recover()
+	if rec == nil {
+		return
+	}
+	metricsReg.Inc(metricAttachPanics)
+	metricsReg.Inc(metricAttachErrors)
+	logger.Errorf("recovered from panic in request %s: %v\n%s", requestID(r), rec, debug.Stack())
+	s.writeError(w, http.StatusInternalServerError, ErrInternal)
+	*status, *err = 0, nil
+}
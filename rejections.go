@@ -0,0 +1,201 @@
+package attach
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidRejectionAlertOption = errors.New("expected a max number of rejections per minute and an optional webhook URL after the rejection_alert option")
+
+// the prefix of the per reason rejection counters
+const metricRejectedPrefix = "attach.rejected."
+
+// the rejection reasons
+const (
+	reasonAuthFailed       = "auth_failed"
+	reasonDenied           = "denied"
+	reasonLimitExceeded    = "limit_exceeded"
+	reasonRateLimited      = "rate_limited"
+	reasonOverloaded       = "overloaded"
+	reasonInvalidTrytes    = "invalid_trytes"
+	reasonInvalidTips      = "invalid_tips"
+	reasonInvalidTimestamp = "invalid_timestamp"
+	reasonReplayed         = "replayed"
+	reasonOther            = "other"
+)
+
+var rejectionReasons = map[error]string{
+	ErrAPIKeyRequired:        reasonAuthFailed,
+	ErrMissingBearerToken:    reasonAuthFailed,
+	ErrInvalidBearerToken:    reasonAuthFailed,
+	ErrUnknownSigningKey:     reasonAuthFailed,
+	ErrMissingSignature:      reasonAuthFailed,
+	ErrInvalidSignature:      reasonAuthFailed,
+	ErrSignatureExpired:      reasonAuthFailed,
+	ErrSignatureReplayed:     reasonAuthFailed,
+	ErrClientCertRequired:    reasonAuthFailed,
+	ErrInvalidReservation:    reasonAuthFailed,
+	ErrIPDenied:              reasonDenied,
+	ErrCountryDenied:         reasonDenied,
+	ErrUserAgentDenied:       reasonDenied,
+	ErrCommandNotAllowed:     reasonDenied,
+	ErrClientCertNotAllowed:  reasonDenied,
+	ErrBundleDenied:          reasonDenied,
+	ErrPolicyDenied:          reasonDenied,
+	ErrNotAuthorized:         reasonDenied,
+	ErrTxBundleLimitExceeded: reasonLimitExceeded,
+	ErrBundleLimitTightened:  reasonLimitExceeded,
+	ErrMWMNotAllowed:         reasonLimitExceeded,
+	ErrBatchTooLarge:         reasonLimitExceeded,
+	ErrTrytesSizeExceeded:    reasonLimitExceeded,
+	ErrRateLimited:           reasonRateLimited,
+	ErrHashBudgetExceeded:    reasonRateLimited,
+	ErrTooManyJobs:           reasonRateLimited,
+	ErrSpamDetected:          reasonRateLimited,
+	ErrOverloaded:            reasonOverloaded,
+	ErrEarlyRejected:         reasonOverloaded,
+	ErrBuildingTx:            reasonInvalidTrytes,
+	ErrMalformedTrytes:       reasonInvalidTrytes,
+	ErrInvalidTips:           reasonInvalidTips,
+	ErrEmptyTips:             reasonInvalidTips,
+	ErrStaleTips:             reasonInvalidTips,
+	ErrImplausibleTimestamp:  reasonInvalidTimestamp,
+	ErrBundleAlreadyAttached: reasonReplayed,
+}
+
+// rejectionReason classifies the error a request was rejected with.
+func rejectionReason(err error) string {
+	if reason, ok := rejectionReasons[errors.Cause(err)]; ok {
+		return reason
+	}
+	return reasonOther
+}
+
+// rejectionAlert fires when the rejections of any reason within the last minute
+// exceed the threshold, which usually means a client release misbehaves.
+// every reason alerts at most once per minute.
+type rejectionAlert struct {
+	threshold int
+	webhook   string
+	client    *http.Client
+
+	mu      sync.Mutex
+	counts  map[string]*rejectionWindow
+	alerted map[string]time.Time
+}
+
+// rejectionWindow counts rejections in per second slots over the last minute.
+type rejectionWindow struct {
+	slots [60]struct {
+		second int64
+		count  int
+	}
+}
+
+func (w *rejectionWindow) Add(now time.Time) int {
+	second := now.Unix()
+	slot := &w.slots[second%int64(len(w.slots))]
+	if slot.second != second {
+		slot.second, slot.count = second, 0
+	}
+	slot.count++
+	total := 0
+	for _, s := range w.slots {
+		if second-s.second < int64(len(w.slots)) {
+			total += s.count
+		}
+	}
+	return total
+}
+
+// newRejectionAlert parses "<max per minute> [webhook URL]".
+func newRejectionAlert(args []string) (*rejectionAlert, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, ErrInvalidRejectionAlertOption
+	}
+	threshold, err := strconv.Atoi(args[0])
+	if err != nil || threshold <= 0 {
+		return nil, ErrInvalidRejectionAlertOption
+	}
+	a := &rejectionAlert{
+		threshold: threshold,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		counts:    map[string]*rejectionWindow{},
+		alerted:   map[string]time.Time{},
+	}
+	if len(args) == 2 {
+		a.webhook = args[1]
+	}
+	return a, nil
+}
+
+// countRejection accounts for a rejected attach request by its reason.
+func (s *site) countRejection(err error) {
+	metricsReg.Inc(metricAttachRejected)
+	reason := rejectionReason(err)
+	metricsReg.Inc(metricRejectedPrefix + reason)
+	if s.rejections != nil {
+		s.rejections.Observe(reason, time.Now())
+	}
+}
+
+func (a *rejectionAlert) Observe(reason string, now time.Time) {
+	a.mu.Lock()
+	window, ok := a.counts[reason]
+	if !ok {
+		window = &rejectionWindow{}
+		a.counts[reason] = window
+	}
+	count := window.Add(now)
+	fire := count > a.threshold && now.Sub(a.alerted[reason]) >= time.Minute
+	if fire {
+		a.alerted[reason] = now
+	}
+	a.mu.Unlock()
+	if fire {
+		logger.Warnf("%d requests rejected with reason %s within the last minute (threshold %d)\n", count, reason, a.threshold)
+		alerts.Fire(eventRejectionSpike+"."+reason, "%d requests rejected with reason %s within the last minute", count, reason)
+		if a.webhook != "" {
+			go a.notify(reason, count, now)
+		}
+	}
+}
+
+type rejectionAlertMsg struct {
+	Reason    string    `json:"reason"`
+	Count     int       `json:"count"`
+	Threshold int       `json:"threshold"`
+	Window    string    `json:"window"`
+	Time      time.Time `json:"time"`
+}
+
+func (a *rejectionAlert) notify(reason string, count int, now time.Time) {
+	body, err := json.Marshal(&rejectionAlertMsg{Reason: reason, Count: count, Threshold: a.threshold, Window: "1m", Time: now})
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), a.client.Timeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, a.webhook, bytes.NewReader(body))
+	if err != nil {
+		logger.Errorf("unable to send rejection alert: %s\n", err.Error())
+		return
+	}
+	req.Header.Set(contentType, contentTypeJSON)
+	res, err := a.client.Do(req.WithContext(ctx))
+	if err != nil {
+		logger.Errorf("unable to send rejection alert: %s\n", err.Error())
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode >= http.StatusBadRequest {
+		logger.Errorf("rejection alert webhook answered with status %d\n", res.StatusCode)
+	}
+}
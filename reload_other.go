@@ -0,0 +1,10 @@
+//go:build windows || plan9 || nacl
+// +build windows plan9 nacl
+
+package attach
+
+import "github.com/pkg/errors"
+
+func requestReload() error {
+	return errors.New("reloading on config file changes is not supported on this platform")
+}
@@ -0,0 +1,18 @@
+//go:build !windows && !plan9 && !nacl
+// +build !windows,!plan9,!nacl
+
+package attach
+
+import (
+	"os"
+	"syscall"
+)
+
+// requestReload makes Caddy reload its configuration like on SIGUSR1 from the outside.
+func requestReload() error {
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		return err
+	}
+	return p.Signal(syscall.SIGUSR1)
+}
@@ -0,0 +1,151 @@
+package attach
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/coreos/bbolt"
+	"github.com/pkg/errors"
+)
+
+var ErrBundleAlreadyAttached = errors.New("bundle was already attached by this node, set force to attach it again")
+var ErrInvalidReplayOption = errors.New("expected ttl and optional database path after the replay_protection option")
+
+var attachedBucket = []byte("attached")
+
+// attachedStore remembers the hashes of bundles which were successfully attached.
+type attachedStore interface {
+	Seen(bundle string) (bool, error)
+	Add(bundle string, ttl time.Duration) error
+	Close() error
+}
+
+// replayGuard rejects exact re-submissions of already attached bundles
+// within the ttl, preventing reattach loops of misbehaving clients.
+type replayGuard struct {
+	ttl   time.Duration
+	path  string
+	store attachedStore
+}
+
+func newReplayGuard(args []string) (*replayGuard, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, ErrInvalidReplayOption
+	}
+	ttl, err := time.ParseDuration(args[0])
+	if err != nil || ttl <= 0 {
+		return nil, ErrInvalidReplayOption
+	}
+	g := &replayGuard{ttl: ttl}
+	if len(args) == 2 {
+		g.path = args[1]
+	}
+	return g, nil
+}
+
+func (g *replayGuard) Start() error {
+	if g.path == "" {
+		g.store = &memoryAttachedStore{entries: map[string]time.Time{}}
+		return nil
+	}
+	store, err := openBoltAttachedStore(g.path)
+	if err != nil {
+		return err
+	}
+	g.store = store
+	return nil
+}
+
+func (g *replayGuard) Stop() error {
+	if g.store == nil {
+		return nil
+	}
+	err := g.store.Close()
+	g.store = nil
+	return err
+}
+
+// memoryAttachedStore keeps the attached bundles in memory only.
+type memoryAttachedStore struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+func (s *memoryAttachedStore) Seen(bundle string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires, ok := s.entries[bundle]
+	return ok && time.Now().Before(expires), nil
+}
+
+func (s *memoryAttachedStore) Add(bundle string, ttl time.Duration) error {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for b, expires := range s.entries {
+		if now.After(expires) {
+			delete(s.entries, b)
+		}
+	}
+	s.entries[bundle] = now.Add(ttl)
+	return nil
+}
+
+func (s *memoryAttachedStore) Close() error {
+	return nil
+}
+
+// boltAttachedStore persists the attached bundles so that the protection survives restarts.
+// values are the expiry time as big endian unix nanoseconds.
+type boltAttachedStore struct {
+	db *bolt.DB
+}
+
+func openBoltAttachedStore(path string) (*boltAttachedStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(attachedBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltAttachedStore{db: db}, nil
+}
+
+func (s *boltAttachedStore) Seen(bundle string) (bool, error) {
+	var seen bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(attachedBucket).Get([]byte(bundle))
+		seen = len(v) == 8 && time.Now().UnixNano() < int64(binary.BigEndian.Uint64(v))
+		return nil
+	})
+	return seen, err
+}
+
+func (s *boltAttachedStore) Add(bundle string, ttl time.Duration) error {
+	now := time.Now()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(attachedBucket)
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if len(v) != 8 || now.UnixNano() >= int64(binary.BigEndian.Uint64(v)) {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+		expires := make([]byte, 8)
+		binary.BigEndian.PutUint64(expires, uint64(now.Add(ttl).UnixNano()))
+		return b.Put([]byte(bundle), expires)
+	})
+}
+
+func (s *boltAttachedStore) Close() error {
+	return s.db.Close()
+}
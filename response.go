@@ -0,0 +1,186 @@
+package attach
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrStrictIRIConflict = errors.New("strict_iri can't be combined with response_hashes, response_timings, response_order, duration_fields or error_codes")
+var ErrInvalidDurationOption = errors.New("expected body, total, pow or queue_pow and an optional unit of ms, us or s after the duration option")
+
+type AttachToTangleRes struct {
+	Trytes   []Trytes `json:"trytes"`
+	Duration int64    `json:"duration"`
+	// Hashes and Bundle are only included if enabled via response_hashes or the request header
+	Hashes []Trytes `json:"hashes,omitempty"`
+	Bundle Trytes   `json:"bundle,omitempty"`
+	// Timings are only included if enabled via response_timings or the request header
+	Timings *AttachTimings `json:"timings,omitempty"`
+	// Durations are only included if enabled via duration_fields
+	Durations *AttachDurations `json:"durations,omitempty"`
+}
+
+// AttachDurations holds the milliseconds of each phase, independent of what the
+// duration field covers.
+type AttachDurations struct {
+	QueueMs int64 `json:"queue"`
+	PoWMs   int64 `json:"pow"`
+	// BodyMs is the time since the body was read, TotalMs since the request was received
+	BodyMs  int64 `json:"body"`
+	TotalMs int64 `json:"total"`
+}
+
+// AttachTimings breaks down where the time of an attach request was spent.
+type AttachTimings struct {
+	QueueMs int64 `json:"queue"`
+	// PoWMs holds the PoW milliseconds per transaction in the order of the returned trytes
+	PoWMs []int64 `json:"pow"`
+}
+
+const (
+	timingsOff = iota
+	timingsInBody
+	timingsInHeaders
+)
+
+// what the duration field covers. IRI measures the whole request, this plugin used
+// to measure from reading the body, which is kept as default outside of strict_iri.
+const (
+	durationDefault = iota
+	durationBody
+	durationTotal
+	durationPoW
+	durationQueuePoW
+)
+
+var durationCovers = map[string]int{"body": durationBody, "total": durationTotal, "pow": durationPoW, "queue_pow": durationQueuePoW}
+var durationUnits = map[string]time.Duration{"ms": time.Millisecond, "us": time.Microsecond, "s": time.Second}
+
+// attachDurations are the phases of an attach request.
+type attachDurations struct {
+	body, total, queue, pow time.Duration
+}
+
+// parseDurationOption parses "<covers> [unit]".
+func parseDurationOption(args []string) (int, time.Duration, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return 0, 0, ErrInvalidDurationOption
+	}
+	covers, ok := durationCovers[args[0]]
+	if !ok {
+		return 0, 0, ErrInvalidDurationOption
+	}
+	unit := time.Millisecond
+	if len(args) == 2 {
+		if unit, ok = durationUnits[args[1]]; !ok {
+			return 0, 0, ErrInvalidDurationOption
+		}
+	}
+	return covers, unit, nil
+}
+
+// duration returns the value of the duration field in the configured unit.
+func (s *site) duration(d *attachDurations) int64 {
+	var took time.Duration
+	switch s.durationCovers {
+	case durationBody:
+		took = d.body
+	case durationTotal:
+		took = d.total
+	case durationPoW:
+		took = d.pow
+	case durationQueuePoW:
+		took = d.queue + d.pow
+	default:
+		took = d.body
+		if s.strictIRI {
+			took = d.total
+		}
+	}
+	return int64(took / s.durationUnit)
+}
+
+const (
+	includeTimingsHeader = "X-Attach-Include-Timings"
+	queueTimeHeader      = "X-Attach-Queue-Ms"
+	powTimesHeader       = "X-Attach-PoW-Ms"
+)
+
+// Ordering of the returned trytes:
+//
+// Wallets submit the bundle's trytes with the last transaction (highest current index)
+// first. IRI attaches them in submission order, chaining every transaction onto the
+// previously attached one, and returns the trytes in reverse, i.e. ordered by current
+// index starting with the tail transaction. Client libraries rely on this and take the
+// first returned trytes as the tail to broadcast and promote.
+//
+// orderIRI (the default) reproduces exactly that. orderSubmitted returns the attached
+// trytes in the order they were submitted instead. Hashes and timings always follow
+// the order of the returned trytes.
+const (
+	orderIRI = iota
+	orderSubmitted
+)
+
+// newAttachResponse builds the response for the attached transactions which are ordered
+// by current index. timing headers are set on w if configured.
+func (s *site) newAttachResponse(w http.ResponseWriter, r *http.Request, txs []Tx, durations *attachDurations, txPoWMs []int64) *AttachToTangleRes {
+	order := make([]int, len(txs))
+	for i := range order {
+		if s.responseOrder == orderSubmitted {
+			order[i] = len(txs) - 1 - i
+		} else {
+			order[i] = i
+		}
+	}
+
+	res := &AttachToTangleRes{Trytes: make([]Trytes, len(txs)), Duration: s.duration(durations)}
+	for i, idx := range order {
+		res.Trytes[i] = txs[idx].Trytes()
+	}
+	if s.strictIRI {
+		return res
+	}
+
+	if s.responseHashes || r.Header.Get(includeHashesHeader) == "true" {
+		res.Hashes = make([]Trytes, len(txs))
+		for i, idx := range order {
+			res.Hashes[i] = txs[idx].Hash()
+		}
+		res.Bundle = txs[0].Bundle
+	}
+
+	if s.durationFields {
+		res.Durations = &AttachDurations{
+			QueueMs: int64(durations.queue / time.Millisecond),
+			PoWMs:   int64(durations.pow / time.Millisecond),
+			BodyMs:  int64(durations.body / time.Millisecond),
+			TotalMs: int64(durations.total / time.Millisecond),
+		}
+	}
+
+	timingsMode := s.responseTimings
+	if timingsMode == timingsOff && r.Header.Get(includeTimingsHeader) == "true" {
+		timingsMode = timingsInBody
+	}
+	powMs := make([]int64, len(txPoWMs))
+	for i, idx := range order {
+		powMs[i] = txPoWMs[idx]
+	}
+	switch timingsMode {
+	case timingsInBody:
+		res.Timings = &AttachTimings{QueueMs: int64(durations.queue / time.Millisecond), PoWMs: powMs}
+	case timingsInHeaders:
+		powMsStrs := make([]string, len(powMs))
+		for i, ms := range powMs {
+			powMsStrs[i] = strconv.FormatInt(ms, 10)
+		}
+		w.Header().Set(queueTimeHeader, strconv.FormatInt(int64(durations.queue/time.Millisecond), 10))
+		w.Header().Set(powTimesHeader, strings.Join(powMsStrs, ","))
+	}
+	return res
+}
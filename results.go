@@ -0,0 +1,283 @@
+package attach
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidKeepResultsOption = errors.New("expected a retention and optional max_count, max_bytes and gc_interval settings after the keep_results option")
+var ErrInvalidGetResultCmd = errors.New("getAttachResult requires a bundle hash or a request id")
+var ErrResultNotFound = errors.New("no attach result for the bundle within the retention")
+
+const defaultResultsGCInterval = time.Minute
+
+// the prefix of the eviction counters, followed by the reason
+const metricResultsEvictedPrefix = "attach.results.evicted."
+
+// the command fetching a previously computed attach result
+const getAttachResultCommand = "getAttachResult"
+
+// GetAttachResultCmd looks up an attach result by bundle hash or by the request id
+// of the attach request.
+type GetAttachResultCmd struct {
+	Command   string `json:"command"`
+	Bundle    string `json:"bundle,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+type storedResult struct {
+	identity  string
+	bundle    string
+	requestID string
+	body      []byte
+	expires   time.Time
+}
+
+// bundleKey namespaces the bundle of the result by its owner, like jobKey does for request ids.
+func (r *storedResult) bundleKey() string {
+	return jobKey(r.identity, r.bundle)
+}
+
+// resultStore keeps the responses of successful attach jobs, so that wallets which
+// crashed before receiving them can fetch them again instead of redoing the PoW.
+// results are dropped after the retention and the oldest ones are evicted early
+// if there are more than maxCount results or they take more than maxBytes.
+type resultStore struct {
+	retention  time.Duration
+	maxCount   int
+	maxBytes   int
+	gcInterval time.Duration
+
+	mu sync.Mutex
+	// the results by the job key of their bundle and request id, as two clients may attach the same bundle
+	byBundle  map[string]*storedResult
+	byRequest map[string]*storedResult
+	// the results in the order they were added, which is also the order they expire in
+	order  []*storedResult
+	bytes  int
+	cancel context.CancelFunc
+
+	// the other stores of the site which are collected alongside
+	history      *attachHistory
+	reservations *reservationStore
+}
+
+// newResultStore parses "<max age> [max_count <n>] [max_bytes <n>] [gc_interval <d>]".
+func newResultStore(args []string) (*resultStore, error) {
+	if len(args) == 0 || len(args)%2 != 1 {
+		return nil, ErrInvalidKeepResultsOption
+	}
+	s := &resultStore{gcInterval: defaultResultsGCInterval, byBundle: map[string]*storedResult{}, byRequest: map[string]*storedResult{}}
+	var err error
+	if s.retention, err = time.ParseDuration(args[0]); err != nil || s.retention <= 0 {
+		return nil, ErrInvalidKeepResultsOption
+	}
+	for i := 1; i < len(args); i += 2 {
+		value := args[i+1]
+		switch args[i] {
+		case "max_count":
+			s.maxCount, err = strconv.Atoi(value)
+		case "max_bytes":
+			s.maxBytes, err = strconv.Atoi(value)
+		case "gc_interval":
+			s.gcInterval, err = time.ParseDuration(value)
+			if err == nil && s.gcInterval <= 0 {
+				err = ErrInvalidKeepResultsOption
+			}
+		default:
+			err = ErrInvalidKeepResultsOption
+		}
+		if err != nil || s.maxCount < 0 || s.maxBytes < 0 {
+			return nil, ErrInvalidKeepResultsOption
+		}
+	}
+	return s, nil
+}
+
+// Add stores the response of the attach job of a bundle.
+func (s *resultStore) Add(identity string, requestID string, bundle string, body []byte) {
+	res := &storedResult{
+		identity:  identity,
+		bundle:    bundle,
+		requestID: requestID,
+		body:      append([]byte(nil), body...),
+		expires:   time.Now().Add(s.retention),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.byBundle[res.bundleKey()]; ok {
+		// the entry in the order is dropped once it is evicted
+		s.forget(old)
+	}
+	s.byBundle[res.bundleKey()] = res
+	if requestID != "" {
+		s.byRequest[requestID] = res
+	}
+	s.order = append(s.order, res)
+	s.bytes += len(res.body)
+	s.evict(time.Now())
+}
+
+// Get returns the stored result by the job key of a bundle or request id.
+func (s *resultStore) Get(bundleKey string, requestKey string) *storedResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res, ok := s.byBundle[bundleKey]
+	if !ok {
+		res, ok = s.byRequest[requestKey]
+	}
+	if !ok || time.Now().After(res.expires) {
+		return nil
+	}
+	return res
+}
+
+// forget removes a result from the lookups, the caller must hold the lock.
+func (s *resultStore) forget(res *storedResult) {
+	if s.byBundle[res.bundleKey()] == res {
+		delete(s.byBundle, res.bundleKey())
+	}
+	if s.byRequest[res.requestID] == res {
+		delete(s.byRequest, res.requestID)
+	}
+}
+
+// evict drops expired results and the oldest ones above the count and size limits.
+// the caller must hold the lock.
+func (s *resultStore) evict(now time.Time) {
+	for len(s.order) > 0 {
+		res := s.order[0]
+		replaced := s.byBundle[res.bundleKey()] != res
+		var reason string
+		switch {
+		case now.After(res.expires):
+			reason = "expired"
+		case s.maxCount > 0 && len(s.order) > s.maxCount:
+			reason = "max_count"
+		case s.maxBytes > 0 && s.bytes > s.maxBytes:
+			reason = "max_bytes"
+		case replaced:
+			reason = "replaced"
+		default:
+			return
+		}
+		s.order[0] = nil
+		s.order = s.order[1:]
+		s.bytes -= len(res.body)
+		s.forget(res)
+		if !replaced {
+			metricsReg.Inc(metricResultsEvictedPrefix + reason)
+		}
+	}
+}
+
+func (s *resultStore) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	go s.collect(ctx)
+	return nil
+}
+
+func (s *resultStore) Stop() error {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	return nil
+}
+
+// collect periodically drops the expired results and entries of the other stores
+// kept for clients, so that idle powboxes release the memory as well.
+func (s *resultStore) collect(ctx context.Context) {
+	ticker := time.NewTicker(s.gcInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			s.evict(now)
+			count, size := len(s.order), s.bytes
+			s.mu.Unlock()
+			if s.history != nil {
+				s.history.Collect()
+			}
+			s.reservations.Collect(now)
+			logger.Debugf("keeping %d attach results with %d bytes\n", count, size)
+		}
+	}
+}
+
+// jobOwner returns who owns the result, partial result and progress of a job: the
+// authenticated client or, for anonymous clients, their address.
+func (s *site) jobOwner(identity string, r *http.Request) string {
+	if identity != "" {
+		return identity
+	}
+	return "ip:" + s.clientHost(r)
+}
+
+// callerOwner returns the job owner the request would be admitted as, without consuming
+// any quota. authentication failures yield an identity owning no job.
+func (s *site) callerOwner(r *http.Request) string {
+	var identity string
+	if s.certAuth != nil {
+		if _, subject, err := s.certAuth.Authorize(r); err == nil {
+			identity = "cert:" + subject
+		}
+	}
+	if s.apiKeys != nil {
+		if key, err := s.apiKeys.Authorize(r); err == nil {
+			identity = "key:" + key.name
+		}
+	}
+	if s.jwtAuthz != nil {
+		if claims, err := s.jwtAuthz.Authorize(r); err == nil {
+			identity = "jwt:" + claims.Subject
+		}
+	}
+	return s.jobOwner(identity, r)
+}
+
+// jobKey namespaces the request ID of a job by its owner. the ID is chosen by the client,
+// keying jobs by owner too keeps clients from colliding with or overwriting others' jobs.
+func jobKey(owner string, requestID string) string {
+	return owner + " " + requestID
+}
+
+// serveGetAttachResult answers the getAttachResult command with the stored response.
+// results are only handed out to the client which attached the bundle.
+func (s *site) serveGetAttachResult(w http.ResponseWriter, r *http.Request, body []byte) (int, error) {
+	command := &GetAttachResultCmd{}
+	if err := json.Unmarshal(body, command); err != nil {
+		return http.StatusBadRequest, ErrBodyUnparsable
+	}
+	if command.Bundle == "" && command.RequestID == "" {
+		return http.StatusBadRequest, ErrInvalidGetResultCmd
+	}
+	owner := s.callerOwner(r)
+	var bundleKey, requestKey string
+	if command.Bundle != "" {
+		bundleKey = jobKey(owner, command.Bundle)
+	}
+	if command.RequestID != "" {
+		requestKey = jobKey(owner, command.RequestID)
+	}
+	// don't tell whether the bundle exists if it isn't the caller's
+	res := s.results.Get(bundleKey, requestKey)
+	if res == nil || res.identity != owner {
+		s.writeError(w, http.StatusNotFound, ErrResultNotFound)
+		return 0, nil
+	}
+	s.signResponse(w, res.body)
+	w.Header().Set(contentType, contentTypeJSON)
+	w.Header().Set("access-control-allow-origin", "*")
+	w.Write(res.body)
+	return http.StatusOK, nil
+}
@@ -0,0 +1,105 @@
+package attach
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// getAttachResult asks the site for a result as the client at the address with the headers.
+func getAttachResult(s *site, remoteAddr string, headers map[string]string, body string) (int, string) {
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.RemoteAddr = remoteAddr
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	status, err := s.serveGetAttachResult(w, r, []byte(body))
+	if err != nil {
+		return status, err.Error()
+	}
+	if status == 0 {
+		status = w.Code
+	}
+	return status, w.Body.String()
+}
+
+func TestGetAttachResultOwnership(t *testing.T) {
+	s := newSite()
+	var err error
+	if s.results, err = newResultStore([]string{"1h"}); err != nil {
+		t.Fatal(err)
+	}
+	s.apiKeys = newAPIKeyAuth()
+	s.apiKeys.Add([]string{"wallet", "wallet-key"})
+	s.apiKeys.Add([]string{"other", "other-key"})
+	s.jwtAuthz = newJWTAuth()
+	s.jwtAuthz.secret = []byte("secret")
+	token := func(subject string) string {
+		raw, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &attachClaims{StandardClaims: jwt.StandardClaims{
+			Subject: subject, ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		}}).SignedString([]byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + raw
+	}
+
+	// the results of a key, a token and an anonymous client, all sent the same request ID
+	s.results.Add("key:wallet", jobKey("key:wallet", "req"), "KEYBUNDLE", []byte(`"key"`))
+	s.results.Add("jwt:alice", jobKey("jwt:alice", "req"), "JWTBUNDLE", []byte(`"jwt"`))
+	s.results.Add("ip:192.0.2.1", jobKey("ip:192.0.2.1", "req"), "IPBUNDLE", []byte(`"ip"`))
+
+	wallet := map[string]string{apiKeyHeader: "wallet-key"}
+	other := map[string]string{apiKeyHeader: "other-key"}
+	alice := map[string]string{"Authorization": token("alice")}
+	mallory := map[string]string{"Authorization": token("mallory")}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		body       string
+		status     int
+		res        string
+	}{
+		{"key by bundle", "198.51.100.1:1", wallet, `{"bundle":"KEYBUNDLE"}`, http.StatusOK, `"key"`},
+		{"key by request id", "198.51.100.1:1", wallet, `{"requestId":"req"}`, http.StatusOK, `"key"`},
+		{"other key by bundle", "198.51.100.1:1", other, `{"bundle":"KEYBUNDLE"}`, http.StatusNotFound, ""},
+		{"other key by request id", "198.51.100.1:1", other, `{"requestId":"req"}`, http.StatusNotFound, ""},
+		{"token by bundle", "198.51.100.1:1", alice, `{"bundle":"JWTBUNDLE"}`, http.StatusOK, `"jwt"`},
+		{"token by request id", "198.51.100.1:1", alice, `{"requestId":"req"}`, http.StatusOK, `"jwt"`},
+		{"other token by bundle", "198.51.100.1:1", mallory, `{"bundle":"JWTBUNDLE"}`, http.StatusNotFound, ""},
+		{"other token by request id", "198.51.100.1:1", mallory, `{"requestId":"req"}`, http.StatusNotFound, ""},
+		{"anonymous by bundle", "192.0.2.1:1", nil, `{"bundle":"IPBUNDLE"}`, http.StatusOK, `"ip"`},
+		{"anonymous by request id", "192.0.2.1:2", nil, `{"requestId":"req"}`, http.StatusOK, `"ip"`},
+		{"other address by bundle", "192.0.2.2:1", nil, `{"bundle":"IPBUNDLE"}`, http.StatusNotFound, ""},
+		{"other address by request id", "192.0.2.2:1", nil, `{"requestId":"req"}`, http.StatusNotFound, ""},
+		{"anonymous for a key's result", "192.0.2.1:1", nil, `{"bundle":"KEYBUNDLE"}`, http.StatusNotFound, ""},
+		{"neither bundle nor request id", "192.0.2.1:1", nil, `{}`, http.StatusBadRequest, ErrInvalidGetResultCmd.Error()},
+	}
+	for _, test := range tests {
+		status, res := getAttachResult(s, test.remoteAddr, test.headers, test.body)
+		if status != test.status || (test.res != "" && res != test.res) {
+			t.Errorf("%s: expected %d %s, got %d %s", test.name, test.status, test.res, status, res)
+		}
+	}
+}
+
+func TestGetAttachResultSharedBundle(t *testing.T) {
+	s := newSite()
+	var err error
+	if s.results, err = newResultStore([]string{"1h"}); err != nil {
+		t.Fatal(err)
+	}
+	// two clients attaching the same bundle both keep their result
+	s.results.Add("ip:192.0.2.1", jobKey("ip:192.0.2.1", "first"), "BUNDLE", []byte(`"first"`))
+	s.results.Add("ip:192.0.2.2", jobKey("ip:192.0.2.2", "second"), "BUNDLE", []byte(`"second"`))
+	for addr, expected := range map[string]string{"192.0.2.1:1": `"first"`, "192.0.2.2:1": `"second"`} {
+		if status, res := getAttachResult(s, addr, nil, `{"bundle":"BUNDLE"}`); status != http.StatusOK || res != expected {
+			t.Errorf("%s: expected 200 %s, got %d %s", addr, expected, status, res)
+		}
+	}
+}
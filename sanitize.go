@@ -0,0 +1,91 @@
+package attach
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+var ErrMalformedTrytes = errors.New("trytes may only contain the characters 9 and A-Z")
+var ErrTrytesSizeExceeded = errors.New("the trytes of the request exceed the size limit")
+var ErrInvalidMaxTrytes = errors.New("expected nothing or a max number of tryte characters after the max_trytes option")
+
+const (
+	// the number of trytes of a transaction
+	txTrytesSize = 2673
+	// the derived cap allows for this much beyond the standard length, e.g. whitespace
+	// repaired by lenient_trytes
+	trytesSizeSlack = txTrytesSize
+)
+
+// trytesCap returns the max number of tryte characters of a request, derived from the
+// tx limit unless a fixed cap is configured.
+func (s *site) trytesCap(txLimit int) int {
+	if s.maxTrytes > 0 {
+		return s.maxTrytes
+	}
+	return txLimit*txTrytesSize + trytesSizeSlack
+}
+
+// checkTrytesSize sums up the trytes of all transactions, which rejects payloads padding
+// transactions with garbage before anything is parsed.
+func (s *site) checkTrytesSize(trytes []Trytes, txLimit int) error {
+	if !s.trytesSizeCheck {
+		return nil
+	}
+	limit := s.trytesCap(txLimit)
+	var size int
+	for i := range trytes {
+		if size += len(trytes[i]); size > limit {
+			return errors.Wrapf(ErrTrytesSizeExceeded, "max allowed is %d", limit)
+		}
+	}
+	return nil
+}
+
+// normalizeTrytes removes whitespace and upper-cases the letters, which repairs the
+// slightly malformed trytes some wallet libraries emit.
+func normalizeTrytes(trytes Trytes) Trytes {
+	return Trytes(strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToUpper(r)
+	}, string(trytes)))
+}
+
+// CheckTrytes reports the first character outside of the tryte alphabet.
+func CheckTrytes(field string, trytes Trytes) error {
+	for i := 0; i < len(trytes); i++ {
+		if c := trytes[i]; c != '9' && (c < 'A' || c > 'Z') {
+			return errors.Wrapf(ErrMalformedTrytes, "%s has %q at position %d", field, c, i)
+		}
+	}
+	return nil
+}
+
+// sanitizeTrytes checks the tips and transaction trytes of the command before they are
+// parsed, in lenient mode they are normalized first.
+func (s *site) sanitizeTrytes(command *AttachToTangleCmd) error {
+	if s.lenientTrytes {
+		command.TrunkTxHash = normalizeTrytes(command.TrunkTxHash)
+		command.BranchTxHash = normalizeTrytes(command.BranchTxHash)
+		for i := range command.Trytes {
+			command.Trytes[i] = normalizeTrytes(command.Trytes[i])
+		}
+	}
+	if err := CheckTrytes("trunkTransaction", command.TrunkTxHash); err != nil {
+		return err
+	}
+	if err := CheckTrytes("branchTransaction", command.BranchTxHash); err != nil {
+		return err
+	}
+	for i := range command.Trytes {
+		if err := CheckTrytes("trytes["+strconv.Itoa(i)+"]", command.Trytes[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package attach
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidScheduleOption = errors.New("expected days, a HH:MM-HH:MM time range and passthrough or procs <n> after the schedule option")
+
+const scheduleModePassthrough = "passthrough"
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// scheduleWindow is a recurring time window during which attachToTangle is either
+// passed through to the node or the PoW runs with fewer threads, e.g. to keep a home
+// server quiet at night. windows may span midnight, they then belong to the day they start on.
+type scheduleWindow struct {
+	days        [7]bool
+	start, end  time.Duration
+	passthrough bool
+	procs       int
+}
+
+// the PoW thread count outside of any window
+var defaultPowProcs = powThreads()
+
+// parseScheduleWindow parses "<days> <HH:MM-HH:MM> passthrough|procs <n>" where days is
+// "*", a comma separated list like "sat,sun" or a range like "mon-fri".
+func parseScheduleWindow(args []string) (*scheduleWindow, error) {
+	if len(args) < 3 {
+		return nil, ErrInvalidScheduleOption
+	}
+	win := &scheduleWindow{}
+	if err := win.parseDays(args[0]); err != nil {
+		return nil, err
+	}
+	times := strings.Split(args[1], "-")
+	if len(times) != 2 {
+		return nil, ErrInvalidScheduleOption
+	}
+	var err error
+	if win.start, err = parseClock(times[0]); err != nil {
+		return nil, err
+	}
+	if win.end, err = parseClock(times[1]); err != nil {
+		return nil, err
+	}
+	switch {
+	case args[2] == scheduleModePassthrough && len(args) == 3:
+		win.passthrough = true
+	case args[2] == "procs" && len(args) == 4:
+		win.procs, err = strconv.Atoi(args[3])
+		if err != nil || win.procs <= 0 {
+			return nil, ErrInvalidScheduleOption
+		}
+	default:
+		return nil, ErrInvalidScheduleOption
+	}
+	return win, nil
+}
+
+func (win *scheduleWindow) parseDays(spec string) error {
+	if spec == "*" {
+		for i := range win.days {
+			win.days[i] = true
+		}
+		return nil
+	}
+	for _, part := range strings.Split(spec, ",") {
+		bounds := strings.Split(part, "-")
+		from, ok := weekdays[bounds[0]]
+		if !ok || len(bounds) > 2 {
+			return errors.Wrapf(ErrInvalidScheduleOption, "invalid days %s", spec)
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, ok = weekdays[bounds[1]]; !ok {
+				return errors.Wrapf(ErrInvalidScheduleOption, "invalid days %s", spec)
+			}
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			win.days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseClock parses a HH:MM time of day into the offset from midnight.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errors.Wrapf(ErrInvalidScheduleOption, "invalid time %s", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Contains reports whether the given local time falls into the window.
+func (win *scheduleWindow) Contains(t time.Time) bool {
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	day := t.Weekday()
+	if win.start <= win.end {
+		return win.days[day] && clock >= win.start && clock < win.end
+	}
+	// the window spans midnight
+	if clock >= win.start {
+		return win.days[day]
+	}
+	return clock < win.end && win.days[(day+6)%7]
+}
+
+// powProcs returns the PoW thread count of the site, which is lowered during a window.
+func (s *site) powProcs() int {
+	if win := s.activeWindow(time.Now()); win != nil && win.procs > 0 {
+		return win.procs
+	}
+	return s.limits().PoWProcs
+}
+
+// activeWindow returns the schedule window the given time falls into, if any.
+func (s *site) activeWindow(t time.Time) *scheduleWindow {
+	for _, win := range s.schedule {
+		if win.Contains(t) {
+			return win
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package attach
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidSchedulerOption = errors.New("expected a name and an optional number of concurrent PoW jobs after the pow_scheduler option")
+var ErrInvalidPoolOption = errors.New("expected a name, a number of CPU shares and optionally default after the pool option")
+var ErrUnknownPool = errors.New("the pool is not defined by the site")
+
+// the scheduler of sites which don't name one
+const defaultSchedulerName = "default"
+
+// powScheduler is a queue for PoW jobs. sites naming the same scheduler share its queue,
+// so that their PoW together doesn't use more CPU than the scheduler's concurrency allows.
+// sites with a scheduler of their own have a queue of their own. jobs of several schedulers,
+// or of a scheduler running several jobs, only run concurrently on different backends: a
+// built-in backend runs one search at a time, see backendLock.
+type powScheduler struct {
+	name     string
+	lock     *priorityMutex
+	pressure *queuePressure
+}
+
+// the schedulers by name, they outlive reloads so that jobs of old and new
+// handlers keep waiting in the same queue
+var schedulers = map[string]*powScheduler{}
+var schedulersMu sync.Mutex
+
+// parseSchedulerOption parses "<name> [concurrent jobs]". without a number of jobs the
+// site joins the scheduler as configured by other sites.
+func parseSchedulerOption(args []string) (string, int, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return "", 0, ErrInvalidSchedulerOption
+	}
+	var jobs int
+	if len(args) == 2 {
+		var err error
+		if jobs, err = strconv.Atoi(args[1]); err != nil || jobs <= 0 {
+			return "", 0, ErrInvalidSchedulerOption
+		}
+	}
+	return args[0], jobs, nil
+}
+
+// parsePoolOption parses "<name> <shares> [default]", the default pool is the one of
+// clients whose API key doesn't name a pool.
+func parsePoolOption(args []string) (string, int, bool, error) {
+	if len(args) < 2 || len(args) > 3 || (len(args) == 3 && args[2] != "default") {
+		return "", 0, false, ErrInvalidPoolOption
+	}
+	shares, err := strconv.Atoi(args[1])
+	if err != nil || shares <= 0 {
+		return "", 0, false, ErrInvalidPoolOption
+	}
+	return args[0], shares, len(args) == 3, nil
+}
+
+// schedulerFor returns the named scheduler, it is created on first use with one job at a
+// time. a non-zero number of jobs changes its concurrency.
+func schedulerFor(name string, jobs int) *powScheduler {
+	schedulersMu.Lock()
+	defer schedulersMu.Unlock()
+	q, ok := schedulers[name]
+	if !ok {
+		q = &powScheduler{name: name, lock: newPriorityMutex(1), pressure: &queuePressure{}}
+		schedulers[name] = q
+	}
+	if jobs > 0 {
+		q.lock.SetSlots(jobs)
+	}
+	return q
+}
+
+// Acquire waits until the job of the pool may run, Release must be called once it is done.
+// the cost is the number of transactions to attach.
+func (q *powScheduler) Acquire(p priorityClass, pool string, cost int) {
+	q.pressure.Enter()
+	q.lock.LockShare(p, pool, cost)
+	q.pressure.Leave()
+}
+
+// SetPool defines the CPU shares of a pool. while jobs of several pools are waiting,
+// each pool gets the PoW in proportion to its shares.
+func (q *powScheduler) SetPool(name string, shares int) {
+	q.lock.SetPool(name, shares)
+}
+
+func (q *powScheduler) Release() {
+	q.lock.Unlock()
+}
+
+// waitingJobs returns the number of jobs waiting in the queues of all schedulers.
+func waitingJobs() int {
+	schedulersMu.Lock()
+	defer schedulersMu.Unlock()
+	var waiting int
+	for _, q := range schedulers {
+		waiting += q.pressure.Waiting()
+	}
+	return waiting
+}
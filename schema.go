@@ -0,0 +1,219 @@
+package attach
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidValidateOption = errors.New("expected an optional max array size after the validate_commands option")
+
+// the default max number of elements of an array field
+const defaultMaxArraySize = 1000
+
+const metricSchemaRejected = "attach.schema_rejected"
+
+// the kinds of values of command fields
+type fieldKind int
+
+const (
+	kindHash fieldKind = iota
+	// addresses with or without checksum
+	kindAddress
+	kindTag
+	kindTxTrytes
+	kindInt
+	kindString
+)
+
+type fieldSpec struct {
+	name     string
+	kind     fieldKind
+	array    bool
+	required bool
+	// bounds of int fields
+	min, max int
+}
+
+type commandSchema struct {
+	fields []fieldSpec
+	// at least one of these fields has to be present
+	anyOf []string
+}
+
+// the shape of the commands of the IRI API
+var commandSchemas = map[string]*commandSchema{
+	"getNodeInfo":                {},
+	"getNodeAPIConfiguration":    {},
+	"getNeighbors":               {},
+	"getTips":                    {},
+	"interruptAttachingToTangle": {},
+	"addNeighbors":               {fields: []fieldSpec{{name: "uris", kind: kindString, array: true, required: true}}},
+	"removeNeighbors":            {fields: []fieldSpec{{name: "uris", kind: kindString, array: true, required: true}}},
+	"findTransactions": {
+		fields: []fieldSpec{
+			{name: "addresses", kind: kindAddress, array: true},
+			{name: "bundles", kind: kindHash, array: true},
+			{name: "tags", kind: kindTag, array: true},
+			{name: "approvees", kind: kindHash, array: true},
+		},
+		anyOf: []string{"addresses", "bundles", "tags", "approvees"},
+	},
+	"getBalances": {fields: []fieldSpec{
+		{name: "addresses", kind: kindAddress, array: true, required: true},
+		{name: "threshold", kind: kindInt, min: 0, max: 100},
+		{name: "tips", kind: kindHash, array: true},
+	}},
+	"getInclusionStates": {fields: []fieldSpec{
+		{name: "transactions", kind: kindHash, array: true, required: true},
+		{name: "tips", kind: kindHash, array: true},
+	}},
+	"getTransactionsToApprove": {fields: []fieldSpec{
+		{name: "depth", kind: kindInt, required: true, min: 0, max: 15},
+		{name: "reference", kind: kindHash},
+	}},
+	"getTrytes":              {fields: []fieldSpec{{name: "hashes", kind: kindHash, array: true, required: true}}},
+	"broadcastTransactions":  {fields: []fieldSpec{{name: "trytes", kind: kindTxTrytes, array: true, required: true}}},
+	"storeTransactions":      {fields: []fieldSpec{{name: "trytes", kind: kindTxTrytes, array: true, required: true}}},
+	"wereAddressesSpentFrom": {fields: []fieldSpec{{name: "addresses", kind: kindAddress, array: true, required: true}}},
+	"checkConsistency":       {fields: []fieldSpec{{name: "tails", kind: kindHash, array: true, required: true}}},
+	"attachToTangle": {fields: []fieldSpec{
+		{name: "trunkTransaction", kind: kindHash, required: true},
+		{name: "branchTransaction", kind: kindHash, required: true},
+		{name: "minWeightMagnitude", kind: kindInt, required: true, min: 1, max: 243},
+		{name: "trytes", kind: kindTxTrytes, array: true, required: true},
+	}},
+}
+
+// parseValidateOption parses "[max array size]".
+func parseValidateOption(args []string) (int, error) {
+	switch len(args) {
+	case 0:
+		return defaultMaxArraySize, nil
+	case 1:
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n <= 0 {
+			return 0, ErrInvalidValidateOption
+		}
+		return n, nil
+	}
+	return 0, ErrInvalidValidateOption
+}
+
+// validateCommand checks the body of a known IRI command against its schema.
+// bodies of unknown commands are left to the node.
+func (s *site) validateCommand(body []byte) error {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return ErrBodyUnparsable
+	}
+	var command string
+	if err := json.Unmarshal(fields["command"], &command); err != nil {
+		return errors.New("command must be a string")
+	}
+	schema, ok := commandSchemas[command]
+	if !ok {
+		return nil
+	}
+	for _, spec := range schema.fields {
+		raw, ok := fields[spec.name]
+		if !ok || string(raw) == "null" {
+			if spec.required {
+				return fmt.Errorf("%s requires %s", command, spec.name)
+			}
+			continue
+		}
+		if err := spec.validate(raw, s.arrayLimit(command)); err != nil {
+			return errors.Wrapf(err, "invalid %s", spec.name)
+		}
+	}
+	if len(schema.anyOf) > 0 {
+		found := false
+		for _, name := range schema.anyOf {
+			_, ok := fields[name]
+			found = found || ok
+		}
+		if !found {
+			return fmt.Errorf("%s requires one of %v", command, schema.anyOf)
+		}
+	}
+	return nil
+}
+
+func (spec *fieldSpec) validate(raw json.RawMessage, limit int) error {
+	if !spec.array {
+		return spec.validateValue(raw)
+	}
+	var values []json.RawMessage
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return errors.New("expected an array")
+	}
+	if len(values) > limit {
+		return fmt.Errorf("more than %d elements", limit)
+	}
+	for i, value := range values {
+		if err := spec.validateValue(value); err != nil {
+			return errors.Wrapf(err, "element %d", i)
+		}
+	}
+	return nil
+}
+
+func (spec *fieldSpec) validateValue(raw json.RawMessage) error {
+	switch spec.kind {
+	case kindInt:
+		var n int
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return errors.New("expected an integer")
+		}
+		if n < spec.min || n > spec.max {
+			return fmt.Errorf("expected a value between %d and %d", spec.min, spec.max)
+		}
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return errors.New("expected a string")
+	}
+	switch spec.kind {
+	case kindHash:
+		return validTrytes(s, 81, 81)
+	case kindAddress:
+		if len(s) == 90 {
+			return validTrytes(s, 90, 90)
+		}
+		return validTrytes(s, 81, 81)
+	case kindTag:
+		return validTrytes(s, 1, 27)
+	case kindTxTrytes:
+		return validTrytes(s, 2673, 2673)
+	}
+	return nil
+}
+
+// validTrytes checks that s consists of min to max trytes.
+func validTrytes(s string, min int, max int) error {
+	if len(s) < min || len(s) > max {
+		if min == max {
+			return fmt.Errorf("expected %d trytes", min)
+		}
+		return fmt.Errorf("expected %d to %d trytes", min, max)
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c != '9' && (c < 'A' || c > 'Z') {
+			return errors.New("expected trytes")
+		}
+	}
+	return nil
+}
+
+// rejectInvalidCommand answers a command which failed the validation like the node would.
+func (s *site) rejectInvalidCommand(w http.ResponseWriter, err error) (int, error) {
+	metricsReg.Inc(metricSchemaRejected)
+	logger.Debugf("rejecting invalid command: %s\n", err.Error())
+	s.writeError(w, http.StatusBadRequest, err)
+	return 0, nil
+}
@@ -0,0 +1,95 @@
+package attach
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var ErrPoWSelfTest = errors.New("the PoW backend failed its self-test")
+
+// the self-test only needs a few hashes, it proves that the backend runs and computes valid nonces
+const selfTestMWM = 5
+
+// powSelfTest does the PoW of a zero-value transaction and verifies the nonce, which
+// catches e.g. a broken GPU driver before the first wallet request does.
+func powSelfTest(name string, pow PowFunc) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = errors.Wrapf(ErrPoWSelfTest, "%s panicked: %v", name, rec)
+		}
+	}()
+	tx := zeroValueBundle(emptyHash, "")[0]
+	nonce, err := pow(tx.Trytes(), selfTestMWM)
+	if err != nil {
+		return errors.Wrapf(ErrPoWSelfTest, "%s: %s", name, err.Error())
+	}
+	tx.Nonce = nonce
+	if !tx.HasValidNonce(selfTestMWM) {
+		return errors.Wrapf(ErrPoWSelfTest, "%s computed a nonce not satisfying mwm %d", name, selfTestMWM)
+	}
+	return nil
+}
+
+// the self-tests of the built-in backends by name. they run once per process, as the
+// self-test on a reload would compete with the PoW of the old instance's clients.
+var (
+	selfTests   = map[string]*selfTestResult{}
+	selfTestsMu sync.Mutex
+)
+
+type selfTestResult struct {
+	once sync.Once
+	err  error
+}
+
+// powSelfTestOnce self-tests a built-in backend once per process, custom backends
+// are tested every time as they may be registered anew.
+func powSelfTestOnce(name string, pow PowFunc) error {
+	if !isBuiltinPoW(name) {
+		return powSelfTest(name, pow)
+	}
+	selfTestsMu.Lock()
+	t, ok := selfTests[name]
+	if !ok {
+		t = &selfTestResult{}
+		selfTests[name] = t
+	}
+	selfTestsMu.Unlock()
+	t.once.Do(func() {
+		t.err = powSelfTest(name, pow)
+	})
+	return t.err
+}
+
+// SelfTest drops the backends failing their self-test from the chain, so that a broken
+// primary is failed over right away. it fails if no backend is left.
+func (c *powChain) SelfTest() error {
+	var passed []powBackend
+	var failed []string
+	for _, b := range c.backends {
+		if err := powSelfTestOnce(b.name, b.fn); err != nil {
+			logger.Warnf("%s, not using it\n", err.Error())
+			failed = append(failed, err.Error())
+			continue
+		}
+		passed = append(passed, b)
+	}
+	if len(passed) == 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	c.backends = passed
+	return nil
+}
+
+// selfTestPoW tests the selected backends, the mock one is skipped as its nonces are invalid by design.
+func (s *site) selfTestPoW() error {
+	switch {
+	case s.powName == powMock:
+		return nil
+	case s.powChain != nil:
+		return s.powChain.SelfTest()
+	}
+	return powSelfTestOnce(s.powName, s.powFn)
+}
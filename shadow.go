@@ -0,0 +1,114 @@
+package attach
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+var ErrShadowWithoutUpstream = errors.New("shadow requires the upstream option")
+
+const metricShadowMismatch = "attach.shadow_mismatch"
+
+const (
+	shadowPrimaryLocal = "local"
+	shadowPrimaryNode  = "node"
+)
+
+type shadowResult struct {
+	status int
+	body   []byte
+	err    error
+}
+
+// shadowAttach sends the original attachToTangle request to the upstream node.
+func (s *site) shadowAttach(r *http.Request, body []byte) <-chan *shadowResult {
+	resCh := make(chan *shadowResult, 1)
+	go func() {
+		req, err := http.NewRequest(http.MethodPost, s.upstream.url.String(), bytes.NewReader(body))
+		if err != nil {
+			resCh <- &shadowResult{err: err}
+			return
+		}
+		req.Header.Set(contentType, contentTypeJSON)
+		req.Header.Set(apiVersionHeader, r.Header.Get(apiVersionHeader))
+		res, err := s.upstream.Client().Do(req)
+		if err != nil {
+			resCh <- &shadowResult{err: err}
+			return
+		}
+		defer res.Body.Close()
+		resBody, err := ioutil.ReadAll(res.Body)
+		resCh <- &shadowResult{status: res.StatusCode, body: resBody, err: err}
+	}()
+	return resCh
+}
+
+// checkAttachedTrytes validates the structure of attached trytes as returned by
+// attachToTangle: transactions ordered by current index, chained onto each other
+// and carrying nonces satisfying the min weight magnitude.
+func checkAttachedTrytes(trytes []Trytes, mwm int) ([]Tx, []string) {
+	var problems []string
+	txs := make([]Tx, 0, len(trytes))
+	for i, t := range trytes {
+		tx, err := parseTransaction(t)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("tx %d can't be parsed: %s", i, err.Error()))
+			return txs, problems
+		}
+		txs = append(txs, *tx)
+	}
+	for i := range txs {
+		if txs[i].CurrentIndex != int64(i) {
+			problems = append(problems, fmt.Sprintf("tx at position %d has current index %d", i, txs[i].CurrentIndex))
+		}
+		if !txs[i].HasValidNonce(int64(mwm)) {
+			problems = append(problems, fmt.Sprintf("tx %d has a nonce below mwm %d", i, mwm))
+		}
+		if i < len(txs)-1 && txs[i].TrunkTransaction != txs[i+1].Hash() {
+			problems = append(problems, fmt.Sprintf("tx %d isn't chained onto tx %d", i, i+1))
+		}
+	}
+	return txs, problems
+}
+
+// compareShadow logs the discrepancies between the local and the node's attach result.
+func compareShadow(bundleHash string, local []Trytes, node *shadowResult, mwm int) {
+	report := func(format string, args ...interface{}) {
+		metricsReg.Inc(metricShadowMismatch)
+		logger.Warnf("shadow mismatch for bundle %s: "+format+"\n", append([]interface{}{bundleHash}, args...)...)
+	}
+	if node.err != nil || node.status != http.StatusOK {
+		report("node failed to attach (status %d, err %v): %s", node.status, node.err, node.body)
+		return
+	}
+	nodeRes := &AttachToTangleRes{}
+	if err := json.Unmarshal(node.body, nodeRes); err != nil {
+		report("node response can't be parsed: %s", err.Error())
+		return
+	}
+	if len(nodeRes.Trytes) != len(local) {
+		report("node returned %d transactions, local %d", len(nodeRes.Trytes), len(local))
+		return
+	}
+	localTxs, localProblems := checkAttachedTrytes(local, mwm)
+	nodeTxs, nodeProblems := checkAttachedTrytes(nodeRes.Trytes, mwm)
+	for _, p := range localProblems {
+		report("local: %s", p)
+	}
+	for _, p := range nodeProblems {
+		report("node: %s", p)
+	}
+	for i := 0; i < len(localTxs) && i < len(nodeTxs); i++ {
+		if localTxs[i].Bundle != nodeTxs[i].Bundle || localTxs[i].Address != nodeTxs[i].Address {
+			report("tx %d differs in bundle or address", i)
+		}
+	}
+	if len(localProblems) == 0 && len(nodeProblems) == 0 {
+		logger.Debugf("shadow result for bundle %s matches\n", bundleHash)
+	}
+}
@@ -0,0 +1,43 @@
+package attach
+
+import (
+	"github.com/mholt/caddy"
+	"github.com/pkg/errors"
+)
+
+var ErrConflictingSharedOption = errors.New("the option is shared by all sites and set differently by another site")
+
+type sharedOptionsKey struct{}
+
+// sharedOptions are the options of a config load which configure process-wide state, like
+// logging and alerts. they can't differ between sites, so the first site setting one
+// decides and later sites may only repeat it.
+type sharedOptions struct {
+	values map[string]string
+}
+
+// sharedOptionsOf returns the shared options of the config load c belongs to. first is
+// set for the first site of the load, which resets the process-wide state of the last one.
+func sharedOptionsOf(c *caddy.Controller) (shared *sharedOptions, first bool) {
+	if shared, ok := c.Get(sharedOptionsKey{}).(*sharedOptions); ok {
+		return shared, false
+	}
+	shared = &sharedOptions{values: map[string]string{}}
+	c.Set(sharedOptionsKey{}, shared)
+	return shared, true
+}
+
+// Set records the value of the option, it fails if another site set another value.
+func (o *sharedOptions) Set(option, value string) error {
+	if prev, ok := o.values[option]; ok && prev != value {
+		return errors.Wrapf(ErrConflictingSharedOption, "%s %s, another site set %s", option, value, prev)
+	}
+	o.values[option] = value
+	return nil
+}
+
+// Has reports whether a site already set the option.
+func (o *sharedOptions) Has(option string) bool {
+	_, ok := o.values[option]
+	return ok
+}
@@ -0,0 +1,86 @@
+package attach
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidSigningKey = errors.New("expected a PEM encoded PKCS#8 Ed25519 private key")
+
+// the header carrying the base64 Ed25519 signature of the response body
+const responseSignatureHeader = "X-Attach-Response-Signature"
+
+// the endpoint publishing the public key which verifies the response signatures
+const publicKeyPath = "/attach/pubkey"
+
+// responseSigner signs response bodies so that clients of third-party powboxes can
+// verify that a result was produced by the operator they trust.
+type responseSigner struct {
+	key ed25519.PrivateKey
+}
+
+func newResponseSigner(keyFile string) (*responseSigner, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrInvalidSigningKey
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidSigningKey, err.Error())
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, ErrInvalidSigningKey
+	}
+	return &responseSigner{key: key}, nil
+}
+
+// Sign sets the signature header for the given response body.
+func (s *responseSigner) Sign(w http.ResponseWriter, body []byte) {
+	w.Header().Set(responseSignatureHeader, base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, body)))
+}
+
+func (s *responseSigner) PublicKey() ed25519.PublicKey {
+	return s.key.Public().(ed25519.PublicKey)
+}
+
+// signResponse signs the body if response signing is enabled.
+func (s *site) signResponse(w http.ResponseWriter, body []byte) {
+	if s.respSigner != nil {
+		s.respSigner.Sign(w, body)
+	}
+}
+
+func (s *site) isPublicKeyRequest(r *http.Request) bool {
+	return s.respSigner != nil && r.Method == http.MethodGet && r.URL.Path == publicKeyPath
+}
+
+type publicKeyRes struct {
+	Algorithm string `json:"algorithm"`
+	PublicKey string `json:"publicKey"`
+}
+
+func (s *site) servePublicKey(w http.ResponseWriter) (int, error) {
+	resBytes, err := json.Marshal(&publicKeyRes{
+		Algorithm: "ed25519",
+		PublicKey: base64.StdEncoding.EncodeToString(s.respSigner.PublicKey()),
+	})
+	if err != nil {
+		return http.StatusInternalServerError, ErrBuildingRes
+	}
+	w.Header().Set(contentType, contentTypeJSON)
+	w.Header().Set("access-control-allow-origin", "*")
+	w.Write(resBytes)
+	return http.StatusOK, nil
+}
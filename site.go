@@ -0,0 +1,196 @@
+package attach
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// site is the state of one attach directive. every virtual host using the directive
+// gets its own, so that two sites can run with different limits, PoW backends and auth.
+// logging, metrics, tracing and alerts are shared by the process, the PoW queue by the
+// sites using the same scheduler.
+type site struct {
+	powFn PowFunc
+	// the name of the selected PoW backend
+	powName string
+	// the backends in order of preference if several are configured
+	powChain *powChain
+	// stops the nonce search of the trytes, nil if the backend can't be stopped
+	powInterrupt func(trytes Trytes)
+	checkpoints  *powCheckpoints
+	// records sampled requests and responses, nil disables it
+	capture *requestCapture
+	// the PoW runs on warm workers if set
+	powWorkers    *powWorkers
+	maxTxInBundle int
+	network       *networkProfile
+	nodeType      *nodeProfile
+
+	// the configured upstream, nil if requests are passed to the next middleware
+	upstream *upstreamNode
+	// the collected upstream_* options, the auth parts of it also apply when
+	// requests are handed to the next middleware
+	upstreamOpts *upstreamNode
+	// the proxies whose X-Forwarded-For and X-Real-IP headers are believed
+	trustedProxies []*net.IPNet
+
+	certAuth    *clientCertAuth
+	jwtAuthz    *jwtAuth
+	signer      *requestSigner
+	apiKeys     *apiKeyAuth
+	clientRules *ipRules
+	agentRules  *userAgentRules
+	geoIP       *geoIPDB
+	// the policies by ISO country code
+	geoPolicies map[string]*geoPolicy
+	statsCreds  *basicCredentials
+	limitsCreds *basicCredentials
+	// the debug endpoints are disabled as long as no credentials are configured
+	debugCreds *basicCredentials
+	// rewrites client addresses before they end up in logs, traces and stats
+	anonymizer *ipAnonymizer
+	// checks the drift of the local clock, nil if disabled
+	clockCheck *ntpCheck
+
+	tipCheck *tipChecker
+	// tip selection while the upstream node is unavailable, nil if disabled
+	tipFallback *tipFallback
+	tipHeaders  *tipHeaders
+	// bundles with transaction timestamps further off the server clock are rejected, 0 disables the check
+	timestampWindow  time.Duration
+	replay           *replayGuard
+	attachTimestamps *timestampSource
+	verifier         *powVerifier
+	chaos            *chaosInjector
+	// the percentage of attachToTangle requests which are handled locally
+	samplePercent float64
+	// the primary of shadow mode, empty if it is off
+	shadowPrimary string
+	// forwards requests to the node if the local PoW fails, nil if disabled
+	nodeFallback *nodeFallback
+
+	// whether the transaction and bundle hashes are always included in the response
+	responseHashes bool
+	// where the timing breakdown is reported if not requested by the client
+	responseTimings int
+	responseOrder   int
+	// what the duration field covers and its unit, durations of each phase are added if durationFields is set
+	durationCovers int
+	durationUnit   time.Duration
+	durationFields bool
+	// in strict IRI mode the response matches IRI byte-for-byte: only trytes and duration
+	// in IRI's order, with the duration covering the whole request handling like IRI does
+	strictIRI bool
+	// whether error responses are JSON with a stable error code
+	errorCodes bool
+	// whether MWMs above the max are refused with the max instead of being lowered to the default
+	mwmNegotiation bool
+	respSigner     *responseSigner
+	// whether responses are stamped with the poweredByHeader
+	poweredBy bool
+
+	// whether the canAttach command is answered
+	canAttachEnabled bool
+	reservations     *reservationStore
+	// whether the validateBundle dry-run command is answered
+	validateBundleEnabled bool
+	// whether the promoteTransaction and reattach commands are handled
+	helperCommands bool
+	// how often promotions and reattachments are redone on fresh tips if the node refuses them
+	broadcastRetries int
+	preattach        *preattachPool
+	// the max number of bundles in a batch, 0 disables batches
+	maxBatchBundles int
+	// whether the info endpoint is served
+	infoEnabled bool
+	history     *attachHistory
+	progress    *progressStream
+	bundleDB    *bundleDB
+	events      *eventStream
+	results     *resultStore
+	partials    *partialResults
+	jobLimits   *jobLimiter
+	cache       *responseCache
+	// the max array size of validated commands, 0 disables the validation
+	maxArraySize int
+	// the max number of elements of the array fields per command, e.g. for getTrytes
+	arrayLimits map[string]int
+
+	// whether JSON-RPC 2.0 envelopes are unwrapped
+	jsonRPC bool
+	// whether MessagePack encoded requests are accepted
+	msgpackEnabled bool
+	// whether clients may negotiate packed trytes
+	tryteEncodingEnabled bool
+	// the methods of the requests parsed as API commands, POST by default
+	methods map[string]bool
+	// the paths the plugin is in charge of, all if empty
+	interceptPaths []string
+	// whether requests must declare a JSON body
+	requireJSON bool
+	// the accepted X-IOTA-API-Version values, any if empty
+	apiVersions map[string]bool
+	// whether whitespace and lowercase letters in trytes are repaired instead of rejected
+	lenientTrytes bool
+	// whether the total size of the trytes is capped, 0 derives the cap from the tx limit
+	trytesSizeCheck bool
+	maxTrytes       int
+	grpcFront       *grpcFrontend
+
+	// the queue the PoW jobs of the site wait in
+	scheduler *powScheduler
+	// the shares of the pools defined by the site and the pool of clients without one
+	pools        map[string]int
+	pool         string
+	dynamicLimit dynamicLimit
+	// decides whether attach requests are allowed, nil disables it
+	authz *externalAuthz
+	// the rules by tag and address prefix, the first matching one applies
+	bundleRules []*bundleRule
+	// deprioritizes or rejects repeated zero-value bundles, nil disables it
+	spam *spamDetector
+	// decides about each bundle after the built-in policies, nil disables it
+	policyHook *policyHook
+	// sheds new jobs at random while the queue grows, nil disables it
+	earlyRejection *earlyRejection
+	// the budget in estimated hashes per minute, 0 disables it
+	hashBudget float64
+	// the configured windows, the first one matching wins
+	schedule   []*scheduleWindow
+	admission  *admissionController
+	rejections *rejectionAlert
+
+	// the limits as configured in the Caddyfile, the limits file applies on top of them
+	baseLimits    *runtimeLimits
+	liveLimits    atomic.Value
+	limitsWatcher *limitsFile
+	// the imported files to watch for changes
+	configFiles []*configFile
+}
+
+// newSite returns a site with the defaults of the directive.
+func newSite() *site {
+	network, _ := networkProfileFor("mainnet", "")
+	s := &site{
+		maxTxInBundle:    200,
+		network:          network,
+		nodeType:         nodeProfiles["iri"],
+		upstreamOpts:     &upstreamNode{headers: http.Header{}},
+		geoPolicies:      map[string]*geoPolicy{},
+		attachTimestamps: &timestampSource{mode: timestampWall},
+		samplePercent:    100,
+		responseTimings:  timingsOff,
+		responseOrder:    orderIRI,
+		durationUnit:     time.Millisecond,
+		poweredBy:        true,
+		reservations:     &reservationStore{},
+		arrayLimits:      map[string]int{},
+		pools:            map[string]int{},
+		methods:          map[string]bool{http.MethodPost: true},
+		anonymizer:       &ipAnonymizer{},
+	}
+	s.liveLimits.Store(&runtimeLimits{MaxTxs: s.maxTxInBundle, PoWProcs: defaultPowProcs})
+	return s
+}
@@ -0,0 +1,136 @@
+package attach
+
+import (
+	"crypto/sha256"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrSpamDetected = errors.New("the same zero-value bundle is attached too often, slow down")
+var ErrInvalidSpamDetectionOption = errors.New("expected a max number of repeats, a window and optionally reject or deprioritize after the spam_detection option")
+
+const metricSpamDetected = "attach.spam_detected"
+
+// the offsets of the fields in the trytes of a transaction, the message and address
+// come first
+const (
+	txMessageEnd = 2187
+	txAddressEnd = 2268
+	txValueEnd   = 2295
+	txTagOffset  = 2592
+	txTagEnd     = 2619
+	// the value field of zero-value transactions
+	zeroValueTrytes = "999999999999999999999999999"
+)
+
+const (
+	spamDeprioritize = "deprioritize"
+	spamReject       = "reject"
+)
+
+type spamCount struct {
+	start time.Time
+	count int
+}
+
+// spamDetector recognizes zero-value bundles sent over and over by the same source with
+// identical addresses, tags and messages, e.g. spammers and stuck wallet loops, and
+// deprioritizes or rejects them to protect the capacity for real transfers. a bundle is
+// spam once its fingerprint is seen more than max repeats times within the window.
+type spamDetector struct {
+	maxRepeats int
+	window     time.Duration
+	action     string
+
+	mu     sync.Mutex
+	seen   map[[sha256.Size]byte]*spamCount
+	pruned time.Time
+}
+
+// newSpamDetector parses "<max repeats> <window> [reject|deprioritize]".
+func newSpamDetector(args []string) (*spamDetector, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, ErrInvalidSpamDetectionOption
+	}
+	d := &spamDetector{action: spamDeprioritize, seen: map[[sha256.Size]byte]*spamCount{}}
+	var err error
+	if d.maxRepeats, err = strconv.Atoi(args[0]); err != nil || d.maxRepeats <= 0 {
+		return nil, ErrInvalidSpamDetectionOption
+	}
+	if d.window, err = time.ParseDuration(args[1]); err != nil || d.window <= 0 {
+		return nil, ErrInvalidSpamDetectionOption
+	}
+	if len(args) == 3 {
+		if args[2] != spamDeprioritize && args[2] != spamReject {
+			return nil, ErrInvalidSpamDetectionOption
+		}
+		d.action = args[2]
+	}
+	return d, nil
+}
+
+// fingerprint hashes the source with the addresses, tags and messages of a zero-value
+// bundle. it reports false for bundles moving value and trytes too short to tell.
+func fingerprint(source string, trytes []Trytes) ([sha256.Size]byte, bool) {
+	h := sha256.New()
+	h.Write([]byte(source))
+	for _, tx := range trytes {
+		if len(tx) < txTrytesSize || tx[txAddressEnd:txValueEnd] != zeroValueTrytes {
+			return [sha256.Size]byte{}, false
+		}
+		h.Write([]byte(tx[:txAddressEnd]))
+		h.Write([]byte(tx[txTagOffset:txTagEnd]))
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum, true
+}
+
+// Check counts the bundle and reports whether it is spam.
+func (d *spamDetector) Check(source string, trytes []Trytes) bool {
+	key, ok := fingerprint(source, trytes)
+	if !ok {
+		return false
+	}
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if now.Sub(d.pruned) >= d.window {
+		for k, c := range d.seen {
+			if now.Sub(c.start) >= d.window {
+				delete(d.seen, k)
+			}
+		}
+		d.pruned = now
+	}
+	c, ok := d.seen[key]
+	if !ok || now.Sub(c.start) >= d.window {
+		c = &spamCount{start: now}
+		d.seen[key] = c
+	}
+	c.count++
+	if c.count <= d.maxRepeats {
+		return false
+	}
+	metricsReg.Inc(metricSpamDetected)
+	return true
+}
+
+// checkSpam applies the configured action to spam, deprioritized jobs get a low priority grant.
+func (s *site) checkSpam(grant *attachGrant, source string, trytes []Trytes) (*attachGrant, error) {
+	if s.spam == nil || !s.spam.Check(source, trytes) {
+		return grant, nil
+	}
+	if s.spam.action == spamReject {
+		logger.Warnf("rejecting repeated zero-value bundle of %s\n", s.anonymizer.Addr(source))
+		return nil, ErrSpamDetected
+	}
+	logger.Debugf("deprioritizing repeated zero-value bundle of %s\n", s.anonymizer.Addr(source))
+	// the grant may be shared by the bundles of a batch
+	deprioritized := *grant
+	deprioritized.priority = priorityLow
+	return &deprioritized, nil
+}
@@ -0,0 +1,228 @@
+package attach
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrMissingStatsCredentials = errors.New("expected user and password after the stats option")
+
+const statsPath = "/attach/stats"
+
+// per-source activity is kept in one minute buckets for the last hour
+const (
+	statsBucketSize = time.Minute
+	statsBuckets    = 60
+)
+
+// sources beyond this many distinct ones within the last hour are counted as otherSource
+const maxTrackedSources = 4096
+
+const otherSource = "other"
+
+// the windows reported by the stats endpoint
+var statsWindows = []struct {
+	name    string
+	buckets int
+}{
+	{"1m", 1},
+	{"5m", 5},
+	{"15m", 15},
+	{"1h", 60},
+}
+
+type statsBucket struct {
+	slot     int64
+	requests int64
+	rejected int64
+	powCount int64
+	powMs    int64
+}
+
+type sourceRecord struct {
+	buckets  [statsBuckets]statsBucket
+	lastSeen time.Time
+}
+
+func (s *sourceRecord) bucket(now time.Time) *statsBucket {
+	slot := now.UnixNano() / int64(statsBucketSize)
+	b := &s.buckets[slot%statsBuckets]
+	if b.slot != slot {
+		*b = statsBucket{slot: slot}
+	}
+	s.lastSeen = now
+	return b
+}
+
+// sourceStats tracks request activity per client over sliding windows. a nil
+// sourceStats records nothing.
+type sourceStats struct {
+	mu      sync.Mutex
+	sources map[string]*sourceRecord
+	// whether the sources are client addresses which have to be anonymized
+	addrs bool
+}
+
+// srcStats is only recorded to by sites with a stats endpoint, see sourceStatsOf
+var srcStats = &sourceStats{sources: map[string]*sourceRecord{}, addrs: true}
+
+func (s *sourceStats) record(source string, fn func(b *statsBucket)) {
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.sources[source]
+	if !ok {
+		if len(s.sources) >= maxTrackedSources {
+			s.prune(now)
+		}
+		if len(s.sources) >= maxTrackedSources {
+			source = otherSource
+		}
+		if rec, ok = s.sources[source]; !ok {
+			rec = &sourceRecord{}
+			s.sources[source] = rec
+		}
+	}
+	fn(rec.bucket(now))
+}
+
+// prune drops sources which weren't seen for longer than the largest window.
+func (s *sourceStats) prune(now time.Time) {
+	for source, rec := range s.sources {
+		if now.Sub(rec.lastSeen) > statsBuckets*statsBucketSize {
+			delete(s.sources, source)
+		}
+	}
+}
+
+func (s *sourceStats) Request(source string) {
+	s.record(source, func(b *statsBucket) { b.requests++ })
+}
+
+func (s *sourceStats) Rejected(source string) {
+	s.record(source, func(b *statsBucket) { b.rejected++ })
+}
+
+func (s *sourceStats) PoW(source string, ms int64) {
+	s.record(source, func(b *statsBucket) {
+		b.powCount++
+		b.powMs += ms
+	})
+}
+
+type windowStats struct {
+	Requests int64   `json:"requests"`
+	Rejected int64   `json:"rejected"`
+	AvgPoWMs float64 `json:"avgPowMs"`
+	powCount int64
+	powMsSum int64
+}
+
+type sourceSummary struct {
+	Source   string                  `json:"source"`
+	LastSeen time.Time               `json:"lastSeen"`
+	Windows  map[string]*windowStats `json:"windows"`
+}
+
+// Summary aggregates the buckets of every source into the reporting windows
+// and drops sources which weren't seen for longer than the largest window.
+// client addresses are anonymized with the anonymizer of the site asking.
+func (s *sourceStats) Summary(anonymizer *ipAnonymizer) []sourceSummary {
+	now := time.Now()
+	current := now.UnixNano() / int64(statsBucketSize)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(now)
+	summaries := []sourceSummary{}
+	for source, rec := range s.sources {
+		label := source
+		// authenticated clients are tracked by their identity instead of their address
+		if s.addrs && net.ParseIP(source) != nil {
+			label = anonymizer.Addr(source)
+		}
+		summary := sourceSummary{Source: label, LastSeen: rec.lastSeen, Windows: map[string]*windowStats{}}
+		for _, window := range statsWindows {
+			ws := &windowStats{}
+			for _, b := range rec.buckets {
+				if b.slot <= current-int64(window.buckets) || b.slot > current {
+					continue
+				}
+				ws.Requests += b.requests
+				ws.Rejected += b.rejected
+				ws.powCount += b.powCount
+				ws.powMsSum += b.powMs
+			}
+			if ws.powCount > 0 {
+				ws.AvgPoWMs = float64(ws.powMsSum) / float64(ws.powCount)
+			}
+			summary.Windows[window.name] = ws
+		}
+		summaries = append(summaries, summary)
+	}
+	// most active sources first
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Windows["1h"].Requests > summaries[j].Windows["1h"].Requests
+	})
+	return summaries
+}
+
+// sourceStatsOf returns the per-source stats the site records to, nil if it has no stats endpoint.
+func (s *site) sourceStatsOf() *sourceStats {
+	if s.statsCreds == nil {
+		return nil
+	}
+	return srcStats
+}
+
+func (s *site) isStatsRequest(r *http.Request) bool {
+	return s.statsCreds != nil && r.URL.Path == statsPath
+}
+
+func (s *site) serveStats(w http.ResponseWriter, r *http.Request) (int, error) {
+	if !s.statsCreds.Authorized(r) {
+		return requireAuth(w, "attach stats")
+	}
+	var summary interface{}
+	switch r.URL.Query().Get("by") {
+	case "user_agent":
+		summary = agentStats.Summary(s.anonymizer)
+	case "histograms":
+		summary = histograms.Summary()
+	case "totals":
+		summary = metricsReg.Totals()
+	default:
+		summary = srcStats.Summary(s.anonymizer)
+	}
+	resBytes, err := json.Marshal(summary)
+	if err != nil {
+		return http.StatusInternalServerError, ErrBuildingRes
+	}
+	w.Header().Set(contentType, contentTypeJSON)
+	w.Write(resBytes)
+	return http.StatusOK, nil
+}
+
+// clientHost returns the client address of a request, as forwarded by a trusted proxy
+// or otherwise the host part of the remote address.
+func (s *site) clientHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	// only trusted proxies may tell who the client is
+	if containsIP(s.trustedProxies, host) {
+		if forwarded, ok := s.forwardedClient(r); ok {
+			return forwarded
+		}
+	}
+	return host
+}
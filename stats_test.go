@@ -0,0 +1,75 @@
+package attach
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestSourceStats() *sourceStats {
+	return &sourceStats{sources: map[string]*sourceRecord{}, addrs: true}
+}
+
+func TestSourceStatsSummary(t *testing.T) {
+	stats := newTestSourceStats()
+	stats.Request("192.0.2.1")
+	stats.Request("192.0.2.1")
+	stats.Rejected("192.0.2.1")
+	stats.Request("key:wallet")
+	stats.PoW("key:wallet", 100)
+	stats.PoW("key:wallet", 300)
+
+	anonymizer, err := newIPAnonymizer([]string{"truncate"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	summaries := stats.Summary(anonymizer)
+	if len(summaries) != 2 {
+		t.Fatalf("expected two sources, got %+v", summaries)
+	}
+	// addresses are anonymized, identities are not
+	if summaries[0].Source != "192.0.2.0" || summaries[1].Source != "key:wallet" {
+		t.Fatalf("unexpected sources %s and %s", summaries[0].Source, summaries[1].Source)
+	}
+	for _, window := range statsWindows {
+		if ws := summaries[0].Windows[window.name]; ws.Requests != 2 || ws.Rejected != 1 {
+			t.Errorf("%s: expected 2 requests and 1 rejection, got %+v", window.name, ws)
+		}
+		if ws := summaries[1].Windows[window.name]; ws.Requests != 1 || ws.AvgPoWMs != 200 {
+			t.Errorf("%s: expected 1 request with 200ms PoW on average, got %+v", window.name, ws)
+		}
+	}
+}
+
+func TestSourceStatsBounded(t *testing.T) {
+	stats := newTestSourceStats()
+	for i := 0; i < maxTrackedSources; i++ {
+		stats.Request("key:" + strconv.Itoa(i))
+	}
+	stats.Request("key:late")
+	if _, ok := stats.sources["key:late"]; ok || len(stats.sources) != maxTrackedSources+1 {
+		t.Fatalf("expected sources beyond the max to be counted as %s, got %d sources", otherSource, len(stats.sources))
+	}
+
+	// sources which weren't seen within the last hour make room again
+	for _, rec := range stats.sources {
+		rec.lastSeen = time.Now().Add(-2 * time.Hour)
+	}
+	stats.Request("key:late")
+	if _, ok := stats.sources["key:late"]; !ok || len(stats.sources) != 1 {
+		t.Fatalf("expected the stale sources to be dropped, got %d sources", len(stats.sources))
+	}
+}
+
+func TestSourceStatsOnlyWithEndpoint(t *testing.T) {
+	s := newSite()
+	if s.sourceStatsOf() != nil {
+		t.Fatal("expected no stats to be recorded without a stats endpoint")
+	}
+	// recording to no stats is a no-op
+	s.sourceStatsOf().Request("192.0.2.1")
+	s.statsCreds = &basicCredentials{user: "admin", password: "s3cret"}
+	if s.sourceStatsOf() != srcStats {
+		t.Fatal("expected the stats to be recorded with a stats endpoint")
+	}
+}
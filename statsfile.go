@@ -0,0 +1,162 @@
+package attach
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidPersistStatsOption = errors.New("expected a file and an optional save interval after the persist_stats option")
+
+const (
+	metricAttachBundles = "attach.bundles"
+	// per API key usage, e.g. attach.key.<name>.txs
+	metricKeyPrefix = "attach.key."
+)
+
+const defaultStatsSaveInterval = time.Minute
+
+// recordKeyUsage counts a completed attachment towards the API key of the client.
+func recordKeyUsage(identity string, txs int, powMs int64) {
+	if !strings.HasPrefix(identity, "key:") {
+		return
+	}
+	prefix := metricKeyPrefix + strings.TrimPrefix(identity, "key:")
+	metricsReg.Inc(prefix + ".bundles")
+	metricsReg.Add(prefix+".txs", int64(txs))
+	metricsReg.Add(prefix+".pow_ms", powMs)
+}
+
+// statsFile periodically saves the cumulative counters, so that usage reports cover more
+// than the time since the last restart. the counters of the file are restored once per
+// process, reloads of the config keep counting on from the ones in memory.
+type statsFile struct {
+	file     string
+	interval time.Duration
+
+	mu      sync.Mutex
+	running int
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+type savedStats struct {
+	Saved  time.Time        `json:"saved"`
+	Totals map[string]int64 `json:"totals"`
+}
+
+// the stats files by path, shared by the sites naming the same file
+var statsFiles = map[string]*statsFile{}
+var statsFilesMu sync.Mutex
+
+// statsFileFor parses "<file> [save interval]" and restores the counters of the file
+// the first time it is named.
+func statsFileFor(args []string) (*statsFile, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, ErrInvalidPersistStatsOption
+	}
+	interval := defaultStatsSaveInterval
+	if len(args) == 2 {
+		var err error
+		if interval, err = time.ParseDuration(args[1]); err != nil || interval <= 0 {
+			return nil, ErrInvalidPersistStatsOption
+		}
+	}
+	statsFilesMu.Lock()
+	defer statsFilesMu.Unlock()
+	f, ok := statsFiles[args[0]]
+	if ok {
+		f.mu.Lock()
+		f.interval = interval
+		f.mu.Unlock()
+		return f, nil
+	}
+	f = &statsFile{file: args[0], interval: interval}
+	if err := f.restore(); err != nil {
+		return nil, err
+	}
+	statsFiles[args[0]] = f
+	return f, nil
+}
+
+func (f *statsFile) restore() error {
+	contents, err := ioutil.ReadFile(f.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	saved := &savedStats{}
+	if err := json.Unmarshal(contents, saved); err != nil {
+		return errors.Wrap(err, f.file)
+	}
+	metricsReg.Restore(saved.Totals)
+	logger.Infof("restored %d counters saved at %s from %s\n", len(saved.Totals), saved.Saved.Format(time.RFC3339), f.file)
+	return nil
+}
+
+// save writes the counters to a temporary file first, so that a crash never leaves a truncated file.
+func (f *statsFile) save() error {
+	contents, err := json.Marshal(&savedStats{Saved: time.Now(), Totals: metricsReg.Totals()})
+	if err != nil {
+		return err
+	}
+	tmp := f.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, contents, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.file)
+}
+
+// Start begins saving the counters, the file is saved by one goroutine however many sites use it.
+func (f *statsFile) Start() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.running++
+	if f.running > 1 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	f.cancel, f.done = cancel, make(chan struct{})
+	go f.saveLoop(ctx, f.interval, f.done)
+	return nil
+}
+
+// Stop saves the counters a last time once no site uses the file anymore.
+func (f *statsFile) Stop() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.running == 0 {
+		return nil
+	}
+	f.running--
+	if f.running > 0 {
+		return nil
+	}
+	f.cancel()
+	<-f.done
+	return f.save()
+}
+
+func (f *statsFile) saveLoop(ctx context.Context, interval time.Duration, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := f.save(); err != nil {
+				logger.Warnf("unable to save the stats to %s: %s\n", f.file, err.Error())
+			}
+		}
+	}
+}
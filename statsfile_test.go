@@ -0,0 +1,24 @@
+package attach
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestImportedPersistStats(t *testing.T) {
+	stats := filepath.Join(t.TempDir(), "stats.json")
+	file := writeConfigFile(t, "attach.yml", "persist_stats: ["+stats+", 1h]\n")
+	c := caddy.NewTestController("http", "attach 10 {\n pow mock\n import "+file+"\n}")
+	// the hooks of the imported option end up on the directive
+	if err := setup(c); err != nil {
+		t.Fatal(err)
+	}
+	statsFilesMu.Lock()
+	f, ok := statsFiles[stats]
+	statsFilesMu.Unlock()
+	if !ok || f.interval.Hours() != 1 {
+		t.Fatalf("expected the stats file of the imported option, got %+v", f)
+	}
+}
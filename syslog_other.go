@@ -0,0 +1,12 @@
+//go:build windows || plan9 || nacl
+// +build windows plan9 nacl
+
+package attach
+
+import "io"
+
+const syslogSupported = false
+
+func newSyslogWriter(network string, addr string) (io.WriteCloser, error) {
+	return nil, ErrSyslogUnsupported
+}
@@ -0,0 +1,17 @@
+//go:build !windows && !plan9 && !nacl
+// +build !windows,!plan9,!nacl
+
+package attach
+
+import (
+	"io"
+	"log/syslog"
+)
+
+const syslogSupported = true
+
+// newSyslogWriter connects to the syslog daemon at the given address,
+// or to the local daemon if network and address are empty.
+func newSyslogWriter(network string, addr string) (io.WriteCloser, error) {
+	return syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, "caddy-attach")
+}
@@ -0,0 +1,159 @@
+package attach
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidTimestampOption = errors.New("expected wall, monotonic, offset <duration> or preserve after the attachment_timestamp option")
+var ErrNTPResponse = errors.New("invalid NTP response")
+var ErrInvalidNTPCheckOption = errors.New("expected an NTP server and an optional max drift after the ntp_check option")
+
+const (
+	timestampWall      = "wall"
+	timestampMonotonic = "monotonic"
+	timestampOffset    = "offset"
+	timestampPreserve  = "preserve"
+)
+
+// timestampSource generates the attachment timestamps. wall uses the current clock,
+// monotonic anchors the wall clock once and advances it with the monotonic clock so
+// that clock jumps don't show up in the timestamps, offset shifts the wall clock and
+// preserve keeps the timestamp of the submitted trytes if they carry one.
+type timestampSource struct {
+	mode   string
+	offset time.Duration
+	anchor time.Time
+
+	mu   sync.Mutex
+	last int64
+}
+
+func newTimestampSource(args []string) (*timestampSource, error) {
+	switch {
+	case len(args) == 1 && (args[0] == timestampWall || args[0] == timestampPreserve):
+		return &timestampSource{mode: args[0]}, nil
+	case len(args) == 1 && args[0] == timestampMonotonic:
+		// time.Now carries a monotonic reading which time.Since uses
+		return &timestampSource{mode: timestampMonotonic, anchor: time.Now()}, nil
+	case len(args) == 2 && args[0] == timestampOffset:
+		offset, err := time.ParseDuration(args[1])
+		if err != nil {
+			return nil, ErrInvalidTimestampOption
+		}
+		return &timestampSource{mode: timestampOffset, offset: offset}, nil
+	}
+	return nil, ErrInvalidTimestampOption
+}
+
+// Timestamp returns the attachment timestamp in milliseconds for the given transaction.
+func (s *timestampSource) Timestamp(tx *Tx) int64 {
+	switch s.mode {
+	case timestampPreserve:
+		if ms := tx.AttachmentTimestamp.Trits().Int(); ms > 0 {
+			return ms
+		}
+	case timestampOffset:
+		return time.Now().Add(s.offset).UnixNano() / int64(time.Millisecond)
+	case timestampMonotonic:
+		ms := s.anchor.Add(time.Since(s.anchor)).UnixNano() / int64(time.Millisecond)
+		// never go backwards, even across concurrent attaches
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if ms < s.last {
+			ms = s.last
+		}
+		s.last = ms
+		return ms
+	}
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// the default drift above which the NTP check warns
+const defaultMaxClockDrift = time.Second
+
+const ntpTimeout = 5 * time.Second
+
+// seconds between the NTP epoch (1900) and the unix epoch
+const ntpEpochOffset = 2208988800
+
+// ntpCheck compares the host clock against an NTP server on startup and warns loudly
+// when it is badly skewed, as the node rejects transactions with bad attachment
+// timestamps and skewed ones end up as lazy tips.
+type ntpCheck struct {
+	server   string
+	maxDrift time.Duration
+}
+
+func newNTPCheck(args []string) (*ntpCheck, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, ErrInvalidNTPCheckOption
+	}
+	check := &ntpCheck{server: args[0], maxDrift: defaultMaxClockDrift}
+	if _, _, err := net.SplitHostPort(check.server); err != nil {
+		check.server = net.JoinHostPort(check.server, "123")
+	}
+	if len(args) == 2 {
+		var err error
+		if check.maxDrift, err = time.ParseDuration(args[1]); err != nil {
+			return nil, err
+		}
+	}
+	return check, nil
+}
+
+// Start runs the check without failing the startup if the server can't be reached.
+func (c *ntpCheck) Start() error {
+	drift, err := c.drift()
+	if err != nil {
+		logger.Warnf("couldn't check the clock drift against %s: %s\n", c.server, err.Error())
+		return nil
+	}
+	if drift < -c.maxDrift || drift > c.maxDrift {
+		logger.Errorf("!!! the host clock is off by %s according to %s, attached transactions will carry bad timestamps !!!\n", drift, c.server)
+		return nil
+	}
+	logger.Infof("host clock drift according to %s is %s\n", c.server, drift)
+	return nil
+}
+
+// drift queries the server via SNTP and returns how far the host clock is ahead.
+func (c *ntpCheck) drift() (time.Duration, error) {
+	conn, err := net.DialTimeout("udp", c.server, ntpTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ntpTimeout))
+
+	req := make([]byte, 48)
+	// leap indicator 0, version 3, client mode
+	req[0] = 0x1b
+	sent := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	res := make([]byte, 48)
+	n, err := conn.Read(res)
+	if err != nil {
+		return 0, err
+	}
+	received := time.Now()
+	if n < 48 {
+		return 0, ErrNTPResponse
+	}
+	// the transmit timestamp in seconds and fractions since 1900
+	secs := binary.BigEndian.Uint32(res[40:44])
+	frac := binary.BigEndian.Uint32(res[44:48])
+	if secs == 0 {
+		return 0, ErrNTPResponse
+	}
+	server := time.Unix(int64(secs)-ntpEpochOffset, (int64(frac)*int64(time.Second))>>32)
+	// assume the response took half of the round trip
+	local := sent.Add(received.Sub(sent) / 2)
+	return local.Sub(server), nil
+}
@@ -0,0 +1,140 @@
+package attach
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidTipFallbackOption = errors.New("expected a timeout and node <url> [depth] or cache [max age] after the tip_fallback option")
+var ErrTipFallbackWithoutUpstream = errors.New("the tip_fallback option requires the upstream option")
+var ErrNoCachedTips = errors.New("no recent tips are cached to fall back to")
+
+const metricTipFallbacks = "attach.tip_fallbacks"
+
+const (
+	// the cached tips are only used while they are younger than this
+	defaultCachedTipsMaxAge = time.Minute
+	// the number of recently selected tip pairs kept for the fallback
+	cachedTipsSize = 32
+)
+
+type cachedTips struct {
+	trunk, branch Trytes
+	selected      time.Time
+}
+
+// tipFallback keeps tip selection working through short outages of the upstream node:
+// when getTransactionsToApprove doesn't answer in time, the tips are selected by a
+// secondary node or taken from the ones the upstream node recently selected.
+type tipFallback struct {
+	timeout time.Duration
+	// the secondary node and the depth of its tip selection, nil falls back to the cache
+	secondaryURL string
+	secondary    *upstreamNode
+	depth        int64
+	maxAge       time.Duration
+	upstream     *upstreamNode
+
+	mu     sync.Mutex
+	cached []cachedTips
+}
+
+// newTipFallback parses "<timeout> node <url> [depth]" or "<timeout> cache [max age]".
+func newTipFallback(args []string) (*tipFallback, error) {
+	if len(args) < 2 {
+		return nil, ErrInvalidTipFallbackOption
+	}
+	timeout, err := time.ParseDuration(args[0])
+	if err != nil || timeout <= 0 {
+		return nil, ErrInvalidTipFallbackOption
+	}
+	f := &tipFallback{timeout: timeout, depth: defaultTipSelectionDepth, maxAge: defaultCachedTipsMaxAge}
+	switch {
+	case args[1] == "node" && (len(args) == 3 || len(args) == 4):
+		f.secondaryURL = args[2]
+		if len(args) == 4 {
+			if f.depth, err = strconv.ParseInt(args[3], 10, 64); err != nil || f.depth <= 0 {
+				return nil, ErrInvalidTipFallbackOption
+			}
+		}
+	case args[1] == "cache" && (len(args) == 2 || len(args) == 3):
+		if len(args) == 3 {
+			if f.maxAge, err = time.ParseDuration(args[2]); err != nil || f.maxAge <= 0 {
+				return nil, ErrInvalidTipFallbackOption
+			}
+		}
+	default:
+		return nil, ErrInvalidTipFallbackOption
+	}
+	return f, nil
+}
+
+// isOutage reports whether the node couldn't be reached or didn't answer in time,
+// as opposed to the node answering with an error.
+func isOutage(err error) bool {
+	_, ok := errors.Cause(err).(net.Error)
+	return ok
+}
+
+func selectTipsOf(node *upstreamNode, timeout time.Duration, depth int64) (Trytes, Trytes, error) {
+	client := node.Client()
+	client.Timeout = timeout
+	return nodeAPI(node, client).GetTransactionsToApprove(depth)
+}
+
+// Select fetches tips from the upstream node and falls back if it is unavailable.
+func (f *tipFallback) Select(depth int64) (Trytes, Trytes, error) {
+	trunk, branch, err := selectTipsOf(f.upstream, f.timeout, depth)
+	if err == nil {
+		f.remember(trunk, branch)
+		return trunk, branch, nil
+	}
+	if !isOutage(err) {
+		return "", "", err
+	}
+	metricsReg.Inc(metricTipFallbacks)
+	if f.secondary != nil {
+		logger.Warnf("tip selection degraded, the node is unavailable (%s), selecting tips on %s\n", err.Error(), f.secondaryURL)
+		return selectTipsOf(f.secondary, f.secondary.Client().Timeout, f.depth)
+	}
+	logger.Warnf("tip selection degraded, the node is unavailable (%s), reusing recently selected tips\n", err.Error())
+	return f.recent()
+}
+
+func (f *tipFallback) remember(trunk, branch Trytes) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cached = append(f.cached, cachedTips{trunk: trunk, branch: branch, selected: time.Now()})
+	if len(f.cached) > cachedTipsSize {
+		f.cached = f.cached[len(f.cached)-cachedTipsSize:]
+	}
+}
+
+// recent returns a random pair of the cached tips younger than the max age, so that
+// the bundles attached during the outage don't all approve the same transactions.
+func (f *tipFallback) recent() (Trytes, Trytes, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	oldest := time.Now().Add(-f.maxAge)
+	for len(f.cached) > 0 && f.cached[0].selected.Before(oldest) {
+		f.cached = f.cached[1:]
+	}
+	if len(f.cached) == 0 {
+		return "", "", ErrNoCachedTips
+	}
+	tips := f.cached[rand.Intn(len(f.cached))]
+	return tips.trunk, tips.branch, nil
+}
+
+// selectTips fetches tips from the upstream node, through the fallback if one is configured.
+func (s *site) selectTips(depth int64) (Trytes, Trytes, error) {
+	if s.tipFallback != nil {
+		return s.tipFallback.Select(depth)
+	}
+	return selectTipsOf(s.upstream, s.upstream.Client().Timeout, depth)
+}
@@ -0,0 +1,67 @@
+package attach
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrTipHeadersWithoutUpstream = errors.New("the tip_headers option requires the upstream option")
+
+const (
+	// how the tips of the request were handled: unchecked, validated, reselected or check_failed
+	tipsStatusHeader = "X-Attach-Tips"
+	// the latest and latest solid milestone index of the upstream node
+	milestoneHeader      = "X-Attach-Milestone"
+	solidMilestoneHeader = "X-Attach-Solid-Milestone"
+)
+
+const (
+	tipsUnchecked   = "unchecked"
+	tipsValidated   = "validated"
+	tipsReselected  = "reselected"
+	tipsCheckFailed = "check_failed"
+)
+
+// the node info is only fetched again after this long, milestones come every minute or so
+const milestoneInfoTTL = 5 * time.Second
+
+// tipHeaders tells clients which tips their bundle was attached to and how far the
+// upstream node was synced, which helps debugging "attached but never confirmed" reports.
+type tipHeaders struct {
+	upstream *upstreamNode
+
+	mu      sync.Mutex
+	fetched time.Time
+	info    *nodeMilestones
+}
+
+// nodeInfo returns the recently fetched node info, nil if the node can't be reached.
+func (t *tipHeaders) nodeInfo() *nodeMilestones {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Since(t.fetched) < milestoneInfoTTL {
+		return t.info
+	}
+	t.fetched = time.Now()
+	info, err := nodeAPI(t.upstream, t.upstream.Client()).GetNodeInfo()
+	if err != nil {
+		logger.Warnf("unable to fetch the node info for the milestone headers: %s\n", err.Error())
+		t.info = nil
+		return nil
+	}
+	t.info = info
+	return info
+}
+
+// Set adds the headers with the tips status and the milestones of the node.
+func (t *tipHeaders) Set(w http.ResponseWriter, tipsStatus string) {
+	w.Header().Set(tipsStatusHeader, tipsStatus)
+	if info := t.nodeInfo(); info != nil {
+		w.Header().Set(milestoneHeader, strconv.FormatInt(info.LatestMilestoneIndex, 10))
+		w.Header().Set(solidMilestoneHeader, strconv.FormatInt(info.LatestSolidSubtangleMilestoneIndex, 10))
+	}
+}
@@ -0,0 +1,79 @@
+package attach
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrStaleTips = errors.New("trunk or branch transaction is unknown or too old, fetch new tips")
+var ErrInvalidTipCheckOption = errors.New("expected max age, reject or reselect and an optional depth after the tip_check option")
+var ErrTipCheckWithoutUpstream = errors.New("tip_check requires the upstream option")
+
+const defaultTipSelectionDepth = 3
+
+// tipChecker verifies via the upstream node that the tips supplied by the client
+// are known and recent. stale tips are either rejected or replaced by fresh ones
+// from getTransactionsToApprove.
+type tipChecker struct {
+	maxAge   time.Duration
+	reselect bool
+	depth    int64
+	upstream *upstreamNode
+}
+
+func newTipChecker(args []string) (*tipChecker, error) {
+	if len(args) < 2 || len(args) > 3 || (args[1] != "reject" && args[1] != "reselect") {
+		return nil, ErrInvalidTipCheckOption
+	}
+	maxAge, err := time.ParseDuration(args[0])
+	if err != nil {
+		return nil, ErrInvalidTipCheckOption
+	}
+	t := &tipChecker{maxAge: maxAge, reselect: args[1] == "reselect", depth: defaultTipSelectionDepth}
+	if len(args) == 3 {
+		t.depth, err = strconv.ParseInt(args[2], 10, 64)
+		if err != nil || t.depth <= 0 {
+			return nil, ErrInvalidTipCheckOption
+		}
+	}
+	return t, nil
+}
+
+func (t *tipChecker) api() *nodeClient {
+	return nodeAPI(t.upstream, t.upstream.Client())
+}
+
+// txTime returns the attachment time of a transaction or its issuance time
+// if it wasn't attached with an attachment timestamp.
+func txTime(tx *Tx) time.Time {
+	if ms := tx.AttachmentTimestamp.Trits().Int(); ms > 0 {
+		return time.Unix(0, ms*int64(time.Millisecond))
+	}
+	return tx.Timestamp
+}
+
+// Fresh reports whether both tips are known to the node and not older than the max age.
+func (t *tipChecker) Fresh(trunk, branch Trytes) (bool, error) {
+	hashes := []Trytes{trunk, branch}
+	res, err := t.api().GetTrytes(hashes)
+	if err != nil {
+		return false, err
+	}
+	if len(res) != 2 {
+		return false, nil
+	}
+	oldest := time.Now().Add(-t.maxAge)
+	for i := range res {
+		tx := &res[i]
+		// unknown transactions are returned as all 9s
+		if tx.Hash() != hashes[i] {
+			return false, nil
+		}
+		if txTime(tx).Before(oldest) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
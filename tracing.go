@@ -0,0 +1,72 @@
+package attach
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/luca-moser/caddy-iri-attach"
+
+// tracer defaults to the globally registered provider so that spans show up
+// if the host process already set up OpenTelemetry.
+var tracer = otel.Tracer(tracerName)
+
+// incoming W3C traceparent/tracestate headers are always honored
+var tracePropagator = propagation.TraceContext{}
+
+// tracingExporter ships spans to an OTLP/HTTP collector when the tracing option is set.
+type tracingExporter struct {
+	endpoint string
+	insecure bool
+	provider *sdktrace.TracerProvider
+}
+
+func (t *tracingExporter) Start() error {
+	if t.endpoint == "" {
+		return nil
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(t.endpoint)}
+	if t.insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return err
+	}
+	t.provider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	tracer = t.provider.Tracer(tracerName)
+	return nil
+}
+
+func (t *tracingExporter) Stop() error {
+	if t.provider == nil {
+		return nil
+	}
+	tracer = otel.Tracer(tracerName)
+	err := t.provider.Shutdown(context.Background())
+	t.provider = nil
+	return err
+}
+
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// spanError records the error on the span and marks it as failed.
+func spanError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// failSpan records the error on the span and ends it.
+func failSpan(span trace.Span, err error) {
+	spanError(span, err)
+	span.End()
+}
@@ -0,0 +1,160 @@
+package attach
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+var ErrUnsupportedTryteEncoding = errors.New("unsupported tryte encoding")
+var ErrInvalidPackedTrytes = errors.New("invalid packed trytes")
+
+// clients negotiate the packed tryte encoding with this header, the response echoes it
+const tryteEncodingHeader = "X-Attach-Tryte-Encoding"
+
+// t5b1 packs 5 balanced trits into one byte, shrinking transaction trytes by ~40%.
+// within JSON the packed bytes are base64 encoded, within MessagePack they're binary.
+const tryteEncodingT5B1 = "t5b1"
+
+const tritsPerByte = 5
+
+// packTrytes encodes trytes with t5b1.
+func packTrytes(trytes Trytes) ([]byte, error) {
+	if err := trytes.IsValid(); err != nil {
+		return nil, err
+	}
+	trits := trytes.Trits()
+	packed := make([]byte, (len(trits)+tritsPerByte-1)/tritsPerByte)
+	for i := range packed {
+		var v int8
+		for j := tritsPerByte - 1; j >= 0; j-- {
+			v *= 3
+			if k := i*tritsPerByte + j; k < len(trits) {
+				v += trits[k]
+			}
+		}
+		packed[i] = byte(v)
+	}
+	return packed, nil
+}
+
+// unpackTrytes decodes t5b1 packed bytes. the number of trytes is derived from the
+// length, which is unambiguous for whole transactions.
+func unpackTrytes(packed []byte) (Trytes, error) {
+	trits := make(Trits, len(packed)*tritsPerByte/3*3)
+	for i, b := range packed {
+		v := int(int8(b))
+		if v > 121 || v < -121 {
+			return "", ErrInvalidPackedTrytes
+		}
+		for j := 0; j < tritsPerByte; j++ {
+			// the remainder in balanced ternary
+			t := ((v%3)+4)%3 - 1
+			if k := i*tritsPerByte + j; k < len(trits) {
+				trits[k] = int8(t)
+			} else if t != 0 {
+				return "", ErrInvalidPackedTrytes
+			}
+			v = (v - t) / 3
+		}
+	}
+	return trits.Trytes(), nil
+}
+
+// serveTryteEncoded unpacks the trytes of an attachToTangle command, runs it through
+// the handler and packs the trytes of the response.
+func (h AttachToTangleHandler) serveTryteEncoded(w http.ResponseWriter, r *http.Request, body []byte) (int, error) {
+	if encoding := r.Header.Get(tryteEncodingHeader); encoding != tryteEncodingT5B1 {
+		return http.StatusBadRequest, errors.Wrap(ErrUnsupportedTryteEncoding, encoding)
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return http.StatusBadRequest, ErrBodyUnparsable
+	}
+	if raw, ok := fields["trytes"]; ok {
+		var packed [][]byte
+		if err := json.Unmarshal(raw, &packed); err != nil {
+			return http.StatusBadRequest, errors.Wrap(ErrInvalidPackedTrytes, err.Error())
+		}
+		trytes := make([]Trytes, len(packed))
+		for i := range packed {
+			t, err := unpackTrytes(packed[i])
+			if err != nil {
+				return http.StatusBadRequest, err
+			}
+			trytes[i] = t
+		}
+		fields["trytes"], _ = json.Marshal(trytes)
+	}
+	inner, err := json.Marshal(fields)
+	if err != nil {
+		return http.StatusBadRequest, ErrBodyUnparsable
+	}
+
+	sub := r.WithContext(r.Context())
+	sub.Header = http.Header{}
+	for name, values := range r.Header {
+		if name != tryteEncodingHeader {
+			sub.Header[name] = values
+		}
+	}
+	sub.Body = ioutil.NopCloser(bytes.NewReader(inner))
+	sub.ContentLength = int64(len(inner))
+	rec := &bufferedResponse{header: http.Header{}, status: http.StatusOK}
+	status, err := h.serveAttach(rec, sub)
+	if err != nil || status >= http.StatusBadRequest {
+		return status, err
+	}
+
+	resBytes := rec.body.Bytes()
+	res := map[string]json.RawMessage{}
+	if rec.status == http.StatusOK && json.Unmarshal(resBytes, &res) == nil {
+		if raw, ok := res["trytes"]; ok {
+			var trytes []Trytes
+			if err := json.Unmarshal(raw, &trytes); err != nil {
+				return http.StatusBadGateway, ErrBuildingRes
+			}
+			packed := make([][]byte, len(trytes))
+			for i := range trytes {
+				if packed[i], err = packTrytes(trytes[i]); err != nil {
+					return http.StatusBadGateway, ErrBuildingRes
+				}
+			}
+			res["trytes"], _ = json.Marshal(packed)
+			if resBytes, err = json.Marshal(res); err != nil {
+				return http.StatusInternalServerError, ErrBuildingRes
+			}
+			rec.header.Set(tryteEncodingHeader, tryteEncodingT5B1)
+		}
+	}
+	for name, values := range rec.header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(rec.status)
+	w.Write(resBytes)
+	return 0, nil
+}
+
+// binaryTryteFields turns the base64 encoded packed trytes of a decoded JSON response
+// into bytes in place, so that they're encoded as binary in MessagePack.
+func binaryTryteFields(v interface{}) {
+	res, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+	trytes, ok := res["trytes"].([]interface{})
+	if !ok {
+		return
+	}
+	for i := range trytes {
+		if s, ok := trytes[i].(string); ok {
+			if packed, err := base64.StdEncoding.DecodeString(s); err == nil {
+				trytes[i] = packed
+			}
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package attach
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidUpstreamOption = errors.New("invalid upstream option")
+var ErrUpstreamCA = errors.New("unable to parse upstream CA certificate")
+
+// upstreamNode is the IRI node non-intercepted commands are forwarded to when
+// the plugin is configured to talk to the node itself instead of handing the
+// request to the next middleware. it allows for client certificates, custom
+// headers and basic auth toward access-protected nodes.
+type upstreamNode struct {
+	url       *url.URL
+	headers   http.Header
+	basicUser string
+	basicPass string
+	tlsConfig *tls.Config
+	transport http.RoundTripper
+	retry     retryPolicy
+	breaker   *circuitBreaker
+	health    *healthChecker
+	// the node software, its responses are mapped to the ones of IRI
+	profile *nodeProfile
+}
+
+func (u *upstreamNode) tls() *tls.Config {
+	if u.tlsConfig == nil {
+		u.tlsConfig = &tls.Config{}
+	}
+	return u.tlsConfig
+}
+
+// ParseOption parses one of the upstream_* options.
+func (u *upstreamNode) ParseOption(option string, args []string) error {
+	switch {
+	case option == "upstream_header" && len(args) == 2:
+		u.headers.Add(args[0], args[1])
+	case option == "upstream_basic_auth" && len(args) == 2:
+		u.basicUser, u.basicPass = args[0], args[1]
+	case option == "upstream_tls_cert" && len(args) == 2:
+		cert, err := tls.LoadX509KeyPair(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		u.tls().Certificates = append(u.tls().Certificates, cert)
+	case option == "upstream_tls_ca" && len(args) == 1:
+		pem, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		if u.tls().RootCAs == nil {
+			u.tls().RootCAs = x509.NewCertPool()
+		}
+		if !u.tls().RootCAs.AppendCertsFromPEM(pem) {
+			return errors.Wrap(ErrUpstreamCA, args[0])
+		}
+	case option == "upstream_tls_insecure" && len(args) == 0:
+		u.tls().InsecureSkipVerify = true
+	case option == "upstream_retries" && (len(args) == 1 || len(args) == 2):
+		retries, err := strconv.Atoi(args[0])
+		if err != nil || retries < 0 || retries > maxRetries {
+			return errors.Wrapf(ErrInvalidUpstreamOption, "invalid number of retries, at most %d are allowed", maxRetries)
+		}
+		u.retry = retryPolicy{retries: retries, backoff: defaultRetryBackoff}
+		if len(args) == 2 {
+			if u.retry.backoff, err = time.ParseDuration(args[1]); err != nil {
+				return err
+			}
+			if u.retry.backoff <= 0 {
+				return errors.Wrap(ErrInvalidUpstreamOption, "the retry backoff must be positive")
+			}
+		}
+	case option == "upstream_breaker" && len(args) == 2:
+		threshold, err := strconv.Atoi(args[0])
+		if err != nil || threshold <= 0 {
+			return errors.Wrap(ErrInvalidUpstreamOption, "invalid circuit breaker failure threshold")
+		}
+		cooldown, err := time.ParseDuration(args[1])
+		if err != nil {
+			return err
+		}
+		u.breaker = &circuitBreaker{threshold: threshold, cooldown: cooldown}
+	default:
+		return errors.Wrap(ErrInvalidUpstreamOption, option)
+	}
+	return nil
+}
+
+// Authorize adds the configured auth headers to an outgoing request.
+func (u *upstreamNode) Authorize(r *http.Request) {
+	for name, values := range u.headers {
+		r.Header.Del(name)
+		for _, v := range values {
+			r.Header.Add(name, v)
+		}
+	}
+	if u.basicUser != "" {
+		r.SetBasicAuth(u.basicUser, u.basicPass)
+	}
+}
+
+// unixSocketPrefix marks an upstream listening on a Unix domain socket, e.g. unix:/var/run/iri.sock
+const unixSocketPrefix = "unix:"
+
+func newUpstreamNode(rawURL string, opts *upstreamNode) (*upstreamNode, error) {
+	var socketPath string
+	if strings.HasPrefix(rawURL, unixSocketPrefix) {
+		socketPath = strings.TrimPrefix(rawURL, unixSocketPrefix)
+		if socketPath == "" {
+			return nil, errors.Wrap(ErrInvalidUpstreamOption, "missing unix socket path")
+		}
+		// the host is irrelevant for the connection but required to build the request URL
+		rawURL = "http://unix"
+	}
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, errors.Wrapf(ErrInvalidUpstreamOption, "unsupported upstream scheme %s", target.Scheme)
+	}
+	u := &upstreamNode{
+		url:       target,
+		headers:   opts.headers,
+		basicUser: opts.basicUser,
+		basicPass: opts.basicPass,
+		tlsConfig: opts.tlsConfig,
+		retry:     opts.retry,
+		breaker:   opts.breaker,
+	}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     u.tlsConfig,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	if socketPath != "" {
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		}
+	}
+	u.transport = &authTransport{node: u, base: transport}
+	return u, nil
+}
+
+// authTransport adds the upstream auth to proxied requests and the plugin's own API calls.
+type authTransport struct {
+	node *upstreamNode
+	base http.RoundTripper
+}
+
+func (t *authTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	t.node.Authorize(r)
+	return t.base.RoundTrip(r)
+}
+
+func (u *upstreamNode) director(r *http.Request) {
+	r.URL.Scheme = u.url.Scheme
+	r.URL.Host = u.url.Host
+	if u.url.Path != "" && u.url.Path != "/" {
+		r.URL.Path = u.url.Path
+	}
+	r.Host = u.url.Host
+}
+
+// bodies up to this size are buffered to be retried, larger ones are streamed once
+const maxRetryBodySize = 4 << 20
+
+// ServeHTTP forwards the request to the upstream node. connection errors and
+// gateway error responses are retried as configured, as nothing has been written
+// to the client at that point. the body is only buffered for retries.
+func (u *upstreamNode) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	var body []byte
+	retries := u.retry.retries
+	if retries > 0 && r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(r.Body, maxRetryBodySize+1))
+		if err != nil {
+			return http.StatusBadRequest, ErrMissingBody
+		}
+		if len(body) > maxRetryBodySize {
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			body, retries = nil, 0
+		}
+	}
+
+	var proxyErr error
+	if u.health != nil && !u.health.Healthy() {
+		return http.StatusServiceUnavailable, ErrUpstreamUnavailable
+	}
+	for attempt := 0; attempt <= retries; attempt++ {
+		if u.breaker != nil && !u.breaker.Allow() {
+			return http.StatusServiceUnavailable, ErrUpstreamUnavailable
+		}
+		if attempt > 0 {
+			u.retry.Wait(attempt)
+		}
+		proxyErr = nil
+		gatewayErr := false
+		lastAttempt := attempt == retries
+		proxy := &httputil.ReverseProxy{
+			Director:  u.director,
+			Transport: u.transport,
+			ModifyResponse: func(res *http.Response) error {
+				u.profile.MapResponse(res)
+				if !isGatewayError(res.StatusCode) {
+					return nil
+				}
+				gatewayErr = true
+				if lastAttempt {
+					return nil
+				}
+				res.Body.Close()
+				return errors.Errorf("upstream node responded with http status %d", res.StatusCode)
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				proxyErr = err
+			},
+		}
+		if body != nil {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		proxy.ServeHTTP(w, r)
+		if u.breaker != nil {
+			if proxyErr == nil && !gatewayErr {
+				u.breaker.Success()
+			} else {
+				u.breaker.Failure()
+			}
+		}
+		if proxyErr == nil {
+			return 0, nil
+		}
+		logger.Warnf("unable to forward request to upstream node (attempt %d/%d): %s\n", attempt+1, retries+1, proxyErr.Error())
+	}
+	return http.StatusBadGateway, proxyErr
+}
+
+func isGatewayError(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// Client returns a HTTP client for issuing own API calls against the upstream node.
+func (u *upstreamNode) Client() *http.Client {
+	return &http.Client{Transport: u.transport, Timeout: 30 * time.Second}
+}
@@ -0,0 +1,126 @@
+package attach
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flakyUpstream answers the first requests with 503 and records the bodies it got.
+func flakyUpstream(t *testing.T, failures int) (*httptest.Server, *[]int) {
+	var received []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = append(received, len(body))
+		if len(received) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &received
+}
+
+func forward(t *testing.T, srv *httptest.Server, retries int, body string) *httptest.ResponseRecorder {
+	u, err := newUpstreamNode(srv.URL, &upstreamNode{retry: retryPolicy{retries: retries, backoff: time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.profile = &nodeProfile{}
+	w := httptest.NewRecorder()
+	if _, err := u.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestUpstreamRetriesWithBody(t *testing.T) {
+	srv, received := flakyUpstream(t, 1)
+	body := strings.Repeat("9", 2673)
+	if w := forward(t, srv, 1, body); w.Code != http.StatusOK {
+		t.Fatalf("expected the retry to succeed, got %d", w.Code)
+	}
+	if len(*received) != 2 || (*received)[0] != len(body) || (*received)[1] != len(body) {
+		t.Fatalf("expected the whole body on both attempts, got %v", *received)
+	}
+}
+
+func TestUpstreamStreamsLargeBodyOnce(t *testing.T) {
+	srv, received := flakyUpstream(t, 1)
+	// too large to be buffered for retries, the upstream response is handed on as is
+	body := strings.Repeat("9", maxRetryBodySize+1)
+	if w := forward(t, srv, 3, body); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected the upstream response without retries, got %d", w.Code)
+	}
+	if len(*received) != 1 || (*received)[0] != len(body) {
+		t.Fatalf("expected the whole body to be streamed once, got %v", *received)
+	}
+}
+
+func TestUpstreamRetriesOption(t *testing.T) {
+	for _, args := range [][]string{{"-1"}, {"11"}, {"3", "0s"}, {"3", "-100ms"}, {"3", "soon"}} {
+		if err := (&upstreamNode{}).ParseOption("upstream_retries", args); err == nil {
+			t.Errorf("%q: expected an error", args)
+		}
+	}
+	u := &upstreamNode{}
+	if err := u.ParseOption("upstream_retries", []string{"10", "50ms"}); err != nil || u.retry.retries != 10 || u.retry.backoff != 50*time.Millisecond {
+		t.Fatalf("expected 10 retries with a 50ms backoff, got %+v, %v", u.retry, err)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	p := retryPolicy{retries: maxRetries, backoff: time.Second}
+	tests := []struct {
+		attempt int
+		delay   time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{5, 16 * time.Second},
+		{6, maxRetryBackoff},
+		// the shift would overflow without the cap
+		{100, maxRetryBackoff},
+	}
+	for _, test := range tests {
+		if delay := p.Delay(test.attempt); delay != test.delay {
+			t.Errorf("attempt %d: expected %s, got %s", test.attempt, test.delay, delay)
+		}
+	}
+}
+
+func TestUpstreamUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "iri.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + " " + r.URL.Path))
+	})}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	u, err := newUpstreamNode(unixSocketPrefix+socket, &upstreamNode{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.profile = &nodeProfile{}
+	w := httptest.NewRecorder()
+	if _, err := u.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("{}"))); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || w.Body.String() != "unix /" {
+		t.Fatalf("expected the request to reach the socket, got %d %s", w.Code, w.Body.String())
+	}
+
+	if _, err := newUpstreamNode(unixSocketPrefix, &upstreamNode{}); err == nil {
+		t.Fatal("expected an error without a socket path")
+	}
+}
@@ -0,0 +1,88 @@
+package attach
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+var ErrUserAgentDenied = errors.New("the client's user agent is not allowed to use the attach interception")
+var ErrInvalidUserAgentOption = errors.New("expected allow or deny and a regular expression after the user_agent option")
+
+// agents beyond this many distinct products are counted as otherAgent
+const maxTrackedAgents = 256
+
+const (
+	unknownAgent = "unknown"
+	otherAgent   = "other"
+)
+
+type userAgentRule struct {
+	allow   bool
+	pattern *regexp.Regexp
+}
+
+// userAgentRules allows or denies clients by case insensitive regular expressions on
+// their User-Agent header. the first matching rule wins, if there are allow rules,
+// unmatched clients are denied.
+type userAgentRules struct {
+	rules    []userAgentRule
+	anyAllow bool
+}
+
+// agentStats tracks the activity per user agent product, like srcStats does per client.
+var agentStats = &sourceStats{sources: map[string]*sourceRecord{}}
+
+// Add parses "allow|deny <regexp>".
+func (u *userAgentRules) Add(args []string) error {
+	if len(args) != 2 || (args[0] != "allow" && args[0] != "deny") {
+		return ErrInvalidUserAgentOption
+	}
+	pattern, err := regexp.Compile("(?i)" + args[1])
+	if err != nil {
+		return errors.Wrap(ErrInvalidUserAgentOption, err.Error())
+	}
+	allow := args[0] == "allow"
+	u.rules = append(u.rules, userAgentRule{allow: allow, pattern: pattern})
+	u.anyAllow = u.anyAllow || allow
+	return nil
+}
+
+func (u *userAgentRules) Allowed(userAgent string) bool {
+	for _, rule := range u.rules {
+		if rule.pattern.MatchString(userAgent) {
+			return rule.allow
+		}
+	}
+	return !u.anyAllow
+}
+
+// userAgentProduct reduces a User-Agent header to its first product name, e.g.
+// "Trinity/1.0.1 (Windows)" to "Trinity", to keep the number of tracked agents low.
+func userAgentProduct(r *http.Request) string {
+	product := strings.TrimSpace(r.UserAgent())
+	if i := strings.IndexAny(product, "/ ("); i >= 0 {
+		product = product[:i]
+	}
+	product = strings.Map(func(c rune) rune {
+		if c > unicode.MaxASCII || !(unicode.IsLetter(c) || unicode.IsDigit(c) || strings.ContainsRune("-_.", c)) {
+			return -1
+		}
+		return c
+	}, product)
+	if len(product) > 64 {
+		product = product[:64]
+	}
+	if product == "" {
+		return unknownAgent
+	}
+	agentStats.mu.Lock()
+	defer agentStats.mu.Unlock()
+	if _, ok := agentStats.sources[product]; !ok && len(agentStats.sources) >= maxTrackedAgents {
+		return otherAgent
+	}
+	return product
+}
@@ -0,0 +1,45 @@
+package attach
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mholt/caddy"
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidConfig = errors.New("invalid attach config")
+var ErrUnknownOption = errors.New("unknown option")
+var ErrInvalidTxBundleLimit = errors.New("the tx bundle limit after the attach directive must be a positive number")
+var ErrGeoPolicyWithoutGeoIP = errors.New("geo_policy requires the geoip option")
+var ErrImpossibleDynamicLimit = errors.New("the min txs of dynamic_bundle_limit exceed the tx bundle limit")
+
+// configErrors collects all problems of a config, so that they can be fixed in one go
+// instead of one restart at a time.
+type configErrors struct {
+	errs []string
+}
+
+// At records an error of the option at the current position of the dispenser.
+func (e *configErrors) At(c *caddy.Controller, option string, err error) {
+	if c.File() != "" {
+		e.errs = append(e.errs, fmt.Sprintf("%s:%d: %s: %s", c.File(), c.Line(), option, err.Error()))
+		return
+	}
+	e.errs = append(e.errs, fmt.Sprintf("%s: %s", option, err.Error()))
+}
+
+// Add records an error which doesn't belong to a single option.
+func (e *configErrors) Add(err error) {
+	if err != nil {
+		e.errs = append(e.errs, err.Error())
+	}
+}
+
+// Err returns all recorded errors as one.
+func (e *configErrors) Err() error {
+	if len(e.errs) == 0 {
+		return nil
+	}
+	return errors.Wrap(ErrInvalidConfig, "\n  "+strings.Join(e.errs, "\n  "))
+}
@@ -0,0 +1,118 @@
+package attach
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var ErrInvalidValidateBundleCmd = errors.New("validateBundle requires the trytes of at least one transaction")
+
+// the dry-run command which validates a bundle like attachToTangle without doing the PoW
+const validateBundleCommand = "validateBundle"
+
+// the checks of validateBundle
+const (
+	bundleCheckAdmission  = "admission"
+	bundleCheckLimits     = "limits"
+	bundleCheckTrytes     = "trytes"
+	bundleCheckTips       = "tips"
+	bundleCheckTimestamps = "timestamps"
+	bundleCheckBundle     = "bundle"
+	bundleCheckPolicy     = "policy"
+)
+
+type BundleCheck struct {
+	Check  string `json:"check"`
+	Passed bool   `json:"passed"`
+	Error  string `json:"error,omitempty"`
+}
+
+type ValidateBundleRes struct {
+	Valid  bool          `json:"valid"`
+	Checks []BundleCheck `json:"checks"`
+}
+
+func (res *ValidateBundleRes) add(check string, err error) {
+	c := BundleCheck{Check: check, Passed: err == nil}
+	if err != nil {
+		c.Error = err.Error()
+		res.Valid = false
+	}
+	res.Checks = append(res.Checks, c)
+}
+
+// serveValidateBundle runs the validations of attachToTangle on the bundle, without
+// charging quotas or doing the PoW, and answers with the outcome of every check, so that
+// wallet developers can pre-flight bundles cheaply. failed authentication is answered
+// with the error status.
+func (s *site) serveValidateBundle(w http.ResponseWriter, r *http.Request, span trace.Span, body []byte) (int, error) {
+	command, err := ParseAttachToTangleCmd(body)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if len(command.Trytes) == 0 {
+		return http.StatusBadRequest, ErrInvalidValidateBundleCmd
+	}
+	res := &ValidateBundleRes{Valid: true}
+	source := s.clientHost(r)
+
+	grant, status, err := s.admitAttach(w, r, span, body, attachToTangleCommand, len(command.Trytes), command.MWM, admitPeek)
+	if status == http.StatusUnauthorized {
+		return status, err
+	}
+	res.add(bundleCheckAdmission, err)
+	if grant == nil {
+		grant = &attachGrant{txLimit: s.limits().MaxTxs, priority: priorityNormal, pool: s.pool}
+	}
+
+	if len(command.Trytes) > grant.txLimit {
+		err = errors.Wrapf(ErrTxBundleLimitExceeded, "max allowed is %d", grant.txLimit)
+	} else {
+		err = s.checkTrytesSize(command.Trytes, grant.txLimit)
+	}
+	res.add(bundleCheckLimits, err)
+
+	var txs []Tx
+	if err = s.sanitizeTrytes(command); err == nil {
+		txs, err = ParseTransactions(command.Trytes)
+	}
+	res.add(bundleCheckTrytes, err)
+	trytesValid := err == nil
+
+	res.add(bundleCheckTips, s.network.ValidateTips(command.TrunkTxHash, command.BranchTxHash))
+
+	// the remaining checks need the parsed transactions
+	if trytesValid {
+		if s.timestampWindow > 0 {
+			err = nil
+			for i := range txs {
+				if skew := time.Since(txs[i].Timestamp); skew > s.timestampWindow || skew < -s.timestampWindow {
+					err = errors.Wrapf(ErrImplausibleTimestamp, "transaction %d, allowed window is %s", txs[i].CurrentIndex, s.timestampWindow)
+					break
+				}
+			}
+			res.add(bundleCheckTimestamps, err)
+		}
+		res.add(bundleCheckBundle, CheckBundle(txs))
+	}
+
+	if _, err = s.authorizeExternally(r, grant, source, command.MWM, command.Trytes); err == nil {
+		if _, err = s.applyBundleRules(grant, command.Trytes); err == nil {
+			_, _, err = s.applyPolicyHook(r, grant, source, command.MWM, command.Trytes)
+		}
+	}
+	res.add(bundleCheckPolicy, err)
+
+	resBytes, err := json.Marshal(res)
+	if err != nil {
+		return http.StatusInternalServerError, ErrBuildingRes
+	}
+	w.Header().Set(contentType, contentTypeJSON)
+	w.Header().Set("access-control-allow-origin", "*")
+	w.Write(resBytes)
+	return http.StatusOK, nil
+}
@@ -0,0 +1,79 @@
+package attach
+
+import (
+	"math/rand"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+var ErrPoWVerification = errors.New("proof of work verification failed")
+var ErrInvalidVerifyOption = errors.New("expected curl or a PoW backend and an optional sample percentage after the verify_with option")
+
+const metricVerifyMismatch = "attach.verify_mismatch"
+
+// the verify_with backend which only re-hashes the transaction with the CPU Curl implementation
+const verifyWithCurl = "curl"
+
+// powVerifier double checks a sample of the computed nonces to protect against
+// flaky (e.g. overclocked) PoW hardware. every sampled nonce is verified by hashing
+// the transaction with CPU Curl. if a second PoW backend is configured, it additionally
+// recomputes a nonce for the sampled transaction to verify that backend agrees on
+// the transaction being attachable.
+type powVerifier struct {
+	backend string
+	pow     PowFunc
+	percent float64
+}
+
+func newPoWVerifier(args []string) (*powVerifier, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, ErrInvalidVerifyOption
+	}
+	v := &powVerifier{backend: canonicalPoWName(args[0]), percent: 100}
+	if v.backend != verifyWithCurl {
+		pow, ok := builtinPoWFuncs()[v.backend]
+		if !ok {
+			return nil, errors.Wrapf(ErrInvalidVerifyOption, "PoW backend %s isn't available", v.backend)
+		}
+		v.pow = lockedPoW(v.backend, pow, nil)
+	}
+	if len(args) == 2 {
+		percent, err := strconv.ParseFloat(args[1], 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return nil, ErrInvalidVerifyOption
+		}
+		v.percent = percent
+	}
+	return v, nil
+}
+
+// Verify checks a sample of the attached transactions.
+func (v *powVerifier) Verify(txs []Tx, mwm int) error {
+	for i := range txs {
+		if v.percent < 100 && rand.Float64()*100 >= v.percent {
+			continue
+		}
+		if !txs[i].HasValidNonce(int64(mwm)) {
+			metricsReg.Inc(metricVerifyMismatch)
+			logger.Errorf("nonce of tx %d (bundle %s) doesn't satisfy mwm %d, the PoW backend might be faulty\n", i, txs[i].Bundle, mwm)
+			return errors.Wrapf(ErrPoWVerification, "invalid nonce for tx %d", i)
+		}
+		if v.pow == nil {
+			continue
+		}
+		check := txs[i]
+		nonce, err := v.pow(check.Trytes(), mwm)
+		if err != nil {
+			metricsReg.Inc(metricVerifyMismatch)
+			logger.Errorf("verification backend %s failed for tx %d: %s\n", v.backend, i, err.Error())
+			continue
+		}
+		check.Nonce = nonce
+		if !check.HasValidNonce(int64(mwm)) {
+			metricsReg.Inc(metricVerifyMismatch)
+			logger.Errorf("verification backend %s computed an invalid nonce for tx %d\n", v.backend, i)
+		}
+	}
+	return nil
+}
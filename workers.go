@@ -0,0 +1,112 @@
+package attach
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidPoWWorkersOption = errors.New("expected a positive number of workers after the pow_workers option")
+
+type powJob struct {
+	trytes Trytes
+	mwm    int
+	done   chan powJobResult
+}
+
+type powJobResult struct {
+	nonce Trytes
+	err   error
+}
+
+// powWorkers runs the PoW on goroutines which are spawned at startup. the backend is
+// warmed up with a tiny PoW before the workers start, so that state like GPU contexts
+// exists before the first attach instead of costing the first client after a reload
+// several seconds. the built-in backends run one search at a time, so more workers than
+// one only add concurrency for custom backends.
+type powWorkers struct {
+	size int
+	name string
+	pow  PowFunc
+
+	mu      sync.RWMutex
+	running bool
+	jobs    chan *powJob
+	wg      sync.WaitGroup
+}
+
+func newPoWWorkers(args []string) (*powWorkers, error) {
+	if len(args) != 1 {
+		return nil, ErrInvalidPoWWorkersOption
+	}
+	size, err := strconv.Atoi(args[0])
+	if err != nil || size <= 0 {
+		return nil, ErrInvalidPoWWorkersOption
+	}
+	return &powWorkers{size: size}, nil
+}
+
+func (w *powWorkers) Start() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// the mock has nothing to warm up and fails the self-test by design
+	if w.name != powMock {
+		if err := powSelfTest(w.name, w.pow); err != nil {
+			logger.Warnf("warming up the PoW workers failed: %s\n", err.Error())
+		}
+	}
+	w.jobs = make(chan *powJob)
+	for i := 0; i < w.size; i++ {
+		w.wg.Add(1)
+		go w.work()
+	}
+	w.running = true
+	logger.Infof("started %d warm %s PoW workers\n", w.size, w.name)
+	return nil
+}
+
+// Stop lets the workers finish the queued jobs, later PoW runs on the calling goroutine.
+func (w *powWorkers) Stop() error {
+	w.mu.Lock()
+	if w.running {
+		w.running = false
+		close(w.jobs)
+	}
+	w.mu.Unlock()
+	w.wg.Wait()
+	return nil
+}
+
+func (w *powWorkers) work() {
+	defer w.wg.Done()
+	for job := range w.jobs {
+		job.done <- w.run(job)
+	}
+}
+
+// run turns a panic of the backend into an error, it would take down the process otherwise.
+func (w *powWorkers) run(job *powJob) (res powJobResult) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			res.err = errors.Wrap(ErrPoWPanicked, fmt.Sprint(rec))
+		}
+	}()
+	res.nonce, res.err = w.pow(job.trytes, job.mwm)
+	return res
+}
+
+// Pow is the PowFunc handing the PoW to a worker.
+func (w *powWorkers) Pow(trytes Trytes, mwm int) (Trytes, error) {
+	w.mu.RLock()
+	if !w.running {
+		w.mu.RUnlock()
+		return w.pow(trytes, mwm)
+	}
+	job := &powJob{trytes: trytes, mwm: mwm, done: make(chan powJobResult, 1)}
+	w.jobs <- job
+	w.mu.RUnlock()
+	res := <-job.done
+	return res.nonce, res.err
+}